@@ -25,6 +25,10 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 */
 package balancer
 
+import (
+	"log"
+)
+
 // A structure that uniquely identify a server.
 type ServerName struct {
 	Host string
@@ -39,6 +43,13 @@ type RackManager interface {
 	GetServers(rack string) []string
 }
 
+// A RackManager that looks up racks of many hosts at once. A balancer
+// asks it for all hosts before it gets their racks one by one.
+type BatchRackManager interface {
+	RackManager
+	ResolveRacks(hosts []string)
+}
+
 // A region (i.e. a shard), is the smallest unit for data movement.
 // A region is determined by the starting and the ending key
 // (not inclusive).
@@ -62,15 +73,64 @@ type ServerStat struct {
 	UpTimestamp int64
 	// Regions that are managed by the server.
 	Regions []Region
+	// Size and load of regions that the server leads.
+	Loads []RegionLoad
+	// Approximate bytes of all regions on the server.
+	DiskUsage int64
+	// Number of client edits that wait to be collected by leaders.
+	EditBacklog int64
+	// Bytes of disk for regions. Servers fill up in proportion to it if
+	// every server reports it.
+	DiskCapacity int64
+	// Capacity of the server relative to one that manages up to
+	// MaxRegionsPerServer regions. It is used if some servers do not
+	// report their disks, and defaults to 1.
+	Weight int
+}
+
+// Size and load of a region that its leader reports periodically.
+type RegionLoad struct {
+	Region
+	// The server that leads the region.
+	Leader ServerName
+	// Servers that have a replica of the region.
+	Members []ServerName
+	// Approximate size of the region in bytes.
+	Size int64
+	// Requests per second since the last report.
+	ReadQps  int64
+	WriteQps int64
+	// A key that splits requests to the region into halves. It is empty
+	// if the region has seen no requests.
+	LoadSplitKey string
 }
 
+// Status of a PlacementAction.
+const (
+	// Waiting for other actions to finish.
+	PLACEMENT_PENDING = iota
+	// Dest has joined the region as a learner, and is copying its data.
+	PLACEMENT_COPYING
+	// Dest has been promoted, and Source is being removed.
+	PLACEMENT_REMOVING_SOURCE
+	PLACEMENT_DONE
+	PLACEMENT_FAILED
+	PLACEMENT_CANCELLED
+)
+
 // Region placement assigns vacant servers to under-replicated region.
 type PlacementAction struct {
 	Region
 	Source    ServerName
 	Dest      ServerName
 	HasSource bool
-	Status    int
+	// If set, the leadership of the region moves from Source to Dest,
+	// which already has a replica. Replicas do not change.
+	LeaderTransfer bool
+	Status         int
+	// Bytes of the region that have been copied to Dest, and in total.
+	BytesCopied int64
+	BytesTotal  int64
 }
 
 // An interface that handles RPCs from balancer to servers.
@@ -78,25 +138,71 @@ type PlacementManager interface {
 	Place(task *PlacementAction)
 }
 
+// Learns about placement actions as they progress.
+type PlacementListener interface {
+	// Called whenever the status or progress of @task changes.
+	PlacementUpdated(task PlacementAction)
+}
+
+// An interface that asks servers to split or merge regions. Servers
+// report the change back through Balancer once it is done.
+type RegionManager interface {
+	// Ask @leader to split region @r at @key. If @key is empty, the
+	// region is split into two halves of about the same size.
+	Split(leader ServerName, r Region, key string)
+	// Ask @leader of region @left to merge its neighbor @right into it.
+	Merge(leader ServerName, left, right Region)
+}
+
 // Save region changes persistently.
-// Region changes are normally saved in zookeeper. Related storage servers
-// does not get the notification directly from load balancer. Instead,
-// the initiating storage server monitors coresponding zookeeper region
-// keys. If the keys are changed, the storage servers will further
-// investigate if a region change (split or merge) has occured.
+// Region changes are normally saved in zookeeper, where standby masters
+// follow them. Storage servers do not get the notification from load
+// balancer or zookeeper. Instead, they learn about a split or a merge from
+// the raft records of the regions involved.
 type StateManager interface {
 	Commit(adds []Region, removals []Region)
 }
 
+// Asks that regions be led by a server that has their replicas. A hint
+// for a region or for a table covers the key range of it.
+type PreferredLeader struct {
+	Region
+	Leader ServerName
+}
+
+// Return true if the hint covers region @r.
+func (p *PreferredLeader) Covers(r Region) bool {
+	return p.StartKey <= r.StartKey &&
+		(p.EndKey == "" || (r.EndKey != "" && r.EndKey <= p.EndKey))
+}
+
+// Policies of how a balancer places replicas and leaders.
+const (
+	// Repairs under-replicated regions by free room of racks and hosts,
+	// and evens leaders out.
+	BALANCER_POLICY_DEFAULT = "default"
+	// Also moves replicas and leaders to lower weighted costs of the
+	// cluster, which a bounded random search finds.
+	BALANCER_POLICY_STOCHASTIC = "stochastic"
+)
+
 // Options a caller can specify before creating a new balancer instance.
 type BalancerOptions struct {
 	// The name of balancer.
 	BalancerName string
 
+	// One of BALANCER_POLICY_*. An empty one means the default policy.
+	Policy string
+
+	// Costs and search limits of the stochastic policy. If it is nil,
+	// defaults are used.
+	Stochastic *StochasticOptions
+
 	// How many replicas a region should have.
 	NumReplicas int
 
-	// The maximum number of regions that a server can handle.
+	// The maximum number of regions that a server of weight 1 can handle,
+	// if servers do not report their disks.
 	MaxRegionsPerServer int
 
 	// Balancer will balance the load periodically.
@@ -117,6 +223,20 @@ type BalancerOptions struct {
 	// Communicate with persistent storage (zookeeper)
 	// to store region information.
 	StateManager StateManager
+
+	// Asks servers to split or merge regions. If it is nil, regions
+	// are never split or merged automatically.
+	RegionManager RegionManager
+
+	// When to split or merge regions. If it is nil, defaults are used.
+	SplitMerge *SplitMergeOptions
+
+	// At most this many leaderships are moved in a run of balancer.
+	// Leaders are not balanced if it is 0.
+	MaxLeaderTransfersPerRound int
+
+	// The leadership of a region is not moved again within this long.
+	LeaderTransferIntervalMs int64
 }
 
 type Balancer interface {
@@ -131,7 +251,39 @@ type Balancer interface {
 	MergeRegions(left, right, light Region)
 
 	// Find under-replicated regions and coordinate the replication
-	// process. This method takes a list of currently pending
-	// moving operations.
+	// process, and then move leaders off busy servers. This method takes
+	// a list of currently pending moving operations.
 	BalanceLoad(pendings []PlacementAction)
+
+	// Learn regions that StateManager has saved, such as when a master
+	// starts. A region that no server reports is not created again, and
+	// one that is no longer saved and that no server reports is forgotten.
+	RestoreRegions(regions []Region)
+
+	// Replace hints of where leaders should be. The first hint that covers
+	// a region applies, so hints for regions go before those for tables.
+	SetPreferredLeaders(hints []PreferredLeader)
+}
+
+// A Balancer whose search for moves may take long. A caller that holds
+// locks while it uses the balancer calls PlanLoad instead of BalanceLoad,
+// runs the search without the locks, and then takes them again to apply
+// the search.
+type SearchBalancer interface {
+	Balancer
+	PlanLoad(pendings []PlacementAction) *Search
+	ApplySearch(search *Search)
+}
+
+// Create a balancer of the policy that @opts asks for. An unknown policy
+// falls back to the default one.
+func NewBalancer(opts *BalancerOptions, servers []ServerName) Balancer {
+	switch opts.Policy {
+	case "", BALANCER_POLICY_DEFAULT:
+		return NewDefaultBalancer(opts, servers)
+	case BALANCER_POLICY_STOCHASTIC:
+		return NewStochasticBalancer(opts, servers)
+	}
+	log.Printf("Unknown balancer policy %s, uses the default one\n", opts.Policy)
+	return NewDefaultBalancer(opts, servers)
 }
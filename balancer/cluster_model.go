@@ -0,0 +1,360 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package balancer
+
+import (
+	"math"
+)
+
+// A layout of replicas and leaders that StochasticBalancer searches
+// through. Servers, hosts, racks and tables are indexed, and aggregates of
+// the layout are kept up to date as replicas and leaders move, so that a
+// cost is computed without going through all regions.
+type clusterModel struct {
+	servers []ServerName
+	// Host and rack of each server.
+	hosts    []int
+	racks    []int
+	numRacks int
+	// Capacity of each server relative to all servers.
+	shares []float64
+
+	regions    []Region
+	tables     []int
+	tableIndex map[string]int
+	replicas   [][]int
+	// The server that leads each region, or -1 if it is unknown.
+	leaders  []int
+	readQps  []int64
+	writeQps []int64
+	// Regions that must not change, and regions whose leaders must not
+	// change.
+	frozen []bool
+	pinned []bool
+
+	// Regions that each server has a replica of.
+	serverRegions [][]int
+	leaderCounts  []int
+	readLoads     []int64
+	writeLoads    []int64
+	// Replicas of each table on each server, and in total.
+	tableCounts   [][]int
+	tableTotals   []int
+	totalReplicas int
+	// Regions with two replicas in a rack, while another rack has none of
+	// their replicas.
+	violations int
+	// Replicas that have moved since the model was built.
+	moved int
+}
+
+// Create a model of @servers without regions. @hosts and @racks are where
+// the servers are, and @capacities are in any unit.
+func newClusterModel(
+	servers []ServerName, hosts, racks []string, capacities []int64) *clusterModel {
+
+	num := len(servers)
+	c := &clusterModel{
+		servers:       servers,
+		hosts:         make([]int, num),
+		racks:         make([]int, num),
+		shares:        make([]float64, num),
+		tableIndex:    make(map[string]int),
+		serverRegions: make([][]int, num),
+		leaderCounts:  make([]int, num),
+		readLoads:     make([]int64, num),
+		writeLoads:    make([]int64, num),
+	}
+
+	hostIndex := make(map[string]int)
+	rackIndex := make(map[string]int)
+	total := int64(0)
+	for s := 0; s < num; s++ {
+		if _, found := hostIndex[hosts[s]]; !found {
+			hostIndex[hosts[s]] = len(hostIndex)
+		}
+		if _, found := rackIndex[racks[s]]; !found {
+			rackIndex[racks[s]] = len(rackIndex)
+		}
+		c.hosts[s] = hostIndex[hosts[s]]
+		c.racks[s] = rackIndex[racks[s]]
+		total += capacities[s]
+	}
+	c.numRacks = len(rackIndex)
+
+	// Servers share evenly if none reports its capacity.
+	for s := 0; s < num; s++ {
+		if total > 0 {
+			c.shares[s] = float64(capacities[s]) / float64(total)
+		} else {
+			c.shares[s] = 1 / float64(num)
+		}
+	}
+	return c
+}
+
+// Add region @r of @table with replicas on servers @replicas, led by
+// @leader, or -1 if it is unknown. Return the index of the region.
+func (c *clusterModel) addRegion(
+	r Region, table string, replicas []int, leader int, readQps, writeQps int64) int {
+
+	i := len(c.regions)
+	t, found := c.tableIndex[table]
+	if !found {
+		t = len(c.tableIndex)
+		c.tableIndex[table] = t
+		c.tableCounts = append(c.tableCounts, make([]int, len(c.servers)))
+		c.tableTotals = append(c.tableTotals, 0)
+	}
+
+	c.regions = append(c.regions, r)
+	c.tables = append(c.tables, t)
+	c.replicas = append(c.replicas, append([]int{}, replicas...))
+	c.leaders = append(c.leaders, leader)
+	c.readQps = append(c.readQps, readQps)
+	c.writeQps = append(c.writeQps, writeQps)
+	c.frozen = append(c.frozen, false)
+	c.pinned = append(c.pinned, false)
+
+	for _, s := range replicas {
+		c.serverRegions[s] = append(c.serverRegions[s], i)
+		c.writeLoads[s] += writeQps
+		c.tableCounts[t][s]++
+		c.tableTotals[t]++
+		c.totalReplicas++
+	}
+	if leader >= 0 {
+		c.leaderCounts[leader]++
+		c.readLoads[leader] += readQps
+	}
+	if c.violates(i) {
+		c.violations++
+	}
+	return i
+}
+
+// Return true if server @s has a replica of region @i.
+func (c *clusterModel) hasReplica(i, s int) bool {
+	for _, replica := range c.replicas[i] {
+		if replica == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if a replica of region @i can move from server @from to
+// server @to, whose host has no replica of the region. The leader of a
+// pinned region stays.
+func (c *clusterModel) canMove(i, from, to int) bool {
+	if c.frozen[i] || (c.pinned[i] && c.leaders[i] == from) {
+		return false
+	}
+	if !c.hasReplica(i, from) {
+		return false
+	}
+	for _, s := range c.replicas[i] {
+		if c.hosts[s] == c.hosts[to] {
+			return false
+		}
+	}
+	return true
+}
+
+// Return true if region @i has two replicas in a rack, while another rack
+// has none of its replicas.
+func (c *clusterModel) violates(i int) bool {
+	racks := make(map[int]bool)
+	for _, s := range c.replicas[i] {
+		racks[c.racks[s]] = true
+	}
+	return len(racks) < len(c.replicas[i]) && len(racks) < c.numRacks
+}
+
+// Move a replica of region @i from server @from to server @to, and its
+// leadership with it if @from leads the region.
+func (c *clusterModel) moveReplica(i, from, to int) {
+	before := c.violates(i)
+	for k, s := range c.replicas[i] {
+		if s == from {
+			c.replicas[i][k] = to
+		}
+	}
+
+	regions := c.serverRegions[from]
+	for k, region := range regions {
+		if region == i {
+			regions[k] = regions[len(regions)-1]
+			c.serverRegions[from] = regions[:len(regions)-1]
+			break
+		}
+	}
+	c.serverRegions[to] = append(c.serverRegions[to], i)
+
+	t := c.tables[i]
+	c.tableCounts[t][from]--
+	c.tableCounts[t][to]++
+	c.writeLoads[from] -= c.writeQps[i]
+	c.writeLoads[to] += c.writeQps[i]
+	if c.leaders[i] == from {
+		c.moveLeader(i, to)
+	}
+
+	if after := c.violates(i); after != before {
+		if after {
+			c.violations++
+		} else {
+			c.violations--
+		}
+	}
+}
+
+// Move the leadership of region @i, whose leader is known, to server @to.
+func (c *clusterModel) moveLeader(i, to int) {
+	from := c.leaders[i]
+	c.leaderCounts[from]--
+	c.readLoads[from] -= c.readQps[i]
+	c.leaderCounts[to]++
+	c.readLoads[to] += c.readQps[i]
+	c.leaders[i] = to
+}
+
+// Return @count of server @s relative to its share of capacity.
+func (c *clusterModel) ratio(count float64, s int) float64 {
+	if c.shares[s] <= 0 {
+		return math.Inf(1)
+	}
+	return count / c.shares[s]
+}
+
+// Return how far @value of servers is from being in proportion to their
+// capacity, from 0 if every server has its share of the total, to 1 if a
+// server without capacity has all.
+func (c *clusterModel) skew(value func(s int) float64) float64 {
+	total := 0.0
+	for s := 0; s < len(c.servers); s++ {
+		total += value(s)
+	}
+	if total <= 0 {
+		return 0
+	}
+
+	deviation := 0.0
+	for s := 0; s < len(c.servers); s++ {
+		deviation += math.Abs(value(s) - total*c.shares[s])
+	}
+	return deviation / (2 * total)
+}
+
+// A cost of a layout from 0 to 1, and its weight.
+type costFunction struct {
+	name   string
+	weight float64
+	cost   func(c *clusterModel) float64
+}
+
+// Return cost functions of positive weights in @opts.
+func newCostFunctions(opts *StochasticOptions) []costFunction {
+	all := []costFunction{
+		{"region count", opts.RegionCountCost, regionCountCost},
+		{"table skew", opts.TableSkewCost, tableSkewCost},
+		{"rack locality", opts.RackLocalityCost, rackLocalityCost},
+		{"leader skew", opts.LeaderSkewCost, leaderSkewCost},
+		{"move", opts.MoveCost, moveCost},
+		{"read load", opts.ReadLoadCost, readLoadCost},
+		{"write load", opts.WriteLoadCost, writeLoadCost},
+	}
+
+	var ret []costFunction
+	for _, f := range all {
+		if f.weight > 0 {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// Replicas of servers out of proportion to their capacity.
+func regionCountCost(c *clusterModel) float64 {
+	return c.skew(func(s int) float64 {
+		return float64(len(c.serverRegions[s]))
+	})
+}
+
+// Replicas of each table out of proportion to capacity of servers, over
+// all tables.
+func tableSkewCost(c *clusterModel) float64 {
+	if c.totalReplicas == 0 {
+		return 0
+	}
+	deviation := 0.0
+	for t, counts := range c.tableCounts {
+		total := float64(c.tableTotals[t])
+		for s, count := range counts {
+			deviation += math.Abs(float64(count) - total*c.shares[s])
+		}
+	}
+	return deviation / float64(2*c.totalReplicas)
+}
+
+// Regions that do not spread over racks as far as they can.
+func rackLocalityCost(c *clusterModel) float64 {
+	if len(c.regions) == 0 {
+		return 0
+	}
+	return float64(c.violations) / float64(len(c.regions))
+}
+
+// Leaders of servers out of proportion to their capacity.
+func leaderSkewCost(c *clusterModel) float64 {
+	return c.skew(func(s int) float64 {
+		return float64(c.leaderCounts[s])
+	})
+}
+
+// Replicas that have moved, relative to all replicas.
+func moveCost(c *clusterModel) float64 {
+	if c.totalReplicas == 0 {
+		return 0
+	}
+	return float64(c.moved) / float64(c.totalReplicas)
+}
+
+// Reads of servers out of proportion to their capacity. Leaders serve
+// reads of their regions.
+func readLoadCost(c *clusterModel) float64 {
+	return c.skew(func(s int) float64 {
+		return float64(c.readLoads[s])
+	})
+}
+
+// Writes of servers out of proportion to their capacity. All replicas
+// serve writes of their regions.
+func writeLoadCost(c *clusterModel) float64 {
+	return c.skew(func(s int) float64 {
+		return float64(c.writeLoads[s])
+	})
+}
@@ -29,6 +29,7 @@ import (
 	"container/heap"
 	"math/rand"
 	"reflect"
+	"sort"
 )
 
 // Element type in a priority queue.
@@ -80,6 +81,37 @@ func (h *WeightHeap) Update(value string, delta int) {
 	panic("value is not in heap!")
 }
 
+// Set the count of @value. Return false if @value is not in the heap.
+func (h *WeightHeap) Set(value string, count int) bool {
+	for idx, w := range *h {
+		if w.value == value {
+			(*h)[idx].count = count
+			heap.Fix(h, idx)
+			return true
+		}
+	}
+	return false
+}
+
+// Free room of a host or a rack is counted in millionths of its capacity,
+// so that hosts of different capacity fill up in proportion.
+const ROOM_SCALE = 1000000
+
+// Capacity and usage of a host or a rack. Space is in bytes if every
+// server reports its disk, or else in regions.
+type room struct {
+	capacity int64
+	used     int64
+	// Requests per second to replicas on the host or in the rack.
+	qps int64
+}
+
+// Add @space and @qps of replicas to the room.
+func (r *room) add(space, qps int64) {
+	r.used += space
+	r.qps += qps
+}
+
 type DefaultBalancer struct {
 	// Maps servers to the regions that they manages.
 	serverMap map[ServerName][]Region
@@ -93,17 +125,55 @@ type DefaultBalancer struct {
 	perRackQueue map[string]WeightHeap
 	// Various options for the balancer.
 	opts *BalancerOptions
+	// Splits and merges regions by their load. It is nil if regions are
+	// not split or merged automatically.
+	policy *SplitMergePolicy
+	// Regions that have been saved by StateManager or reported by servers.
+	// A known region that no server reports stays in regionMap without
+	// replicas, until reported regions replace it.
+	known map[Region]bool
+	// Capacity and usage of hosts, racks and all servers.
+	hostRooms map[string]*room
+	rackRooms map[string]*room
+	total     room
+	// Capacity of each server, in the same unit as rooms.
+	capacities map[ServerName]int64
+	// Whether space is counted in bytes rather than regions.
+	bySize bool
+	// The latest loads of regions that leaders report.
+	regionLoads map[Region]RegionLoad
+	// Timestamp of the latest server stats.
+	timestamp int64
+	// Hints of where leaders should be.
+	preferred []PreferredLeader
+	// Maps regions to when their leaderships were moved.
+	transferred map[Region]int64
 }
 
 // Create a brand new balancer for a brand new system.
 func NewDefaultBalancer(opts *BalancerOptions, servers []ServerName) *DefaultBalancer {
-	return &DefaultBalancer{
+	b := &DefaultBalancer{
 		serverMap:    make(map[ServerName][]Region),
 		hostMap:      make(map[string][]ServerName),
 		regionMap:    make(map[Region][]ServerName),
 		perRackQueue: make(map[string]WeightHeap),
 		opts:         opts,
+		known:        make(map[Region]bool),
+		hostRooms:    make(map[string]*room),
+		rackRooms:    make(map[string]*room),
+		capacities:   make(map[ServerName]int64),
+		regionLoads:  make(map[Region]RegionLoad),
+		transferred:  make(map[Region]int64),
 	}
+
+	if opts.RegionManager != nil {
+		splitMerge := opts.SplitMerge
+		if splitMerge == nil {
+			splitMerge = DefaultSplitMergeOptions()
+		}
+		b.policy = NewSplitMergePolicy(splitMerge, opts.RegionManager)
+	}
+	return b
 }
 
 func (b *DefaultBalancer) UpdateServerStats(timestamp int64, stats []ServerStat) {
@@ -114,8 +184,12 @@ func (b *DefaultBalancer) UpdateServerStats(timestamp int64, stats []ServerStat)
 	b.globalQueue = WeightHeap{}
 	b.perRackQueue = make(map[string]WeightHeap)
 
+	b.timestamp = timestamp
+
 	// Then build server map and host map.
+	var loads []RegionLoad
 	for _, s := range stats {
+		loads = append(loads, s.Loads...)
 		b.serverMap[s.ServerName] = s.Regions
 		slist := b.hostMap[s.ServerName.Host]
 		slist = append(slist, s.ServerName)
@@ -131,30 +205,42 @@ func (b *DefaultBalancer) UpdateServerStats(timestamp int64, stats []ServerStat)
 		}
 	}
 
-	// Build global and per rack queue.
-	rackMap := make(map[string]int)
-	knownHostMap := make(map[string]int)
-
-	for server, regions := range b.serverMap {
-		rack := b.opts.RackManager.GetRack(server.Host)
-		cnt := rackMap[rack]
-		delta := b.opts.MaxRegionsPerServer - len(regions)
-		cnt = cnt + delta
-		rackMap[rack] = cnt
+	// Keep known regions that no server reports, unless they have been
+	// split or merged into reported ones.
+	for r, _ := range b.known {
+		if _, found := b.regionMap[r]; found {
+			continue
+		}
+		if b.overlapsReported(r) {
+			delete(b.known, r)
+		} else {
+			b.regionMap[r] = nil
+		}
+	}
+	for r, _ := range b.regionMap {
+		b.known[r] = true
+	}
 
-		_, hostAlreadyKnown := knownHostMap[server.Host]
-		if !hostAlreadyKnown {
-			knownHostMap[server.Host] = 1
-			queue := b.perRackQueue[rack]
-			w := Weight{value: server.Host, count: delta}
-			queue = append(queue, w)
-			b.perRackQueue[rack] = queue
+	// Racks of all hosts are looked up at once if the rack manager can.
+	if rm, ok := b.opts.RackManager.(BatchRackManager); ok {
+		hosts := make([]string, 0, len(b.hostMap))
+		for host, _ := range b.hostMap {
+			hosts = append(hosts, host)
 		}
+		sort.Strings(hosts)
+		rm.ResolveRacks(hosts)
 	}
 
-	// Finalize the queues.
-	for r, cnt := range rackMap {
-		w := Weight{value: r, count: cnt}
+	// Build global and per rack queue.
+	b.updateRooms(stats, loads)
+
+	for host, hr := range b.hostRooms {
+		rack := b.opts.RackManager.GetRack(host)
+		w := Weight{value: host, count: b.freeRoom(hr)}
+		b.perRackQueue[rack] = append(b.perRackQueue[rack], w)
+	}
+	for rack, rr := range b.rackRooms {
+		w := Weight{value: rack, count: b.freeRoom(rr)}
 		b.globalQueue = append(b.globalQueue, w)
 	}
 
@@ -191,8 +277,10 @@ func (b *DefaultBalancer) UpdateServerStats(timestamp int64, stats []ServerStat)
 			}
 		}
 
-		// Then pick a server from each of rack.
+		// Then pick a server from each of rack, on different hosts
+		// if the rack has enough.
 		servers := make([]ServerName, b.opts.NumReplicas)
+		picked := make(map[string]bool)
 		for i := 0; i < b.opts.NumReplicas; i++ {
 			r := racks[i].value
 			q, found := b.perRackQueue[r]
@@ -200,13 +288,21 @@ func (b *DefaultBalancer) UpdateServerStats(timestamp int64, stats []ServerStat)
 				panic("rack is not found")
 			}
 
-			// Adjust per rack counter.
-			w := heap.Pop(&q).(Weight)
-			w.count = w.count - 1
-			heap.Push(&q, w)
+			var pendingHosts []Weight
+			for len(q) > 0 {
+				w := heap.Pop(&q).(Weight)
+				pendingHosts = append(pendingHosts, w)
+				if !picked[w.value] {
+					break
+				}
+			}
+			for _, w := range pendingHosts {
+				heap.Push(&q, w)
+			}
 			b.perRackQueue[r] = q
 
-			host := w.value
+			host := pendingHosts[len(pendingHosts)-1].value
+			picked[host] = true
 			var slist []ServerName
 			slist, found = b.hostMap[host]
 			if !found {
@@ -216,19 +312,16 @@ func (b *DefaultBalancer) UpdateServerStats(timestamp int64, stats []ServerStat)
 			servers[i] = slist[idx]
 		}
 
-		// Adjust globalQueue weights.
-		rackCountMap := make(map[string]int)
+		// Restore globalQueue, and account the new replicas.
+		restored := make(map[string]bool)
 		for _, rack := range racks {
-			cnt, found := rackCountMap[rack.value]
-			if !found {
-				rackCountMap[rack.value] = rack.count - 1
-			} else {
-				rackCountMap[rack.value] = cnt - 1
+			if !restored[rack.value] {
+				restored[rack.value] = true
+				heap.Push(&b.globalQueue, rack)
 			}
 		}
-		for name, cnt := range rackCountMap {
-			w := Weight{value: name, count: cnt}
-			heap.Push(&b.globalQueue, w)
+		for _, s := range servers {
+			b.charge(s.Host, b.regionSpace(), 0)
 		}
 
 		// Adjust serverMap.
@@ -244,6 +337,7 @@ func (b *DefaultBalancer) UpdateServerStats(timestamp int64, stats []ServerStat)
 
 		// Adjust regionMap.
 		b.regionMap[r1] = servers
+		b.known[r1] = true
 
 		// Notify servers of the change.
 		for _, s := range servers {
@@ -260,6 +354,11 @@ func (b *DefaultBalancer) UpdateServerStats(timestamp int64, stats []ServerStat)
 		var removals []Region
 		b.opts.StateManager.Commit(adds, removals)
 	}
+
+	// Split or merge regions by their load.
+	if b.policy != nil {
+		b.policy.UpdateRegionLoads(timestamp, loads)
+	}
 }
 
 func (b *DefaultBalancer) SplitRegion(origin, left, right Region) bool {
@@ -273,6 +372,9 @@ func (b *DefaultBalancer) SplitRegion(origin, left, right Region) bool {
 	delete(b.regionMap, origin)
 	b.regionMap[left] = slist
 	b.regionMap[right] = slist
+	delete(b.known, origin)
+	b.known[left] = true
+	b.known[right] = true
 
 	// Adjust serverMap.
 	for _, s := range slist {
@@ -301,32 +403,16 @@ func (b *DefaultBalancer) SplitRegion(origin, left, right Region) bool {
 
 	// Adjust globalQueue and perRackQueue.
 	for _, s := range slist {
-		rack := b.opts.RackManager.GetRack(s.Host)
-		for i := 0; i < len(b.globalQueue); i++ {
-			if b.globalQueue[i].value == rack {
-				b.globalQueue[i].count = b.globalQueue[i].count - 1
-				heap.Fix(&b.globalQueue, i)
-				break
-			}
-		}
-
-		q, found := b.perRackQueue[rack]
-		if !found {
-			panic("Fails to find the rack!")
-		}
-		for i := 0; i < len(q); i++ {
-			if q[i].value == s.Host {
-				q[i].count = q[i].count - 1
-				heap.Fix(&q, i)
-				break
-			}
-		}
+		b.charge(s.Host, b.regionSpace(), 0)
 	}
 
 	// Save region changes.
 	adds := []Region{left, right}
 	removals := []Region{origin}
 	b.opts.StateManager.Commit(adds, removals)
+	if b.policy != nil {
+		b.policy.RegionsChanged(adds, removals)
+	}
 
 	return true
 }
@@ -377,45 +463,198 @@ func (b *DefaultBalancer) MergeRegions(left, right, light Region) {
 	delete(b.regionMap, left)
 	delete(b.regionMap, right)
 	b.regionMap[newRegion] = slist
+	delete(b.known, left)
+	delete(b.known, right)
+	b.known[newRegion] = true
 
 	// Adjust globalQueue and perRackQueue.
 	for _, s := range slist {
-		rack := b.opts.RackManager.GetRack(s.Host)
-		for i := 0; i < len(b.globalQueue); i++ {
-			if b.globalQueue[i].value == rack {
-				b.globalQueue[i].count = b.globalQueue[i].count + 1
-				heap.Fix(&b.globalQueue, i)
-				break
+		b.charge(s.Host, -b.regionSpace(), 0)
+	}
+
+	// Save region changes.
+	adds := []Region{newRegion}
+	removals := []Region{left, right}
+	b.opts.StateManager.Commit(adds, removals)
+	if b.policy != nil {
+		b.policy.RegionsChanged(adds, removals)
+	}
+}
+
+func (b *DefaultBalancer) RestoreRegions(regions []Region) {
+	saved := make(map[Region]bool)
+	for _, r := range regions {
+		saved[r] = true
+	}
+	// Regions restored before may have been split or merged since.
+	for r, _ := range b.known {
+		if !saved[r] && len(b.regionMap[r]) == 0 {
+			delete(b.known, r)
+			delete(b.regionMap, r)
+		}
+	}
+	for _, r := range regions {
+		b.known[r] = true
+		if _, found := b.regionMap[r]; !found {
+			b.regionMap[r] = nil
+		}
+	}
+}
+
+// Check if @r overlaps a region that a server reports.
+func (b *DefaultBalancer) overlapsReported(r Region) bool {
+	for other, slist := range b.regionMap {
+		if len(slist) > 0 && regionsOverlap(r, other) {
+			return true
+		}
+	}
+	return false
+}
+
+func regionsOverlap(a, b Region) bool {
+	return (b.EndKey == "" || a.StartKey < b.EndKey) &&
+		(a.EndKey == "" || b.StartKey < a.EndKey)
+}
+
+// Rebuild capacity and usage of hosts and racks from @stats and @loads.
+func (b *DefaultBalancer) updateRooms(stats []ServerStat, loads []RegionLoad) {
+	b.hostRooms = make(map[string]*room)
+	b.rackRooms = make(map[string]*room)
+	b.total = room{}
+	b.capacities = make(map[ServerName]int64)
+	b.regionLoads = make(map[Region]RegionLoad)
+
+	// Space is counted in bytes only if every server reports its disk.
+	b.bySize = len(stats) > 0
+	for _, s := range stats {
+		if s.DiskCapacity <= 0 {
+			b.bySize = false
+		}
+	}
+
+	for _, s := range stats {
+		capacity, used := s.DiskCapacity, s.DiskUsage
+		if !b.bySize {
+			weight := s.Weight
+			if weight <= 0 {
+				weight = 1
 			}
+			capacity = int64(b.opts.MaxRegionsPerServer * weight)
+			used = int64(len(s.Regions))
 		}
+		b.capacities[s.ServerName] = capacity
 
-		q, found := b.perRackQueue[rack]
-		if !found {
-			panic("Fails to find the rack!")
+		if _, found := b.hostRooms[s.Host]; !found {
+			b.hostRooms[s.Host] = &room{}
 		}
-		for i := 0; i < len(q); i++ {
-			if q[i].value == s.Host {
-				q[i].count = q[i].count + 1
-				heap.Fix(&q, i)
-				break
+		rack := b.opts.RackManager.GetRack(s.Host)
+		if _, found := b.rackRooms[rack]; !found {
+			b.rackRooms[rack] = &room{}
+		}
+		for _, r := range b.roomsOf(s.Host) {
+			r.capacity += capacity
+			r.used += used
+		}
+	}
+
+	// Writes go to all replicas of a region, and reads to its leader.
+	for _, load := range loads {
+		b.regionLoads[load.Region] = load
+		for _, s := range b.regionMap[load.Region] {
+			for _, r := range b.roomsOf(s.Host) {
+				r.add(0, load.WriteQps)
 			}
 		}
+		for _, r := range b.roomsOf(load.Leader.Host) {
+			r.add(0, load.ReadQps)
+		}
 	}
+}
 
-	// Save region changes.
-	adds := []Region{newRegion}
-	removals := []Region{left, right}
-	b.opts.StateManager.Commit(adds, removals)
+// Return rooms of @host, its rack and all servers, or nil if @host does
+// not report.
+func (b *DefaultBalancer) roomsOf(host string) []*room {
+	hr, found := b.hostRooms[host]
+	if !found {
+		return nil
+	}
+	rack := b.opts.RackManager.GetRack(host)
+	return []*room{hr, b.rackRooms[rack], &b.total}
+}
+
+// Return the free room of @r in millionths of its capacity. A host or a
+// rack that serves more than its share of requests is taken as fuller,
+// as if it used space in the same proportion as requests.
+func (b *DefaultBalancer) freeRoom(r *room) int {
+	if r.capacity <= 0 {
+		return -ROOM_SCALE
+	}
+	used := float64(r.used)
+	if b.total.qps > 0 {
+		busy := float64(r.qps) / float64(b.total.qps) * float64(b.total.used)
+		if busy > used {
+			used = busy
+		}
+	}
+	return int((float64(r.capacity) - used) * ROOM_SCALE / float64(r.capacity))
+}
+
+// Add @space and @qps of replicas to @host, and reorder the queues.
+func (b *DefaultBalancer) charge(host string, space, qps int64) {
+	rooms := b.roomsOf(host)
+	if rooms == nil {
+		return
+	}
+	for _, r := range rooms {
+		r.add(space, qps)
+	}
+
+	// Racks that are out of globalQueue are pushed back by the caller.
+	rack := b.opts.RackManager.GetRack(host)
+	q := b.perRackQueue[rack]
+	q.Set(host, b.freeRoom(rooms[0]))
+	b.perRackQueue[rack] = q
+	b.globalQueue.Set(rack, b.freeRoom(rooms[1]))
+}
+
+// Return the space that a region adds to each replica when it is created
+// or split. Bytes of regions do not change by splits and merges.
+func (b *DefaultBalancer) regionSpace() int64 {
+	if b.bySize {
+		return 0
+	}
+	return 1
+}
+
+// Return the space and requests per second that a new replica of @r adds.
+func (b *DefaultBalancer) replicaLoad(r Region) (space, qps int64) {
+	space = b.regionSpace()
+	if load, found := b.regionLoads[r]; found {
+		if b.bySize {
+			space = load.Size
+		}
+		qps = load.WriteQps
+	}
+	return
 }
 
 // TODO: If all regions are balanced, there is no need to run this.
 func (b *DefaultBalancer) BalanceLoad(pendings []PlacementAction) {
+	b.placeReplicas(pendings)
+	b.balanceLeaders(pendings)
+}
+
+// Add replicas to under-replicated regions.
+func (b *DefaultBalancer) placeReplicas(pendings []PlacementAction) {
 	// Remember hosts that are involved in region move.
 	// For bigger deployment, we want to avoid reuse hosts that are
 	// already involved in data movements.
 	used := make(map[string]int)
 	if len(b.serverMap) > b.opts.NumServersInSmallDeployment {
 		for _, act := range pendings {
+			if act.LeaderTransfer {
+				continue
+			}
 			used[act.Dest.Host] = 1
 			if act.HasSource {
 				used[act.Source.Host] = 1
@@ -429,7 +668,9 @@ func (b *DefaultBalancer) BalanceLoad(pendings []PlacementAction) {
 
 	for r, slist := range b.regionMap {
 		replicas := len(slist)
-		if replicas < b.opts.NumReplicas {
+		// A region without replicas has either lost its data, or its
+		// servers are down. It is left to an operator.
+		if replicas > 0 && replicas < b.opts.NumReplicas {
 			w := Weight{value: r.StartKey, count: -replicas}
 			regionQueue = append(regionQueue, w)
 			boundsMap[r.StartKey] = r.EndKey
@@ -461,9 +702,10 @@ func (b *DefaultBalancer) BalanceLoad(pendings []PlacementAction) {
 			continue
 		}
 
-		// Remember used hosts.
+		// Hosts of the replicas never take another one.
+		replicaHosts := make(map[string]bool)
 		for _, s := range slist {
-			used[s.Host] = 1
+			replicaHosts[s.Host] = true
 		}
 
 		// No racks are available, we cannot proceed.
@@ -471,74 +713,51 @@ func (b *DefaultBalancer) BalanceLoad(pendings []PlacementAction) {
 			return
 		}
 
-		pendingRacks := make([]Weight, 0)
-		var server ServerName
-
-		for len(b.globalQueue) > 0 {
-			rackWeight := heap.Pop(&b.globalQueue).(Weight)
-			pendingRacks = append(pendingRacks, rackWeight)
-
-			q, hasQueue := b.perRackQueue[rackWeight.value]
-			if !hasQueue {
-				panic("Fails to find the queue")
-			}
-
-			pendingHosts := make([]Weight, 0)
-			for len(q) > 0 {
-				hostWeight := heap.Pop(&q).(Weight)
-				pendingHosts = append(pendingHosts, hostWeight)
-				_, hasHost := used[hostWeight.value]
-				if hasHost && (len(b.globalQueue) > 0 || len(q) > 0) {
-					continue
-				}
-
-				slist, hasServerList := b.hostMap[hostWeight.value]
-				if !hasServerList {
-					panic("Miss a host in host map!")
-				}
-				if len(slist) == 0 {
-					continue
-				}
-
-				idx := rand.Int31() % int32(len(slist))
-				server = slist[idx]
-
-				break
-			}
-
-			// If there is a candidate, adjust the last weight count.
-			if len(server.Host) > 0 {
-				last := len(pendingHosts) - 1
-				cnt := pendingHosts[last].count
-				pendingHosts[last].count = cnt - 1
+		pendingRacks, shared := b.rankRacks(slist)
+		free := func(host string) bool {
+			_, hasHost := used[host]
+			return !hasHost && !replicaHosts[host]
+		}
+		vacant := func(host string) bool {
+			return !replicaHosts[host]
+		}
 
-				last = len(pendingRacks) - 1
-				cnt = pendingRacks[last].count
-				pendingRacks[last].count = cnt - 1
+		// Racks that share as few failure domains with the replicas are
+		// tried together, where hosts that are not involved in other moves
+		// are preferred.
+		var server ServerName
+		for start := 0; start < len(pendingRacks) && len(server.Host) == 0; {
+			end := start + 1
+			level := shared[pendingRacks[start].value]
+			for end < len(pendingRacks) && shared[pendingRacks[end].value] == level {
+				end++
 			}
-
-			// Restore per rack queue.
-			for _, hw := range pendingHosts {
-				heap.Push(&q, hw)
+			server = b.pickServer(pendingRacks[start:end], free)
+			if len(server.Host) == 0 {
+				server = b.pickServer(pendingRacks[start:end], vacant)
 			}
-			b.perRackQueue[rackWeight.value] = q
+			start = end
+		}
 
-			// Restore global queue.
-			for _, w := range pendingRacks {
-				heap.Push(&b.globalQueue, w)
-			}
+		// Remember used hosts.
+		for host, _ := range replicaHosts {
+			used[host] = 1
+		}
+		if len(server.Host) > 0 {
+			used[server.Host] = 1
+		}
 
-			// If we already had an allocation, break the loop.
-			if len(server.Host) > 0 {
-				used[server.Host] = 1
-				break
-			}
+		// Restore global queue.
+		for _, w := range pendingRacks {
+			heap.Push(&b.globalQueue, w)
 		}
 
 		// If we fails to find an allocation, there is nothing we can do.
 		if len(server.Host) == 0 {
 			return
 		}
+		space, qps := b.replicaLoad(r)
+		b.charge(server.Host, space, qps)
 
 		act := PlacementAction{
 			Region:    r,
@@ -550,6 +769,96 @@ func (b *DefaultBalancer) BalanceLoad(pendings []PlacementAction) {
 	}
 }
 
+// Pick a server on the host with the most room in @racks, in their order,
+// for which @accept returns true. Return an empty name if there is none.
+func (b *DefaultBalancer) pickServer(racks []Weight, accept func(host string) bool) ServerName {
+	var server ServerName
+	for _, rackWeight := range racks {
+		q, hasQueue := b.perRackQueue[rackWeight.value]
+		if !hasQueue {
+			panic("Fails to find the queue")
+		}
+
+		pendingHosts := make([]Weight, 0)
+		for len(q) > 0 {
+			hostWeight := heap.Pop(&q).(Weight)
+			pendingHosts = append(pendingHosts, hostWeight)
+			if !accept(hostWeight.value) {
+				continue
+			}
+
+			slist, hasServerList := b.hostMap[hostWeight.value]
+			if !hasServerList {
+				panic("Miss a host in host map!")
+			}
+			if len(slist) == 0 {
+				continue
+			}
+
+			idx := rand.Int31() % int32(len(slist))
+			server = slist[idx]
+
+			break
+		}
+
+		// Restore per rack queue.
+		for _, hw := range pendingHosts {
+			heap.Push(&q, hw)
+		}
+		b.perRackQueue[rackWeight.value] = q
+
+		if len(server.Host) > 0 {
+			break
+		}
+	}
+	return server
+}
+
+// Take all racks out of globalQueue, and order them for a new replica of
+// a region on @replicas. Racks that share fewer failure domains with the
+// replicas come first, and then racks with more room. Also return how many
+// failure domains each rack shares with the replicas.
+func (b *DefaultBalancer) rankRacks(replicas []ServerName) ([]Weight, map[string]int) {
+	var racks []Weight
+	for len(b.globalQueue) > 0 {
+		racks = append(racks, heap.Pop(&b.globalQueue).(Weight))
+	}
+
+	replicaRacks := make([]string, 0, len(replicas))
+	for _, s := range replicas {
+		replicaRacks = append(replicaRacks, b.opts.RackManager.GetRack(s.Host))
+	}
+	shared := make(map[string]int)
+	for _, w := range racks {
+		for _, rack := range replicaRacks {
+			if n := sharedDomains(w.value, rack); n > shared[w.value] {
+				shared[w.value] = n
+			}
+		}
+	}
+
+	sort.Stable(racksBySharedDomains{racks: racks, shared: shared})
+	return racks, shared
+}
+
+// Orders racks by how many failure domains they share with replicas.
+type racksBySharedDomains struct {
+	racks  []Weight
+	shared map[string]int
+}
+
+func (r racksBySharedDomains) Len() int {
+	return len(r.racks)
+}
+
+func (r racksBySharedDomains) Swap(i, j int) {
+	r.racks[i], r.racks[j] = r.racks[j], r.racks[i]
+}
+
+func (r racksBySharedDomains) Less(i, j int) bool {
+	return r.shared[r.racks[i].value] < r.shared[r.racks[j].value]
+}
+
 func (b *DefaultBalancer) hasSameReplications(left, right Region) bool {
 	rlist1, found := b.regionMap[left]
 	if !found {
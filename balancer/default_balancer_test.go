@@ -523,3 +523,426 @@ func TestDefaultBalancerBalancingWithoutPendingMove(t *testing.T) {
 		t.Error("Expect activities on storage servers")
 	}
 }
+
+func TestDefaultBalancerRestoreRegions(t *testing.T) {
+	serverMap := make(map[ServerName]string)
+	serverMap[ServerName{Host: "a"}] = "1"
+	serverMap[ServerName{Host: "b"}] = "2"
+	serverMap[ServerName{Host: "c"}] = "3"
+
+	b := DefaultBalancerForTest(serverMap)
+
+	left := Region{EndKey: "m"}
+	right := Region{StartKey: "m"}
+	b.RestoreRegions([]Region{left, right})
+
+	// Only the left region is reported, by two servers.
+	stats := make([]ServerStat, 0)
+	for s, _ := range serverMap {
+		stat := ServerStat{ServerName: s, UpTimestamp: 1}
+		if s.Host != "c" {
+			stat.Regions = []Region{left}
+		}
+		stats = append(stats, stat)
+	}
+	b.UpdateServerStats(1, stats)
+
+	// Restored regions are not created again.
+	sm := b.opts.StateManager.(*PassThroughStateManager)
+	if len(sm.adds) != 0 {
+		t.Error("Creates regions:", sm.adds)
+	}
+	if len(b.regionMap) != 2 || len(b.regionMap[right]) != 0 {
+		t.Error("Unexpected region map:", b.regionMap)
+	}
+
+	// The right region has no replica to copy from.
+	b.BalanceLoad([]PlacementAction{})
+	pm := b.opts.PlacementManager.(*PassThroughPlacementManager)
+	if len(pm.actions) != 1 || pm.actions[0].Region != left || pm.actions[0].Dest.Host != "c" {
+		t.Error("Unexpected placements:", pm.actions)
+	}
+
+	// Reported regions replace known ones that they overlap.
+	half := Region{StartKey: "m", EndKey: "t"}
+	for i, _ := range stats {
+		stats[i].Regions = append(stats[i].Regions, half)
+	}
+	b.UpdateServerStats(2, stats)
+	if _, found := b.regionMap[right]; found {
+		t.Error("Keeps a region that has been replaced")
+	}
+	if _, found := b.regionMap[half]; !found {
+		t.Error("Misses a reported region")
+	}
+
+	// Restored regions that are no longer saved are forgotten, unless
+	// servers report them.
+	tail := Region{StartKey: "t"}
+	b.RestoreRegions([]Region{left, tail})
+	if _, found := b.regionMap[tail]; !found {
+		t.Error("Misses a restored region")
+	}
+	b.RestoreRegions([]Region{left})
+	if _, found := b.regionMap[tail]; found || b.known[tail] {
+		t.Error("Keeps a region that is no longer saved")
+	}
+	if _, found := b.regionMap[half]; !found {
+		t.Error("Forgets a reported region")
+	}
+}
+
+func TestDefaultBalancerFailureDomains(t *testing.T) {
+	serverMap := make(map[ServerName]string)
+	serverMap[ServerName{Host: "a"}] = "/dc1/r1"
+	serverMap[ServerName{Host: "b1"}] = "/dc1/r2"
+	serverMap[ServerName{Host: "b2"}] = "/dc1/r2"
+	serverMap[ServerName{Host: "b3"}] = "/dc1/r2"
+	serverMap[ServerName{Host: "c"}] = "/dc2/r3"
+
+	b := DefaultBalancerForTest(serverMap)
+
+	// Only "a" has the region.
+	stats := make([]ServerStat, 0)
+	for s, _ := range serverMap {
+		stat := ServerStat{ServerName: s, UpTimestamp: 1}
+		if s.Host == "a" {
+			stat.Regions = []Region{Region{}}
+		}
+		stats = append(stats, stat)
+	}
+	b.UpdateServerStats(1, stats)
+
+	// The new replica goes to the other datacenter, though the other rack
+	// of the same datacenter has more room.
+	b.BalanceLoad([]PlacementAction{})
+	pm := b.opts.PlacementManager.(*PassThroughPlacementManager)
+	if len(pm.actions) != 1 || pm.actions[0].Dest.Host != "c" {
+		t.Error("Unexpected placements:", pm.actions)
+	}
+}
+
+func TestDefaultBalancerReplicaHosts(t *testing.T) {
+	serverMap := make(map[ServerName]string)
+	serverMap[ServerName{Host: "a", Port: 1}] = "/r1"
+	serverMap[ServerName{Host: "a", Port: 2}] = "/r1"
+	serverMap[ServerName{Host: "b"}] = "/r2"
+
+	// The region is on "a:1" and "b".
+	statsWith := func(serverMap map[ServerName]string) []ServerStat {
+		stats := make([]ServerStat, 0)
+		for s, _ := range serverMap {
+			stat := ServerStat{ServerName: s, UpTimestamp: 1}
+			if s.Port == 1 || s.Host == "b" {
+				stat.Regions = []Region{Region{}}
+			}
+			stats = append(stats, stat)
+		}
+		return stats
+	}
+
+	// No host is left for the third replica.
+	b := DefaultBalancerForTest(serverMap)
+	b.UpdateServerStats(1, statsWith(serverMap))
+	b.BalanceLoad([]PlacementAction{})
+	pm := b.opts.PlacementManager.(*PassThroughPlacementManager)
+	if len(pm.actions) != 0 {
+		t.Error("Places a replica on a host of the region:", pm.actions)
+	}
+
+	// A new host takes the third replica.
+	serverMap[ServerName{Host: "c"}] = "/r1"
+	b = DefaultBalancerForTest(serverMap)
+	b.UpdateServerStats(1, statsWith(serverMap))
+	b.BalanceLoad([]PlacementAction{})
+	pm = b.opts.PlacementManager.(*PassThroughPlacementManager)
+	if len(pm.actions) != 1 || pm.actions[0].Dest.Host != "c" {
+		t.Error("Unexpected placements:", pm.actions)
+	}
+}
+
+// Returns a balancer with two replicas per region, and each host in a rack
+// of its own.
+func capacityBalancerForTest(hosts []string) *DefaultBalancer {
+	hostMap := make(map[string]string)
+	for _, h := range hosts {
+		hostMap[h] = "/" + h
+	}
+
+	opts := BalancerOptions{
+		BalancerName:                "testBalancer",
+		NumReplicas:                 2,
+		MaxRegionsPerServer:         10,
+		NumIterationPerBalanceRound: 1,
+		NumServersInSmallDeployment: 3,
+		RackManager:                 NewMappedRackManager(hostMap),
+		PlacementManager:            NewPassThroughPlacementManager(),
+		StateManager:                NewPassThroughStateManager(),
+	}
+	return NewDefaultBalancer(&opts, nil)
+}
+
+// Copy @numRegions regions of @size bytes from "seed" to the other servers
+// of @stats one by one, and return the number of regions on each of them.
+func fillServers(t *testing.T, stats []ServerStat, numRegions int, size int64) map[string]int {
+	hosts := []string{"seed"}
+	for _, stat := range stats {
+		hosts = append(hosts, stat.Host)
+	}
+	b := capacityBalancerForTest(hosts)
+	pm := b.opts.PlacementManager.(*PassThroughPlacementManager)
+
+	seed := ServerStat{
+		ServerName:   ServerName{Host: "seed"},
+		DiskCapacity: 1 << 40,
+		Weight:       1000,
+	}
+	for i := 0; i < numRegions; i++ {
+		r := Region{StartKey: fmt.Sprintf("%03d", i), EndKey: fmt.Sprintf("%03d", i+1)}
+		seed.Regions = append(seed.Regions, r)
+		seed.Loads = append(seed.Loads, RegionLoad{Region: r, Leader: seed.ServerName, Size: size})
+		seed.DiskUsage += size
+	}
+
+	for i := 0; i < numRegions; i++ {
+		b.UpdateServerStats(int64(i), append([]ServerStat{seed}, stats...))
+		pm.actions = pm.actions[:0]
+		b.BalanceLoad([]PlacementAction{})
+		if len(pm.actions) != 1 {
+			t.Fatal("Unexpected placements:", pm.actions)
+		}
+
+		for j, _ := range stats {
+			if stats[j].ServerName == pm.actions[0].Dest {
+				stats[j].Regions = append(stats[j].Regions, pm.actions[0].Region)
+				stats[j].DiskUsage += size
+			}
+		}
+	}
+
+	ret := make(map[string]int)
+	for _, stat := range stats {
+		ret[stat.Host] = len(stat.Regions)
+	}
+	return ret
+}
+
+func TestDefaultBalancerDiskCapacity(t *testing.T) {
+	// An 8TB server takes four times the regions of a 2TB one.
+	stats := []ServerStat{
+		ServerStat{ServerName: ServerName{Host: "small"}, DiskCapacity: 2 << 40},
+		ServerStat{ServerName: ServerName{Host: "big"}, DiskCapacity: 8 << 40},
+	}
+	counts := fillServers(t, stats, 50, 1<<30)
+	if counts["small"] < 9 || counts["small"] > 11 || counts["small"]+counts["big"] != 50 {
+		t.Error("Unexpected regions:", counts)
+	}
+}
+
+func TestDefaultBalancerServerWeight(t *testing.T) {
+	// Servers are balanced by weight if some do not report their disks.
+	stats := []ServerStat{
+		ServerStat{ServerName: ServerName{Host: "a"}, DiskCapacity: 2 << 40},
+		ServerStat{ServerName: ServerName{Host: "b"}, Weight: 3},
+	}
+	counts := fillServers(t, stats, 20, 1<<30)
+	if counts["a"] < 4 || counts["a"] > 6 || counts["a"]+counts["b"] != 20 {
+		t.Error("Unexpected regions:", counts)
+	}
+}
+
+func TestDefaultBalancerRequestLoad(t *testing.T) {
+	hot := Region{StartKey: "a", EndKey: "b"}
+	cold := Region{StartKey: "b", EndKey: "c"}
+	r := Region{StartKey: "c"}
+
+	seed := ServerStat{
+		ServerName:   ServerName{Host: "seed"},
+		Regions:      []Region{r, hot, cold},
+		DiskCapacity: 1 << 40,
+		DiskUsage:    3 << 30,
+	}
+	// "a" uses less space than "b", but serves all requests.
+	a := ServerStat{
+		ServerName:   ServerName{Host: "a"},
+		Regions:      []Region{hot},
+		Loads:        []RegionLoad{RegionLoad{Region: hot, Size: 1 << 30, ReadQps: 1000}},
+		DiskCapacity: 1 << 40,
+		DiskUsage:    1 << 30,
+	}
+	a.Loads[0].Leader = a.ServerName
+	b := ServerStat{
+		ServerName:   ServerName{Host: "b"},
+		Regions:      []Region{cold},
+		DiskCapacity: 1 << 40,
+		DiskUsage:    2 << 30,
+	}
+
+	balancer := capacityBalancerForTest([]string{"seed", "a", "b"})
+	balancer.UpdateServerStats(1, []ServerStat{seed, a, b})
+	balancer.BalanceLoad([]PlacementAction{})
+	pm := balancer.opts.PlacementManager.(*PassThroughPlacementManager)
+	if len(pm.actions) != 1 || pm.actions[0].Region != r || pm.actions[0].Dest.Host != "b" {
+		t.Error("Unexpected placements:", pm.actions)
+	}
+}
+
+// Returns a balancer that moves at most @maxTransfers leaderships in a round,
+// with each host in a rack of its own.
+func leaderBalancerForTest(hosts []string, maxTransfers int) *DefaultBalancer {
+	b := capacityBalancerForTest(hosts)
+	b.opts.NumReplicas = len(hosts)
+	b.opts.MaxLeaderTransfersPerRound = maxTransfers
+	b.opts.LeaderTransferIntervalMs = 1000
+	return b
+}
+
+// Returns stats of servers @hosts that all have replicas of @regions.
+// Region i is led by @leaders[i], and has @qps[i] reads per second.
+func leaderStatsForTest(hosts []string, regions []Region, leaders []string, qps []int64) []ServerStat {
+	var stats []ServerStat
+	for _, h := range hosts {
+		stat := ServerStat{ServerName: ServerName{Host: h}, Regions: regions}
+		for i, r := range regions {
+			if leaders[i] == h {
+				load := RegionLoad{Region: r, Leader: stat.ServerName, ReadQps: qps[i]}
+				stat.Loads = append(stat.Loads, load)
+			}
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+// Returns leaders of @regions after leadership transfers in @actions.
+func leadersAfter(regions []Region, leaders []string, actions []*PlacementAction) map[Region]string {
+	ret := make(map[Region]string)
+	for i, r := range regions {
+		ret[r] = leaders[i]
+	}
+	for _, act := range actions {
+		if act.LeaderTransfer && ret[act.Region] == act.Source.Host {
+			ret[act.Region] = act.Dest.Host
+		}
+	}
+	return ret
+}
+
+func regionsForTest(num int) []Region {
+	var ret []Region
+	for i := 0; i < num; i++ {
+		ret = append(ret, Region{StartKey: fmt.Sprintf("%03d", i), EndKey: fmt.Sprintf("%03d", i+1)})
+	}
+	return ret
+}
+
+func TestDefaultBalancerLeaderCount(t *testing.T) {
+	hosts := []string{"a", "b", "c"}
+	regions := regionsForTest(6)
+	leaders := []string{"a", "a", "a", "a", "a", "a"}
+	qps := make([]int64, 6)
+
+	b := leaderBalancerForTest(hosts, 10)
+	b.UpdateServerStats(1, leaderStatsForTest(hosts, regions, leaders, qps))
+	b.BalanceLoad([]PlacementAction{})
+
+	pm := b.opts.PlacementManager.(*PassThroughPlacementManager)
+	if len(pm.actions) != 4 {
+		t.Fatal("Unexpected placements:", pm.actions)
+	}
+	counts := make(map[string]int)
+	for _, leader := range leadersAfter(regions, leaders, pm.actions) {
+		counts[leader]++
+	}
+	if counts["a"] != 2 || counts["b"] != 2 || counts["c"] != 2 {
+		t.Error("Unexpected leaders:", counts)
+	}
+
+	// Leaderships that have just moved stay, though stats lag behind.
+	moved := make(map[Region]bool)
+	for _, act := range pm.actions {
+		moved[act.Region] = true
+	}
+	pm.actions = pm.actions[:0]
+	b.UpdateServerStats(500, leaderStatsForTest(hosts, regions, leaders, qps))
+	b.BalanceLoad([]PlacementAction{})
+	for _, act := range pm.actions {
+		if moved[act.Region] {
+			t.Error("Moves a leadership again:", act)
+		}
+	}
+
+	// Leaderships are moved a few at a time.
+	b = leaderBalancerForTest(hosts, 1)
+	b.UpdateServerStats(1, leaderStatsForTest(hosts, regions, leaders, qps))
+	b.BalanceLoad([]PlacementAction{})
+	pm = b.opts.PlacementManager.(*PassThroughPlacementManager)
+	if len(pm.actions) != 1 || !pm.actions[0].LeaderTransfer || pm.actions[0].Source.Host != "a" {
+		t.Error("Unexpected placements:", pm.actions)
+	}
+}
+
+func TestDefaultBalancerLeaderLoad(t *testing.T) {
+	hosts := []string{"a", "b", "c"}
+	regions := regionsForTest(6)
+	// "a" leads as many regions as others, but all requests go to it.
+	leaders := []string{"a", "a", "b", "b", "c", "c"}
+	qps := []int64{1000, 1000, 0, 0, 0, 0}
+
+	b := leaderBalancerForTest(hosts, 10)
+	b.UpdateServerStats(1, leaderStatsForTest(hosts, regions, leaders, qps))
+	b.BalanceLoad([]PlacementAction{})
+
+	pm := b.opts.PlacementManager.(*PassThroughPlacementManager)
+	after := leadersAfter(regions, leaders, pm.actions)
+	if after[regions[0]] == after[regions[1]] {
+		t.Error("Busy regions have the same leader:", after)
+	}
+	counts := make(map[string]int)
+	for _, leader := range after {
+		counts[leader]++
+	}
+	for _, h := range hosts {
+		if counts[h] != 2 {
+			t.Error("Unexpected leaders:", after)
+		}
+	}
+}
+
+func TestDefaultBalancerPreferredLeader(t *testing.T) {
+	hosts := []string{"a", "b", "c"}
+	regions := []Region{
+		Region{EndKey: "t1"},
+		Region{StartKey: "t1", EndKey: "t1/m"},
+		Region{StartKey: "t1/m", EndKey: "t2"},
+		Region{StartKey: "t2", EndKey: "t3"},
+		Region{StartKey: "t3", EndKey: "t4"},
+		Region{StartKey: "t4"},
+	}
+	leaders := []string{"a", "a", "b", "b", "c", "c"}
+	qps := make([]int64, 6)
+
+	b := leaderBalancerForTest(hosts, 10)
+	// A hint for a region goes before the one for its table "t1".
+	b.SetPreferredLeaders([]PreferredLeader{
+		PreferredLeader{Region: regions[1], Leader: ServerName{Host: "b"}},
+		PreferredLeader{Region: Region{StartKey: "t1", EndKey: "t2"}, Leader: ServerName{Host: "c"}},
+	})
+	b.UpdateServerStats(1, leaderStatsForTest(hosts, regions, leaders, qps))
+	b.BalanceLoad([]PlacementAction{})
+
+	pm := b.opts.PlacementManager.(*PassThroughPlacementManager)
+	after := leadersAfter(regions, leaders, pm.actions)
+	if after[regions[1]] != "b" || after[regions[2]] != "c" {
+		t.Error("Ignores preferred leaders:", after)
+	}
+
+	// Other leaders are balanced around them.
+	counts := make(map[string]int)
+	for _, leader := range after {
+		counts[leader]++
+	}
+	if counts["a"] != 2 || counts["b"] != 2 || counts["c"] != 2 {
+		t.Error("Unexpected leaders:", after)
+	}
+}
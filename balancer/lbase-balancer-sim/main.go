@@ -0,0 +1,187 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// Runs the balancer on a snapshot of a cluster, to see what it would do
+// before it is rolled out. Events such as "@3 add 5 /dc1/r4 8T",
+// "@5 kill-rack /dc1/r2" or "kill-server host:port" change the cluster
+// during the simulation.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"lbase/balancer"
+	"log"
+	"math/rand"
+)
+
+// Events given by repeated -event flags.
+type eventList []balancer.SimEvent
+
+func (l *eventList) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *eventList) Set(text string) error {
+	event, ok := balancer.ParseSimEvent(text)
+	if !ok {
+		return fmt.Errorf("bad event %q", text)
+	}
+	*l = append(*l, event)
+	return nil
+}
+
+var (
+	snapshotPath = flag.String("snapshot", "", "JSON file of a ClusterSnapshot to start from")
+	topologyFile = flag.String("topology_file", "", "File that maps hosts to racks that the snapshot does not have")
+	rounds       = flag.Int("rounds", 20, "Number of rounds of balancing")
+	seed         = flag.Int64("seed", 1, "Seed of random choices")
+
+	numReplicas = flag.Int("replicas", 3, "Number of replicas of a region")
+	maxRegions  = flag.Int("max_regions", 1000, "Maximum number of regions on a server")
+	iterations  = flag.Int("iterations", 10, "Number of under-replicated regions fixed in a round")
+	smallSize   = flag.Int("small_deployment", 10, "Number of servers up to which a deployment is small")
+
+	policy     = flag.String("balancer", balancer.BALANCER_POLICY_DEFAULT, "Balancer policy, default or stochastic")
+	tableDelim = flag.String("table_delim", "", "Keys start with their table names and then this, which the stochastic balancer keeps tables even by")
+
+	leaderTransfers          = flag.Int("leader_transfers", 4, "Maximum number of leaderships moved in a round, or 0 to leave leaders alone")
+	leaderTransferIntervalMs = flag.Int("leader_transfer_interval_ms", 600000, "How long the leadership of a region stays before it is moved again")
+
+	moveRounds      = flag.Int("move_rounds", 1, "Number of rounds that a move takes")
+	roundIntervalMs = flag.Int("round_interval_ms", 10000, "Time between rounds")
+
+	events eventList
+)
+
+func init() {
+	flag.Var(&events, "event", "An event such as \"@3 add 5 /dc1/r4 8T\", \"@5 kill-rack /dc1/r2\" or \"kill-server host:port\". It may be repeated")
+}
+
+func main() {
+	flag.Parse()
+	if *snapshotPath == "" {
+		log.Fatal("Misses -snapshot")
+	}
+	rand.Seed(*seed)
+
+	snapshot, ok := balancer.LoadClusterSnapshot(*snapshotPath)
+	if !ok {
+		log.Fatal("Fails to load the snapshot")
+	}
+
+	balancerOpts := &balancer.BalancerOptions{
+		Policy:                      *policy,
+		BalancerName:                "simulator",
+		NumReplicas:                 *numReplicas,
+		MaxRegionsPerServer:         *maxRegions,
+		NumIterationPerBalanceRound: *iterations,
+		NumServersInSmallDeployment: *smallSize,
+		MaxLeaderTransfersPerRound:  *leaderTransfers,
+		LeaderTransferIntervalMs:    int64(*leaderTransferIntervalMs),
+	}
+	if *tableDelim != "" {
+		balancerOpts.Stochastic = balancer.DefaultStochasticOptions()
+		balancerOpts.Stochastic.TableOf = balancer.TableByKeyPrefix(*tableDelim)
+	}
+	if *topologyFile != "" {
+		rm, ok := balancer.NewFileRackManager(*topologyFile, 0)
+		if !ok {
+			log.Fatal("Fails to load the topology file")
+		}
+		balancerOpts.RackManager = rm
+	}
+
+	opts := balancer.DefaultSimulatorOptions(balancerOpts)
+	opts.MoveRounds = *moveRounds
+	opts.RoundIntervalMs = int64(*roundIntervalMs)
+	sim := balancer.NewSimulator(opts, snapshot)
+
+	last := sim.Report()
+	for i := 0; i < *rounds; i++ {
+		report := sim.Run(1, events)
+		fmt.Printf("round %d: %d moves, %d leader transfers, %d failed, "+
+			"%d under-replicated, %d lost, %d rack violations\n",
+			report.Rounds-1, report.Moves-last.Moves,
+			report.LeaderTransfers-last.LeaderTransfers,
+			report.FailedMoves-last.FailedMoves,
+			report.UnderReplicated, report.Lost, report.RackViolations)
+		last = report
+	}
+	fmt.Println()
+	printReport(&last)
+}
+
+func printReport(report *balancer.SimReport) {
+	fmt.Printf("%-24s %-16s %8s %8s %8s %10s\n",
+		"server", "rack", "regions", "leaders", "disk", "qps")
+	for _, s := range report.Servers {
+		name := fmt.Sprintf("%s:%d", s.Host, s.Port)
+		fmt.Printf("%-24s %-16s %8d %8d %8s %10d\n",
+			name, s.Rack, s.Regions, s.Leaders, usage(&s), s.LeaderQps)
+	}
+	fmt.Println()
+
+	fmt.Printf("regions: %d, under-replicated: %d, lost: %d, rack violations: %d\n",
+		report.Regions, report.UnderReplicated, report.Lost, report.RackViolations)
+	fmt.Printf("moves: %d (%d failed, %d pending), leader transfers: %d\n",
+		report.Moves, report.FailedMoves, report.PendingMoves, report.LeaderTransfers)
+	if len(report.Servers) == 0 {
+		return
+	}
+
+	var regions, leaders []int
+	for _, s := range report.Servers {
+		regions = append(regions, s.Regions)
+		leaders = append(leaders, s.Leaders)
+	}
+	fmt.Println("regions per server:", spread(regions))
+	fmt.Println("leaders per server:", spread(leaders))
+}
+
+// Return the disk usage of @s in percent, or the bytes if its disk is not
+// known.
+func usage(s *balancer.SimServer) string {
+	if s.DiskCapacity <= 0 {
+		return fmt.Sprintf("%dM", s.DiskUsage>>20)
+	}
+	return fmt.Sprintf("%.1f%%", float64(s.DiskUsage)*100/float64(s.DiskCapacity))
+}
+
+// Return the minimum, maximum and mean of @values.
+func spread(values []int) string {
+	min, max, sum := values[0], values[0], 0
+	for _, v := range values {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+		sum += v
+	}
+	mean := float64(sum) / float64(len(values))
+	return fmt.Sprintf("min %d, max %d, mean %.1f", min, max, mean)
+}
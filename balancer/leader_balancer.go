@@ -0,0 +1,243 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package balancer
+
+// Leaders are not moved off a server unless its load is this much above
+// the average.
+const LEADER_IMBALANCE_SLOP = 0.1
+
+// A leadership is not moved unless it evens shares of servers by more than
+// this, which keeps rounding errors from moving leaders back and forth.
+const LEADER_MIN_GAIN = 1e-6
+
+// Regions that a server leads, and their requests per second.
+type leaderLoad struct {
+	regions []Region
+	qps     int64
+}
+
+func (b *DefaultBalancer) SetPreferredLeaders(hints []PreferredLeader) {
+	b.preferred = append([]PreferredLeader{}, hints...)
+}
+
+// Return the server that should lead region @r, if there is a hint for it
+// and the server has a replica.
+func (b *DefaultBalancer) preferredLeader(r Region) (leader ServerName, found bool) {
+	for i, _ := range b.preferred {
+		if b.preferred[i].Covers(r) {
+			leader = b.preferred[i].Leader
+			return leader, b.hasReplica(r, leader)
+		}
+	}
+	return
+}
+
+func (b *DefaultBalancer) hasReplica(r Region, s ServerName) bool {
+	for _, replica := range b.regionMap[r] {
+		if replica == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Return requests per second to region @r.
+func (b *DefaultBalancer) regionQps(r Region) int64 {
+	load := b.regionLoads[r]
+	return load.ReadQps + load.WriteQps
+}
+
+// Move leaderships to preferred leaders first, and then off servers that
+// lead more regions or requests than others. At most
+// MaxLeaderTransfersPerRound leaderships are moved, and those of regions
+// that are being moved, or have been moved lately, are left alone.
+func (b *DefaultBalancer) balanceLeaders(pendings []PlacementAction) {
+	budget := b.opts.MaxLeaderTransfersPerRound
+	if budget <= 0 {
+		return
+	}
+
+	busy := b.busyRegions(pendings)
+	loads, totalCount, totalQps := b.leaderLoads()
+	budget = b.movePreferredLeaders(budget, busy, loads)
+
+	// Shares of leaders and requests of a server relative to the average,
+	// which is 1. Squares of shares of all servers add up to the least
+	// when they are even.
+	num := float64(len(loads))
+	squares := func(count int, qps int64) float64 {
+		ret := 0.0
+		if totalCount > 0 {
+			share := float64(count) * num / float64(totalCount)
+			ret += share * share
+		}
+		if totalQps > 0 {
+			share := float64(qps) * num / float64(totalQps)
+			ret += share * share
+		}
+		return ret
+	}
+	isBusy := func(ll *leaderLoad) bool {
+		limit := 1 + LEADER_IMBALANCE_SLOP
+		return float64(len(ll.regions))*num > limit*float64(totalCount) ||
+			float64(ll.qps)*num > limit*float64(totalQps)
+	}
+
+	for ; budget > 0; budget-- {
+		// Find the move off a busy server that evens shares the most.
+		var source, dest ServerName
+		var region Region
+		bestGain := 0.0
+		for s, ll := range loads {
+			if !isBusy(ll) {
+				continue
+			}
+			cur := squares(len(ll.regions), ll.qps)
+			for _, r := range ll.regions {
+				if _, hinted := b.preferredLeader(r); hinted || busy[r] {
+					continue
+				}
+				qps := b.regionQps(r)
+				next := squares(len(ll.regions)-1, ll.qps-qps)
+				for _, d := range b.regionMap[r] {
+					dl, alive := loads[d]
+					if d == s || !alive {
+						continue
+					}
+					other := squares(len(dl.regions), dl.qps)
+					otherNext := squares(len(dl.regions)+1, dl.qps+qps)
+					gain := cur + other - next - otherNext
+					if gain > bestGain {
+						source, dest, region, bestGain = s, d, r, gain
+					}
+				}
+			}
+		}
+		if bestGain <= LEADER_MIN_GAIN {
+			return
+		}
+		b.transferLeader(region, source, dest, loads)
+		busy[region] = true
+	}
+}
+
+// Return regions that are being moved, or whose leaderships have been
+// moved lately.
+func (b *DefaultBalancer) busyRegions(pendings []PlacementAction) map[Region]bool {
+	busy := make(map[Region]bool)
+	for _, act := range pendings {
+		busy[act.Region] = true
+	}
+	for r, ts := range b.transferred {
+		if b.timestamp-ts < b.opts.LeaderTransferIntervalMs {
+			busy[r] = true
+		} else {
+			delete(b.transferred, r)
+		}
+	}
+	return busy
+}
+
+// Return leaders on live servers of known regions, and their number and
+// requests in total.
+func (b *DefaultBalancer) leaderLoads() (
+	loads map[ServerName]*leaderLoad, totalCount int, totalQps int64) {
+
+	loads = make(map[ServerName]*leaderLoad)
+	for s, _ := range b.serverMap {
+		loads[s] = &leaderLoad{}
+	}
+	for r, load := range b.regionLoads {
+		ll, found := loads[load.Leader]
+		if _, known := b.regionMap[r]; !found || !known {
+			continue
+		}
+		ll.regions = append(ll.regions, r)
+		ll.qps += b.regionQps(r)
+		totalCount++
+		totalQps += b.regionQps(r)
+	}
+	return
+}
+
+// Move leaderships of regions that are not @busy to their preferred
+// leaders, at most @budget of them. Return the budget that is left.
+func (b *DefaultBalancer) movePreferredLeaders(
+	budget int, busy map[Region]bool, loads map[ServerName]*leaderLoad) int {
+
+	for r, load := range b.regionLoads {
+		if budget == 0 {
+			break
+		}
+		if _, alive := loads[load.Leader]; !alive || busy[r] {
+			continue
+		}
+		leader, found := b.preferredLeader(r)
+		if found && leader != load.Leader {
+			b.transferLeader(r, load.Leader, leader, loads)
+			busy[r] = true
+			budget--
+		}
+	}
+	return budget
+}
+
+// Ask @dest to take over the leadership of region @r from @source.
+func (b *DefaultBalancer) transferLeader(
+	r Region, source, dest ServerName, loads map[ServerName]*leaderLoad) {
+
+	qps := b.regionQps(r)
+	sl := loads[source]
+	for i, cur := range sl.regions {
+		if cur == r {
+			sl.regions = append(sl.regions[:i], sl.regions[i+1:]...)
+			break
+		}
+	}
+	sl.qps -= qps
+	dl := loads[dest]
+	dl.regions = append(dl.regions, r)
+	dl.qps += qps
+
+	b.placeLeaderTransfer(r, source, dest)
+}
+
+// Issue the transfer of the leadership of region @r from @source to @dest.
+func (b *DefaultBalancer) placeLeaderTransfer(r Region, source, dest ServerName) {
+	load := b.regionLoads[r]
+	load.Leader = dest
+	b.regionLoads[r] = load
+	b.transferred[r] = b.timestamp
+
+	act := PlacementAction{
+		Region:         r,
+		Source:         source,
+		Dest:           dest,
+		HasSource:      true,
+		LeaderTransfer: true,
+	}
+	b.opts.PlacementManager.Place(&act)
+}
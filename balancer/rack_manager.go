@@ -0,0 +1,390 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package balancer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Racks may be paths of nested failure domains from the top, such as
+// "/dc1/rack1" for a rack in a datacenter, like topologies of Hadoop.
+// Replicas are spread over the highest failure domains first.
+const (
+	// Rack of hosts that a topology does not know.
+	DEFAULT_RACK = "/default-rack"
+	// How long a topology script may run.
+	TOPOLOGY_SCRIPT_TIMEOUT_MS = 5000
+	// How long to wait before a topology script that fails runs again.
+	// The wait doubles with each failure in a row, up to the maximum.
+	TOPOLOGY_SCRIPT_BACKOFF_MS     = 1000
+	TOPOLOGY_SCRIPT_MAX_BACKOFF_MS = 60000
+)
+
+// Return how many levels of failure domains racks @a and @b share. Racks
+// that are not paths only share themselves.
+func sharedDomains(a, b string) int {
+	x := strings.Split(strings.Trim(a, "/"), "/")
+	y := strings.Split(strings.Trim(b, "/"), "/")
+	n := 0
+	for n < len(x) && n < len(y) && x[n] == y[n] {
+		n++
+	}
+	return n
+}
+
+// Maps hosts to racks and back.
+type rackTable struct {
+	racks map[string]string
+	hosts map[string][]string
+}
+
+func newRackTable(racks map[string]string) *rackTable {
+	hosts := make(map[string][]string)
+	for host, rack := range racks {
+		hosts[rack] = append(hosts[rack], host)
+	}
+	for _, list := range hosts {
+		sort.Strings(list)
+	}
+	return &rackTable{racks: racks, hosts: hosts}
+}
+
+// Puts every host in DEFAULT_RACK, for clusters without a topology.
+type SingleRackManager struct {
+	mutex sync.Mutex
+	// Hosts that have been asked about.
+	hosts map[string]bool
+}
+
+func NewSingleRackManager() *SingleRackManager {
+	return &SingleRackManager{hosts: make(map[string]bool)}
+}
+
+func (rm *SingleRackManager) GetRack(host string) string {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	rm.hosts[host] = true
+	return DEFAULT_RACK
+}
+
+func (rm *SingleRackManager) GetServers(rack string) []string {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	if rack != DEFAULT_RACK {
+		return nil
+	}
+	ret := make([]string, 0, len(rm.hosts))
+	for host, _ := range rm.hosts {
+		ret = append(ret, host)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Reads racks of hosts from a topology file, and reloads the file once it
+// changes. The file is either a JSON object that maps hosts to racks, or
+// a table with a host and its rack on each line, where "#" starts a
+// comment. Hosts that the file does not have are in DEFAULT_RACK.
+type FileRackManager struct {
+	path string
+
+	mutex   sync.Mutex
+	table   *rackTable
+	modTime time.Time
+	size    int64
+	quit    chan bool
+}
+
+// Load topology file @path, and check it for changes every @reloadMs. The
+// file is not reloaded if @reloadMs is not positive.
+func NewFileRackManager(path string, reloadMs int) (rm *FileRackManager, ok bool) {
+	rm = &FileRackManager{
+		path: path,
+		quit: make(chan bool),
+	}
+	if !rm.reload() {
+		return nil, false
+	}
+	if reloadMs > 0 {
+		go rm.watch(time.Duration(reloadMs) * time.Millisecond)
+	}
+	return rm, true
+}
+
+// Stop reloading the file.
+func (rm *FileRackManager) Close() {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	select {
+	case <-rm.quit:
+	default:
+		close(rm.quit)
+	}
+}
+
+func (rm *FileRackManager) GetRack(host string) string {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	if rack, found := rm.table.racks[host]; found {
+		return rack
+	}
+	return DEFAULT_RACK
+}
+
+func (rm *FileRackManager) GetServers(rack string) []string {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	return append([]string{}, rm.table.hosts[rack]...)
+}
+
+func (rm *FileRackManager) watch(interval time.Duration) {
+	for {
+		select {
+		case <-rm.quit:
+			return
+		case <-time.After(interval):
+		}
+		rm.reload()
+	}
+}
+
+// Read the file if it has changed. A file that fails to parse is ignored,
+// and the last topology is kept.
+func (rm *FileRackManager) reload() bool {
+	info, err := os.Stat(rm.path)
+	if err != nil {
+		log.Printf("Fails to read topology file %s: %v\n", rm.path, err)
+		return false
+	}
+
+	rm.mutex.Lock()
+	changed := !info.ModTime().Equal(rm.modTime) || info.Size() != rm.size
+	rm.mutex.Unlock()
+	if !changed {
+		return true
+	}
+
+	content, err := ioutil.ReadFile(rm.path)
+	if err != nil {
+		log.Printf("Fails to read topology file %s: %v\n", rm.path, err)
+		return false
+	}
+	racks, ok := parseTopology(content)
+	if !ok {
+		log.Printf("Fails to parse topology file %s\n", rm.path)
+		return false
+	}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	rm.table = newRackTable(racks)
+	rm.modTime = info.ModTime()
+	rm.size = info.Size()
+	log.Printf("Loads %d hosts from topology file %s\n", len(racks), rm.path)
+	return true
+}
+
+// Parse a topology file into a map from hosts to racks.
+func parseTopology(content []byte) (racks map[string]string, ok bool) {
+	racks = make(map[string]string)
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &racks); err != nil {
+			return nil, false
+		}
+		return racks, true
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, false
+		}
+		racks[fields[0]] = fields[1]
+	}
+	return racks, scanner.Err() == nil
+}
+
+// Resolves racks of hosts by an external script, like net.topology.script
+// of Hadoop. The script takes hosts as arguments, and prints their racks
+// in the same order. Racks are cached for a while, and hosts whose racks
+// expire are resolved again together. If the script fails, hosts keep
+// the racks that they had, or are in DEFAULT_RACK if they never had one,
+// and the script is not run again until a backoff passes.
+type ScriptRackManager struct {
+	script  string
+	cacheMs int
+
+	mutex   sync.Mutex
+	entries map[string]scriptEntry
+	// The script does not run before this time after it fails.
+	retryAt time.Time
+	backoff time.Duration
+}
+
+type scriptEntry struct {
+	rack    string
+	expires time.Time
+}
+
+// Resolve racks by @script, and keep them for @cacheMs.
+func NewScriptRackManager(script string, cacheMs int) *ScriptRackManager {
+	return &ScriptRackManager{
+		script:  script,
+		cacheMs: cacheMs,
+		entries: make(map[string]scriptEntry),
+	}
+}
+
+func (rm *ScriptRackManager) GetRack(host string) string {
+	rm.ResolveRacks([]string{host})
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	if entry, found := rm.entries[host]; found {
+		return entry.rack
+	}
+	return DEFAULT_RACK
+}
+
+// Run the script once for those of @hosts that are not cached, and
+// other hosts whose racks have expired.
+func (rm *ScriptRackManager) ResolveRacks(hosts []string) {
+	now := time.Now()
+	rm.mutex.Lock()
+	if now.Before(rm.retryAt) {
+		rm.mutex.Unlock()
+		return
+	}
+	pending := make(map[string]bool)
+	for _, host := range hosts {
+		if entry, found := rm.entries[host]; !found || !now.Before(entry.expires) {
+			pending[host] = true
+		}
+	}
+	if len(pending) > 0 {
+		for host, entry := range rm.entries {
+			if !now.Before(entry.expires) {
+				pending[host] = true
+			}
+		}
+	}
+	rm.mutex.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	batch := make([]string, 0, len(pending))
+	for host, _ := range pending {
+		batch = append(batch, host)
+	}
+	sort.Strings(batch)
+
+	// The script runs without the lock, since it may be slow.
+	racks, ok := rm.resolve(batch)
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+	if !ok {
+		if rm.backoff == 0 {
+			rm.backoff = TOPOLOGY_SCRIPT_BACKOFF_MS * time.Millisecond
+		} else if rm.backoff < TOPOLOGY_SCRIPT_MAX_BACKOFF_MS*time.Millisecond {
+			rm.backoff *= 2
+		}
+		rm.retryAt = time.Now().Add(rm.backoff)
+		return
+	}
+
+	rm.backoff = 0
+	expires := now.Add(time.Duration(rm.cacheMs) * time.Millisecond)
+	for i, host := range batch {
+		rm.entries[host] = scriptEntry{rack: racks[i], expires: expires}
+	}
+}
+
+// Return hosts that have been resolved to @rack.
+func (rm *ScriptRackManager) GetServers(rack string) []string {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	var ret []string
+	for host, entry := range rm.entries {
+		if entry.rack == rack {
+			ret = append(ret, host)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Run the script for @hosts, and return their racks.
+func (rm *ScriptRackManager) resolve(hosts []string) (racks []string, ok bool) {
+	var out bytes.Buffer
+	cmd := exec.Command(rm.script, hosts...)
+	cmd.Stdout = &out
+	if err := cmd.Start(); err != nil {
+		log.Printf("Fails to run topology script %s: %v\n", rm.script, err)
+		return nil, false
+	}
+
+	timer := time.AfterFunc(TOPOLOGY_SCRIPT_TIMEOUT_MS*time.Millisecond, func() {
+		cmd.Process.Kill()
+	})
+	err := cmd.Wait()
+	timer.Stop()
+	if err != nil {
+		log.Printf("Topology script %s fails: %v\n", rm.script, err)
+		return nil, false
+	}
+
+	racks = strings.Fields(out.String())
+	if len(racks) != len(hosts) {
+		log.Printf("Topology script %s returns %d racks for %d hosts\n",
+			rm.script, len(racks), len(hosts))
+		return nil, false
+	}
+	return racks, true
+}
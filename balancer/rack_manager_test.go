@@ -0,0 +1,182 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package balancer
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSharedDomains(t *testing.T) {
+	if n := sharedDomains("/dc1/r1", "/dc1/r2"); n != 1 {
+		t.Error("Unexpected shared domains:", n)
+	}
+	if n := sharedDomains("/dc1/r1", "/dc1/r1"); n != 2 {
+		t.Error("Unexpected shared domains:", n)
+	}
+	if n := sharedDomains("r1", "r2"); n != 0 {
+		t.Error("Unexpected shared domains:", n)
+	}
+}
+
+func TestSingleRackManager(t *testing.T) {
+	rm := NewSingleRackManager()
+	if rack := rm.GetRack("b"); rack != DEFAULT_RACK {
+		t.Error("Unexpected rack:", rack)
+	}
+	rm.GetRack("a")
+	if hosts := rm.GetServers(DEFAULT_RACK); !reflect.DeepEqual(hosts, []string{"a", "b"}) {
+		t.Error("Unexpected hosts:", hosts)
+	}
+}
+
+func TestFileRackManager(t *testing.T) {
+	root := "/tmp/TestFileRackManager"
+	os.RemoveAll(root)
+	os.MkdirAll(root, 0755)
+	path := root + "/topology"
+
+	table := "# host rack\na /dc1/r1\nb /dc1/r1 # comment\n\nc /dc2/r2\n"
+	ioutil.WriteFile(path, []byte(table), 0644)
+	rm, ok := NewFileRackManager(path, 10)
+	if !ok {
+		t.Fatal("Fails to load a topology table")
+	}
+	defer rm.Close()
+
+	if rack := rm.GetRack("c"); rack != "/dc2/r2" {
+		t.Error("Unexpected rack:", rack)
+	}
+	if rack := rm.GetRack("d"); rack != DEFAULT_RACK {
+		t.Error("Unexpected rack of an unknown host:", rack)
+	}
+	if hosts := rm.GetServers("/dc1/r1"); !reflect.DeepEqual(hosts, []string{"a", "b"}) {
+		t.Error("Unexpected hosts:", hosts)
+	}
+
+	// A file that fails to parse keeps the last topology.
+	ioutil.WriteFile(path, []byte("a b c\n"), 0644)
+	time.Sleep(50 * time.Millisecond)
+	if rack := rm.GetRack("a"); rack != "/dc1/r1" {
+		t.Error("Unexpected rack:", rack)
+	}
+
+	// Changes are picked up.
+	ioutil.WriteFile(path, []byte(`{"a": "/dc3/r3", "d": "/dc3/r3"}`), 0644)
+	for i := 0; rm.GetRack("a") != "/dc3/r3"; i++ {
+		if i == 100 {
+			t.Fatal("Fails to reload a topology file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hosts := rm.GetServers("/dc3/r3"); !reflect.DeepEqual(hosts, []string{"a", "d"}) {
+		t.Error("Unexpected hosts:", hosts)
+	}
+	if rack := rm.GetRack("c"); rack != DEFAULT_RACK {
+		t.Error("Unexpected rack of a removed host:", rack)
+	}
+
+	if _, ok := NewFileRackManager(root+"/missing", 0); ok {
+		t.Error("Loads a missing topology file")
+	}
+}
+
+func TestScriptRackManager(t *testing.T) {
+	root := "/tmp/TestScriptRackManager"
+	os.RemoveAll(root)
+	os.MkdirAll(root, 0755)
+
+	// The script logs each run, and resolves hosts but "bad".
+	script := root + "/topology.sh"
+	content := "#!/bin/sh\n" +
+		"echo run >> " + root + "/runs\n" +
+		"for h in \"$@\"; do\n" +
+		"  if [ \"$h\" = bad ]; then exit 1; fi\n" +
+		"  echo /dc1/rack-$h\n" +
+		"done\n"
+	ioutil.WriteFile(script, []byte(content), 0755)
+
+	runs := func() int {
+		data, _ := ioutil.ReadFile(root + "/runs")
+		return strings.Count(string(data), "run")
+	}
+
+	rm := NewScriptRackManager(script, 60000)
+	if rack := rm.GetRack("a"); rack != "/dc1/rack-a" {
+		t.Error("Unexpected rack:", rack)
+	}
+	if rack := rm.GetRack("a"); rack != "/dc1/rack-a" || runs() != 1 {
+		t.Error("Fails to cache a rack:", rack, runs())
+	}
+	if rack := rm.GetRack("bad"); rack != DEFAULT_RACK {
+		t.Error("Unexpected rack of a host that fails:", rack)
+	}
+	if hosts := rm.GetServers("/dc1/rack-a"); !reflect.DeepEqual(hosts, []string{"a"}) {
+		t.Error("Unexpected hosts:", hosts)
+	}
+
+	// Racks expire from the cache.
+	rm = NewScriptRackManager(script, 0)
+	rm.GetRack("a")
+	rm.GetRack("a")
+	if runs() != 4 {
+		t.Error("Unexpected number of runs:", runs())
+	}
+
+	rm = NewScriptRackManager(root+"/missing.sh", 60000)
+	if rack := rm.GetRack("a"); rack != DEFAULT_RACK {
+		t.Error("Unexpected rack of a missing script:", rack)
+	}
+
+	// Hosts are resolved by one run, and expired ones again together.
+	rm = NewScriptRackManager(script, 0)
+	rm.ResolveRacks([]string{"a", "b", "c"})
+	if runs() != 5 {
+		t.Error("Fails to resolve hosts at once:", runs())
+	}
+	if rack := rm.GetRack("c"); rack != "/dc1/rack-c" || runs() != 6 {
+		t.Error("Unexpected rack:", rack, runs())
+	}
+	if hosts := rm.GetServers("/dc1/rack-a"); !reflect.DeepEqual(hosts, []string{"a"}) {
+		t.Error("Fails to refresh an expired host with another:", hosts)
+	}
+
+	// A host keeps its expired rack when the script fails, which does
+	// not run again until it backs off.
+	if rack := rm.GetRack("bad"); rack != DEFAULT_RACK || runs() != 7 {
+		t.Error("Unexpected rack of a host that fails:", rack, runs())
+	}
+	if rack := rm.GetRack("a"); rack != "/dc1/rack-a" || runs() != 7 {
+		t.Error("Fails to keep a rack while the script backs off:", rack, runs())
+	}
+	if rack := rm.GetRack("d"); rack != DEFAULT_RACK || runs() != 7 {
+		t.Error("Runs the script while it backs off:", rack, runs())
+	}
+}
@@ -0,0 +1,601 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package balancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A cluster that a simulation starts from, such as stats that a master
+// has collected.
+type ClusterSnapshot struct {
+	Servers []ServerStat
+	// Maps hosts to racks. Hosts that it does not have are looked up in
+	// the RackManager of the simulation.
+	Racks map[string]string
+}
+
+// Read a snapshot in JSON from @path.
+func LoadClusterSnapshot(path string) (snapshot *ClusterSnapshot, ok bool) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Fails to read snapshot %s: %v\n", path, err)
+		return nil, false
+	}
+	snapshot = &ClusterSnapshot{}
+	if err := json.Unmarshal(content, snapshot); err != nil {
+		log.Printf("Fails to parse snapshot %s: %v\n", path, err)
+		return nil, false
+	}
+	return snapshot, true
+}
+
+// Kinds of SimEvent.
+const (
+	// Add servers to a rack.
+	SIM_ADD_SERVERS = iota
+	// Kill servers in a rack, or in a failure domain above racks.
+	SIM_KILL_RACK
+	// Kill a server.
+	SIM_KILL_SERVER
+)
+
+// A change to the cluster during a simulation.
+type SimEvent struct {
+	Kind int
+	// The round before which the event happens.
+	Round int
+	// Number of servers to add.
+	Count int
+	// Rack of new servers, or the rack to kill. New servers are placed by
+	// the RackManager of the simulation if it is empty.
+	Rack string
+	// Bytes of disk of new servers, or 0 if they do not report it.
+	DiskCapacity int64
+	// The server to kill. Any port of the host matches if Port is 0.
+	Server ServerName
+}
+
+// Parse an event such as "@3 add 5 /dc1/r4 8T", "kill-rack /dc1/r2" or
+// "kill-server host:port". The optional "@N" gives the round of the event,
+// which is 0 by default.
+func ParseSimEvent(text string) (event SimEvent, ok bool) {
+	fields := strings.Fields(text)
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		round, err := strconv.Atoi(fields[0][1:])
+		if err != nil || round < 0 {
+			return event, false
+		}
+		event.Round = round
+		fields = fields[1:]
+	}
+	if len(fields) < 2 {
+		return event, false
+	}
+
+	switch fields[0] {
+	case "add":
+		event.Kind = SIM_ADD_SERVERS
+		count, err := strconv.Atoi(fields[1])
+		if err != nil || count <= 0 || len(fields) > 4 {
+			return event, false
+		}
+		event.Count = count
+		if len(fields) > 2 {
+			event.Rack = fields[2]
+		}
+		if len(fields) > 3 {
+			if event.DiskCapacity, ok = parseBytes(fields[3]); !ok {
+				return event, false
+			}
+		}
+	case "kill-rack":
+		event.Kind = SIM_KILL_RACK
+		event.Rack = fields[1]
+		if len(fields) > 2 {
+			return event, false
+		}
+	case "kill-server":
+		event.Kind = SIM_KILL_SERVER
+		if len(fields) > 2 {
+			return event, false
+		}
+		parts := strings.Split(fields[1], ":")
+		event.Server.Host = parts[0]
+		if len(parts) > 2 || parts[0] == "" {
+			return event, false
+		}
+		if len(parts) == 2 {
+			port, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return event, false
+			}
+			event.Server.Port = port
+		}
+	default:
+		return event, false
+	}
+	return event, true
+}
+
+// Parse a size such as "512", "4G" or "8T".
+func parseBytes(text string) (size int64, ok bool) {
+	shift := uint(0)
+	if n := len(text); n > 0 {
+		if i := strings.IndexByte("KMGT", text[n-1]); i >= 0 {
+			shift = uint(i+1) * 10
+			text = text[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, false
+	}
+	return size << shift, true
+}
+
+type SimulatorOptions struct {
+	// Options of the balancer. Its PlacementManager and StateManager are
+	// set by the simulator. Its RackManager places hosts that snapshots
+	// and events do not, and puts each host in a rack of its own if it is
+	// nil.
+	Balancer BalancerOptions
+	// Rounds that a placement action takes. An action that starts in a
+	// round finishes before the next round if it is 1.
+	MoveRounds int
+	// Time between rounds, which stats of servers are stamped with.
+	RoundIntervalMs int64
+}
+
+func DefaultSimulatorOptions(balancerOpts *BalancerOptions) *SimulatorOptions {
+	return &SimulatorOptions{
+		Balancer:        *balancerOpts,
+		MoveRounds:      1,
+		RoundIntervalMs: 10000,
+	}
+}
+
+// A region in a simulation.
+type simRegion struct {
+	size     int64
+	readQps  int64
+	writeQps int64
+	// Empty if the region has no replicas.
+	leader  ServerName
+	members []ServerName
+}
+
+// A placement action that has not finished.
+type simMove struct {
+	task PlacementAction
+	// The round that the action finishes before.
+	finish int
+}
+
+// Racks of hosts in a simulation.
+type simRackManager struct {
+	racks map[string]string
+	base  RackManager
+}
+
+func (rm *simRackManager) GetRack(host string) string {
+	if rack, found := rm.racks[host]; found {
+		return rack
+	}
+	if rm.base != nil {
+		return rm.base.GetRack(host)
+	}
+	return host
+}
+
+func (rm *simRackManager) GetServers(rack string) []string {
+	var ret []string
+	if rm.base != nil {
+		for _, host := range rm.base.GetServers(rack) {
+			if _, found := rm.racks[host]; !found {
+				ret = append(ret, host)
+			}
+		}
+	} else if _, found := rm.racks[rack]; !found {
+		// A host that is not placed is a rack of its own.
+		ret = []string{rack}
+	}
+	for host, cur := range rm.racks {
+		if cur == rack {
+			ret = append(ret, host)
+		}
+	}
+	return ret
+}
+
+// Runs a DefaultBalancer on a simulated cluster, to see how it balances a
+// cluster and how it recovers from failures. Servers report their regions
+// at the start of each round, and placement actions of the balancer take
+// MoveRounds to finish. Like Master, an action for a region that is being
+// moved is dropped.
+type Simulator struct {
+	opts     SimulatorOptions
+	balancer Balancer
+	racks    *simRackManager
+	// Servers that are alive. Their regions and loads are filled in by
+	// the simulation.
+	servers map[ServerName]*ServerStat
+	regions map[Region]*simRegion
+	moves   []*simMove
+	round   int
+	// Number of servers that have been added.
+	added  int
+	report SimReport
+}
+
+func NewSimulator(opts *SimulatorOptions, snapshot *ClusterSnapshot) *Simulator {
+	s := &Simulator{
+		opts:    *opts,
+		servers: make(map[ServerName]*ServerStat),
+		regions: make(map[Region]*simRegion),
+	}
+	s.racks = &simRackManager{racks: make(map[string]string), base: opts.Balancer.RackManager}
+	for host, rack := range snapshot.Racks {
+		s.racks.racks[host] = rack
+	}
+	s.opts.Balancer.RackManager = s.racks
+	s.opts.Balancer.PlacementManager = s
+	s.opts.Balancer.StateManager = s
+	s.opts.Balancer.RegionManager = nil
+
+	for i, _ := range snapshot.Servers {
+		stat := snapshot.Servers[i]
+		s.servers[stat.ServerName] = &ServerStat{
+			ServerName:   stat.ServerName,
+			UpTimestamp:  stat.UpTimestamp,
+			DiskCapacity: stat.DiskCapacity,
+			Weight:       stat.Weight,
+		}
+		for _, r := range stat.Regions {
+			region := s.getRegion(r)
+			region.members = append(region.members, stat.ServerName)
+		}
+	}
+	for _, stat := range snapshot.Servers {
+		for _, load := range stat.Loads {
+			region := s.getRegion(load.Region)
+			region.size = load.Size
+			region.readQps = load.ReadQps
+			region.writeQps = load.WriteQps
+			region.leader = load.Leader
+		}
+	}
+	for _, region := range s.regions {
+		if !region.hasMember(region.leader) {
+			region.leader = ServerName{}
+			if len(region.members) > 0 {
+				region.leader = region.members[0]
+			}
+		}
+	}
+
+	s.balancer = NewBalancer(&s.opts.Balancer, nil)
+	return s
+}
+
+func (s *Simulator) getRegion(r Region) *simRegion {
+	region, found := s.regions[r]
+	if !found {
+		region = &simRegion{}
+		s.regions[r] = region
+	}
+	return region
+}
+
+func (r *simRegion) hasMember(sn ServerName) bool {
+	for _, member := range r.members {
+		if member == sn {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *simRegion) removeMember(sn ServerName) {
+	for i, member := range r.members {
+		if member == sn {
+			r.members = append(r.members[:i], r.members[i+1:]...)
+			break
+		}
+	}
+	if r.leader == sn {
+		r.leader = ServerName{}
+		if len(r.members) > 0 {
+			r.leader = r.members[0]
+		}
+	}
+}
+
+// Called by the balancer.
+func (s *Simulator) Place(task *PlacementAction) {
+	for _, m := range s.moves {
+		if m.task.Region == task.Region {
+			return
+		}
+	}
+	if task.LeaderTransfer {
+		s.report.LeaderTransfers++
+	} else {
+		s.report.Moves++
+	}
+	s.moves = append(s.moves, &simMove{task: *task, finish: s.round + s.opts.MoveRounds})
+}
+
+// Called by the balancer when it creates regions.
+func (s *Simulator) Commit(adds []Region, removals []Region) {
+	for _, r := range removals {
+		delete(s.regions, r)
+	}
+	for _, r := range adds {
+		s.getRegion(r)
+	}
+}
+
+// Run the balancer for @rounds rounds. Events happen before their rounds,
+// which are counted from the start of the simulation. Return a report of
+// the cluster after the last round.
+func (s *Simulator) Run(rounds int, events []SimEvent) SimReport {
+	for i := 0; i < rounds; i++ {
+		for _, event := range events {
+			if event.Round == s.round {
+				s.apply(event)
+			}
+		}
+
+		// Like Master, nothing is balanced without servers.
+		if len(s.servers) > 0 {
+			pendings := make([]PlacementAction, 0, len(s.moves))
+			for _, m := range s.moves {
+				pendings = append(pendings, m.task)
+			}
+			s.balancer.UpdateServerStats(int64(s.round)*s.opts.RoundIntervalMs, s.stats())
+			s.balancer.BalanceLoad(pendings)
+		}
+
+		s.round++
+		s.finishMoves()
+	}
+	return s.Report()
+}
+
+func (s *Simulator) apply(event SimEvent) {
+	switch event.Kind {
+	case SIM_ADD_SERVERS:
+		for i := 0; i < event.Count; i++ {
+			s.added++
+			sn := ServerName{Host: fmt.Sprintf("sim-%d", s.added)}
+			if event.Rack != "" {
+				s.racks.racks[sn.Host] = event.Rack
+			}
+			s.servers[sn] = &ServerStat{
+				ServerName:   sn,
+				UpTimestamp:  int64(s.round) * s.opts.RoundIntervalMs,
+				DiskCapacity: event.DiskCapacity,
+			}
+		}
+	case SIM_KILL_RACK:
+		for sn, _ := range s.servers {
+			rack := s.racks.GetRack(sn.Host)
+			if rack == event.Rack || strings.HasPrefix(rack, strings.TrimRight(event.Rack, "/")+"/") {
+				s.kill(sn)
+			}
+		}
+	case SIM_KILL_SERVER:
+		for sn, _ := range s.servers {
+			if sn.Host == event.Server.Host && (event.Server.Port == 0 || sn.Port == event.Server.Port) {
+				s.kill(sn)
+			}
+		}
+	}
+}
+
+// Remove server @sn and its replicas. A replica on a dead server is
+// removed from the quorum of its region at once.
+func (s *Simulator) kill(sn ServerName) {
+	delete(s.servers, sn)
+	for _, region := range s.regions {
+		region.removeMember(sn)
+	}
+}
+
+// Return stats that servers report at the start of a round.
+func (s *Simulator) stats() []ServerStat {
+	stats := make(map[ServerName]*ServerStat)
+	for sn, server := range s.servers {
+		stat := *server
+		stats[sn] = &stat
+	}
+	for r, region := range s.regions {
+		for _, member := range region.members {
+			stat := stats[member]
+			stat.Regions = append(stat.Regions, r)
+			stat.DiskUsage += region.size
+		}
+		if stat, found := stats[region.leader]; found {
+			stat.Loads = append(stat.Loads, RegionLoad{
+				Region:   r,
+				Leader:   region.leader,
+				Members:  append([]ServerName{}, region.members...),
+				Size:     region.size,
+				ReadQps:  region.readQps,
+				WriteQps: region.writeQps,
+			})
+		}
+	}
+
+	ret := make([]ServerStat, 0, len(stats))
+	for _, stat := range stats {
+		ret = append(ret, *stat)
+	}
+	return ret
+}
+
+// Carry out actions that are due. An action fails if its region or Dest
+// is gone.
+func (s *Simulator) finishMoves() {
+	var pendings []*simMove
+	for _, m := range s.moves {
+		if m.finish > s.round {
+			pendings = append(pendings, m)
+			continue
+		}
+
+		task := m.task
+		region, found := s.regions[task.Region]
+		_, alive := s.servers[task.Dest]
+		switch {
+		case !found || !alive:
+			s.report.FailedMoves++
+		case task.LeaderTransfer:
+			if region.hasMember(task.Dest) {
+				region.leader = task.Dest
+			} else {
+				s.report.FailedMoves++
+			}
+		default:
+			if !region.hasMember(task.Dest) {
+				region.members = append(region.members, task.Dest)
+			}
+			if task.HasSource && task.Source != task.Dest {
+				region.removeMember(task.Source)
+			}
+			if !region.hasMember(region.leader) {
+				region.leader = task.Dest
+			}
+		}
+	}
+	s.moves = pendings
+}
+
+// A server at the end of a simulation.
+type SimServer struct {
+	ServerName
+	Rack    string
+	Regions int
+	Leaders int
+	// Requests per second to regions that the server leads.
+	LeaderQps    int64
+	DiskUsage    int64
+	DiskCapacity int64
+}
+
+// The state of a simulated cluster.
+type SimReport struct {
+	// Rounds that have run.
+	Rounds int
+	// Replica moves and leadership transfers that the balancer has asked
+	// for, and those that have failed.
+	Moves           int
+	LeaderTransfers int
+	FailedMoves     int
+	// Actions that have not finished.
+	PendingMoves int
+	Regions      int
+	// Regions with some but fewer than NumReplicas replicas, and those
+	// without any.
+	UnderReplicated int
+	Lost            int
+	// Regions that have two replicas in a rack, while a live rack has none
+	// of their replicas.
+	RackViolations int
+	// Live servers ordered by name.
+	Servers []SimServer
+}
+
+// Return the state of the cluster.
+func (s *Simulator) Report() SimReport {
+	report := s.report
+	report.Rounds = s.round
+	report.PendingMoves = len(s.moves)
+	report.Regions = len(s.regions)
+
+	servers := make(map[ServerName]*SimServer)
+	liveRacks := make(map[string]bool)
+	for sn, stat := range s.servers {
+		rack := s.racks.GetRack(sn.Host)
+		liveRacks[rack] = true
+		servers[sn] = &SimServer{ServerName: sn, Rack: rack, DiskCapacity: stat.DiskCapacity}
+	}
+
+	for _, region := range s.regions {
+		switch {
+		case len(region.members) == 0:
+			report.Lost++
+		case len(region.members) < s.opts.Balancer.NumReplicas:
+			report.UnderReplicated++
+		}
+
+		racks := make(map[string]bool)
+		for _, member := range region.members {
+			racks[s.racks.GetRack(member.Host)] = true
+			server := servers[member]
+			server.Regions++
+			server.DiskUsage += region.size
+		}
+		if len(racks) < len(region.members) && len(racks) < len(liveRacks) {
+			report.RackViolations++
+		}
+		if server, found := servers[region.leader]; found {
+			server.Leaders++
+			server.LeaderQps += region.readQps + region.writeQps
+		}
+	}
+
+	for _, server := range servers {
+		report.Servers = append(report.Servers, *server)
+	}
+	sort.Sort(simServersByName(report.Servers))
+	return report
+}
+
+// Orders servers by their names.
+type simServersByName []SimServer
+
+func (s simServersByName) Len() int {
+	return len(s)
+}
+
+func (s simServersByName) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s simServersByName) Less(i, j int) bool {
+	if s[i].Host != s[j].Host {
+		return s[i].Host < s[j].Host
+	}
+	return s[i].Port < s[j].Port
+}
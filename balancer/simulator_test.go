@@ -0,0 +1,168 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package balancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Returns a snapshot of two servers in each of @numRacks racks, and
+// @numRegions regions with a replica in each of the first three racks.
+func snapshotForTest(numRacks, numRegions int) *ClusterSnapshot {
+	snapshot := &ClusterSnapshot{Racks: make(map[string]string)}
+	for i := 0; i < numRacks*2; i++ {
+		sn := ServerName{Host: fmt.Sprintf("h%d", i)}
+		snapshot.Racks[sn.Host] = fmt.Sprintf("/r%d", i/2)
+		snapshot.Servers = append(snapshot.Servers, ServerStat{ServerName: sn, DiskCapacity: 1 << 40})
+	}
+	for i := 0; i < numRegions; i++ {
+		r := Region{StartKey: fmt.Sprintf("%03d", i), EndKey: fmt.Sprintf("%03d", i+1)}
+		for rack := 0; rack < 3; rack++ {
+			stat := &snapshot.Servers[rack*2+i%2]
+			stat.Regions = append(stat.Regions, r)
+			if rack == 0 {
+				load := RegionLoad{Region: r, Leader: stat.ServerName, Size: 1 << 30}
+				stat.Loads = append(stat.Loads, load)
+			}
+		}
+	}
+	return snapshot
+}
+
+func simulatorOptionsForTest() *SimulatorOptions {
+	opts := DefaultSimulatorOptions(&BalancerOptions{
+		NumReplicas:                 3,
+		MaxRegionsPerServer:         100,
+		NumIterationPerBalanceRound: 10,
+		NumServersInSmallDeployment: 3,
+	})
+	return opts
+}
+
+func TestSimulatorKillRack(t *testing.T) {
+	root := "/tmp/TestSimulatorKillRack"
+	os.RemoveAll(root)
+	os.MkdirAll(root, 0755)
+
+	// Save the snapshot, as a master does.
+	content, _ := json.Marshal(snapshotForTest(4, 30))
+	path := root + "/snapshot"
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal("Fails to write the snapshot:", err)
+	}
+	snapshot, ok := LoadClusterSnapshot(path)
+	if !ok {
+		t.Fatal("Fails to load the snapshot")
+	}
+
+	sim := NewSimulator(simulatorOptionsForTest(), snapshot)
+	report := sim.Run(1, nil)
+	if report.Moves != 0 || report.Regions != 30 || len(report.Servers) != 8 {
+		t.Fatal("Unexpected report of a balanced cluster:", report)
+	}
+
+	// Replicas in "/r1" move to "/r3", which has none of them.
+	event, _ := ParseSimEvent("@1 kill-rack /r1")
+	report = sim.Run(5, []SimEvent{event})
+	if report.Moves != 30 || report.FailedMoves != 0 || report.PendingMoves != 0 {
+		t.Error("Unexpected moves:", report)
+	}
+	if report.UnderReplicated != 0 || report.Lost != 0 || report.RackViolations != 0 {
+		t.Error("Fails to recover:", report)
+	}
+	regions := 0
+	for _, server := range report.Servers {
+		if server.Rack == "/r1" {
+			t.Error("Keeps a dead server:", server)
+		}
+		if server.Rack == "/r3" {
+			regions += server.Regions
+			if server.DiskUsage != int64(server.Regions)<<30 {
+				t.Error("Unexpected disk usage:", server)
+			}
+		}
+	}
+	if regions != 30 {
+		t.Error("Unexpected regions in the new rack:", report.Servers)
+	}
+}
+
+func TestSimulatorAddServers(t *testing.T) {
+	// A cluster that starts empty creates its first region.
+	sim := NewSimulator(simulatorOptionsForTest(), &ClusterSnapshot{})
+	events := []SimEvent{
+		SimEvent{Kind: SIM_ADD_SERVERS, Count: 3},
+		SimEvent{Kind: SIM_ADD_SERVERS, Round: 5, Count: 1, Rack: "/new"},
+		SimEvent{Kind: SIM_KILL_SERVER, Round: 5, Server: ServerName{Host: "sim-1"}},
+	}
+	report := sim.Run(5, events)
+	if report.Regions != 1 || report.UnderReplicated != 0 || len(report.Servers) != 3 {
+		t.Fatal("Fails to create the first region:", report)
+	}
+
+	// The new server takes the replica of the dead one.
+	report = sim.Run(5, events)
+	if report.Rounds != 10 || report.UnderReplicated != 0 || report.RackViolations != 0 {
+		t.Error("Fails to recover:", report)
+	}
+	for _, server := range report.Servers {
+		if server.Host == "sim-1" || server.Regions != 1 {
+			t.Error("Unexpected server:", server)
+		}
+	}
+}
+
+func TestParseSimEvent(t *testing.T) {
+	cases := []struct {
+		text  string
+		ok    bool
+		event SimEvent
+	}{
+		{"add 5", true, SimEvent{Kind: SIM_ADD_SERVERS, Count: 5}},
+		{"@3 add 2 /dc1/r4 8T", true,
+			SimEvent{Kind: SIM_ADD_SERVERS, Round: 3, Count: 2, Rack: "/dc1/r4", DiskCapacity: 8 << 40}},
+		{"@2 kill-rack /dc1", true, SimEvent{Kind: SIM_KILL_RACK, Round: 2, Rack: "/dc1"}},
+		{"kill-server h1:8000", true,
+			SimEvent{Kind: SIM_KILL_SERVER, Server: ServerName{Host: "h1", Port: 8000}}},
+		{"kill-server h1", true, SimEvent{Kind: SIM_KILL_SERVER, Server: ServerName{Host: "h1"}}},
+		{"add", false, SimEvent{}},
+		{"add five", false, SimEvent{}},
+		{"add 1 /r 8X", false, SimEvent{}},
+		{"@x add 1", false, SimEvent{}},
+		{"kill-server h1:x", false, SimEvent{}},
+		{"restart h1", false, SimEvent{}},
+	}
+	for _, c := range cases {
+		event, ok := ParseSimEvent(c.text)
+		if ok != c.ok || (ok && event != c.event) {
+			t.Error("Unexpected event of", c.text, ":", event, ok)
+		}
+	}
+}
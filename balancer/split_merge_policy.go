@@ -0,0 +1,297 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package balancer
+
+import (
+	"reflect"
+	"sync"
+)
+
+// When SplitMergePolicy splits or merges regions.
+type SplitMergeOptions struct {
+	// A region larger than this is split into halves of the same size.
+	MaxRegionSize int64
+	// A region that serves more requests per second than this is split
+	// where its load splits into halves.
+	MaxRegionQps int64
+	// Two neighbors are merged if the merged region is smaller than
+	// MergeRegionSize and serves fewer requests than MergeRegionQps.
+	// They are kept well below the split thresholds, so that a merged
+	// region does not split again soon.
+	MergeRegionSize int64
+	MergeRegionQps  int64
+	// A region has to cross a threshold in this many reports in a row
+	// before it is split or merged.
+	NumStableReports int
+	// A region that has just split or merged is left alone for this long.
+	CooldownMs int64
+	// A region whose load is not reported for this long is forgotten.
+	LoadExpiryMs int64
+}
+
+func DefaultSplitMergeOptions() *SplitMergeOptions {
+	return &SplitMergeOptions{
+		MaxRegionSize:    256 << 20,
+		MaxRegionQps:     5000,
+		MergeRegionSize:  64 << 20,
+		MergeRegionQps:   500,
+		NumStableReports: 3,
+		CooldownMs:       600000,
+		LoadExpiryMs:     300000,
+	}
+}
+
+// What the policy knows about a region.
+type regionTrend struct {
+	load RegionLoad
+	// When the load is reported.
+	timestamp int64
+	// Number of reports in a row that the region is too big or too hot.
+	splitReports int
+	// Number of reports in a row that the region and its neighbor on the
+	// right are small and cold enough to be merged.
+	mergeReports int
+}
+
+// Decides when to split or merge regions by their size and load, which
+// their leaders report periodically. A threshold has to be crossed for
+// several reports in a row, and a region that has just changed is left
+// alone for a while, so that regions do not split and merge back and
+// forth.
+type SplitMergePolicy struct {
+	opts    SplitMergeOptions
+	manager RegionManager
+	// Protects all fields below.
+	mutex  sync.Mutex
+	trends map[Region]*regionTrend
+	// Maps regions that have just changed, or have been asked to change,
+	// to the time of the change.
+	cooldowns map[Region]int64
+	// The latest report time.
+	now int64
+}
+
+func NewSplitMergePolicy(opts *SplitMergeOptions, manager RegionManager) *SplitMergePolicy {
+	return &SplitMergePolicy{
+		opts:      *opts,
+		manager:   manager,
+		trends:    make(map[Region]*regionTrend),
+		cooldowns: make(map[Region]int64),
+	}
+}
+
+// A split or merge that the policy decides.
+type splitMergeAction struct {
+	leader ServerName
+	left   Region
+	right  Region
+	key    string
+	merge  bool
+}
+
+// Take loads that leaders report at @timestamp in milliseconds, and ask
+// servers to split or merge regions that have crossed a threshold long
+// enough.
+func (p *SplitMergePolicy) UpdateRegionLoads(timestamp int64, loads []RegionLoad) {
+	p.mutex.Lock()
+	actions := p.update(timestamp, loads)
+	p.mutex.Unlock()
+
+	// The manager is called without the lock, so that the change can be
+	// reported back right away.
+	for _, act := range actions {
+		if act.merge {
+			p.manager.Merge(act.leader, act.left, act.right)
+		} else {
+			p.manager.Split(act.leader, act.left, act.key)
+		}
+	}
+}
+
+func (p *SplitMergePolicy) update(timestamp int64, loads []RegionLoad) (actions []splitMergeAction) {
+	if timestamp > p.now {
+		p.now = timestamp
+	}
+	p.expire()
+
+	for _, load := range loads {
+		trend, found := p.trends[load.Region]
+		if !found {
+			trend = &regionTrend{}
+			p.trends[load.Region] = trend
+		}
+		trend.load = load
+		trend.timestamp = timestamp
+	}
+
+	for _, load := range loads {
+		trend := p.trends[load.Region]
+		if p.coolingDown(load.Region) {
+			trend.splitReports = 0
+			trend.mergeReports = 0
+			continue
+		}
+
+		if p.tooBig(&load) || p.tooHot(&load) {
+			trend.splitReports++
+		} else {
+			trend.splitReports = 0
+		}
+		if trend.splitReports >= p.opts.NumStableReports {
+			actions = append(actions, p.split(trend))
+			continue
+		}
+
+		right := p.mergeableNeighbor(trend)
+		if right == nil {
+			trend.mergeReports = 0
+			continue
+		}
+		trend.mergeReports++
+		if trend.mergeReports >= p.opts.NumStableReports {
+			actions = append(actions, p.merge(trend, right))
+		}
+	}
+	return
+}
+
+// Forget old loads and cooldowns.
+func (p *SplitMergePolicy) expire() {
+	for r, trend := range p.trends {
+		if p.now-trend.timestamp > p.opts.LoadExpiryMs {
+			delete(p.trends, r)
+		}
+	}
+	for r, start := range p.cooldowns {
+		if p.now-start >= p.opts.CooldownMs {
+			delete(p.cooldowns, r)
+		}
+	}
+}
+
+func (p *SplitMergePolicy) coolingDown(r Region) bool {
+	_, found := p.cooldowns[r]
+	return found
+}
+
+func (p *SplitMergePolicy) tooBig(load *RegionLoad) bool {
+	return load.Size > p.opts.MaxRegionSize
+}
+
+func (p *SplitMergePolicy) tooHot(load *RegionLoad) bool {
+	return load.ReadQps+load.WriteQps > p.opts.MaxRegionQps
+}
+
+// A region that is too big is split into halves of the same size. A hot
+// region that is not too big is split where its load splits.
+func (p *SplitMergePolicy) split(trend *regionTrend) splitMergeAction {
+	r := trend.load.Region
+	key := trend.load.LoadSplitKey
+	if p.tooBig(&trend.load) || key <= r.StartKey || (r.EndKey != "" && key >= r.EndKey) {
+		key = ""
+	}
+
+	trend.splitReports = 0
+	trend.mergeReports = 0
+	p.cooldowns[r] = p.now
+	return splitMergeAction{leader: trend.load.Leader, left: r, key: key}
+}
+
+// Return the neighbor on the right if it can be merged into the region
+// of @trend.
+func (p *SplitMergePolicy) mergeableNeighbor(trend *regionTrend) *regionTrend {
+	left := &trend.load
+	if left.EndKey == "" {
+		return nil
+	}
+
+	var right *regionTrend
+	for r, cur := range p.trends {
+		if r.StartKey == left.EndKey {
+			right = cur
+			break
+		}
+	}
+	if right == nil || p.coolingDown(right.load.Region) || right.splitReports > 0 {
+		return nil
+	}
+
+	size := left.Size + right.load.Size
+	qps := left.ReadQps + left.WriteQps + right.load.ReadQps + right.load.WriteQps
+	if size >= p.opts.MergeRegionSize || qps >= p.opts.MergeRegionQps {
+		return nil
+	}
+	if !sameServers(left.Members, right.load.Members) {
+		return nil
+	}
+	return right
+}
+
+func (p *SplitMergePolicy) merge(left, right *regionTrend) splitMergeAction {
+	left.mergeReports = 0
+	right.mergeReports = 0
+	p.cooldowns[left.load.Region] = p.now
+	p.cooldowns[right.load.Region] = p.now
+	return splitMergeAction{
+		leader: left.load.Leader,
+		left:   left.load.Region,
+		right:  right.load.Region,
+		merge:  true,
+	}
+}
+
+// Tell the policy that regions in @removals are replaced by those in
+// @adds. New regions are left alone for a while.
+func (p *SplitMergePolicy) RegionsChanged(adds []Region, removals []Region) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, r := range removals {
+		delete(p.trends, r)
+		delete(p.cooldowns, r)
+	}
+	for _, r := range adds {
+		p.cooldowns[r] = p.now
+	}
+}
+
+// Check if both lists have the same servers.
+func sameServers(x, y []ServerName) bool {
+	if len(x) != len(y) {
+		return false
+	}
+
+	// Use map to compare two sets of list.
+	tmp1 := make(map[ServerName]int)
+	tmp2 := make(map[ServerName]int)
+	for _, s := range x {
+		tmp1[s] = 1
+	}
+	for _, s := range y {
+		tmp2[s] = 1
+	}
+	return reflect.DeepEqual(tmp1, tmp2)
+}
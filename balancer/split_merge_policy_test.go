@@ -0,0 +1,229 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package balancer
+
+import (
+	"testing"
+)
+
+// A RegionManager that remembers what it is asked to do.
+type RecordingRegionManager struct {
+	splits []PlacementAction
+	keys   []string
+	merges [][2]Region
+}
+
+func (rm *RecordingRegionManager) Split(leader ServerName, r Region, key string) {
+	rm.splits = append(rm.splits, PlacementAction{Region: r, Dest: leader})
+	rm.keys = append(rm.keys, key)
+}
+
+func (rm *RecordingRegionManager) Merge(leader ServerName, left, right Region) {
+	rm.merges = append(rm.merges, [2]Region{left, right})
+}
+
+func splitMergeOptionsForTest() *SplitMergeOptions {
+	return &SplitMergeOptions{
+		MaxRegionSize:    1000,
+		MaxRegionQps:     100,
+		MergeRegionSize:  300,
+		MergeRegionQps:   20,
+		NumStableReports: 3,
+		CooldownMs:       10000,
+		LoadExpiryMs:     5000,
+	}
+}
+
+var policyTestMembers = []ServerName{{Host: "a"}, {Host: "b"}, {Host: "c"}}
+
+func loadForTest(r Region, size, qps int64) RegionLoad {
+	return RegionLoad{
+		Region:   r,
+		Leader:   ServerName{Host: "a"},
+		Members:  policyTestMembers,
+		Size:     size,
+		ReadQps:  qps,
+		WriteQps: qps,
+	}
+}
+
+func TestSplitMergePolicySplitBigRegion(t *testing.T) {
+	rm := &RecordingRegionManager{}
+	p := NewSplitMergePolicy(splitMergeOptionsForTest(), rm)
+
+	r := Region{}
+	p.UpdateRegionLoads(1000, []RegionLoad{loadForTest(r, 2000, 0)})
+	p.UpdateRegionLoads(2000, []RegionLoad{loadForTest(r, 2000, 0)})
+
+	// A spike does not split the region.
+	p.UpdateRegionLoads(3000, []RegionLoad{loadForTest(r, 500, 0)})
+	p.UpdateRegionLoads(4000, []RegionLoad{loadForTest(r, 2000, 0)})
+	p.UpdateRegionLoads(5000, []RegionLoad{loadForTest(r, 2000, 0)})
+	if len(rm.splits) != 0 {
+		t.Fatal("Splits a region too early")
+	}
+
+	p.UpdateRegionLoads(6000, []RegionLoad{loadForTest(r, 2000, 0)})
+	if len(rm.splits) != 1 || rm.splits[0].Region != r || rm.keys[0] != "" {
+		t.Fatal("Fails to split a big region:", rm.splits, rm.keys)
+	}
+
+	// The region is not asked to split again while it is splitting.
+	for ts := int64(7000); ts < 12000; ts += 1000 {
+		p.UpdateRegionLoads(ts, []RegionLoad{loadForTest(r, 2000, 0)})
+	}
+	if len(rm.splits) != 1 {
+		t.Error("Asks a region to split twice")
+	}
+}
+
+func TestSplitMergePolicySplitHotRegion(t *testing.T) {
+	rm := &RecordingRegionManager{}
+	p := NewSplitMergePolicy(splitMergeOptionsForTest(), rm)
+
+	hot := loadForTest(Region{EndKey: "x"}, 100, 60)
+	hot.LoadSplitKey = "m"
+	outside := loadForTest(Region{StartKey: "x"}, 100, 60)
+	outside.LoadSplitKey = "a"
+
+	for ts := int64(1000); ts <= 3000; ts += 1000 {
+		p.UpdateRegionLoads(ts, []RegionLoad{hot, outside})
+	}
+
+	if len(rm.splits) != 2 {
+		t.Fatal("Fails to split hot regions:", rm.splits)
+	}
+	if rm.keys[0] != "m" {
+		t.Error("A hot region is not split where its load splits:", rm.keys[0])
+	}
+	if rm.keys[1] != "" {
+		t.Error("A split key outside of the region is used:", rm.keys[1])
+	}
+}
+
+func TestSplitMergePolicyMerge(t *testing.T) {
+	rm := &RecordingRegionManager{}
+	p := NewSplitMergePolicy(splitMergeOptionsForTest(), rm)
+
+	a := Region{EndKey: "g"}
+	b := Region{StartKey: "g", EndKey: "p"}
+	c := Region{StartKey: "p"}
+
+	// @a and @b are too big to merge, although neither splits. @c has
+	// different members than @b.
+	other := loadForTest(c, 150, 0)
+	other.Members = []ServerName{{Host: "a"}, {Host: "b"}, {Host: "d"}}
+	for ts := int64(1000); ts <= 3000; ts += 1000 {
+		p.UpdateRegionLoads(ts, []RegionLoad{
+			loadForTest(a, 50, 1),
+			loadForTest(b, 300, 1),
+			other,
+		})
+	}
+
+	if len(rm.merges) != 0 {
+		t.Fatal("Merges regions that are too big:", rm.merges)
+	}
+
+	for ts := int64(4000); ts <= 6000; ts += 1000 {
+		p.UpdateRegionLoads(ts, []RegionLoad{
+			loadForTest(a, 50, 1),
+			loadForTest(b, 100, 1),
+			other,
+		})
+	}
+
+	if len(rm.merges) != 1 || rm.merges[0] != [2]Region{a, b} {
+		t.Fatal("Fails to merge cold neighbors:", rm.merges)
+	}
+
+	// The merged region is left alone for a while.
+	ab := Region{EndKey: "p"}
+	p.RegionsChanged([]Region{ab}, []Region{a, b})
+	other.Members = policyTestMembers
+	for ts := int64(7000); ts <= 12000; ts += 1000 {
+		p.UpdateRegionLoads(ts, []RegionLoad{loadForTest(ab, 100, 1), other})
+	}
+	if len(rm.merges) != 1 {
+		t.Error("Merges a region that has just changed:", rm.merges)
+	}
+
+	for ts := int64(17000); ts <= 19000; ts += 1000 {
+		p.UpdateRegionLoads(ts, []RegionLoad{loadForTest(ab, 100, 1), other})
+	}
+	if len(rm.merges) != 2 || rm.merges[1] != [2]Region{ab, c} {
+		t.Error("Fails to merge after the cooldown:", rm.merges)
+	}
+}
+
+func TestDefaultBalancerSplitsByLoad(t *testing.T) {
+	serverMap := make(map[ServerName]string)
+	for _, s := range policyTestMembers {
+		serverMap[s] = "r"
+	}
+
+	b := DefaultBalancerForTest(serverMap)
+	rm := &RecordingRegionManager{}
+	b.policy = NewSplitMergePolicy(splitMergeOptionsForTest(), rm)
+
+	r := Region{}
+	for ts := int64(1000); ts <= 3000; ts += 1000 {
+		var stats []ServerStat
+		for _, s := range policyTestMembers {
+			stat := ServerStat{ServerName: s, UpTimestamp: 1, Regions: []Region{r}}
+			if s == policyTestMembers[0] {
+				stat.Loads = []RegionLoad{loadForTest(r, 2000, 0)}
+			}
+			stats = append(stats, stat)
+		}
+		b.UpdateServerStats(ts, stats)
+	}
+
+	if len(rm.splits) != 1 || rm.splits[0].Dest != policyTestMembers[0] {
+		t.Fatal("Fails to split a big region:", rm.splits)
+	}
+
+	// The new regions are not merged back right away.
+	left := Region{EndKey: "m"}
+	right := Region{StartKey: "m"}
+	if !b.SplitRegion(r, left, right) {
+		t.Fatal("Fails to split the region")
+	}
+	for ts := int64(4000); ts <= 6000; ts += 1000 {
+		var stats []ServerStat
+		for _, s := range policyTestMembers {
+			stat := ServerStat{ServerName: s, UpTimestamp: 1, Regions: []Region{left, right}}
+			if s == policyTestMembers[0] {
+				stat.Loads = []RegionLoad{loadForTest(left, 10, 0), loadForTest(right, 10, 0)}
+			}
+			stats = append(stats, stat)
+		}
+		b.UpdateServerStats(ts, stats)
+	}
+	if len(rm.merges) != 0 {
+		t.Error("Merges regions that have just split:", rm.merges)
+	}
+}
@@ -0,0 +1,524 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package balancer
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Weights of costs and limits of the search of StochasticBalancer. Each
+// cost is from 0 to 1, and a layout is better if its weighted costs add
+// up to less. A cost of weight 0 is ignored.
+type StochasticOptions struct {
+	// Replicas of servers out of proportion to their capacity.
+	RegionCountCost float64
+	// Replicas of each table out of proportion to capacity of servers.
+	TableSkewCost float64
+	// Regions with two replicas in a rack, while another rack has none.
+	RackLocalityCost float64
+	// Leaders of servers out of proportion to their capacity.
+	LeaderSkewCost float64
+	// Replicas that are moved in a round, relative to all replicas.
+	MoveCost float64
+	// Reads and writes of servers out of proportion to their capacity.
+	ReadLoadCost  float64
+	WriteLoadCost float64
+
+	// A search takes StepsPerRegion steps for each region, but no more
+	// than MaxSteps steps and no longer than MaxSearchMs.
+	StepsPerRegion int
+	MaxSteps       int
+	MaxSearchMs    int64
+	// At most this many replicas are moved in a round.
+	MaxMovesPerRound int
+	// There is no search unless a cost other than MoveCost reaches this.
+	MinCostToBalance float64
+
+	// Return the table of a region. If it is nil, all regions are in a
+	// table.
+	TableOf func(r Region) string
+}
+
+func DefaultStochasticOptions() *StochasticOptions {
+	return &StochasticOptions{
+		RegionCountCost:  500,
+		TableSkewCost:    35,
+		RackLocalityCost: 10000,
+		LeaderSkewCost:   100,
+		MoveCost:         7,
+		ReadLoadCost:     5,
+		WriteLoadCost:    5,
+		StepsPerRegion:   800,
+		MaxSteps:         100000,
+		MaxSearchMs:      5000,
+		MaxMovesPerRound: 10,
+		MinCostToBalance: 0.025,
+	}
+}
+
+// Return a TableOf function for keys that start with their table name
+// and then @delim. A key without @delim is in a table of its own name.
+func TableByKeyPrefix(delim string) func(r Region) string {
+	return func(r Region) string {
+		if idx := strings.Index(r.StartKey, delim); idx >= 0 {
+			return r.StartKey[:idx]
+		}
+		return r.StartKey
+	}
+}
+
+// A balancer that repairs under-replicated regions and moves leaders to
+// preferred ones like DefaultBalancer. Once every region has all its
+// replicas, it searches for moves of replicas and leaders that lower
+// weighted costs of the cluster, by a bounded random walk that keeps a
+// step only if the cost goes down.
+type StochasticBalancer struct {
+	*DefaultBalancer
+	stochastic *StochasticOptions
+	costs      []costFunction
+}
+
+func NewStochasticBalancer(opts *BalancerOptions, servers []ServerName) *StochasticBalancer {
+	stochastic := opts.Stochastic
+	if stochastic == nil {
+		stochastic = DefaultStochasticOptions()
+	}
+	return &StochasticBalancer{
+		DefaultBalancer: NewDefaultBalancer(opts, servers),
+		stochastic:      stochastic,
+		costs:           newCostFunctions(stochastic),
+	}
+}
+
+// Repair under-replicated regions and move leaders to preferred ones
+// first. The cluster is searched only after repairs and moves finish.
+func (b *StochasticBalancer) BalanceLoad(pendings []PlacementAction) {
+	if search := b.PlanLoad(pendings); search != nil {
+		search.Run()
+		b.ApplySearch(search)
+	}
+}
+
+// Do what BalanceLoad does, except that the search is returned rather than
+// run. It is nil if the cluster needs no search.
+func (b *StochasticBalancer) PlanLoad(pendings []PlacementAction) *Search {
+	b.placeReplicas(pendings)
+
+	busy := b.busyRegions(pendings)
+	budget := b.opts.MaxLeaderTransfersPerRound
+	if budget > 0 {
+		loads, _, _ := b.leaderLoads()
+		budget = b.movePreferredLeaders(budget, busy, loads)
+	}
+
+	if !b.settled(pendings) {
+		return nil
+	}
+
+	c := b.buildModel(busy)
+	if len(c.regions) == 0 || len(c.servers) < 2 || !b.needsBalance(c) {
+		return nil
+	}
+	return &Search{
+		model:      c,
+		costs:      b.costs,
+		stochastic: b.stochastic,
+		budget:     budget,
+	}
+}
+
+// Return true if no replica is being moved, and every region has all its
+// replicas.
+func (b *StochasticBalancer) settled(pendings []PlacementAction) bool {
+	for _, act := range pendings {
+		if !act.LeaderTransfer {
+			return false
+		}
+	}
+	for _, slist := range b.regionMap {
+		if len(slist) > 0 && len(slist) < b.opts.NumReplicas {
+			return false
+		}
+	}
+	return true
+}
+
+// Build a model of live servers and their regions. Regions that are
+// @busy do not change, and neither do leaders of regions with preferred
+// leaders.
+func (b *StochasticBalancer) buildModel(busy map[Region]bool) *clusterModel {
+	servers := make([]ServerName, 0, len(b.serverMap))
+	for s, _ := range b.serverMap {
+		servers = append(servers, s)
+	}
+	sort.Sort(serverNames(servers))
+
+	index := make(map[ServerName]int)
+	hosts := make([]string, len(servers))
+	racks := make([]string, len(servers))
+	capacities := make([]int64, len(servers))
+	for i, s := range servers {
+		index[s] = i
+		hosts[i] = s.Host
+		racks[i] = b.opts.RackManager.GetRack(s.Host)
+		capacities[i] = b.capacities[s]
+	}
+	c := newClusterModel(servers, hosts, racks, capacities)
+
+	regions := make([]Region, 0, len(b.regionMap))
+	for r, slist := range b.regionMap {
+		if len(slist) > 0 {
+			regions = append(regions, r)
+		}
+	}
+	sort.Sort(regionsByStartKey(regions))
+
+	for _, r := range regions {
+		slist := b.regionMap[r]
+		replicas := make([]int, len(slist))
+		for k, s := range slist {
+			replicas[k] = index[s]
+		}
+
+		leader := -1
+		load, found := b.regionLoads[r]
+		if found && b.hasReplica(r, load.Leader) {
+			leader = index[load.Leader]
+		}
+		table := ""
+		if b.stochastic.TableOf != nil {
+			table = b.stochastic.TableOf(r)
+		}
+
+		i := c.addRegion(r, table, replicas, leader, load.ReadQps, load.WriteQps)
+		c.frozen[i] = busy[r] || len(slist) != b.opts.NumReplicas
+		_, hinted := b.preferredLeader(r)
+		c.pinned[i] = hinted || leader < 0
+	}
+	return c
+}
+
+// Return the weighted @costs of @c.
+func totalCost(costs []costFunction, c *clusterModel) float64 {
+	total := 0.0
+	for _, f := range costs {
+		total += f.weight * f.cost(c)
+	}
+	return total
+}
+
+// Return true if a cost other than the move cost is high enough.
+func (b *StochasticBalancer) needsBalance(c *clusterModel) bool {
+	for _, f := range b.costs {
+		if f.name != "move" && f.cost(c) >= b.stochastic.MinCostToBalance {
+			return true
+		}
+	}
+	return false
+}
+
+// A step of the search, which moves a replica or the leadership of a
+// region.
+type searchStep struct {
+	region int
+	from   int
+	to     int
+	leader bool
+}
+
+// A search of StochasticBalancer for moves that lower the cost of a copy
+// of the cluster. Run touches nothing but the copy, so a caller can run it
+// without the locks that the balancer is used with, and then apply the
+// moves it finds with ApplySearch.
+type Search struct {
+	model      *clusterModel
+	costs      []costFunction
+	stochastic *StochasticOptions
+	// At most this many leader transfers are planned.
+	budget int
+	// Steps that lower the cost, in the order they are found.
+	plan []searchStep
+}
+
+// Search for moves of replicas and leaders that lower the cost, within
+// the limits of the options.
+func (search *Search) Run() {
+	c := search.model
+	opts := search.stochastic
+
+	steps := opts.StepsPerRegion * len(c.regions)
+	if steps > opts.MaxSteps {
+		steps = opts.MaxSteps
+	}
+	deadline := time.Now().Add(time.Duration(opts.MaxSearchMs) * time.Millisecond)
+
+	// Regions that do not spread over racks at the start.
+	var violators []int
+	for i := 0; i < len(c.regions); i++ {
+		if !c.frozen[i] && c.violates(i) {
+			violators = append(violators, i)
+		}
+	}
+
+	initial := totalCost(search.costs, c)
+	cost := initial
+	// A region moves at most once in a round.
+	touched := make([]bool, len(c.regions))
+	moves, transfers := 0, 0
+	for n := 0; n < steps; n++ {
+		if n%100 == 0 && time.Now().After(deadline) {
+			break
+		}
+
+		var step searchStep
+		var ok bool
+		switch rand.Intn(4) {
+		case 0:
+			step, ok = randomMove(c)
+		case 1:
+			step, ok = skewedMove(c)
+		case 2:
+			step, ok = rackMove(c, violators)
+		case 3:
+			step, ok = leaderMove(c)
+		}
+		if !ok || touched[step.region] {
+			continue
+		}
+		if step.leader && transfers >= search.budget {
+			continue
+		}
+		if !step.leader && moves >= opts.MaxMovesPerRound {
+			continue
+		}
+
+		if step.leader {
+			c.moveLeader(step.region, step.to)
+		} else {
+			c.moveReplica(step.region, step.from, step.to)
+			c.moved++
+		}
+		next := totalCost(search.costs, c)
+		if next < cost {
+			cost = next
+			touched[step.region] = true
+			search.plan = append(search.plan, step)
+			if step.leader {
+				transfers++
+			} else {
+				moves++
+			}
+			continue
+		}
+
+		// Undo the step.
+		if step.leader {
+			c.moveLeader(step.region, step.from)
+		} else {
+			c.moveReplica(step.region, step.to, step.from)
+			c.moved--
+		}
+	}
+
+	if len(search.plan) > 0 {
+		log.Printf("Lowers balancer cost from %.4f to %.4f with %d moves and %d leader transfers\n",
+			initial, cost, moves, transfers)
+	}
+}
+
+// Carry out moves that @search has found. The cluster may have changed
+// while the search ran, so a move is dropped unless its source still has
+// the replica or the leadership, and its destination can still take it.
+func (b *StochasticBalancer) ApplySearch(search *Search) {
+	c := search.model
+	for _, step := range search.plan {
+		r := c.regions[step.region]
+		source, dest := c.servers[step.from], c.servers[step.to]
+		if !b.hasReplica(r, source) {
+			continue
+		}
+
+		if step.leader {
+			_, hinted := b.preferredLeader(r)
+			if hinted || b.regionLoads[r].Leader != source || !b.hasReplica(r, dest) {
+				continue
+			}
+			b.placeLeaderTransfer(r, source, dest)
+			continue
+		}
+
+		if _, live := b.serverMap[dest]; !live || b.hasReplica(r, dest) {
+			continue
+		}
+		act := PlacementAction{
+			Region:    r,
+			Source:    source,
+			Dest:      dest,
+			HasSource: true,
+		}
+		b.opts.PlacementManager.Place(&act)
+	}
+}
+
+// Move a replica of a random region to a random server.
+func randomMove(c *clusterModel) (step searchStep, ok bool) {
+	i := rand.Intn(len(c.regions))
+	replicas := c.replicas[i]
+	from := replicas[rand.Intn(len(replicas))]
+	to := rand.Intn(len(c.servers))
+	return searchStep{region: i, from: from, to: to}, c.canMove(i, from, to)
+}
+
+// Move a random replica of the server with the most replicas for its
+// capacity to the server with the fewest.
+func skewedMove(c *clusterModel) (step searchStep, ok bool) {
+	from, to := -1, -1
+	for s := 0; s < len(c.servers); s++ {
+		ratio := c.ratio(float64(len(c.serverRegions[s])), s)
+		if from < 0 || ratio > c.ratio(float64(len(c.serverRegions[from])), from) {
+			from = s
+		}
+		if math.IsInf(ratio, 1) {
+			continue
+		}
+		if to < 0 || ratio < c.ratio(float64(len(c.serverRegions[to])), to) {
+			to = s
+		}
+	}
+	if to < 0 || from == to || len(c.serverRegions[from]) == 0 {
+		return step, false
+	}
+
+	regions := c.serverRegions[from]
+	i := regions[rand.Intn(len(regions))]
+	return searchStep{region: i, from: from, to: to}, c.canMove(i, from, to)
+}
+
+// Move a replica of a region in @violators out of a rack with another
+// replica, to a random server in a rack without any.
+func rackMove(c *clusterModel, violators []int) (step searchStep, ok bool) {
+	if len(violators) == 0 {
+		return step, false
+	}
+	i := violators[rand.Intn(len(violators))]
+	if !c.violates(i) {
+		return step, false
+	}
+
+	from := -1
+	racks := make(map[int]bool)
+	for _, s := range c.replicas[i] {
+		if racks[c.racks[s]] {
+			from = s
+		}
+		racks[c.racks[s]] = true
+	}
+	to := rand.Intn(len(c.servers))
+	if from < 0 || racks[c.racks[to]] {
+		return step, false
+	}
+	return searchStep{region: i, from: from, to: to}, c.canMove(i, from, to)
+}
+
+// Move the leadership of a random region to another replica of it. Half
+// of the time, the region is led by the server with the most leaders for
+// its capacity, and the replica with the fewest takes over.
+func leaderMove(c *clusterModel) (step searchStep, ok bool) {
+	i := rand.Intn(len(c.regions))
+	if rand.Intn(2) == 0 {
+		from := 0
+		for s := 1; s < len(c.servers); s++ {
+			if c.ratio(float64(c.leaderCounts[s]), s) >
+				c.ratio(float64(c.leaderCounts[from]), from) {
+				from = s
+			}
+		}
+		regions := c.serverRegions[from]
+		if len(regions) == 0 {
+			return step, false
+		}
+		i = regions[rand.Intn(len(regions))]
+		if c.leaders[i] != from {
+			return step, false
+		}
+	}
+	if c.frozen[i] || c.pinned[i] {
+		return step, false
+	}
+
+	from, to := c.leaders[i], -1
+	for _, s := range c.replicas[i] {
+		if s == from {
+			continue
+		}
+		if to < 0 || c.ratio(float64(c.leaderCounts[s]), s) <
+			c.ratio(float64(c.leaderCounts[to]), to) {
+			to = s
+		}
+	}
+	if to < 0 {
+		return step, false
+	}
+	return searchStep{region: i, from: from, to: to, leader: true}, true
+}
+
+// Orders servers by their names.
+type serverNames []ServerName
+
+func (s serverNames) Len() int {
+	return len(s)
+}
+
+func (s serverNames) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s serverNames) Less(i, j int) bool {
+	if s[i].Host != s[j].Host {
+		return s[i].Host < s[j].Host
+	}
+	return s[i].Port < s[j].Port
+}
+
+// Orders regions by their start keys.
+type regionsByStartKey []Region
+
+func (r regionsByStartKey) Len() int {
+	return len(r)
+}
+
+func (r regionsByStartKey) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
+
+func (r regionsByStartKey) Less(i, j int) bool {
+	return r[i].StartKey < r[j].StartKey
+}
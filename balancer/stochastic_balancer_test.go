@@ -0,0 +1,176 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package balancer
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func stochasticOptionsForTest() *SimulatorOptions {
+	opts := simulatorOptionsForTest()
+	opts.Balancer.Policy = BALANCER_POLICY_STOCHASTIC
+	opts.Balancer.MaxLeaderTransfersPerRound = 4
+	return opts
+}
+
+func TestStochasticBalancerSpreadsRegions(t *testing.T) {
+	// The fourth rack and leaders in the second and third racks start
+	// empty.
+	sim := NewSimulator(stochasticOptionsForTest(), snapshotForTest(4, 30))
+	if _, ok := sim.balancer.(*StochasticBalancer); !ok {
+		t.Fatal("Unexpected balancer:", sim.balancer)
+	}
+
+	last := sim.Report()
+	for i := 0; i < 10; i++ {
+		report := sim.Run(1, nil)
+		if report.Moves-last.Moves > DefaultStochasticOptions().MaxMovesPerRound ||
+			report.LeaderTransfers-last.LeaderTransfers > 4 {
+			t.Fatal("Moves too many in a round:", report)
+		}
+		if report.UnderReplicated != 0 || report.RackViolations != 0 {
+			t.Fatal("Breaks regions:", report)
+		}
+		last = report
+	}
+	for _, server := range last.Servers {
+		if server.Regions < 11 || server.Regions > 12 || server.Leaders < 3 || server.Leaders > 4 {
+			t.Error("Unexpected server:", server)
+		}
+	}
+
+	// Nothing moves once the cluster is balanced.
+	report := sim.Run(5, nil)
+	if report.Moves != last.Moves || report.LeaderTransfers != last.LeaderTransfers {
+		t.Error("Moves in a balanced cluster:", report)
+	}
+}
+
+func TestStochasticBalancerRackLocality(t *testing.T) {
+	// Regions have two replicas in the first rack, and none in the third.
+	snapshot := snapshotForTest(3, 0)
+	for i := 0; i < 6; i++ {
+		r := Region{StartKey: fmt.Sprintf("%03d", i), EndKey: fmt.Sprintf("%03d", i+1)}
+		for _, s := range []int{0, 1, 2 + i%2} {
+			stat := &snapshot.Servers[s]
+			stat.Regions = append(stat.Regions, r)
+			if s == 0 {
+				stat.Loads = append(stat.Loads, RegionLoad{Region: r, Leader: stat.ServerName})
+			}
+		}
+	}
+
+	sim := NewSimulator(stochasticOptionsForTest(), snapshot)
+	if report := sim.Report(); report.RackViolations != 6 {
+		t.Fatal("Unexpected report:", report)
+	}
+	report := sim.Run(5, nil)
+	if report.RackViolations != 0 || report.UnderReplicated != 0 || report.FailedMoves != 0 {
+		t.Error("Fails to spread regions over racks:", report)
+	}
+}
+
+func TestClusterModelCosts(t *testing.T) {
+	servers := []ServerName{ServerName{Host: "a"}, ServerName{Host: "b"}}
+	c := newClusterModel(servers, []string{"a", "b"}, []string{"/r1", "/r2"}, []int64{1, 3})
+	if c.shares[0] != 0.25 || c.shares[1] != 0.75 {
+		t.Fatal("Unexpected shares:", c.shares)
+	}
+
+	// Table "x" is on server a, and table "y" on server b.
+	for i := 0; i < 4; i++ {
+		r := Region{StartKey: fmt.Sprintf("x%d", i)}
+		c.addRegion(r, "x", []int{0}, 0, 10, 0)
+	}
+	for i := 0; i < 12; i++ {
+		r := Region{StartKey: fmt.Sprintf("y%d", i)}
+		c.addRegion(r, "y", []int{1}, 1, 10, 0)
+	}
+	costs := []float64{
+		regionCountCost(c), tableSkewCost(c), rackLocalityCost(c),
+		leaderSkewCost(c), moveCost(c), readLoadCost(c), writeLoadCost(c),
+	}
+	expected := []float64{0, 0.375, 0, 0, 0, 0, 0}
+	for k, cost := range costs {
+		if math.Abs(cost-expected[k]) > 1e-9 {
+			t.Error("Unexpected costs:", costs)
+			break
+		}
+	}
+
+	// A move skews regions, and moving back restores costs.
+	c.moveReplica(0, 0, 1)
+	if c.leaders[0] != 1 || len(c.serverRegions[0]) != 3 ||
+		math.Abs(regionCountCost(c)-0.0625) > 1e-9 {
+		t.Error("Unexpected move:", c.leaders, c.serverRegions)
+	}
+	c.moveReplica(0, 1, 0)
+	if c.leaders[0] != 0 || regionCountCost(c) != 0 || math.Abs(tableSkewCost(c)-0.375) > 1e-9 {
+		t.Error("Fails to move back:", c.leaders, c.serverRegions)
+	}
+
+	// A replica does not move to a host with another one.
+	c.addRegion(Region{StartKey: "z"}, "z", []int{0, 1}, 0, 0, 0)
+	if c.canMove(16, 0, 1) || !c.canMove(15, 1, 0) {
+		t.Error("Unexpected moves")
+	}
+}
+
+func TestStochasticBalancerDropsStaleMoves(t *testing.T) {
+	// The fourth rack starts empty, so the search moves replicas to it.
+	sim := NewSimulator(stochasticOptionsForTest(), snapshotForTest(4, 30))
+	b := sim.balancer.(*StochasticBalancer)
+	b.UpdateServerStats(0, sim.stats())
+	search := b.PlanLoad(nil)
+	if search == nil {
+		t.Fatal("Should search an unbalanced cluster")
+	}
+	search.Run()
+
+	moves := 0
+	for _, step := range search.plan {
+		if !step.leader && search.model.racks[step.to] == search.model.racks[6] {
+			moves++
+		}
+	}
+	if moves == 0 {
+		t.Fatal("Should move replicas to the empty rack:", search.plan)
+	}
+
+	// The empty rack dies while the search runs. Nothing moves to it.
+	for _, host := range []string{"h6", "h7"} {
+		sim.kill(ServerName{Host: host})
+	}
+	b.UpdateServerStats(1, sim.stats())
+	b.ApplySearch(search)
+	for _, m := range sim.moves {
+		if m.task.Dest.Host == "h6" || m.task.Dest.Host == "h7" {
+			t.Error("Moves to a dead server:", m.task)
+		}
+	}
+}
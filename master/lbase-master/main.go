@@ -0,0 +1,189 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// The master of a cluster. Masters elect an active one through zookeeper,
+// which balances regions among servers. Standbys keep track of servers and
+// saved regions as well, so that one can take over right away. Any master
+// finds regions for clients.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"lbase/balancer"
+	"lbase/master"
+	"lbase/server"
+	"lbase/zk/coord"
+	"lbase/zk/recipes"
+	"log"
+	"os"
+	"time"
+)
+
+var (
+	host        = flag.String("host", "", "Host name that servers reach the master at")
+	port        = flag.Int("port", 0, "Port to serve RPCs on")
+	rpcPrefix   = flag.String("rpc_prefix", "", "HTTP RPC path prefix of the cluster")
+	zkHosts     = flag.String("zk", "127.0.0.1:2181", "Comma separated zookeeper servers")
+	zkTimeoutMs = flag.Int("zk_timeout_ms", 10000, "Zookeeper session timeout")
+	zkRoot      = flag.String("zk_root", "/lbase", "Zookeeper path of the cluster")
+	zkDigest    = flag.String("zk_digest", "", "Zookeeper digest credentials user:password that znodes of the cluster are restricted to")
+	numReplicas = flag.Int("replicas", 3, "Number of replicas of a region")
+	maxRegions  = flag.Int("max_regions", 1000, "Maximum number of regions on a server")
+
+	policy     = flag.String("balancer", balancer.BALANCER_POLICY_DEFAULT, "Balancer policy, default or stochastic")
+	tableDelim = flag.String("table_delim", "", "Keys start with their table names and then this, which the stochastic balancer keeps tables even by")
+
+	leaderTransfers          = flag.Int("leader_transfers", 4, "Maximum number of leaderships moved in a round of balancing, or 0 to leave leaders alone")
+	leaderTransferIntervalMs = flag.Int("leader_transfer_interval_ms", 600000, "How long the leadership of a region stays before it is moved again")
+
+	topologyFile     = flag.String("topology_file", "", "File that maps hosts to racks, such as /dc1/rack1")
+	topologyReloadMs = flag.Int("topology_reload_ms", 60000, "How often to check the topology file for changes")
+	topologyScript   = flag.String("topology_script", "", "Script that prints racks of hosts in its arguments")
+	topologyCacheMs  = flag.Int("topology_cache_ms", 600000, "How long to keep racks that the topology script prints")
+)
+
+// Without a topology, all hosts are in one rack, and replicas of a
+// region are still kept on different hosts.
+func newRackManager() balancer.RackManager {
+	switch {
+	case *topologyFile != "":
+		rm, ok := balancer.NewFileRackManager(*topologyFile, *topologyReloadMs)
+		if !ok {
+			log.Fatal("Fails to load the topology file")
+		}
+		return rm
+	case *topologyScript != "":
+		return balancer.NewScriptRackManager(*topologyScript, *topologyCacheMs)
+	default:
+		return balancer.NewSingleRackManager()
+	}
+}
+
+func main() {
+	flag.Parse()
+	if *host == "" {
+		name, err := os.Hostname()
+		if err != nil {
+			log.Fatal("Fails to get the host name: ", err)
+		}
+		*host = name
+	}
+
+	rpcServer, rport := server.NewServer(*rpcPrefix, *port)
+	if rpcServer == nil {
+		log.Fatal("Fails to start the RPC server")
+	}
+
+	// The election and the regions go on with a new session if the
+	// session expires.
+	client, ok := coord.NewSessionKeeper(func() (coord.Coordinator, bool) {
+		c, ok := coord.Dial(*zkHosts, *zkTimeoutMs, nil)
+		if !ok {
+			return nil, false
+		}
+		return c, true
+	})
+	if !ok {
+		log.Fatal("Fails to connect to zookeeper")
+	}
+	defer client.Close()
+	// Znodes of the cluster are readable by anyone, but only changed by
+	// masters with the same credentials, because the ensemble may be
+	// shared with others.
+	if *zkDigest != "" {
+		if rc := client.AddAuth(coord.SCHEME_DIGEST, []byte(*zkDigest)); rc != coord.ZOK {
+			log.Fatal("Fails to add zookeeper credentials: ", rc)
+		}
+		client.SetCreateACL(append(coord.CreatorAllACL(), coord.WorldACL(coord.ZOO_PERM_READ)...))
+	}
+	stateManager := master.NewZkStateManager(client, *zkRoot)
+
+	balancerOpts := &balancer.BalancerOptions{
+		Policy:                      *policy,
+		BalancerName:                fmt.Sprintf("%s:%d", *host, rport),
+		NumReplicas:                 *numReplicas,
+		MaxRegionsPerServer:         *maxRegions,
+		NumIterationPerBalanceRound: 10,
+		NumServersInSmallDeployment: 10,
+		RackManager:                 newRackManager(),
+		StateManager:                stateManager,
+		RegionManager: server.NewRegionManagerClient(
+			&server.HTTPTransport{}, *rpcPrefix, &server.RealClock{}),
+		MaxLeaderTransfersPerRound: *leaderTransfers,
+		LeaderTransferIntervalMs:   int64(*leaderTransferIntervalMs),
+	}
+	if *tableDelim != "" {
+		balancerOpts.Stochastic = balancer.DefaultStochasticOptions()
+		balancerOpts.Stochastic.TableOf = balancer.TableByKeyPrefix(*tableDelim)
+	}
+
+	opts := server.DefaultMasterOptions(balancerOpts)
+	opts.Placement.RPCPrefix = *rpcPrefix
+	opts.Standby = true
+	m := rpcServer.StartMaster(opts)
+
+	// Standbys keep up with regions that the active master saves.
+	go stateManager.FollowRegions(m.FollowRegions, nil)
+
+	election := recipes.NewLeaderElection(client, *zkRoot+"/masters", balancerOpts.BalancerName)
+	for {
+		lost, ok := election.Campaign()
+		if !ok {
+			break
+		}
+
+		// Regions are learned before balancing, so that a region that no
+		// server reports is not created again.
+		regions, loaded := stateManager.LoadRegions()
+		if !loaded {
+			log.Printf("Fails to load regions, and leaves the election\n")
+			election.Resign()
+			time.Sleep(recipes.RECIPE_RETRY_MS * time.Millisecond)
+			continue
+		}
+
+		log.Printf("Becomes the active master\n")
+		m.Activate(regions)
+
+		// Regions that fail to be saved may have been changed by another
+		// master, so this one steps down, and loads them again if it wins
+		// the next election.
+		failed := false
+		select {
+		case <-lost:
+		case <-stateManager.CommitFailures():
+			failed = true
+		}
+
+		log.Printf("Steps down as the active master\n")
+		m.SetActive(false)
+		if failed {
+			log.Printf("Fails to save region changes, and leaves the election\n")
+			election.Resign()
+			time.Sleep(recipes.RECIPE_RETRY_MS * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package master
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"lbase/balancer"
+	"lbase/zk/coord"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Znode under the root whose children are regions.
+	REGIONS_NODE = "regions"
+	// Znode under the root whose version changes with every commit.
+	VERSION_NODE = "version"
+	// How many times a read is retried when it races with a commit.
+	READ_RETRIES = 10
+	// How many times a commit is tried when zookeeper fails.
+	COMMIT_RETRIES = 3
+	// How long a follower waits before it reads regions again after a
+	// failure.
+	FOLLOW_RETRY_MS = 1000
+)
+
+// Saves regions of the cluster in zookeeper. Each region is a znode under
+// root/regions, named by its start key in hex, and its data is the encoded
+// region.
+//
+// A commit changes region znodes and root/version in one transaction,
+// which fails if root/version has changed since the master loaded the
+// regions or last committed, so masters that commit at the same time do
+// not overwrite each other. A master whose commit fails is told to step
+// down. Readers read regions again if root/version changes meanwhile, so
+// they never see a commit half done. FollowRegions watches root/version,
+// and reads regions again whenever it changes, so that standby masters
+// keep up with the active one. Servers do not watch it, since they learn
+// about splits and merges from raft records of their regions.
+type ZkStateManager struct {
+	zk   coord.Coordinator
+	root string
+
+	mutex sync.Mutex
+	// Version of root/version when regions were last loaded or committed
+	// by this master. Commits are made against it.
+	version int32
+	// Set once regions have been loaded.
+	versionKnown bool
+	// Fired when a commit fails.
+	failures chan bool
+}
+
+func NewZkStateManager(client coord.Coordinator, root string) *ZkStateManager {
+	return &ZkStateManager{
+		zk:       client,
+		root:     root,
+		failures: make(chan bool, 1),
+	}
+}
+
+// Save region changes. The changes are dropped if another master has
+// changed regions since this one loaded or committed them, or zookeeper
+// keeps failing, and CommitFailures fires.
+func (m *ZkStateManager) Commit(adds []balancer.Region, removals []balancer.Region) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.versionKnown {
+		log.Printf("Fails to save region changes before regions are loaded\n")
+		m.fail()
+		return
+	}
+
+	for i := 0; i < COMMIT_RETRIES; i++ {
+		rc := m.commit(adds, removals, m.version)
+		if rc == coord.ZOK {
+			// Every set of root/version bumps its version by one.
+			m.version++
+			return
+		}
+		log.Printf("Fails to save region changes: %d\n", rc)
+		if rc == coord.ZBADVERSION {
+			break
+		}
+	}
+	m.fail()
+}
+
+// Return a channel that fires once a commit fails. Regions that the
+// master has may then differ from those in zookeeper, so it should step
+// down, and load regions again before it becomes active. Loading regions
+// clears the failure.
+func (m *ZkStateManager) CommitFailures() chan bool {
+	return m.failures
+}
+
+func (m *ZkStateManager) fail() {
+	select {
+	case m.failures <- true:
+	default:
+	}
+}
+
+// Commit changes over regions at @version.
+func (m *ZkStateManager) commit(adds, removals []balancer.Region, version int32) (rc int) {
+	children, rc := m.zk.GetChildren(m.regionsPath())
+	if rc != coord.ZOK {
+		return
+	}
+	existing := make(map[string]bool)
+	for _, child := range children {
+		existing[m.regionsPath()+"/"+child] = true
+	}
+
+	// A region that is removed may start at the same key as one that is
+	// added, so removals go first.
+	ops := make([]coord.Op, 0, len(removals)+len(adds)+1)
+	for _, r := range removals {
+		if path := m.regionPath(r); existing[path] {
+			ops = append(ops, coord.DeleteOp(path, -1))
+			delete(existing, path)
+		}
+	}
+	for _, r := range adds {
+		if path := m.regionPath(r); existing[path] {
+			ops = append(ops, coord.SetOp(path, encodeRegion(r), -1))
+		} else {
+			ops = append(ops, coord.CreateOp(path, encodeRegion(r), 0))
+			existing[path] = true
+		}
+	}
+	ops = append(ops, coord.SetOp(m.versionPath(), nil, int(version)))
+
+	// Another master that has committed since fails this.
+	_, rc = m.zk.Multi(ops)
+	return
+}
+
+// Return all regions, ordered by their start keys. Later commits are made
+// against the regions returned.
+func (m *ZkStateManager) LoadRegions() (regions []balancer.Region, ok bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var version int32
+	regions, version, _, ok = m.load(false)
+	if ok {
+		m.version = version
+		m.versionKnown = true
+		select {
+		case <-m.failures:
+		default:
+		}
+	}
+	return
+}
+
+// Return all regions like LoadRegions, and a watch that is fired when
+// they change next. Unlike LoadRegions, it does not change the version
+// that commits are made against.
+func (m *ZkStateManager) WatchRegions() (
+	regions []balancer.Region,
+	watch chan coord.Event,
+	ok bool) {
+
+	regions, _, watch, ok = m.load(true)
+	return
+}
+
+// Call @apply with all regions, and again whenever they change, until
+// @quit is closed. Regions are read again after a while if zookeeper
+// fails.
+func (m *ZkStateManager) FollowRegions(apply func(regions []balancer.Region), quit chan bool) {
+	for {
+		var retry <-chan time.Time
+		regions, watch, ok := m.WatchRegions()
+		if ok {
+			apply(regions)
+		} else {
+			log.Printf("Fails to read regions, and tries again later\n")
+			retry = time.After(FOLLOW_RETRY_MS * time.Millisecond)
+		}
+
+		// A session event fires the watch too, and regions are read
+		// again with a new watch.
+		select {
+		case <-watch:
+		case <-retry:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Read regions, and the version of root/version that they are at.
+func (m *ZkStateManager) load(setWatch bool) (
+	regions []balancer.Region,
+	version int32,
+	watch chan coord.Event,
+	ok bool) {
+
+	if !m.init() {
+		return
+	}
+
+	for i := 0; i < READ_RETRIES; i++ {
+		var before int32
+		var rc int
+		if setWatch {
+			_, before, watch, rc = m.zk.GetW(m.versionPath())
+		} else {
+			_, before, rc = m.zk.Get(m.versionPath())
+		}
+		if rc != coord.ZOK {
+			return
+		}
+
+		found, readOk := m.readRegions()
+		if !readOk {
+			return
+		}
+
+		_, after, rc := m.zk.Get(m.versionPath())
+		if rc != coord.ZOK {
+			return
+		}
+		if after != before {
+			continue
+		}
+
+		sort.Sort(regionsByStartKey(found))
+		return found, before, watch, true
+	}
+
+	log.Printf("Fails to read regions that keep changing\n")
+	return nil, 0, nil, false
+}
+
+// Read regions under root/regions.
+func (m *ZkStateManager) readRegions() (regions []balancer.Region, ok bool) {
+	children, rc := m.zk.GetChildren(m.regionsPath())
+	if rc != coord.ZOK {
+		return nil, false
+	}
+
+	for _, child := range children {
+		data, _, rc := m.zk.Get(m.regionsPath() + "/" + child)
+		if rc == coord.ZNONODE {
+			// Removed by a commit, which changes root/version.
+			continue
+		}
+		if rc != coord.ZOK {
+			return nil, false
+		}
+
+		r, decodeOk := decodeRegion(data)
+		if !decodeOk {
+			log.Printf("Fails to decode region %s\n", child)
+			return nil, false
+		}
+		regions = append(regions, r)
+	}
+	return regions, true
+}
+
+// Create znodes of the layout if they do not exist.
+func (m *ZkStateManager) init() bool {
+	if rc := coord.CreateAll(m.zk, m.regionsPath()); rc != coord.ZOK {
+		log.Printf("Fails to create %s: %d\n", m.regionsPath(), rc)
+		return false
+	}
+	_, rc := m.zk.Create(m.versionPath(), nil, 0)
+	return rc == coord.ZOK || rc == coord.ZNODEEXISTS
+}
+
+func (m *ZkStateManager) regionsPath() string {
+	return m.root + "/" + REGIONS_NODE
+}
+
+func (m *ZkStateManager) versionPath() string {
+	return m.root + "/" + VERSION_NODE
+}
+
+// Return the znode of region @r.
+func (m *ZkStateManager) regionPath(r balancer.Region) string {
+	return m.regionsPath() + "/r" + hex.EncodeToString([]byte(r.StartKey))
+}
+
+type regionsByStartKey []balancer.Region
+
+func (a regionsByStartKey) Len() int           { return len(a) }
+func (a regionsByStartKey) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a regionsByStartKey) Less(i, j int) bool { return a[i].StartKey < a[j].StartKey }
+
+func encodeRegion(r balancer.Region) []byte {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(&r); err != nil {
+		return nil
+	}
+	return b.Bytes()
+}
+
+func decodeRegion(data []byte) (r balancer.Region, ok bool) {
+	err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&r)
+	return r, err == nil
+}
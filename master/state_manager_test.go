@@ -0,0 +1,218 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package master
+
+import (
+	"lbase/balancer"
+	"lbase/zk/coord"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	wholeRegion = balancer.Region{}
+	leftRegion  = balancer.Region{EndKey: "m"}
+	rightRegion = balancer.Region{StartKey: "m"}
+)
+
+func checkRegions(t *testing.T, sm *ZkStateManager, expected []balancer.Region) {
+	regions, ok := sm.LoadRegions()
+	if !ok {
+		t.Fatal("Fails to load regions")
+	}
+	if !reflect.DeepEqual(regions, expected) {
+		t.Fatal("Unexpected regions:", regions, "expected:", expected)
+	}
+}
+
+func TestZkStateManagerCommit(t *testing.T) {
+	sm := NewZkStateManager(coord.NewMemoryStore().NewSession(), "/lbase")
+	checkRegions(t, sm, nil)
+
+	sm.Commit([]balancer.Region{wholeRegion}, nil)
+	checkRegions(t, sm, []balancer.Region{wholeRegion})
+
+	// Split, and then merge back into a region with the same start key.
+	sm.Commit([]balancer.Region{leftRegion, rightRegion}, []balancer.Region{wholeRegion})
+	checkRegions(t, sm, []balancer.Region{leftRegion, rightRegion})
+
+	sm.Commit([]balancer.Region{wholeRegion}, []balancer.Region{leftRegion, rightRegion})
+	checkRegions(t, sm, []balancer.Region{wholeRegion})
+
+	// Another master sees the same regions.
+	other := NewZkStateManager(sm.zk, "/lbase")
+	checkRegions(t, other, []balancer.Region{wholeRegion})
+}
+
+func TestZkStateManagerFailedCommit(t *testing.T) {
+	before := []balancer.Region{wholeRegion}
+	after := []balancer.Region{leftRegion, rightRegion}
+
+	// Fail a split at every write it makes.
+	for n := 0; ; n++ {
+		fake := coord.NewMemoryStore()
+		sm := NewZkStateManager(fake.NewSession(), "/lbase")
+		sm.LoadRegions()
+		sm.Commit(before, nil)
+
+		fake.FailWritesAfter(n)
+		sm.Commit(after, before)
+		fake.FailWritesAfter(-1)
+
+		failed := false
+		select {
+		case <-sm.CommitFailures():
+			failed = true
+		default:
+		}
+
+		// Readers never see a split half done.
+		regions, ok := sm.LoadRegions()
+		if !ok {
+			t.Fatal("Fails to load regions after", n, "writes")
+		}
+		if reflect.DeepEqual(regions, after) {
+			if failed {
+				t.Fatal("Reports a commit that succeeds as failed")
+			}
+			break
+		}
+		if !reflect.DeepEqual(regions, before) {
+			t.Fatal("Sees a partial commit after", n, "writes:", regions)
+		}
+		if !failed {
+			t.Fatal("Drops a commit silently after", n, "writes")
+		}
+		if n == 100 {
+			t.Fatal("Never finishes a split")
+		}
+	}
+}
+
+func TestZkStateManagerWatchRegions(t *testing.T) {
+	fake := coord.NewMemoryStore()
+	sm := NewZkStateManager(fake.NewSession(), "/lbase")
+	sm.LoadRegions()
+	sm.Commit([]balancer.Region{wholeRegion}, nil)
+
+	watcher := NewZkStateManager(fake.NewSession(), "/lbase")
+	regions, watch, ok := watcher.WatchRegions()
+	if !ok || !reflect.DeepEqual(regions, []balancer.Region{wholeRegion}) {
+		t.Fatal("Unexpected regions:", regions)
+	}
+
+	select {
+	case <-watch:
+		t.Fatal("Watch fires without a commit")
+	default:
+	}
+
+	sm.Commit([]balancer.Region{leftRegion, rightRegion}, []balancer.Region{wholeRegion})
+	select {
+	case <-watch:
+	default:
+		t.Fatal("Watch does not fire on a commit")
+	}
+	checkRegions(t, watcher, []balancer.Region{leftRegion, rightRegion})
+}
+
+func TestZkStateManagerFollowRegions(t *testing.T) {
+	fake := coord.NewMemoryStore()
+	sm := NewZkStateManager(fake.NewSession(), "/lbase")
+	sm.LoadRegions()
+	sm.Commit([]balancer.Region{wholeRegion}, nil)
+
+	applied := make(chan []balancer.Region, 10)
+	quit := make(chan bool)
+	done := make(chan bool)
+	follower := NewZkStateManager(fake.NewSession(), "/lbase")
+	go func() {
+		follower.FollowRegions(func(regions []balancer.Region) {
+			applied <- regions
+		}, quit)
+		close(done)
+	}()
+
+	expect := func(expected []balancer.Region) {
+		select {
+		case regions := <-applied:
+			if !reflect.DeepEqual(regions, expected) {
+				t.Fatal("Unexpected regions:", regions, "expected:", expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Regions are not read again")
+		}
+	}
+	expect([]balancer.Region{wholeRegion})
+
+	sm.Commit([]balancer.Region{leftRegion, rightRegion}, []balancer.Region{wholeRegion})
+	expect([]balancer.Region{leftRegion, rightRegion})
+
+	sm.Commit([]balancer.Region{wholeRegion}, []balancer.Region{leftRegion, rightRegion})
+	expect([]balancer.Region{wholeRegion})
+
+	close(quit)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Keeps following regions after quit")
+	}
+}
+
+func TestZkStateManagerConflictingCommit(t *testing.T) {
+	fake := coord.NewMemoryStore()
+	sm := NewZkStateManager(fake.NewSession(), "/lbase")
+	sm.LoadRegions()
+	sm.Commit([]balancer.Region{wholeRegion}, nil)
+
+	// Commits follow each other without loading regions again.
+	sm.Commit([]balancer.Region{leftRegion, rightRegion}, []balancer.Region{wholeRegion})
+	sm.Commit([]balancer.Region{wholeRegion}, []balancer.Region{leftRegion, rightRegion})
+	select {
+	case <-sm.CommitFailures():
+		t.Fatal("Fails a commit that follows its own")
+	default:
+	}
+
+	// Another master commits after this one does, so the stale commit
+	// is dropped, and this master is told to step down.
+	other := NewZkStateManager(fake.NewSession(), "/lbase")
+	other.LoadRegions()
+	other.Commit([]balancer.Region{leftRegion, rightRegion}, []balancer.Region{wholeRegion})
+
+	sm.Commit(nil, []balancer.Region{wholeRegion})
+	select {
+	case <-sm.CommitFailures():
+	default:
+		t.Fatal("Does not report a conflicting commit")
+	}
+	checkRegions(t, sm, []balancer.Region{leftRegion, rightRegion})
+
+	// Commits are made against the regions loaded again.
+	sm.Commit([]balancer.Region{wholeRegion}, []balancer.Region{leftRegion, rightRegion})
+	checkRegions(t, other, []balancer.Region{wholeRegion})
+}
@@ -40,6 +40,8 @@ type AppendEntries struct {
 	LeaderGuessedSequence RaftSequence
 	// List of records that the leader wants to push to other servers.
 	Data map[RaftSequence][]byte
+	// The last record that the leader has committed.
+	CommitSequence RaftSequence
 }
 
 // The response to raft protocol command.
@@ -47,11 +49,13 @@ type AppendEntriesReply struct {
 	// Set it to true if the server believes the leader is no
 	// longer the current leader for the region.
 	NotLeader bool
+	// Set it to true if the server has the record at LeaderGuessedSequence,
+	// and has saved all records in the request.
+	Ok bool
 	// If leader and server has already agreed on the sequence
-	// number, return the next sequence to be replicated from
-	// the leader;
-	// The same as LeaderGuessedSequence if the leader guessed
-	// correctly, otherwise return the previous sequence number
-	// for leader to match.
+	// number, return the last sequence that the server has saved
+	// from the leader;
+	// Otherwise return the previous sequence number for leader
+	// to match.
 	RealSequence RaftSequence
 }
@@ -64,7 +64,7 @@ func (c *EditCollector) Collect(
 	ss map[balancer.ServerName]int64) CollectedResults {
 
 	var res CollectedResults
-	waitChan := time.After(c.RPCTimeoutMs * time.Millisecond)
+	waitChan := raft.opts.Clock.After(c.RPCTimeoutMs * time.Millisecond)
 
 	// Send collect request to quorum members.
 	cliMap := make(map[balancer.ServerName]RequestInfo)
@@ -95,17 +95,17 @@ func (c *EditCollector) Collect(
 
 	// Collect replies from RPC.
 	respMap := make(map[balancer.ServerName][][]byte)
-	for sn, cxt := range cliMap {
-		select {
-		case <-cxt.Call.Done:
-			resp := cxt.Call.Reply.(GetNRecordsReply)
-			if resp.Ok {
-				respMap[sn] = resp.Records
-			}
-			raft.ReturnClient(sn, cxt.Cli)
-		case <-waitChan:
-			waitChan = time.After(time.Duration(0))
+	for _, sn := range sortedServers(cliMap) {
+		cxt := cliMap[sn]
+		if !waitCall(cxt.Call, waitChan) {
+			waitChan = raft.opts.Clock.After(time.Duration(0))
+			continue
 		}
+		resp := cxt.Call.Reply.(GetNRecordsReply)
+		if resp.Ok {
+			respMap[sn] = resp.Records
+		}
+		raft.ReturnClient(sn, cxt.Cli)
 	}
 
 	// First pass to identify consensus records.
@@ -168,7 +168,7 @@ func (c *EditCollector) Trim(raft *RaftStates, ss map[balancer.ServerName]int64)
 	// Send collect request to quorum members.
 	cliMap := make(map[balancer.ServerName]RequestInfo)
 	callName := "ServerRPC.TrimEditQueue"
-	waitChan := time.After(c.RPCTimeoutMs * time.Millisecond)
+	waitChan := raft.opts.Clock.After(c.RPCTimeoutMs * time.Millisecond)
 
 	for sn, seq := range ss {
 		cli := raft.GetClient(sn)
@@ -186,13 +186,13 @@ func (c *EditCollector) Trim(raft *RaftStates, ss map[balancer.ServerName]int64)
 		}
 	}
 
-	for sn, ri := range cliMap {
-		select {
-		case <-ri.Call.Done:
-			raft.ReturnClient(sn, ri.Cli)
-		case <-waitChan:
-			waitChan = time.After(time.Duration(0))
+	for _, sn := range sortedServers(cliMap) {
+		ri := cliMap[sn]
+		if !waitCall(ri.Call, waitChan) {
+			waitChan = raft.opts.Clock.After(time.Duration(0))
+			continue
 		}
+		raft.ReturnClient(sn, ri.Cli)
 	}
 }
 
@@ -30,6 +30,7 @@ import (
 	"encoding/binary"
 	"lbase/db"
 	"log"
+	"sync"
 )
 
 // A EditQueue stores client's update requests before raft leader
@@ -43,8 +44,14 @@ type EditQueueOptions struct {
 }
 
 type EditQueue struct {
-	opts     EditQueueOptions
-	db       db.Db
+	opts EditQueueOptions
+	db   db.Db
+	// Set if the db is shared with other queues, in which case the queue
+	// does not close it.
+	shared bool
+	// Protects lastSeq and firstSeq, which are read by stat reports while
+	// edits are appended.
+	mutex    sync.Mutex
 	lastSeq  int64
 	firstSeq int64
 	rdOpts   db.ReadOptions
@@ -82,11 +89,52 @@ func NewEditQueue(opts *EditQueueOptions) *EditQueue {
 	}
 }
 
+// Create a queue that keeps its records in a db shared with others.
+// Keys of the queue are prefixed with @prefix.
+func newSharedEditQueue(store db.Db, prefix string) *EditQueue {
+	return &EditQueue{
+		opts:   EditQueueOptions{QueueKeyPrefix: prefix},
+		db:     store,
+		shared: true,
+		wrOpts: db.NewWriteOptions(),
+		rdOpts: db.NewReadOptions(),
+	}
+}
+
 func (q *EditQueue) Close() {
-	q.db.Close()
+	if !q.shared {
+		q.db.Close()
+	}
+}
+
+// Position the iterator at the last record of the queue.
+func (q *EditQueue) seekToLast(iter db.Iterator) {
+	end := prefixEnd([]byte(q.opts.QueueKeyPrefix))
+	if end == nil {
+		iter.SeekToLast()
+		return
+	}
+
+	iter.Seek(end)
+	if iter.Valid() {
+		iter.Prev()
+	} else {
+		iter.SeekToLast()
+	}
+}
+
+// Check if the iterator is positioned at a record of the queue.
+func (q *EditQueue) valid(iter db.Iterator) bool {
+	return iter.Valid() && bytes.HasPrefix(iter.Key(), []byte(q.opts.QueueKeyPrefix))
 }
 
 func (q *EditQueue) GetLastSequence() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.lastSequence()
+}
+
+func (q *EditQueue) lastSequence() int64 {
 	if q.lastSeq != 0 {
 		return q.lastSeq
 	}
@@ -94,8 +142,8 @@ func (q *EditQueue) GetLastSequence() int64 {
 	iter := q.db.CreateIterator(q.rdOpts)
 	defer iter.Destroy()
 
-	iter.SeekToLast()
-	if iter.Valid() {
+	q.seekToLast(iter)
+	if q.valid(iter) {
 		qk := iter.Key()
 		q.lastSeq = ParseQueueKey(q.opts.QueueKeyPrefix, qk)
 	}
@@ -104,6 +152,12 @@ func (q *EditQueue) GetLastSequence() int64 {
 }
 
 func (q *EditQueue) GetFirstSequence() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.firstSequence()
+}
+
+func (q *EditQueue) firstSequence() int64 {
 	if q.firstSeq != 0 {
 		return q.firstSeq
 	}
@@ -111,8 +165,12 @@ func (q *EditQueue) GetFirstSequence() int64 {
 	iter := q.db.CreateIterator(q.rdOpts)
 	defer iter.Destroy()
 
-	iter.SeekToFirst()
-	if iter.Valid() {
+	if len(q.opts.QueueKeyPrefix) > 0 {
+		iter.Seek([]byte(q.opts.QueueKeyPrefix))
+	} else {
+		iter.SeekToFirst()
+	}
+	if q.valid(iter) {
 		qk := iter.Key()
 		q.firstSeq = ParseQueueKey(q.opts.QueueKeyPrefix, qk)
 	}
@@ -120,8 +178,24 @@ func (q *EditQueue) GetFirstSequence() int64 {
 	return q.firstSeq
 }
 
+// Return the number of edits that wait in the queue.
+func (q *EditQueue) Len() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	firstSeq := q.firstSequence()
+	lastSeq := q.lastSequence()
+	if firstSeq == 0 || lastSeq < firstSeq {
+		return 0
+	}
+	return lastSeq - firstSeq + 1
+}
+
 func (q *EditQueue) AppendEdit(data []byte) {
-	lastSeq := q.GetLastSequence()
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	lastSeq := q.lastSequence()
 	lastSeq++
 	q.lastSeq = lastSeq
 	qk := GetQueueKey(q.opts.QueueKeyPrefix, lastSeq)
@@ -139,7 +213,7 @@ func (q *EditQueue) GetN(seq int64, n int) (data [][]byte, startSeq int64) {
 	key := GetQueueKey(q.opts.QueueKeyPrefix, seq)
 	iter.Seek(key)
 
-	if !iter.Valid() {
+	if !q.valid(iter) {
 		return
 	}
 
@@ -148,7 +222,7 @@ func (q *EditQueue) GetN(seq int64, n int) (data [][]byte, startSeq int64) {
 	}
 
 	startSeq = seq
-	for n > 0 && iter.Valid() {
+	for n > 0 && q.valid(iter) {
 		val := iter.Value()
 		data = append(data, val)
 
@@ -160,8 +234,11 @@ func (q *EditQueue) GetN(seq int64, n int) (data [][]byte, startSeq int64) {
 
 // Trim pending records up to sequence number @endSeq.
 func (q *EditQueue) Trim(endSeq int64) {
-	firstSeq := q.GetFirstSequence()
-	lastSeq := q.GetLastSequence()
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	firstSeq := q.firstSequence()
+	lastSeq := q.lastSequence()
 
 	if endSeq < lastSeq {
 		lastSeq = endSeq
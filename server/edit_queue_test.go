@@ -74,8 +74,16 @@ func TestEditQueueInsertAndTrim(t *testing.T) {
 		t.Error("Incorrect last sequence")
 	}
 
+	if queue.Len() != int64(len(items)) {
+		t.Error("Incorrect queue length", queue.Len())
+	}
+
 	queue.Trim(int64(len(items)))
 
+	if queue.Len() != 1 {
+		t.Error("Incorrect queue length after trim", queue.Len())
+	}
+
 	if queue.GetFirstSequence() != int64(len(items)) {
 		t.Error("Incorrect first sequence", queue.GetFirstSequence())
 	}
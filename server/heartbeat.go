@@ -0,0 +1,56 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"lbase/balancer"
+)
+
+// Raft protocol command. A leader periodically sends heartbeats to keep
+// its leadership. Heartbeats carry no records, so they are never delayed
+// by replication.
+type Heartbeat struct {
+	ServerName balancer.ServerName
+	// Current term.
+	Term int64
+	// Id of this region.
+	Region balancer.Region
+	// The last record that the leader has committed.
+	CommitSequence RaftSequence
+	// Set if the leader has nothing to replicate and is going to stop
+	// sending heartbeats. Members that are up to date stop waiting for
+	// heartbeats as well.
+	Quiesce bool
+}
+
+// The response to Heartbeat command.
+type HeartbeatReply struct {
+	// Set it to true if the server believes the leader is no
+	// longer the current leader for the region.
+	NotLeader bool
+	// Set if the server has gone quiescent along with the leader.
+	Quiesced bool
+}
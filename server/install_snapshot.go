@@ -0,0 +1,70 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"lbase/balancer"
+)
+
+// Raft protocol command. The leader sends all committed data to a member
+// that falls too far behind to catch up from the log. Rows are sent in
+// chunks, one InstallSnapshot for each, and the snapshot is installed
+// once the last chunk arrives.
+type InstallSnapshot struct {
+	ServerName balancer.ServerName
+	// Current term.
+	Term int64
+	// Id of this region.
+	Region balancer.Region
+	// The last record that has been committed in the snapshot.
+	LastSequence RaftSequence
+	// Committed quorum configuration at LastSequence.
+	Configuration RaftConfiguration
+	// Rows in the region store.
+	Keys   [][]byte
+	Values [][]byte
+	// Number of rows sent in earlier chunks.
+	Offset int
+	// Set in the last chunk.
+	Done bool
+}
+
+// How much of a snapshot the leader has sent to a member.
+type SnapshotProgress struct {
+	// Bytes of rows sent so far.
+	Sent int64
+	// Bytes of all rows in the snapshot.
+	Total int64
+}
+
+// The response to InstallSnapshot command.
+type InstallSnapshotReply struct {
+	// Set it to true if the server believes the leader is no
+	// longer the current leader for the region.
+	NotLeader bool
+	// Set it to true if the server has installed the snapshot.
+	Ok bool
+}
@@ -0,0 +1,395 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+// This file contains a checker that tells whether a history of client
+// operations is linearizable. The search follows the algorithm by Wing and
+// Gong, improved by Lowe, which is also used by Knossos and Porcupine.
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// An operation issued by a client. Call and Return are logical times, so
+// an operation returns before another is invoked iff its Return is less
+// than the Call of the other.
+type Operation struct {
+	ClientId int
+	Input    interface{}
+	// Nil if the outcome of the operation is unknown.
+	Output interface{}
+	Call   int64
+	// math.MaxInt64 if the operation has not returned.
+	Return int64
+}
+
+// Records operations issued by concurrent clients.
+type History struct {
+	mutex sync.Mutex
+	now   int64
+	ops   map[int]*Operation
+	next  int
+}
+
+func NewHistory() *History {
+	return &History{ops: make(map[int]*Operation)}
+}
+
+// Record the invocation of an operation. Return an id of the operation.
+func (h *History) Invoke(clientId int, input interface{}) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.now++
+	h.next++
+	h.ops[h.next] = &Operation{
+		ClientId: clientId,
+		Input:    input,
+		Call:     h.now,
+		Return:   math.MaxInt64,
+	}
+	return h.next
+}
+
+// Record the result of an operation.
+func (h *History) Complete(id int, output interface{}) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.now++
+	op := h.ops[id]
+	op.Output = output
+	op.Return = h.now
+}
+
+// Forget an operation that is known to have no effect, such as a failed
+// read, or a write that is rejected before it is proposed.
+func (h *History) Discard(id int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.ops, id)
+}
+
+// Return all recorded operations in the order they are invoked. Operations
+// that have not returned may or may not have taken effect.
+func (h *History) Operations() []Operation {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	ops := make([]Operation, 0, len(h.ops))
+	for _, op := range h.ops {
+		ops = append(ops, *op)
+	}
+	sort.Sort(operationsByCall(ops))
+	return ops
+}
+
+type operationsByCall []Operation
+
+func (a operationsByCall) Len() int           { return len(a) }
+func (a operationsByCall) Less(i, j int) bool { return a[i].Call < a[j].Call }
+func (a operationsByCall) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// A sequential specification of an object. States must be comparable
+// with ==, so that they can be cached during the search.
+type Model struct {
+	// Split a history into independent histories, such as one per key.
+	// Optional.
+	Partition func(ops []Operation) [][]Operation
+	Init      func() interface{}
+	// Apply an operation to a state. Return false if the output is not
+	// possible in the state. The output of an operation whose outcome is
+	// unknown is nil.
+	Step func(state, input, output interface{}) (bool, interface{})
+}
+
+// Check if a history is linearizable. Return descriptions of independent
+// histories that are not.
+func CheckLinearizability(model *Model, ops []Operation) (violations []string) {
+	partitions := [][]Operation{ops}
+	if model.Partition != nil {
+		partitions = model.Partition(ops)
+	}
+
+	for _, partition := range partitions {
+		if !checkPartition(model, partition) {
+			violations = append(violations, fmt.Sprintf(
+				"history is not linearizable: %s", describeOperations(partition)))
+		}
+	}
+	return
+}
+
+func describeOperations(ops []Operation) string {
+	var s string
+	for _, op := range ops {
+		s += fmt.Sprintf("\n  client %d [%d, %d] %+v -> %+v",
+			op.ClientId, op.Call, op.Return, op.Input, op.Output)
+	}
+	return s
+}
+
+// An invocation or a response in the history. Entries form a doubly linked
+// list ordered by time.
+type historyEntry struct {
+	isCall bool
+	id     int
+	op     *Operation
+	// The response of a call entry, or the call of a response entry.
+	match *historyEntry
+	prev  *historyEntry
+	next  *historyEntry
+}
+
+// Remove a call and its response from the list.
+func (e *historyEntry) lift() {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	r := e.match
+	r.prev.next = r.next
+	if r.next != nil {
+		r.next.prev = r.prev
+	}
+}
+
+// Put back a call and its response removed by lift().
+func (e *historyEntry) unlift() {
+	r := e.match
+	r.prev.next = r
+	if r.next != nil {
+		r.next.prev = r
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int) {
+	b[i/64] |= 1 << uint(i%64)
+}
+
+func (b bitset) clear(i int) {
+	b[i/64] &^= 1 << uint(i%64)
+}
+
+func (b bitset) key() string {
+	buf := make([]byte, 0, len(b)*8)
+	for _, w := range b {
+		for i := uint(0); i < 64; i += 8 {
+			buf = append(buf, byte(w>>i))
+		}
+	}
+	return string(buf)
+}
+
+type historyEvent struct {
+	time  int64
+	entry *historyEntry
+}
+
+type eventsByTime []historyEvent
+
+func (a eventsByTime) Len() int           { return len(a) }
+func (a eventsByTime) Less(i, j int) bool { return a[i].time < a[j].time }
+func (a eventsByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+type linearizedState struct {
+	linearized string
+	state      interface{}
+}
+
+type searchFrame struct {
+	entry *historyEntry
+	state interface{}
+}
+
+// Search for a valid order of operations. Operations are linearized one by
+// one. The first pending call that can be linearized in the current state
+// is tried first, and the search backtracks when a response is reached
+// whose call has not been linearized. Combinations of linearized
+// operations and states that have been explored are skipped.
+func checkPartition(model *Model, ops []Operation) bool {
+	var events []historyEvent
+	for i := range ops {
+		call := &historyEntry{isCall: true, id: i, op: &ops[i]}
+		ret := &historyEntry{id: i, op: &ops[i], match: call}
+		call.match = ret
+		events = append(events,
+			historyEvent{ops[i].Call, call},
+			historyEvent{ops[i].Return, ret})
+	}
+	sort.Sort(eventsByTime(events))
+
+	head := &historyEntry{}
+	prev := head
+	for _, ev := range events {
+		ev.entry.prev = prev
+		prev.next = ev.entry
+		prev = ev.entry
+	}
+
+	linearized := newBitset(len(ops))
+	cache := make(map[linearizedState]bool)
+	var stack []searchFrame
+	state := model.Init()
+
+	entry := head.next
+	for head.next != nil {
+		if entry.isCall {
+			ok, newState := model.Step(state, entry.op.Input, entry.op.Output)
+			if ok {
+				linearized.set(entry.id)
+				key := linearizedState{linearized.key(), newState}
+				if !cache[key] {
+					cache[key] = true
+					stack = append(stack, searchFrame{entry, state})
+					state = newState
+					entry.lift()
+					entry = head.next
+					continue
+				}
+				linearized.clear(entry.id)
+			}
+			entry = entry.next
+			continue
+		}
+
+		// The call of this response is not linearized yet, so undo the
+		// last step and try the next call.
+		if len(stack) == 0 {
+			return false
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		linearized.clear(top.entry.id)
+		top.entry.unlift()
+		entry = top.entry.next
+	}
+	return true
+}
+
+// Input of an operation on a key value register.
+type RegisterInput struct {
+	Key   string
+	Write bool
+	Value string
+}
+
+// Output of a read on a key value register.
+type RegisterOutput struct {
+	Found bool
+	Value string
+}
+
+type registerState struct {
+	found bool
+	value string
+}
+
+// A model of registers indexed by keys. Writes have no output.
+func NewRegisterModel() *Model {
+	return &Model{
+		Partition: func(ops []Operation) [][]Operation {
+			return partitionByKey(ops, func(input interface{}) string {
+				return input.(RegisterInput).Key
+			})
+		},
+		Init: func() interface{} {
+			return registerState{}
+		},
+		Step: func(state, input, output interface{}) (bool, interface{}) {
+			in := input.(RegisterInput)
+			if in.Write {
+				return true, registerState{true, in.Value}
+			}
+
+			st := state.(registerState)
+			if output == nil {
+				return true, st
+			}
+			out := output.(RegisterOutput)
+			return out.Found == st.found && out.Value == st.value, st
+		},
+	}
+}
+
+// Input of an operation on a counter. It either adds Delta to the counter,
+// or reads the counter.
+type CounterInput struct {
+	Key   string
+	Read  bool
+	Delta int64
+}
+
+// A model of counters indexed by keys. A counter starts from 0. Reads
+// output the value as an int64, and increments have no output.
+func NewCounterModel() *Model {
+	return &Model{
+		Partition: func(ops []Operation) [][]Operation {
+			return partitionByKey(ops, func(input interface{}) string {
+				return input.(CounterInput).Key
+			})
+		},
+		Init: func() interface{} {
+			return int64(0)
+		},
+		Step: func(state, input, output interface{}) (bool, interface{}) {
+			in := input.(CounterInput)
+			value := state.(int64)
+			if !in.Read {
+				return true, value + in.Delta
+			}
+			return output == nil || output.(int64) == value, value
+		},
+	}
+}
+
+func partitionByKey(
+	ops []Operation,
+	keyOf func(input interface{}) string) (partitions [][]Operation) {
+
+	index := make(map[string]int)
+	for _, op := range ops {
+		key := keyOf(op.Input)
+		i, found := index[key]
+		if !found {
+			i = len(partitions)
+			index[key] = i
+			partitions = append(partitions, nil)
+		}
+		partitions[i] = append(partitions[i], op)
+	}
+	return
+}
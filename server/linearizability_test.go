@@ -0,0 +1,150 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"math"
+	"testing"
+)
+
+func registerOp(call, ret int64, in RegisterInput, out interface{}) Operation {
+	return Operation{Input: in, Output: out, Call: call, Return: ret}
+}
+
+func TestLinearizabilityRegister(t *testing.T) {
+	model := NewRegisterModel()
+	write := func(value string) RegisterInput {
+		return RegisterInput{Key: "x", Write: true, Value: value}
+	}
+	read := RegisterInput{Key: "x"}
+
+	// The read overlaps with the write, so it may see either value.
+	ops := []Operation{
+		registerOp(1, 2, write("a"), nil),
+		registerOp(3, 6, write("b"), nil),
+		registerOp(4, 5, read, RegisterOutput{true, "a"}),
+		registerOp(7, 8, read, RegisterOutput{true, "b"}),
+	}
+	if violations := CheckLinearizability(model, ops); len(violations) > 0 {
+		t.Error("History should be linearizable:", violations)
+	}
+
+	// A read after the write completes cannot see the old value.
+	ops = append(ops, registerOp(9, 10, read, RegisterOutput{true, "a"}))
+	if violations := CheckLinearizability(model, ops); len(violations) != 1 {
+		t.Error("Stale read is not detected:", violations)
+	}
+
+	// Two reads cannot see the two values in different orders.
+	ops = []Operation{
+		registerOp(1, 10, write("a"), nil),
+		registerOp(2, 10, write("b"), nil),
+		registerOp(3, 4, read, RegisterOutput{true, "a"}),
+		registerOp(5, 6, read, RegisterOutput{true, "b"}),
+		registerOp(7, 8, read, RegisterOutput{true, "a"}),
+	}
+	if violations := CheckLinearizability(model, ops); len(violations) != 1 {
+		t.Error("Flip flopping reads are not detected:", violations)
+	}
+
+	// Keys are checked separately.
+	ops = []Operation{
+		registerOp(1, 2, RegisterInput{Key: "y", Write: true, Value: "a"}, nil),
+		registerOp(3, 4, read, RegisterOutput{false, ""}),
+	}
+	if violations := CheckLinearizability(model, ops); len(violations) > 0 {
+		t.Error("Keys should be independent:", violations)
+	}
+}
+
+func TestLinearizabilityUnknownOutcome(t *testing.T) {
+	model := NewRegisterModel()
+	read := RegisterInput{Key: "x"}
+	pending := registerOp(1, math.MaxInt64,
+		RegisterInput{Key: "x", Write: true, Value: "a"}, nil)
+
+	// A write that never returns may take effect at any time, or never.
+	ops := []Operation{
+		pending,
+		registerOp(2, 3, read, RegisterOutput{false, ""}),
+		registerOp(4, 5, read, RegisterOutput{true, "a"}),
+	}
+	if violations := CheckLinearizability(model, ops); len(violations) > 0 {
+		t.Error("History should be linearizable:", violations)
+	}
+
+	ops = []Operation{
+		pending,
+		registerOp(2, 3, read, RegisterOutput{false, ""}),
+	}
+	if violations := CheckLinearizability(model, ops); len(violations) > 0 {
+		t.Error("History should be linearizable:", violations)
+	}
+
+	// But it cannot be undone once it is seen.
+	ops = append(ops,
+		registerOp(4, 5, read, RegisterOutput{true, "a"}),
+		registerOp(6, 7, read, RegisterOutput{false, ""}))
+	if violations := CheckLinearizability(model, ops); len(violations) != 1 {
+		t.Error("Lost write is not detected:", violations)
+	}
+}
+
+func TestLinearizabilityCounter(t *testing.T) {
+	model := NewCounterModel()
+	add := func(delta int64) CounterInput {
+		return CounterInput{Key: "c", Delta: delta}
+	}
+	read := CounterInput{Key: "c", Read: true}
+
+	h := NewHistory()
+	a := h.Invoke(1, add(1))
+	b := h.Invoke(2, add(2))
+	r := h.Invoke(3, read)
+	h.Complete(r, int64(2))
+	h.Complete(a, nil)
+	h.Complete(b, nil)
+	r = h.Invoke(3, read)
+	h.Complete(r, int64(3))
+	lost := h.Invoke(1, add(10))
+	h.Discard(lost)
+	h.Invoke(2, add(5))
+
+	ops := h.Operations()
+	if len(ops) != 5 {
+		t.Error("Unexpected operations:", ops)
+	}
+	if violations := CheckLinearizability(model, ops); len(violations) > 0 {
+		t.Error("History should be linearizable:", violations)
+	}
+
+	// Increments are never lost.
+	r = h.Invoke(3, read)
+	h.Complete(r, int64(2))
+	if violations := CheckLinearizability(model, h.Operations()); len(violations) != 1 {
+		t.Error("Lost increment is not detected:", violations)
+	}
+}
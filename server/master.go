@@ -0,0 +1,351 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"lbase/balancer"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+type MasterOptions struct {
+	// Options of the balancer. Its PlacementManager is set to the master,
+	// which hands placement actions to a PlacementExecutor.
+	Balancer balancer.BalancerOptions
+	// Options of the PlacementExecutor. Its Locate is set by the master.
+	Placement PlacementOptions
+	// A server that sends no stats for this long is taken as dead.
+	ServerTimeoutMs int64
+	// How often dead servers are looked for, and regions are balanced.
+	BalanceIntervalMs int64
+	// If set, the master starts as a standby. It keeps track of servers,
+	// but does not balance regions until it is made active.
+	Standby bool
+	// Source of time. If this is nil, RealClock is used.
+	Clock Clock
+}
+
+func DefaultMasterOptions(balancerOpts *balancer.BalancerOptions) *MasterOptions {
+	return &MasterOptions{
+		Balancer:          *balancerOpts,
+		Placement:         *DefaultPlacementOptions(),
+		ServerTimeoutMs:   15000,
+		BalanceIntervalMs: 10000,
+	}
+}
+
+func MasterOptionsForTest(balancerOpts *balancer.BalancerOptions) *MasterOptions {
+	return &MasterOptions{
+		Balancer:          *balancerOpts,
+		Placement:         *PlacementOptionsForTest(),
+		ServerTimeoutMs:   500,
+		BalanceIntervalMs: 200,
+	}
+}
+
+// The latest stat of a server.
+type serverRecord struct {
+	stat     balancer.ServerStat
+	lastSeen time.Time
+}
+
+// Keeps track of servers by the stats that they report, and balances
+// regions among them. A server that misses reports for ServerTimeoutMs
+// is dead. Its regions become under-replicated, and its replicas are
+// replaced by new ones on other servers.
+type Master struct {
+	opts     MasterOptions
+	executor *PlacementExecutor
+	started  time.Time
+	quit     chan bool
+	// Protects all fields below.
+	mutex    sync.Mutex
+	balancer balancer.Balancer
+	servers  map[balancer.ServerName]*serverRecord
+	// Servers that have been found dead, and have not reported since.
+	dead   map[balancer.ServerName]bool
+	active bool
+	// Regions that servers report, to find them by keys.
+	index *regionIndex
+}
+
+func NewMaster(opts *MasterOptions) *Master {
+	m := &Master{
+		opts:    *opts,
+		quit:    make(chan bool),
+		servers: make(map[balancer.ServerName]*serverRecord),
+		dead:    make(map[balancer.ServerName]bool),
+		active:  !opts.Standby,
+		index:   newRegionIndex(),
+	}
+	if m.opts.Clock == nil {
+		m.opts.Clock = &RealClock{}
+	}
+	if m.opts.Placement.Clock == nil {
+		m.opts.Placement.Clock = m.opts.Clock
+	}
+	m.opts.Placement.Locate = m.locate
+	m.executor = NewPlacementExecutor(&m.opts.Placement)
+
+	m.opts.Balancer.PlacementManager = m
+	m.balancer = balancer.NewBalancer(&m.opts.Balancer, nil)
+	m.started = m.opts.Clock.Now()
+	return m
+}
+
+func (m *Master) Close() {
+	close(m.quit)
+}
+
+func (m *Master) run() {
+	interval := time.Duration(m.opts.BalanceIntervalMs) * time.Millisecond
+	ticker := m.opts.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			m.Balance()
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// Make the master active or a standby. Only one master is active in a
+// cluster.
+func (m *Master) SetActive(active bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.setActive(active)
+}
+
+func (m *Master) setActive(active bool) {
+	if active && !m.active {
+		// Servers are given a timeout to report again, because stats
+		// of a standby may be stale.
+		m.started = m.opts.Clock.Now()
+	}
+	m.active = active
+}
+
+func (m *Master) IsActive() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.active
+}
+
+// Make the master active, after the balancer learns regions that have
+// been saved, so that a region that no server reports is not created
+// again.
+func (m *Master) Activate(regions []balancer.Region) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.balancer.RestoreRegions(regions)
+	m.setActive(true)
+}
+
+// Let the balancer of a standby learn regions that the active master has
+// saved. It is ignored once the master is active, since regions may then
+// be older than those that the master has.
+func (m *Master) FollowRegions(regions []balancer.Region) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.active {
+		m.balancer.RestoreRegions(regions)
+	}
+}
+
+// Replace hints of where leaders of regions should be.
+func (m *Master) SetPreferredLeaders(hints []balancer.PreferredLeader) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.balancer.SetPreferredLeaders(hints)
+}
+
+// Record a stat reported by a server.
+func (m *Master) ReportStat(stat *balancer.ServerStat) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var old *balancer.ServerStat
+	record, found := m.servers[stat.ServerName]
+	if !found {
+		log.Printf("Server %v joins\n", stat.ServerName)
+		record = &serverRecord{}
+		m.servers[stat.ServerName] = record
+	} else {
+		if record.stat.UpTimestamp != stat.UpTimestamp {
+			log.Printf("Server %v restarts\n", stat.ServerName)
+		}
+		old = &balancer.ServerStat{}
+		*old = record.stat
+	}
+	delete(m.dead, stat.ServerName)
+
+	record.stat = *stat
+	record.lastSeen = m.opts.Clock.Now()
+	m.index.update(stat.ServerName, old, &record.stat, record.lastSeen)
+}
+
+// Return stats of servers that are alive.
+func (m *Master) GetServerStats() []balancer.ServerStat {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ret := make([]balancer.ServerStat, 0, len(m.servers))
+	for _, record := range m.servers {
+		ret = append(ret, record.stat)
+	}
+	return ret
+}
+
+func (m *Master) GetPlacementExecutor() *PlacementExecutor {
+	return m.executor
+}
+
+// Forget servers that have missed their reports, and let the balancer
+// fix regions that are under-replicated. Servers are given a timeout
+// after the master starts to report, so that regions are not moved just
+// because their servers have not been heard from.
+//
+// A balancer that searches the cluster for moves does so without m.mutex,
+// so that reports and lookups do not wait for the search.
+func (m *Master) Balance() {
+	m.mutex.Lock()
+	search, searcher := m.planBalance()
+	m.mutex.Unlock()
+	if search == nil {
+		return
+	}
+
+	search.Run()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.active {
+		searcher.ApplySearch(search)
+	}
+}
+
+// Called with m.mutex held. Return the search that the balancer leaves to
+// be run, if any.
+func (m *Master) planBalance() (search *balancer.Search, searcher balancer.SearchBalancer) {
+	now := m.opts.Clock.Now()
+	timeOut := time.Duration(m.opts.ServerTimeoutMs) * time.Millisecond
+	for sn, record := range m.servers {
+		if now.Sub(record.lastSeen) >= timeOut {
+			log.Printf("Server %v is dead\n", sn)
+			delete(m.servers, sn)
+			m.dead[sn] = true
+			m.index.update(sn, &record.stat, nil, now)
+		}
+	}
+
+	if !m.active || now.Sub(m.started) < timeOut || len(m.servers) == 0 {
+		return
+	}
+
+	stats := make([]balancer.ServerStat, 0, len(m.servers))
+	for _, record := range m.servers {
+		stats = append(stats, record.stat)
+	}
+	m.balancer.UpdateServerStats(now.UnixNano()/int64(time.Millisecond), stats)
+
+	pendings := m.executor.GetPendings()
+	searcher, ok := m.balancer.(balancer.SearchBalancer)
+	if !ok {
+		m.balancer.BalanceLoad(pendings)
+		return
+	}
+	return searcher.PlanLoad(pendings), searcher
+}
+
+// Return the region that contains @key, with its leader and members. The
+// leader is empty if no server reports that it leads the region.
+func (m *Master) LocateRegion(key []byte) (location balancer.RegionLoad, found bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.index.locate(key)
+}
+
+// Called by the balancer with m.mutex held. A new replica of a region
+// replaces one on a dead server, which is removed from the quorum.
+// Leadership transfers are carried out as they are.
+//
+// Stats lag behind moves, so a region that is being moved, or whose
+// leader already has enough live members, is left alone.
+func (m *Master) Place(task *balancer.PlacementAction) {
+	for _, pending := range m.executor.GetPendings() {
+		if pending.Region == task.Region {
+			return
+		}
+	}
+
+	if !task.HasSource {
+		members := m.membersOf(task.Region)
+		live := 0
+		for _, sn := range members {
+			if !m.dead[sn] {
+				live++
+			} else if !task.HasSource {
+				task.Source = sn
+				task.HasSource = true
+			}
+		}
+		if len(members) > 0 && live >= m.opts.Balancer.NumReplicas {
+			return
+		}
+	}
+	m.executor.Place(task)
+}
+
+// Return members of region @r that its leader reports.
+func (m *Master) membersOf(r balancer.Region) []balancer.ServerName {
+	if loc, found := m.index.locations[r]; found && loc.hasLeader {
+		return loc.load.Members
+	}
+	return nil
+}
+
+// Return servers that report region @r.
+func (m *Master) locate(r balancer.Region) []balancer.ServerName {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	loc, found := m.index.locations[r]
+	if !found {
+		return nil
+	}
+	ret := make([]balancer.ServerName, 0, len(loc.members))
+	for sn, _ := range loc.members {
+		ret = append(ret, sn)
+	}
+	sort.Sort(serverNames(ret))
+	return ret
+}
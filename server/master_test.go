@@ -0,0 +1,193 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"fmt"
+	"lbase/balancer"
+	"testing"
+	"time"
+)
+
+// Puts each host in a rack of its own.
+type hostRackManager struct {
+}
+
+func (rm *hostRackManager) GetRack(host string) string {
+	return host
+}
+
+func (rm *hostRackManager) GetServers(rack string) []string {
+	return []string{rack}
+}
+
+type nullStateManager struct {
+}
+
+func (sm *nullStateManager) Commit(adds, removals []balancer.Region) {
+}
+
+// Host a master on the network of @c, and let all servers of @c report
+// to it.
+func startSimMaster(c *SimCluster, standby bool) (*Server, *Master) {
+	balancerOpts := &balancer.BalancerOptions{
+		NumReplicas:                 3,
+		MaxRegionsPerServer:         10,
+		NumIterationPerBalanceRound: 10,
+		NumServersInSmallDeployment: 10,
+		RackManager:                 &hostRackManager{},
+		StateManager:                &nullStateManager{},
+	}
+
+	name := balancer.ServerName{Host: "master", Port: 1}
+	opts := MasterOptionsForTest(balancerOpts)
+	opts.Clock = c.Clock
+	opts.Placement.Transport = c.Network.Transport(name)
+	opts.Standby = standby
+
+	server := NewLocalServer()
+	m := server.StartMaster(opts)
+	c.Network.AddServer(name, server)
+
+	for i, s := range c.servers {
+		reporterOpts := StatReporterOptionsForTest(c.Names[i], []balancer.ServerName{name})
+		reporterOpts.Clock = c.Clock
+		reporterOpts.Transport = c.Network.Transport(c.Names[i])
+		s.StartStatReporter(reporterOpts)
+	}
+	return server, m
+}
+
+func TestStatReporter(t *testing.T) {
+	c := NewSimCluster("/tmp/TestStatReporter", 3, 1, nil)
+	defer c.Close()
+
+	server, m := startSimMaster(c, false)
+	defer server.Close()
+
+	c.Run(3 * time.Second)
+	leader := c.Leader()
+	if leader == nil {
+		t.Fatal("Fails to elect a leader!")
+	}
+	writeSimKeys(t, leader, 20)
+	c.Run(time.Second)
+
+	location, found := m.LocateRegion([]byte("key05"))
+	if !found || location.Region != leader.GetRegion() ||
+		location.Leader != leader.opts.Address || len(location.Members) != 3 {
+		t.Error("Unexpected location:", location)
+	}
+
+	stats := m.GetServerStats()
+	if len(stats) != 3 {
+		t.Fatal("Unexpected stats:", stats)
+	}
+	for _, stat := range stats {
+		if len(stat.Regions) != 1 || stat.Regions[0] != leader.GetRegion() {
+			t.Error("Unexpected regions:", stat)
+		}
+		if stat.DiskUsage <= 0 {
+			t.Error("Misses the server stat:", stat)
+		}
+		isLeader := stat.ServerName == leader.opts.Address
+		if isLeader != (len(stat.Loads) == 1) {
+			t.Error("Only the leader reports the load:", stat)
+		}
+	}
+}
+
+func TestMasterReplacesDeadServer(t *testing.T) {
+	c := NewSimCluster("/tmp/TestMasterReplacesDeadServer", 3, 2, nil)
+	defer c.Close()
+
+	spare := c.AddServer()
+	server, m := startSimMaster(c, true)
+	defer server.Close()
+
+	c.Run(3 * time.Second)
+	leader := c.Leader()
+	if leader == nil {
+		t.Fatal("Fails to elect a leader!")
+	}
+	writeSimKeys(t, leader, 20)
+	c.Run(time.Second)
+
+	// A region with enough replicas is left alone.
+	if regions := c.servers[spare].GetRegions(); len(regions) != 0 {
+		t.Fatal("Places an extra replica:", regions)
+	}
+
+	dead := (leader.opts.Address.Port) % 3
+	c.Crash(dead)
+
+	// Only an active master replaces dead servers.
+	c.Run(3 * time.Second)
+	if regions := c.servers[spare].GetRegions(); len(regions) != 0 {
+		t.Fatal("A standby places a replica:", regions)
+	}
+	m.SetActive(true)
+
+	r := leader.GetRegion()
+	replaced := false
+	for i := 0; i < 100 && !replaced; i++ {
+		c.Run(200 * time.Millisecond)
+		if leader = c.Leader(); leader == nil {
+			continue
+		}
+		config := leader.GetConfiguration()
+		replaced = config.IsVoter(c.Names[spare]) && !config.IsMember(c.Names[dead]) &&
+			len(m.GetPlacementExecutor().GetPendings()) == 0
+	}
+	if !replaced {
+		t.Fatal("Fails to replace the dead server:", leader.GetConfiguration())
+	}
+
+	for _, stat := range m.GetServerStats() {
+		if stat.ServerName == c.Names[dead] {
+			t.Error("The master keeps the dead server")
+		}
+	}
+
+	store := c.servers[spare].GetRegions()[r].GetStorage()
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key%02d", i))
+		if _, found := store.Read(key); !found {
+			t.Error("The new replica misses a key:", string(key))
+		}
+	}
+
+	// Stats lag behind, but the region gets no more replicas.
+	c.Run(3 * time.Second)
+	config := c.Leader().GetConfiguration()
+	if members := config.GetMembers(); len(members) != 3 {
+		t.Error("Unexpected members:", members)
+	}
+
+	if violations := c.Checker.Violations(); len(violations) > 0 {
+		t.Error("Safety violations:", violations)
+	}
+}
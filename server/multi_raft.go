@@ -0,0 +1,351 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+// This file contains the multi-raft layer of a server. Regions served by
+// a server share a single log engine, and their heartbeats to the same
+// server are merged into one request. Regions that have nothing to do go
+// quiescent: their leaders stop sending heartbeats, and their followers
+// stop waiting for them. Followers rely on heartbeats between servers to
+// find out that the leader of a quiescent region has died.
+
+import (
+	"errors"
+	"fmt"
+	"lbase/balancer"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errNoHeartbeatReply = errors.New("no reply to heartbeat")
+
+type MultiRaftOptions struct {
+	// The network access point of this server.
+	Address balancer.ServerName
+	// Directory of the shared log engine.
+	RaftRoot string
+	// How often heartbeats are sent to other servers.
+	HeartbeatIntervalMs int64
+	// A server is considered dead if nothing is heard from it for this
+	// long. Quiescent regions led by a dead server wake up.
+	PeerTimeoutMs int64
+	// Number of heartbeat intervals that a leader has nothing to replicate
+	// before its region goes quiescent. If it is 0, regions never go
+	// quiescent.
+	QuiesceAfterTicks int
+	// HTTP RPC path prefix.
+	RPCPrefix string
+	// Connects to other servers. If this is nil, HTTPTransport is used.
+	Transport Transport
+	// Source of time. If this is nil, RealClock is used.
+	Clock Clock
+}
+
+func DefaultMultiRaftOptions(root string) *MultiRaftOptions {
+	return &MultiRaftOptions{
+		RaftRoot:            root,
+		HeartbeatIntervalMs: 15000,
+		PeerTimeoutMs:       60000,
+		QuiesceAfterTicks:   4,
+	}
+}
+
+func MultiRaftOptionsForTest(root string) *MultiRaftOptions {
+	return &MultiRaftOptions{
+		RaftRoot:            root,
+		HeartbeatIntervalMs: 50,
+		PeerTimeoutMs:       200,
+		QuiesceAfterTicks:   4,
+	}
+}
+
+func (opts *MultiRaftOptions) GetLogEngineDir() string {
+	return fmt.Sprintf("%s/log", opts.RaftRoot)
+}
+
+// A heartbeat waiting to be sent with others to the same server.
+type queuedHeartbeat struct {
+	req  Heartbeat
+	done func(reply *HeartbeatReply, err error)
+}
+
+type MultiRaft struct {
+	opts   MultiRaftOptions
+	engine *RaftLogEngine
+	// Returns regions served by this server.
+	regions func() map[balancer.Region]*RaftStates
+	// Protects all fields below.
+	mutex sync.Mutex
+	// Heartbeats to be sent to each server on the next tick.
+	pending map[balancer.ServerName][]queuedHeartbeat
+	// One connection to each server.
+	clients map[balancer.ServerName]RaftClient
+	// The last time that each server was heard from. Every server is
+	// assumed to be alive when this starts.
+	startTime   time.Time
+	lastContact map[balancer.ServerName]time.Time
+	quit        chan bool
+}
+
+func newMultiRaft(
+	opts *MultiRaftOptions,
+	regions func() map[balancer.Region]*RaftStates) (ret *MultiRaft, err error) {
+
+	engine, openErr := NewRaftLogEngine(opts.GetLogEngineDir())
+	if openErr != nil {
+		err = openErr
+		return
+	}
+
+	ret = &MultiRaft{
+		opts:        *opts,
+		engine:      engine,
+		regions:     regions,
+		pending:     make(map[balancer.ServerName][]queuedHeartbeat),
+		clients:     make(map[balancer.ServerName]RaftClient),
+		lastContact: make(map[balancer.ServerName]time.Time),
+		quit:        make(chan bool),
+	}
+
+	if ret.opts.Transport == nil {
+		ret.opts.Transport = &HTTPTransport{}
+	}
+	if ret.opts.Clock == nil {
+		ret.opts.Clock = &RealClock{}
+	}
+	ret.startTime = ret.opts.Clock.Now()
+	return
+}
+
+func (m *MultiRaft) GetOptions() *MultiRaftOptions {
+	return &m.opts
+}
+
+func (m *MultiRaft) GetLogEngine() *RaftLogEngine {
+	return m.engine
+}
+
+// Stop sending heartbeats, and close the log engine. Regions must have
+// been closed.
+func (m *MultiRaft) Close() {
+	close(m.quit)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, cli := range m.clients {
+		cli.Close()
+	}
+	m.clients = make(map[balancer.ServerName]RaftClient)
+	m.engine.Close()
+}
+
+func (m *MultiRaft) run() {
+	interval := time.Duration(m.opts.HeartbeatIntervalMs) * time.Millisecond
+	ticker := m.opts.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			m.sendHeartbeats()
+			m.wakeRegions()
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// Queue a heartbeat of a region to @sn. It is sent on the next tick along
+// with heartbeats of other regions. @done is called with the reply, or
+// with an error if the reply does not arrive in time.
+func (m *MultiRaft) SendHeartbeat(
+	sn balancer.ServerName,
+	req *Heartbeat,
+	done func(reply *HeartbeatReply, err error)) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.pending[sn] = append(m.pending[sn], queuedHeartbeat{*req, done})
+}
+
+// Send a BatchHeartbeat to every server that shares a region with this
+// server.
+func (m *MultiRaft) sendHeartbeats() {
+	peers := make(map[balancer.ServerName]bool)
+	for _, states := range m.regions() {
+		config := states.GetConfiguration()
+		for _, sn := range config.GetMembers() {
+			if sn != m.opts.Address {
+				peers[sn] = true
+			}
+		}
+	}
+
+	m.mutex.Lock()
+	pending := m.pending
+	m.pending = make(map[balancer.ServerName][]queuedHeartbeat)
+	for sn, _ := range pending {
+		peers[sn] = true
+	}
+	m.mutex.Unlock()
+
+	// Batches are sent in order, so that their timeouts are created in
+	// the same order every time.
+	names := make([]balancer.ServerName, 0, len(peers))
+	for sn, _ := range peers {
+		names = append(names, sn)
+	}
+	sort.Sort(serverNames(names))
+
+	for _, sn := range names {
+		m.sendBatch(sn, pending[sn])
+	}
+}
+
+func (m *MultiRaft) sendBatch(sn balancer.ServerName, queued []queuedHeartbeat) {
+	cli := m.getClient(sn)
+	if cli == nil {
+		for _, q := range queued {
+			q.done(nil, errServerDown)
+		}
+		return
+	}
+
+	req := &BatchHeartbeat{ServerName: m.opts.Address}
+	for _, q := range queued {
+		req.Heartbeats = append(req.Heartbeats, q.req)
+	}
+
+	reply := &BatchHeartbeatReply{}
+	call := cli.Go("ServerRPC.BatchHeartbeat", req, reply, nil)
+	timeOut := time.Duration(m.opts.PeerTimeoutMs) * time.Millisecond
+	go m.wait(sn, cli, call, m.opts.Clock.After(timeOut), reply, queued)
+}
+
+// Wait for the reply of a BatchHeartbeat until @timeOut fires, and hand
+// replies of individual heartbeats to their regions.
+func (m *MultiRaft) wait(
+	sn balancer.ServerName,
+	cli RaftClient,
+	call *rpc.Call,
+	timeOut <-chan time.Time,
+	reply *BatchHeartbeatReply,
+	queued []queuedHeartbeat) {
+
+	var err error
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-timeOut:
+		err = errRequestTimeout
+	case <-m.quit:
+		err = errServerDown
+	}
+
+	if err != nil {
+		m.dropClient(sn, cli)
+	} else {
+		m.RecordContact(sn)
+	}
+
+	for i, q := range queued {
+		if err != nil {
+			q.done(nil, err)
+		} else if i >= len(reply.Replies) {
+			q.done(nil, errNoHeartbeatReply)
+		} else {
+			q.done(&reply.Replies[i], nil)
+		}
+	}
+}
+
+func (m *MultiRaft) getClient(sn balancer.ServerName) RaftClient {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	cli, found := m.clients[sn]
+	if found {
+		return cli
+	}
+
+	cli, err := m.opts.Transport.Dial(sn, m.opts.RPCPrefix)
+	if err != nil {
+		return nil
+	}
+	m.clients[sn] = cli
+	return cli
+}
+
+// Close a broken connection.
+func (m *MultiRaft) dropClient(sn balancer.ServerName, cli RaftClient) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	cur, found := m.clients[sn]
+	if found && cur == cli {
+		delete(m.clients, sn)
+		cli.Close()
+	}
+}
+
+// Remember that @sn is alive.
+func (m *MultiRaft) RecordContact(sn balancer.ServerName) {
+	now := m.opts.Clock.Now()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lastContact[sn] = now
+}
+
+// Check if something has been heard from @sn recently.
+func (m *MultiRaft) IsAlive(sn balancer.ServerName) bool {
+	if sn == m.opts.Address {
+		return true
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	last, found := m.lastContact[sn]
+	if !found {
+		last = m.startTime
+	}
+	timeOut := time.Duration(m.opts.PeerTimeoutMs) * time.Millisecond
+	return m.opts.Clock.Now().Sub(last) <= timeOut
+}
+
+// Wake up quiescent regions whose leaders seem to be dead, so that they
+// elect new leaders.
+func (m *MultiRaft) wakeRegions() {
+	for _, states := range m.regions() {
+		leader, quiescent := states.GetQuiescentLeader()
+		if quiescent && !m.IsAlive(leader) {
+			states.Unquiesce()
+		}
+	}
+}
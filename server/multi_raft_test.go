@@ -0,0 +1,341 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"fmt"
+	"lbase/balancer"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	MULTI_RAFT_TEST_SERVERS = 3
+	MULTI_RAFT_TEST_REGIONS = 20
+)
+
+// Servers that serve the same regions through the multi-raft layer, on
+// a simulated network.
+type multiRaftTestCluster struct {
+	root    string
+	clock   *SimClock
+	network *SimNetwork
+	names   []balancer.ServerName
+	regions []balancer.Region
+	servers []*Server
+}
+
+func newMultiRaftTestCluster(root string) *multiRaftTestCluster {
+	os.RemoveAll(root)
+
+	clock := NewSimClock()
+	c := &multiRaftTestCluster{
+		root:    root,
+		clock:   clock,
+		network: NewSimNetwork(clock, 1),
+	}
+
+	for i := 0; i < MULTI_RAFT_TEST_SERVERS; i++ {
+		c.names = append(c.names, balancer.ServerName{Host: "sim", Port: i + 1})
+	}
+	for j := 0; j < MULTI_RAFT_TEST_REGIONS; j++ {
+		r := balancer.Region{
+			StartKey: fmt.Sprintf("%03d", j),
+			EndKey:   fmt.Sprintf("%03d", j+1),
+		}
+		c.regions = append(c.regions, r)
+	}
+
+	for i, _ := range c.names {
+		c.servers = append(c.servers, c.start(i))
+	}
+	return c
+}
+
+func (c *multiRaftTestCluster) start(i int) *Server {
+	root := fmt.Sprintf("%s/%d", c.root, i)
+	server := NewLocalServer()
+
+	mopts := MultiRaftOptionsForTest(root)
+	mopts.Address = c.names[i]
+	mopts.Clock = c.clock
+	mopts.Transport = c.network.Transport(c.names[i])
+	m, err := server.StartMultiRaft(mopts)
+	if err != nil {
+		panic("Fails to start multi-raft")
+	}
+
+	var all []*RaftStates
+	for j, r := range c.regions {
+		storeOpts := &RegionStoreOptions{
+			Name:   fmt.Sprintf("%s/store/%d", root, j),
+			Region: r,
+		}
+		os.MkdirAll(storeOpts.Name, os.ModePerm)
+
+		opts := RaftOptionsForTest(fmt.Sprintf("%s/raft/%d", root, j))
+		opts.Region = r
+		opts.Address = c.names[i]
+		opts.Members = c.names
+		opts.Clock = c.clock
+		opts.Transport = c.network.Transport(c.names[i])
+		opts.MultiRaft = m
+		opts.Rand = rand.New(rand.NewSource(int64(i*1000 + j)))
+
+		store, err := NewRaftStorage(opts, NewRegionStore(storeOpts))
+		if err != nil {
+			panic("Fails to create raft storage")
+		}
+
+		states := NewRaftStates(opts, store)
+		server.RegisterRegion(r, states)
+		all = append(all, states)
+	}
+
+	c.network.AddServer(c.names[i], server)
+	for _, states := range all {
+		states.TransitToFollower()
+	}
+	return server
+}
+
+func (c *multiRaftTestCluster) Run(d time.Duration) {
+	RunSimulation(c.clock, c.network, d)
+}
+
+// Stop a server abruptly.
+func (c *multiRaftTestCluster) Crash(i int) {
+	if c.servers[i] == nil {
+		return
+	}
+
+	c.network.RemoveServer(c.names[i])
+	waitSimIdle()
+	c.servers[i].UnregisterRegions()
+	c.servers[i].Close()
+	c.servers[i] = nil
+}
+
+func (c *multiRaftTestCluster) Close() {
+	for i, _ := range c.servers {
+		c.Crash(i)
+	}
+}
+
+// Return the leader of each region. A region without a leader is left out.
+func (c *multiRaftTestCluster) Leaders() map[balancer.Region]*RaftStates {
+	ret := make(map[balancer.Region]*RaftStates)
+	for _, server := range c.servers {
+		if server == nil {
+			continue
+		}
+		for r, states := range server.GetRegions() {
+			if states.GetState() == RAFT_LEADER {
+				ret[r] = states
+			}
+		}
+	}
+	return ret
+}
+
+// Return the number of region replicas that are quiescent.
+func (c *multiRaftTestCluster) NumQuiescent() (n int) {
+	for _, server := range c.servers {
+		if server == nil {
+			continue
+		}
+		for _, states := range server.GetRegions() {
+			if _, quiescent := states.GetQuiescentLeader(); quiescent {
+				n++
+			}
+		}
+	}
+	return
+}
+
+func TestMultiRaftQuiescence(t *testing.T) {
+	c := newMultiRaftTestCluster("/tmp/TestMultiRaftQuiescence")
+	defer c.Close()
+
+	c.Run(5 * time.Second)
+	leaders := c.Leaders()
+	if len(leaders) != len(c.regions) {
+		t.Fatal("Fails to elect leaders:", len(leaders))
+	}
+
+	// Every region commits a record.
+	seqs := make(map[balancer.Region]RaftSequence)
+	for r, leader := range leaders {
+		record := RaftRecord{Key: []byte(r.StartKey), Value: []byte("hello")}
+		seq, ok := leader.Propose(&record)
+		if !ok {
+			t.Fatal("Fails to propose a record")
+		}
+		seqs[r] = seq
+	}
+	c.Run(2 * time.Second)
+
+	for r, leader := range leaders {
+		if leader.GetCommitSequence().Index < seqs[r].Index {
+			t.Error("Fails to commit a record", r)
+		}
+	}
+
+	// Heartbeats only travel in batches between servers.
+	if n := c.network.NumCalls("ServerRPC.Heartbeat"); n != 0 {
+		t.Error("Sends heartbeats of single regions:", n)
+	}
+
+	// Idle regions go quiescent on all replicas.
+	total := len(c.regions) * len(c.servers)
+	if n := c.NumQuiescent(); n != total {
+		t.Error("Regions fail to go quiescent:", n, "of", total)
+	}
+
+	// Only batches between servers remain, no matter how many regions.
+	sent := c.network.NumCalls("ServerRPC.BatchHeartbeat")
+	c.Run(time.Second)
+	sent = c.network.NumCalls("ServerRPC.BatchHeartbeat") - sent
+	pairs := len(c.servers) * (len(c.servers) - 1)
+	interval := MultiRaftOptionsForTest("").HeartbeatIntervalMs
+	if limit := pairs * int(1000/interval+1); sent > limit {
+		t.Error("Sends too many batches when quiescent:", sent)
+	}
+	if c.network.NumCalls("ServerRPC.AppendEntries") == 0 {
+		t.Error("Fails to count messages")
+	}
+
+	// A write wakes up its region.
+	var region balancer.Region
+	var leader *RaftStates
+	for region, leader = range leaders {
+		break
+	}
+	record := RaftRecord{Key: []byte(region.StartKey), Value: []byte("world")}
+	seq, ok := leader.Propose(&record)
+	if !ok {
+		t.Fatal("Fails to propose a record to a quiescent leader")
+	}
+	c.Run(time.Second)
+	for _, server := range c.servers {
+		states := server.GetRegions()[region]
+		if states.GetCommitSequence().Index < seq.Index {
+			t.Error("Fails to commit a record after waking up")
+		}
+	}
+}
+
+func TestMultiRaftLeaderCrash(t *testing.T) {
+	c := newMultiRaftTestCluster("/tmp/TestMultiRaftLeaderCrash")
+	defer c.Close()
+
+	c.Run(5 * time.Second)
+	if n := c.NumQuiescent(); n != len(c.regions)*len(c.servers) {
+		t.Fatal("Regions fail to go quiescent:", n)
+	}
+
+	// Crash the server leading the most regions. Quiescent followers
+	// find out from missing batches, and elect new leaders.
+	counts := make(map[balancer.ServerName]int)
+	for _, leader := range c.Leaders() {
+		counts[leader.GetStorage().GetRaftOptions().Address]++
+	}
+	crashed := 0
+	for i, sn := range c.names {
+		if counts[sn] > counts[c.names[crashed]] {
+			crashed = i
+		}
+	}
+	c.Crash(crashed)
+	c.Run(5 * time.Second)
+
+	leaders := c.Leaders()
+	if len(leaders) != len(c.regions) {
+		t.Fatal("Fails to elect new leaders:", len(leaders))
+	}
+
+	for r, leader := range leaders {
+		record := RaftRecord{Key: []byte(r.StartKey), Value: []byte("again")}
+		if _, ok := leader.Propose(&record); !ok {
+			t.Error("Fails to propose a record", r)
+		}
+	}
+	c.Run(2 * time.Second)
+
+	for _, server := range c.servers {
+		if server == nil {
+			continue
+		}
+		for r, states := range server.GetRegions() {
+			if states.GetCommitSequence().Index < leaders[r].GetCommitSequence().Index {
+				t.Error("Fails to commit a record after the crash", r)
+			}
+		}
+	}
+}
+
+func TestMultiRaftSplit(t *testing.T) {
+	c := newMultiRaftTestCluster("/tmp/TestMultiRaftSplit")
+	defer c.Close()
+
+	c.Run(5 * time.Second)
+	origin := c.regions[0]
+	leader := c.Leaders()[origin]
+	if leader == nil {
+		t.Fatal("Fails to elect a leader")
+	}
+
+	key := []byte(origin.StartKey + "5")
+	if _, ok := leader.Propose(&RaftRecord{Key: key, Value: key}); !ok {
+		t.Fatal("Fails to propose a record to a quiescent leader")
+	}
+	c.Run(time.Second)
+	if !leader.SplitRegion(key) {
+		t.Fatal("Fails to split a region")
+	}
+	c.Run(5 * time.Second)
+
+	right := balancer.Region{StartKey: string(key), EndKey: origin.EndKey}
+	if len(c.Leaders()) != len(c.regions)+1 || c.Leaders()[right] == nil {
+		t.Error("Fails to elect a leader of the new region")
+	}
+	for i, server := range c.servers {
+		states := server.GetRegions()[right]
+		if states == nil {
+			t.Fatal("Server", i, "does not serve the new region")
+		}
+		if _, found := states.GetStorage().Read(key); !found {
+			t.Error("The new region misses a key")
+		}
+	}
+
+	// The new region goes quiescent like the others.
+	if n := c.NumQuiescent(); n != (len(c.regions)+1)*len(c.servers) {
+		t.Error("Regions fail to go quiescent:", n)
+	}
+}
@@ -0,0 +1,473 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"lbase/balancer"
+	"log"
+	"sync"
+	"time"
+)
+
+type PlacementOptions struct {
+	// Connects to servers. If this is nil, HTTPTransport is used.
+	Transport Transport
+	// HTTP RPC path prefix.
+	RPCPrefix string
+	// Source of time. If this is nil, RealClock is used.
+	Clock Clock
+	// Number of moves that run at the same time. Others wait for them.
+	MaxConcurrentMoves int
+	// How often a move checks its progress.
+	PollIntervalMs int64
+	// A move that does not finish in this long fails.
+	MoveTimeoutMs int64
+	// A leadership transfer that does not finish in this long fails.
+	LeaderTransferTimeoutMs int64
+	// Timeout of a single RPC.
+	RPCTimeoutMs int64
+	// Returns servers that may serve a region, such as those that report
+	// it in their stats. It may be nil.
+	Locate func(r balancer.Region) []balancer.ServerName
+	// Told whenever a move changes. It may be nil.
+	Listener balancer.PlacementListener
+}
+
+func DefaultPlacementOptions() *PlacementOptions {
+	return &PlacementOptions{
+		MaxConcurrentMoves:      4,
+		PollIntervalMs:          1000,
+		MoveTimeoutMs:           3600000,
+		LeaderTransferTimeoutMs: 30000,
+		RPCTimeoutMs:            10000,
+	}
+}
+
+func PlacementOptionsForTest() *PlacementOptions {
+	return &PlacementOptions{
+		MaxConcurrentMoves:      2,
+		PollIntervalMs:          20,
+		MoveTimeoutMs:           5000,
+		LeaderTransferTimeoutMs: 2000,
+		RPCTimeoutMs:            200,
+	}
+}
+
+// A placement action that is waiting or running.
+type placementMove struct {
+	task      balancer.PlacementAction
+	running   bool
+	cancelled bool
+}
+
+// Carries out placement actions of a balancer. Dest joins the quorum of
+// the region as a learner, which receives a snapshot from the leader and
+// is promoted once it catches up. Source is then removed from the quorum,
+// and its replica is dropped. If nobody serves the region yet, a new
+// quorum is started on Dest. A leadership transfer asks the leader to hand
+// over its leadership to Dest.
+//
+// Moves of the same region run one at a time, in the order that they are
+// placed, and at most MaxConcurrentMoves run together. The leader also
+// throttles the snapshot that it sends to Dest.
+type PlacementExecutor struct {
+	opts PlacementOptions
+	// Protects all fields below.
+	mutex   sync.Mutex
+	moves   []*placementMove
+	running int
+	// Members of regions that moves have seen.
+	members map[balancer.Region][]balancer.ServerName
+}
+
+func NewPlacementExecutor(opts *PlacementOptions) *PlacementExecutor {
+	e := &PlacementExecutor{
+		opts:    *opts,
+		members: make(map[balancer.Region][]balancer.ServerName),
+	}
+	if e.opts.Transport == nil {
+		e.opts.Transport = &HTTPTransport{}
+	}
+	if e.opts.Clock == nil {
+		e.opts.Clock = &RealClock{}
+	}
+	return e
+}
+
+func (e *PlacementExecutor) Place(task *balancer.PlacementAction) {
+	m := &placementMove{task: *task}
+	m.task.Status = balancer.PLACEMENT_PENDING
+
+	e.mutex.Lock()
+	e.moves = append(e.moves, m)
+	e.mutex.Unlock()
+
+	e.notify(m.task)
+	e.schedule()
+}
+
+// Stop moving region @r to @dest. A move can be cancelled until Dest is
+// promoted to a voter, in which case the replica on Dest is dropped.
+// Return false if there is no such move.
+func (e *PlacementExecutor) Cancel(r balancer.Region, dest balancer.ServerName) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for _, m := range e.moves {
+		if m.task.Region == r && m.task.Dest == dest {
+			m.cancelled = true
+			return true
+		}
+	}
+	return false
+}
+
+// Return moves that have not finished. They can be passed to
+// Balancer.BalanceLoad.
+func (e *PlacementExecutor) GetPendings() []balancer.PlacementAction {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	ret := make([]balancer.PlacementAction, 0, len(e.moves))
+	for _, m := range e.moves {
+		ret = append(ret, m.task)
+	}
+	return ret
+}
+
+// Start moves that can run now.
+func (e *PlacementExecutor) schedule() {
+	e.mutex.Lock()
+	busy := make(map[balancer.Region]bool)
+	for _, m := range e.moves {
+		if m.running {
+			busy[m.task.Region] = true
+		}
+	}
+
+	var started []*placementMove
+	for _, m := range e.moves {
+		if e.running >= e.opts.MaxConcurrentMoves {
+			break
+		}
+		if m.running || busy[m.task.Region] {
+			continue
+		}
+		m.running = true
+		e.running++
+		busy[m.task.Region] = true
+		started = append(started, m)
+	}
+	e.mutex.Unlock()
+
+	for _, m := range started {
+		go e.run(m)
+	}
+}
+
+func (e *PlacementExecutor) run(m *placementMove) {
+	var status int
+	if m.task.LeaderTransfer {
+		status = e.transfer(m)
+	} else {
+		status = e.move(m)
+	}
+
+	e.mutex.Lock()
+	m.task.Status = status
+	for i, cur := range e.moves {
+		if cur == m {
+			e.moves = append(e.moves[:i], e.moves[i+1:]...)
+			break
+		}
+	}
+	e.running--
+	task := m.task
+	e.mutex.Unlock()
+
+	log.Printf("Placement of %v from %v to %v ends with status %d\n",
+		task.Region, task.Source, task.Dest, task.Status)
+	e.notify(task)
+	e.schedule()
+}
+
+func (e *PlacementExecutor) notify(task balancer.PlacementAction) {
+	if e.opts.Listener != nil {
+		e.opts.Listener.PlacementUpdated(task)
+	}
+}
+
+// Change the status and progress of a move, and tell the listener.
+func (e *PlacementExecutor) update(m *placementMove, status int, copied, total int64) {
+	e.mutex.Lock()
+	changed := m.task.Status != status ||
+		m.task.BytesCopied != copied || m.task.BytesTotal != total
+	m.task.Status = status
+	m.task.BytesCopied = copied
+	m.task.BytesTotal = total
+	task := m.task
+	e.mutex.Unlock()
+
+	if changed {
+		e.notify(task)
+	}
+}
+
+// Carry out a move step by step. Each step is decided by the latest
+// state of the leader, so a move goes on after the leader changes.
+// Return the final status.
+func (e *PlacementExecutor) move(m *placementMove) int {
+	r, dest, source := m.task.Region, m.task.Dest, m.task.Source
+
+	timeOut := time.Duration(e.opts.MoveTimeoutMs) * time.Millisecond
+	deadline := e.opts.Clock.Now().Add(timeOut)
+	interval := time.Duration(e.opts.PollIntervalMs) * time.Millisecond
+
+	for ; ; e.opts.Clock.Sleep(interval) {
+		e.mutex.Lock()
+		cancelled := m.cancelled
+		task := m.task
+		e.mutex.Unlock()
+
+		failed := !e.opts.Clock.Now().Before(deadline)
+		if failed && !e.opts.Clock.Now().Before(deadline.Add(timeOut)) {
+			// Even rolling back does not finish.
+			return balancer.PLACEMENT_FAILED
+		}
+
+		leader, reply, missing := e.findLeader(&task)
+		if missing {
+			if failed || cancelled || task.HasSource {
+				return balancer.PLACEMENT_FAILED
+			}
+			if e.startRegion(r, dest) {
+				return balancer.PLACEMENT_DONE
+			}
+			continue
+		}
+
+		var empty balancer.ServerName
+		if leader == empty {
+			continue
+		}
+		config := &reply.Configuration
+
+		// Roll back a move that has not promoted Dest.
+		if (failed || cancelled) && !config.IsVoter(dest) {
+			if config.IsMember(dest) {
+				if reply.ConfigurationCommitted {
+					e.changeMember(leader, r, dest, "ServerRPC.RemoveMember")
+				}
+				continue
+			}
+			if !reply.ConfigurationCommitted {
+				continue
+			}
+			e.call(dest, "ServerRPC.DropRegion", &DropRegionRequest{Region: r}, &DropRegionReply{})
+			if cancelled {
+				return balancer.PLACEMENT_CANCELLED
+			}
+			return balancer.PLACEMENT_FAILED
+		}
+
+		switch {
+		case !config.IsMember(dest):
+			if !reply.ConfigurationCommitted {
+				continue
+			}
+			var openReply OpenRegionReply
+			req := &OpenRegionRequest{Region: r}
+			if e.call(dest, "ServerRPC.OpenRegion", req, &openReply) && openReply.Ok {
+				e.changeMember(leader, r, dest, "ServerRPC.AddMember")
+			}
+			e.update(m, balancer.PLACEMENT_COPYING, 0, 0)
+
+		case config.IsLearner(dest):
+			progress := reply.Snapshots[dest]
+			if progress.Total == 0 {
+				progress.Total = task.BytesTotal
+				progress.Sent = task.BytesCopied
+			}
+			e.update(m, balancer.PLACEMENT_COPYING, progress.Sent, progress.Total)
+
+		case task.HasSource && config.IsMember(source):
+			e.update(m, balancer.PLACEMENT_REMOVING_SOURCE, task.BytesTotal, task.BytesTotal)
+			if !reply.ConfigurationCommitted {
+				continue
+			}
+
+			// The leader hands over its leadership before it is removed.
+			if leader == source {
+				req := &TransferLeadershipRequest{Region: r, Target: dest}
+				e.call(leader, "ServerRPC.TransferLeadership", req, &TransferLeadershipReply{})
+			} else {
+				e.changeMember(leader, r, source, "ServerRPC.RemoveMember")
+			}
+
+		case !reply.ConfigurationCommitted:
+
+		default:
+			// Source is no longer a member, so a replica that is left
+			// behind, such as on a dead server, does no harm.
+			if task.HasSource {
+				req := &DropRegionRequest{Region: r}
+				if !e.call(source, "ServerRPC.DropRegion", req, &DropRegionReply{}) {
+					log.Printf("Fails to drop %v from %v\n", r, source)
+				}
+			}
+			return balancer.PLACEMENT_DONE
+		}
+	}
+}
+
+// Carry out a leadership transfer until Dest leads the region. Return the
+// final status.
+func (e *PlacementExecutor) transfer(m *placementMove) int {
+	r, dest := m.task.Region, m.task.Dest
+
+	timeOut := time.Duration(e.opts.LeaderTransferTimeoutMs) * time.Millisecond
+	deadline := e.opts.Clock.Now().Add(timeOut)
+	interval := time.Duration(e.opts.PollIntervalMs) * time.Millisecond
+
+	for ; ; e.opts.Clock.Sleep(interval) {
+		e.mutex.Lock()
+		cancelled := m.cancelled
+		task := m.task
+		e.mutex.Unlock()
+
+		if cancelled {
+			return balancer.PLACEMENT_CANCELLED
+		}
+		if !e.opts.Clock.Now().Before(deadline) {
+			return balancer.PLACEMENT_FAILED
+		}
+
+		leader, reply, missing := e.findLeader(&task)
+		if missing {
+			return balancer.PLACEMENT_FAILED
+		}
+
+		var empty balancer.ServerName
+		switch {
+		case leader == empty:
+		case leader == dest:
+			return balancer.PLACEMENT_DONE
+		case !reply.Configuration.IsVoter(dest):
+			// Only a voter can be elected.
+			return balancer.PLACEMENT_FAILED
+		default:
+			req := &TransferLeadershipRequest{Region: r, Target: dest}
+			e.call(leader, "ServerRPC.TransferLeadership", req, &TransferLeadershipReply{})
+		}
+	}
+}
+
+// Find the leader of the region of @task, and return its state. @missing
+// is set if every server that is asked does not serve the region.
+func (e *PlacementExecutor) findLeader(
+	task *balancer.PlacementAction) (leader balancer.ServerName, reply RaftStateReply, missing bool) {
+
+	var candidates []balancer.ServerName
+	if task.HasSource {
+		candidates = append(candidates, task.Source)
+	}
+	if e.opts.Locate != nil {
+		candidates = append(candidates, e.opts.Locate(task.Region)...)
+	}
+	e.mutex.Lock()
+	candidates = append(candidates, e.members[task.Region]...)
+	e.mutex.Unlock()
+	candidates = append(candidates, task.Dest)
+
+	asked := make(map[balancer.ServerName]bool)
+	missing = true
+	for i := 0; i < len(candidates); i++ {
+		sn := candidates[i]
+		if asked[sn] {
+			continue
+		}
+		asked[sn] = true
+
+		var cur RaftStateReply
+		req := RaftStateRequest{Region: task.Region}
+		if !e.call(sn, "ServerRPC.GetRaftState", &req, &cur) {
+			missing = false
+			continue
+		}
+		if !cur.Found || cur.Region != task.Region {
+			continue
+		}
+		missing = false
+
+		// Members of the region may know the leader.
+		members := cur.Configuration.GetMembers()
+		candidates = append(candidates, members...)
+		if cur.State == RAFT_LEADER {
+			e.mutex.Lock()
+			e.members[task.Region] = members
+			e.mutex.Unlock()
+			return sn, cur, false
+		}
+	}
+	return
+}
+
+// Start a new quorum of region @r on @dest.
+func (e *PlacementExecutor) startRegion(r balancer.Region, dest balancer.ServerName) bool {
+	var reply OpenRegionReply
+	req := &OpenRegionRequest{Region: r, Members: []balancer.ServerName{dest}}
+	if !e.call(dest, "ServerRPC.OpenRegion", req, &reply) || !reply.Ok {
+		return false
+	}
+
+	e.mutex.Lock()
+	e.members[r] = []balancer.ServerName{dest}
+	e.mutex.Unlock()
+	return true
+}
+
+// Ask @leader to add or remove @sn with @method.
+func (e *PlacementExecutor) changeMember(
+	leader balancer.ServerName,
+	r balancer.Region,
+	sn balancer.ServerName,
+	method string) bool {
+
+	var reply MembershipReply
+	req := &MembershipRequest{Region: r, ServerName: sn}
+	return e.call(leader, method, req, &reply) && reply.Ok
+}
+
+func (e *PlacementExecutor) call(
+	sn balancer.ServerName,
+	method string,
+	req interface{},
+	reply interface{}) bool {
+
+	timeOut := time.Duration(e.opts.RPCTimeoutMs) * time.Millisecond
+	return callServer(
+		e.opts.Transport, e.opts.RPCPrefix, e.opts.Clock, timeOut, sn, method, req, reply)
+}
@@ -0,0 +1,379 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"fmt"
+	"lbase/balancer"
+	"sync"
+	"testing"
+	"time"
+)
+
+type placementRecorder struct {
+	mutex   sync.Mutex
+	updates []balancer.PlacementAction
+}
+
+func (p *placementRecorder) PlacementUpdated(task balancer.PlacementAction) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.updates = append(p.updates, task)
+}
+
+func (p *placementRecorder) getUpdates() []balancer.PlacementAction {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]balancer.PlacementAction{}, p.updates...)
+}
+
+// Create an executor that runs on the clock and network of @c.
+func newSimPlacementExecutor(c *SimCluster, listener balancer.PlacementListener) *PlacementExecutor {
+	opts := PlacementOptionsForTest()
+	opts.Clock = c.Clock
+	opts.Transport = c.Network.Transport(balancer.ServerName{Host: "master"})
+	opts.Listener = listener
+	return NewPlacementExecutor(opts)
+}
+
+// Advance @c until @exec has no pending moves, for at most @d.
+func runPlacements(c *SimCluster, exec *PlacementExecutor, d time.Duration) bool {
+	for elapsed := time.Duration(0); elapsed < d; elapsed += 100 * time.Millisecond {
+		c.Run(100 * time.Millisecond)
+		if len(exec.GetPendings()) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the replica of @r on server @i, and check that it has all
+// keys written by writeSimKeys.
+func checkSimReplica(t *testing.T, c *SimCluster, i int, r balancer.Region, num int) *RaftStates {
+	states := c.servers[i].GetRegions()[r]
+	if states == nil {
+		t.Fatal("Server", i, "does not serve the region")
+	}
+
+	store := states.GetStorage()
+	for j := 0; j < num; j++ {
+		key := []byte(fmt.Sprintf("key%02d", j))
+		if _, found := store.Read(key); !found {
+			t.Error("Server", i, "misses a key:", string(key))
+		}
+	}
+	return states
+}
+
+func writeSimKeys(t *testing.T, leader *RaftStates, num int) {
+	for i := 0; i < num; i++ {
+		key := []byte(fmt.Sprintf("key%02d", i))
+		value := []byte(fmt.Sprintf("value of key%02d padded to a few dozen bytes", i))
+		if _, ok := leader.Propose(&RaftRecord{Key: key, Value: value}); !ok {
+			t.Fatal("Fails to propose a record")
+		}
+	}
+}
+
+func throttleSnapshots(opts *RaftOptions) {
+	opts.SnapshotChunkBytes = 256
+	opts.SnapshotBytesPerSec = 1024
+}
+
+func TestPlacementExecutorMove(t *testing.T) {
+	c := NewSimCluster("/tmp/TestPlacementExecutorMove", 3, 1, throttleSnapshots)
+	defer c.Close()
+
+	c.Run(3 * time.Second)
+	leader := c.Leader()
+	if leader == nil {
+		t.Fatal("Fails to elect a leader!")
+	}
+	writeSimKeys(t, leader, 40)
+	c.Run(time.Second)
+
+	// Move the replica of the leader, which has to hand over its
+	// leadership first.
+	source := leader.opts.Address
+	sourceIdx := source.Port - 1
+	dest := c.AddServer()
+
+	recorder := &placementRecorder{}
+	exec := newSimPlacementExecutor(c, recorder)
+	r := leader.GetRegion()
+	exec.Place(&balancer.PlacementAction{
+		Region:    r,
+		Source:    source,
+		Dest:      c.Names[dest],
+		HasSource: true,
+	})
+	if pendings := exec.GetPendings(); len(pendings) != 1 ||
+		pendings[0].Status != balancer.PLACEMENT_PENDING {
+		t.Error("Unexpected pending moves:", pendings)
+	}
+
+	if !runPlacements(c, exec, 30*time.Second) {
+		t.Fatal("Fails to finish the move:", exec.GetPendings())
+	}
+
+	updates := recorder.getUpdates()
+	if last := updates[len(updates)-1]; last.Status != balancer.PLACEMENT_DONE {
+		t.Fatal("Unexpected final status:", last)
+	}
+
+	// The snapshot is throttled, so its progress is reported in steps.
+	var copying, removing bool
+	for _, task := range updates {
+		switch task.Status {
+		case balancer.PLACEMENT_COPYING:
+			if task.BytesCopied > 0 && task.BytesCopied < task.BytesTotal {
+				copying = true
+			}
+		case balancer.PLACEMENT_REMOVING_SOURCE:
+			removing = true
+		}
+	}
+	if !copying || !removing {
+		t.Error("Misses progress of the move:", updates)
+	}
+
+	states := checkSimReplica(t, c, dest, r, 40)
+	config := states.GetConfiguration()
+	if !config.IsVoter(c.Names[dest]) || config.IsMember(source) {
+		t.Error("Unexpected configuration:", config)
+	}
+	if regions := c.servers[sourceIdx].GetRegions(); len(regions) != 0 {
+		t.Error("The source does not drop its replica:", regions)
+	}
+	c.States[sourceIdx] = nil
+	c.States[dest] = states
+
+	c.Run(time.Second)
+	leader = c.Leader()
+	if leader == nil {
+		t.Fatal("Fails to elect a leader after the move")
+	}
+	record := &RaftRecord{Key: []byte("key99"), Value: []byte("moved")}
+	if _, ok := leader.Propose(record); !ok {
+		t.Error("The quorum rejects writes after the move")
+	}
+
+	if violations := c.Checker.Violations(); len(violations) > 0 {
+		t.Error("Safety violations:", violations)
+	}
+}
+
+func TestPlacementExecutorCancel(t *testing.T) {
+	c := NewSimCluster("/tmp/TestPlacementExecutorCancel", 3, 2, throttleSnapshots)
+	defer c.Close()
+
+	c.Run(3 * time.Second)
+	leader := c.Leader()
+	if leader == nil {
+		t.Fatal("Fails to elect a leader!")
+	}
+	writeSimKeys(t, leader, 40)
+	c.Run(time.Second)
+
+	dest := c.AddServer()
+	recorder := &placementRecorder{}
+	exec := newSimPlacementExecutor(c, recorder)
+	r := leader.GetRegion()
+	source := c.Names[0]
+	exec.Place(&balancer.PlacementAction{
+		Region:    r,
+		Source:    source,
+		Dest:      c.Names[dest],
+		HasSource: true,
+	})
+
+	// Cancel the move while the snapshot is being copied.
+	copying := false
+	for i := 0; i < 50 && !copying; i++ {
+		c.Run(100 * time.Millisecond)
+		pendings := exec.GetPendings()
+		copying = len(pendings) == 1 && pendings[0].Status == balancer.PLACEMENT_COPYING
+	}
+	if !copying {
+		t.Fatal("The move does not start copying")
+	}
+
+	if exec.Cancel(r, c.Names[1]) {
+		t.Error("Cancels a move that does not exist")
+	}
+	if !exec.Cancel(r, c.Names[dest]) {
+		t.Fatal("Fails to cancel the move")
+	}
+	if !runPlacements(c, exec, 30*time.Second) {
+		t.Fatal("Fails to roll back the move:", exec.GetPendings())
+	}
+
+	updates := recorder.getUpdates()
+	if last := updates[len(updates)-1]; last.Status != balancer.PLACEMENT_CANCELLED {
+		t.Fatal("Unexpected final status:", last)
+	}
+
+	if regions := c.servers[dest].GetRegions(); len(regions) != 0 {
+		t.Error("Dest does not drop its replica:", regions)
+	}
+	leader = c.Leader()
+	if leader == nil {
+		t.Fatal("Loses the leader")
+	}
+	config := leader.GetConfiguration()
+	if config.IsMember(c.Names[dest]) || !config.IsVoter(source) {
+		t.Error("Unexpected configuration:", config)
+	}
+	checkSimReplica(t, c, 0, r, 40)
+
+	if violations := c.Checker.Violations(); len(violations) > 0 {
+		t.Error("Safety violations:", violations)
+	}
+}
+
+func TestPlacementExecutorNewRegion(t *testing.T) {
+	c := NewSimCluster("/tmp/TestPlacementExecutorNewRegion", 3, 3, nil)
+	defer c.Close()
+
+	var added []int
+	for i := 0; i < 3; i++ {
+		added = append(added, c.AddServer())
+	}
+
+	// A region that nobody serves is started on its first Dest, and the
+	// others join it one at a time.
+	recorder := &placementRecorder{}
+	exec := newSimPlacementExecutor(c, recorder)
+	r := balancer.Region{StartKey: "new", EndKey: "newer"}
+	for _, i := range added {
+		exec.Place(&balancer.PlacementAction{Region: r, Dest: c.Names[i]})
+	}
+	if !runPlacements(c, exec, 30*time.Second) {
+		t.Fatal("Fails to place the region:", exec.GetPendings())
+	}
+	c.Run(time.Second)
+
+	for _, task := range recorder.getUpdates() {
+		if task.Status == balancer.PLACEMENT_FAILED {
+			t.Error("A placement fails:", task)
+		}
+	}
+
+	var leader *RaftStates
+	for _, i := range added {
+		states := c.servers[i].GetRegions()[r]
+		if states == nil {
+			t.Fatal("Server", i, "does not serve the new region")
+		}
+		if states.GetState() == RAFT_LEADER {
+			leader = states
+		}
+	}
+	if leader == nil {
+		t.Fatal("Fails to elect a leader of the new region")
+	}
+
+	config := leader.GetConfiguration()
+	for _, i := range added {
+		if !config.IsVoter(c.Names[i]) {
+			t.Error("Server", i, "is not a voter:", config)
+		}
+	}
+	if _, ok := leader.Propose(&RaftRecord{Key: []byte("new1"), Value: []byte("x")}); !ok {
+		t.Error("The new region rejects writes")
+	}
+}
+
+func TestPlacementExecutorLeaderTransfer(t *testing.T) {
+	c := NewSimCluster("/tmp/TestPlacementExecutorLeaderTransfer", 3, 4, nil)
+	defer c.Close()
+
+	c.Run(3 * time.Second)
+	leader := c.Leader()
+	if leader == nil {
+		t.Fatal("Fails to elect a leader!")
+	}
+	writeSimKeys(t, leader, 10)
+	c.Run(time.Second)
+
+	source := leader.opts.Address
+	target := c.Names[0]
+	if target == source {
+		target = c.Names[1]
+	}
+
+	recorder := &placementRecorder{}
+	exec := newSimPlacementExecutor(c, recorder)
+	r := leader.GetRegion()
+	exec.Place(&balancer.PlacementAction{
+		Region:         r,
+		Source:         source,
+		Dest:           target,
+		HasSource:      true,
+		LeaderTransfer: true,
+	})
+	if !runPlacements(c, exec, 10*time.Second) {
+		t.Fatal("Fails to finish the transfer:", exec.GetPendings())
+	}
+
+	updates := recorder.getUpdates()
+	if last := updates[len(updates)-1]; last.Status != balancer.PLACEMENT_DONE {
+		t.Fatal("Unexpected final status:", last)
+	}
+	c.Run(time.Second)
+	leader = c.Leader()
+	if leader == nil || leader.opts.Address != target {
+		t.Fatal("Leadership does not move to", target)
+	}
+	config := leader.GetConfiguration()
+	if len(config.GetMembers()) != 3 {
+		t.Error("Replicas change:", config)
+	}
+
+	// A server without a replica cannot lead the region.
+	dest := c.AddServer()
+	exec.Place(&balancer.PlacementAction{
+		Region:         r,
+		Source:         target,
+		Dest:           c.Names[dest],
+		HasSource:      true,
+		LeaderTransfer: true,
+	})
+	if !runPlacements(c, exec, 10*time.Second) {
+		t.Fatal("Fails to finish the transfer:", exec.GetPendings())
+	}
+	updates = recorder.getUpdates()
+	if last := updates[len(updates)-1]; last.Status != balancer.PLACEMENT_FAILED {
+		t.Error("Unexpected final status:", last)
+	}
+	if leader := c.Leader(); leader == nil || leader.opts.Address != target {
+		t.Error("Leadership moves without a transfer")
+	}
+
+	if violations := c.Checker.Violations(); len(violations) > 0 {
+		t.Error("Safety violations:", violations)
+	}
+}
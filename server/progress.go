@@ -0,0 +1,146 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"time"
+)
+
+// Replication states of a member.
+const (
+	// The leader is looking for the last record that it shares with the
+	// member. Only one AppendEntries is in flight.
+	PROGRESS_PROBE = iota
+	// The member is in sync with the leader. Records are pipelined.
+	PROGRESS_REPLICATE
+	// The member is receiving a snapshot.
+	PROGRESS_SNAPSHOT
+)
+
+// Records and bytes sent by an in-flight AppendEntries.
+type inflightAppend struct {
+	lastIndex int64
+	bytes     int64
+}
+
+// Replication progress of a member, tracked by the leader.
+type Progress struct {
+	State int
+	// The last record that is known to be replicated to the member.
+	Match RaftSequence
+	// Records after this sequence are sent next.
+	Next RaftSequence
+	// In-flight AppendEntries in the order they are sent.
+	inflights     []inflightAppend
+	inflightBytes int64
+	// Bumped when in-flight requests are abandoned. Replies to requests
+	// of an old generation are not used to move Next.
+	generation int64
+	// Do not send to the member before this time after a failure.
+	retryAt time.Time
+}
+
+func NewProgress(next RaftSequence) *Progress {
+	return &Progress{State: PROGRESS_PROBE, Next: next}
+}
+
+// Check if another AppendEntries can be sent within the limits.
+func (p *Progress) CanSend(now time.Time, maxInflights int, maxBytes int64) bool {
+	switch p.State {
+	case PROGRESS_PROBE:
+		return len(p.inflights) == 0 && !now.Before(p.retryAt)
+	case PROGRESS_REPLICATE:
+		return len(p.inflights) < maxInflights && p.inflightBytes < maxBytes
+	}
+	return false
+}
+
+// Remember an AppendEntries that sends records up to @last.
+func (p *Progress) Sent(last RaftSequence, bytes int64) {
+	p.inflights = append(p.inflights, inflightAppend{last.Index, bytes})
+	p.inflightBytes += bytes
+	if p.State == PROGRESS_REPLICATE {
+		p.Next = last
+	}
+}
+
+// The member has acknowledged all records up to @seq.
+func (p *Progress) Acked(seq RaftSequence) {
+	if p.Match.Index < seq.Index {
+		p.Match = seq
+	}
+
+	i := 0
+	for ; i < len(p.inflights) && p.inflights[i].lastIndex <= seq.Index; i++ {
+		p.inflightBytes -= p.inflights[i].bytes
+	}
+	p.inflights = p.inflights[i:]
+
+	if p.State == PROGRESS_PROBE {
+		p.State = PROGRESS_REPLICATE
+		p.Next = seq
+	} else if p.State == PROGRESS_REPLICATE && p.Next.Index < p.Match.Index {
+		p.Next = p.Match
+	}
+}
+
+// The member has installed a snapshot that ends at @seq.
+func (p *Progress) SnapshotInstalled(seq RaftSequence) {
+	p.State = PROGRESS_REPLICATE
+	p.Next = seq
+	if p.Match.Index < seq.Index {
+		p.Match = seq
+	}
+}
+
+// Abandon in-flight requests and look for a matching record from @next.
+func (p *Progress) BecomeProbe(next RaftSequence) {
+	p.State = PROGRESS_PROBE
+	p.Next = next
+	p.abandonInflights()
+}
+
+// Abandon in-flight requests, and wait for a snapshot to be installed.
+func (p *Progress) BecomeSnapshot() {
+	p.State = PROGRESS_SNAPSHOT
+	p.abandonInflights()
+}
+
+// A request has failed. Once it is @retryAt, probe the member from the
+// last record sent to it, and let its hint move Next backward. Falling
+// back to Match would ask for records that the leader may have removed
+// after commit, although the member may well have them.
+func (p *Progress) Retry(retryAt time.Time) {
+	p.State = PROGRESS_PROBE
+	p.abandonInflights()
+	p.retryAt = retryAt
+}
+
+func (p *Progress) abandonInflights() {
+	p.inflights = nil
+	p.inflightBytes = 0
+	p.generation++
+}
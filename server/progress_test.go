@@ -0,0 +1,117 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgressProbeAndReplicate(t *testing.T) {
+	now := time.Now()
+	pr := NewProgress(RaftSequence{Term: 1, Index: 10})
+
+	// Only one request is in flight while probing.
+	if !pr.CanSend(now, 4, 1000) {
+		t.Fatal("Should be able to probe")
+	}
+	pr.Sent(RaftSequence{Term: 1, Index: 10}, 0)
+	if pr.CanSend(now, 4, 1000) {
+		t.Error("Should not send more than one probe")
+	}
+
+	pr.Acked(RaftSequence{Term: 1, Index: 10})
+	if pr.State != PROGRESS_REPLICATE || pr.Match.Index != 10 {
+		t.Fatal("Should replicate after a probe succeeds:", pr)
+	}
+
+	// Requests are pipelined until the limit of requests is reached.
+	for i := int64(1); i <= 4; i++ {
+		if !pr.CanSend(now, 4, 1000) {
+			t.Fatal("Should pipeline request", i)
+		}
+		pr.Sent(RaftSequence{Term: 1, Index: 10 + i}, 10)
+	}
+	if pr.CanSend(now, 4, 1000) {
+		t.Error("Should not exceed the limit of in-flight requests")
+	}
+	if pr.Next.Index != 14 {
+		t.Error("Unexpected next sequence:", pr.Next)
+	}
+
+	pr.Acked(RaftSequence{Term: 1, Index: 12})
+	if len(pr.inflights) != 2 || pr.inflightBytes != 20 || pr.Match.Index != 12 {
+		t.Error("Acked requests should be released:", pr)
+	}
+
+	// The limit of bytes also applies.
+	pr.Sent(RaftSequence{Term: 1, Index: 15}, 1000)
+	if pr.CanSend(now, 4, 1000) {
+		t.Error("Should not exceed the limit of in-flight bytes")
+	}
+
+	// Abandoned requests are forgotten.
+	generation := pr.generation
+	pr.BecomeProbe(RaftSequence{Term: 1, Index: 11})
+	if pr.State != PROGRESS_PROBE || pr.generation == generation ||
+		len(pr.inflights) != 0 || pr.inflightBytes != 0 {
+		t.Error("Should abandon in-flight requests:", pr)
+	}
+}
+
+func TestProgressRetryAndSnapshot(t *testing.T) {
+	now := time.Now()
+	pr := NewProgress(RaftSequence{Term: 1, Index: 10})
+	pr.Sent(RaftSequence{Term: 1, Index: 10}, 0)
+	pr.Acked(RaftSequence{Term: 1, Index: 10})
+	pr.Sent(RaftSequence{Term: 1, Index: 12}, 10)
+
+	// A failed request restarts probing from the last record sent. The
+	// member may have the records although the reply is lost.
+	pr.Retry(now.Add(time.Hour))
+	if pr.State != PROGRESS_PROBE || pr.Next.Index != 12 || pr.Match.Index != 10 {
+		t.Error("Should probe from the last record sent:", pr)
+	}
+	if pr.CanSend(now, 4, 1000) {
+		t.Error("Should pause after a failure")
+	}
+
+	pr.BecomeSnapshot()
+	if pr.CanSend(now, 4, 1000) {
+		t.Error("Should not send while installing a snapshot")
+	}
+
+	// Replies to regular requests do not end a snapshot.
+	pr.Acked(RaftSequence{Term: 1, Index: 11})
+	if pr.State != PROGRESS_SNAPSHOT {
+		t.Error("Should wait for the snapshot")
+	}
+
+	pr.SnapshotInstalled(RaftSequence{Term: 2, Index: 20})
+	if pr.State != PROGRESS_REPLICATE || pr.Next.Index != 20 || pr.Match.Index != 20 {
+		t.Error("Should replicate after the snapshot:", pr)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"lbase/balancer"
+)
+
+// A RaftConfiguration describes the membership of a raft quorum.
+// Membership is changed one server at a time. A new server always joins
+// as a learner, which receives the log but does not vote. Once the learner
+// has caught up with the leader, the leader promotes it to a voter.
+
+type RaftConfiguration struct {
+	// Members that vote in elections and count towards commit majority.
+	Voters []balancer.ServerName
+	// Members that replicate the log but do not vote.
+	Learners []balancer.ServerName
+}
+
+// Parse a slice to get a raft configuration.
+func NewRaftConfiguration(msg []byte) (ret *RaftConfiguration, err error) {
+	ret = &RaftConfiguration{}
+	b := bytes.NewBuffer(msg)
+	dec := gob.NewDecoder(b)
+	err = dec.Decode(ret)
+	return
+}
+
+// Serialize a raft configuration into a slice.
+func (c *RaftConfiguration) ToSlice() []byte {
+	var b bytes.Buffer
+	enc := gob.NewEncoder(&b)
+	err := enc.Encode(c)
+	var res []byte
+	if err == nil {
+		res = b.Bytes()
+	}
+	return res
+}
+
+func (c *RaftConfiguration) IsVoter(sn balancer.ServerName) bool {
+	for _, v := range c.Voters {
+		if v == sn {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *RaftConfiguration) IsLearner(sn balancer.ServerName) bool {
+	for _, l := range c.Learners {
+		if l == sn {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *RaftConfiguration) IsMember(sn balancer.ServerName) bool {
+	return c.IsVoter(sn) || c.IsLearner(sn)
+}
+
+// Return all voters and learners.
+func (c *RaftConfiguration) GetMembers() []balancer.ServerName {
+	ret := make([]balancer.ServerName, 0, len(c.Voters)+len(c.Learners))
+	ret = append(ret, c.Voters...)
+	ret = append(ret, c.Learners...)
+	return ret
+}
+
+// Check if both configurations have the same voters and learners.
+func (c *RaftConfiguration) SameMembers(other *RaftConfiguration) bool {
+	if len(c.Voters) != len(other.Voters) || len(c.Learners) != len(other.Learners) {
+		return false
+	}
+	for _, sn := range c.Voters {
+		if !other.IsVoter(sn) {
+			return false
+		}
+	}
+	for _, sn := range c.Learners {
+		if !other.IsLearner(sn) {
+			return false
+		}
+	}
+	return true
+}
+
+// The number of votes needed to elect a leader or commit a record.
+func (c *RaftConfiguration) Quorum() int {
+	return len(c.Voters)/2 + 1
+}
+
+// Return a copy of the configuration with @sn added as a learner.
+func (c *RaftConfiguration) WithLearner(sn balancer.ServerName) RaftConfiguration {
+	ret := c.Clone()
+	ret.Learners = append(ret.Learners, sn)
+	return ret
+}
+
+// Return a copy of the configuration with learner @sn turned into a voter.
+func (c *RaftConfiguration) WithVoter(sn balancer.ServerName) RaftConfiguration {
+	ret := c.Without(sn)
+	ret.Voters = append(ret.Voters, sn)
+	return ret
+}
+
+// Return a copy of the configuration with @sn removed.
+func (c *RaftConfiguration) Without(sn balancer.ServerName) RaftConfiguration {
+	var ret RaftConfiguration
+	for _, v := range c.Voters {
+		if v != sn {
+			ret.Voters = append(ret.Voters, v)
+		}
+	}
+	for _, l := range c.Learners {
+		if l != sn {
+			ret.Learners = append(ret.Learners, l)
+		}
+	}
+	return ret
+}
+
+func (c *RaftConfiguration) Clone() RaftConfiguration {
+	var ret RaftConfiguration
+	ret.Voters = append(ret.Voters, c.Voters...)
+	ret.Learners = append(ret.Learners, c.Learners...)
+	return ret
+}
@@ -0,0 +1,82 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"lbase/balancer"
+	"testing"
+)
+
+func TestRaftConfigurationSerDeser(t *testing.T) {
+	config := RaftConfiguration{
+		Voters:   []balancer.ServerName{{Host: "a"}, {Host: "b"}},
+		Learners: []balancer.ServerName{{Host: "c"}},
+	}
+
+	newConfig, err := NewRaftConfiguration(config.ToSlice())
+	if err != nil {
+		t.Error("Fails to parse configuration:", err)
+	}
+
+	if len(newConfig.Voters) != 2 || len(newConfig.Learners) != 1 {
+		t.Error("configuration mismatch:", newConfig)
+	}
+}
+
+func TestRaftConfigurationChanges(t *testing.T) {
+	a := balancer.ServerName{Host: "a"}
+	b := balancer.ServerName{Host: "b"}
+	c := balancer.ServerName{Host: "c"}
+
+	config := RaftConfiguration{Voters: []balancer.ServerName{a, b}}
+	if config.Quorum() != 2 {
+		t.Error("Unexpected quorum:", config.Quorum())
+	}
+
+	added := config.WithLearner(c)
+	if !added.IsLearner(c) || added.IsVoter(c) {
+		t.Error("c should be a learner")
+	}
+	if added.Quorum() != 2 {
+		t.Error("learners should not count towards quorum")
+	}
+	if config.IsMember(c) {
+		t.Error("original configuration should not change")
+	}
+
+	promoted := added.WithVoter(c)
+	if !promoted.IsVoter(c) || promoted.IsLearner(c) {
+		t.Error("c should be a voter")
+	}
+	if promoted.Quorum() != 2 || len(promoted.GetMembers()) != 3 {
+		t.Error("Unexpected members:", promoted)
+	}
+
+	removed := promoted.Without(a)
+	if removed.IsMember(a) || len(removed.Voters) != 2 {
+		t.Error("a should be removed:", removed)
+	}
+}
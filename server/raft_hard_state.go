@@ -0,0 +1,63 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"lbase/balancer"
+)
+
+// Raft states that must survive a restart. Without them, a restarted
+// server may vote twice in the same term, or accept a leader of a term
+// that it has already seen replaced.
+type RaftHardState struct {
+	// The biggest term that has been seen.
+	Term int64
+	// Maps voting history for each of term.
+	Votes map[int64]balancer.ServerName
+}
+
+// Parse a slice to get a hard state.
+func NewRaftHardState(msg []byte) (ret *RaftHardState, err error) {
+	ret = &RaftHardState{}
+	b := bytes.NewBuffer(msg)
+	dec := gob.NewDecoder(b)
+	err = dec.Decode(ret)
+	return
+}
+
+// Serialize a hard state into a slice.
+func (h *RaftHardState) ToSlice() []byte {
+	var b bytes.Buffer
+	enc := gob.NewEncoder(&b)
+	err := enc.Encode(h)
+	var res []byte
+	if err == nil {
+		res = b.Bytes()
+	}
+	return res
+}
@@ -0,0 +1,263 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"lbase/balancer"
+	"lbase/db"
+	"os"
+)
+
+// Tags of key spaces in a RaftLogEngine.
+const (
+	LOG_ENGINE_TAG_LOG   = 'L'
+	LOG_ENGINE_TAG_QUEUE = 'Q'
+)
+
+// A db shared by raft logs and edit queues of all regions on a server.
+// Keys of a region are prefixed with the region, so that regions never
+// see each other's keys.
+type RaftLogEngine struct {
+	db db.Db
+}
+
+func NewRaftLogEngine(path string) (ret *RaftLogEngine, err error) {
+	os.MkdirAll(path, os.ModePerm)
+
+	dbopts := db.NewDbOptions()
+	dbopts.SetCreateIfMissing(1)
+
+	store, openError := db.OpenDb(dbopts, path)
+	if openError != nil {
+		err = openError
+		return
+	}
+
+	ret = &RaftLogEngine{db: store}
+	return
+}
+
+// Return the raft log of a region.
+func (e *RaftLogEngine) GetLog(r balancer.Region) *RaftLog {
+	return &RaftLog{
+		db:     e.db,
+		prefix: regionKeyPrefix(LOG_ENGINE_TAG_LOG, r),
+		wrOpts: db.NewWriteOptions(),
+		rdOpts: db.NewReadOptions(),
+	}
+}
+
+// Return the edit queue of a region.
+func (e *RaftLogEngine) GetEditQueue(r balancer.Region) *EditQueue {
+	prefix := regionKeyPrefix(LOG_ENGINE_TAG_QUEUE, r)
+	return newSharedEditQueue(e.db, string(prefix))
+}
+
+func (e *RaftLogEngine) Close() {
+	e.db.Close()
+}
+
+// Build the key prefix of a region. Both keys of the region are led by
+// their lengths, so a prefix is never a prefix of another one.
+func regionKeyPrefix(tag byte, r balancer.Region) []byte {
+	buf := bytes.NewBuffer([]byte{tag})
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+
+	for _, key := range []string{r.StartKey, r.EndKey} {
+		n := binary.PutUvarint(lenBuf, uint64(len(key)))
+		buf.Write(lenBuf[:n])
+		buf.WriteString(key)
+	}
+	return buf.Bytes()
+}
+
+// Return the smallest key that is bigger than all keys with @prefix.
+// Return nil if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// The raft log of a region. It either has a db of its own, or lives in
+// a RaftLogEngine with other regions.
+type RaftLog struct {
+	db     db.Db
+	prefix []byte
+	// Set if the db belongs to this log only.
+	owned  bool
+	wrOpts db.WriteOptions
+	rdOpts db.ReadOptions
+}
+
+// Open a raft log that has a db of its own.
+func OpenRaftLog(path string) (ret *RaftLog, err error) {
+	dbopts := db.NewDbOptions()
+	dbopts.SetCreateIfMissing(1)
+
+	store, openError := db.OpenDb(dbopts, path)
+	if openError != nil {
+		err = openError
+		return
+	}
+
+	ret = &RaftLog{
+		db:     store,
+		owned:  true,
+		wrOpts: db.NewWriteOptions(),
+		rdOpts: db.NewReadOptions(),
+	}
+	return
+}
+
+func (l *RaftLog) withPrefix(key []byte) []byte {
+	ret := make([]byte, 0, len(l.prefix)+len(key))
+	ret = append(ret, l.prefix...)
+	return append(ret, key...)
+}
+
+func (l *RaftLog) Get(opts db.ReadOptions, key []byte) ([]byte, error) {
+	return l.db.Get(opts, l.withPrefix(key))
+}
+
+func (l *RaftLog) Put(opts db.WriteOptions, key, val []byte) error {
+	return l.db.Put(opts, l.withPrefix(key), val)
+}
+
+func (l *RaftLog) NewBatch() RaftLogBatch {
+	return RaftLogBatch{log: l, batch: db.NewWriteBatch()}
+}
+
+func (l *RaftLog) Write(opts db.WriteOptions, batch RaftLogBatch) error {
+	return l.db.Write(opts, batch.batch)
+}
+
+func (l *RaftLog) CreateIterator(opts db.ReadOptions) *RaftLogIterator {
+	return &RaftLogIterator{log: l, iter: l.db.CreateIterator(opts)}
+}
+
+// Remove all records of the log.
+func (l *RaftLog) Clear() {
+	iter := l.CreateIterator(l.rdOpts)
+	defer iter.Destroy()
+
+	batch := l.NewBatch()
+	defer batch.Destroy()
+
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	l.Write(l.wrOpts, batch)
+}
+
+// Close the db if the log owns it. A shared db is closed with its engine.
+func (l *RaftLog) Close() {
+	if l.owned {
+		l.db.Close()
+	}
+}
+
+type RaftLogBatch struct {
+	log   *RaftLog
+	batch db.WriteBatch
+}
+
+func (b RaftLogBatch) Put(key, val []byte) {
+	b.batch.Put(b.log.withPrefix(key), val)
+}
+
+func (b RaftLogBatch) Delete(key []byte) {
+	b.batch.Delete(b.log.withPrefix(key))
+}
+
+func (b RaftLogBatch) Destroy() {
+	b.batch.Destroy()
+}
+
+// Iterates over records of a single log. Keys are returned without
+// the prefix of the log.
+type RaftLogIterator struct {
+	log  *RaftLog
+	iter db.Iterator
+}
+
+func (it *RaftLogIterator) Destroy() {
+	it.iter.Destroy()
+}
+
+func (it *RaftLogIterator) Valid() bool {
+	return it.iter.Valid() && bytes.HasPrefix(it.iter.Key(), it.log.prefix)
+}
+
+func (it *RaftLogIterator) SeekToFirst() {
+	if len(it.log.prefix) == 0 {
+		it.iter.SeekToFirst()
+		return
+	}
+	it.iter.Seek(it.log.prefix)
+}
+
+func (it *RaftLogIterator) SeekToLast() {
+	end := prefixEnd(it.log.prefix)
+	if end == nil {
+		it.iter.SeekToLast()
+		return
+	}
+
+	it.iter.Seek(end)
+	if it.iter.Valid() {
+		it.iter.Prev()
+	} else {
+		it.iter.SeekToLast()
+	}
+}
+
+func (it *RaftLogIterator) Seek(key []byte) {
+	it.iter.Seek(it.log.withPrefix(key))
+}
+
+func (it *RaftLogIterator) Next() {
+	it.iter.Next()
+}
+
+func (it *RaftLogIterator) Prev() {
+	it.iter.Prev()
+}
+
+func (it *RaftLogIterator) Key() []byte {
+	return it.iter.Key()[len(it.log.prefix):]
+}
+
+func (it *RaftLogIterator) Value() []byte {
+	return it.iter.Value()
+}
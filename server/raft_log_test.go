@@ -0,0 +1,114 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"lbase/balancer"
+	"lbase/db"
+	"os"
+	"testing"
+)
+
+func TestRaftLogEngineIsolatesRegions(t *testing.T) {
+	root := "/tmp/TestRaftLogEngineIsolatesRegions"
+	os.RemoveAll(root)
+
+	engine, err := NewRaftLogEngine(root)
+	if err != nil {
+		t.Fatal("Fails to open log engine", err)
+	}
+	defer engine.Close()
+
+	// The start key of r2 is the end key of r1.
+	r1 := balancer.Region{StartKey: "a", EndKey: "m"}
+	r2 := balancer.Region{StartKey: "m", EndKey: "z"}
+	l1 := engine.GetLog(r1)
+	l2 := engine.GetLog(r2)
+
+	wrOpts := db.NewWriteOptions()
+	rdOpts := db.NewReadOptions()
+	for i := int64(1); i <= 3; i++ {
+		key := RaftSequence{Term: 1, Index: i}.AsKey()
+		l1.Put(wrOpts, key, []byte("r1"))
+		if i < 3 {
+			l2.Put(wrOpts, key, []byte("r2"))
+		}
+	}
+
+	count := func(l *RaftLog, val string) (n int) {
+		iter := l.CreateIterator(rdOpts)
+		defer iter.Destroy()
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			if string(iter.Value()) != val {
+				t.Error("Sees a record of another region")
+			}
+			n++
+		}
+		return
+	}
+
+	if count(l1, "r1") != 3 || count(l2, "r2") != 2 {
+		t.Error("Fails to count records of regions")
+	}
+
+	iter := l2.CreateIterator(rdOpts)
+	iter.SeekToLast()
+	if !iter.Valid() {
+		t.Error("Fails to find the last record")
+	} else if seq, _ := NewRaftSequenceFromKey(iter.Key()); seq.Index != 2 {
+		t.Error("Finds a wrong last record", seq)
+	}
+	iter.Destroy()
+
+	l2.Clear()
+	if count(l1, "r1") != 3 || count(l2, "r2") != 0 {
+		t.Error("Clear affects another region")
+	}
+
+	q1 := engine.GetEditQueue(r1)
+	q2 := engine.GetEditQueue(r2)
+	q1.AppendEdit([]byte("hello"))
+	q1.AppendEdit([]byte("world"))
+	q2.AppendEdit([]byte("edit"))
+
+	if q1.GetFirstSequence() != 1 || q1.GetLastSequence() != 2 {
+		t.Error("Incorrect sequences of the first queue")
+	}
+	if q2.GetFirstSequence() != 1 || q2.GetLastSequence() != 1 {
+		t.Error("Incorrect sequences of the second queue")
+	}
+
+	res, _ := q2.GetN(1, 10)
+	if len(res) != 1 || string(res[0]) != "edit" {
+		t.Error("Sees edits of another queue")
+	}
+
+	// Queues do not own the shared db.
+	q1.Close()
+	if q2.GetLastSequence() != 1 {
+		t.Error("Closing a queue affects another queue")
+	}
+}
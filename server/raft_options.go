@@ -28,6 +28,7 @@ package server
 import (
 	"fmt"
 	"lbase/balancer"
+	"math/rand"
 )
 
 type RaftOptions struct {
@@ -46,29 +47,84 @@ type RaftOptions struct {
 	RequestVoteTimeoutMs int64
 	// Timeout value for leader.
 	RaftLeaderTimeoutMs int64
+	// How long a leader waits for a leadership transfer to complete
+	// before it gives up and accepts new writes again.
+	LeaderTransferTimeoutMs int64
+	// How long a leader waits for the region on its right to freeze and
+	// catch up before it gives up merging the region.
+	MergeTimeoutMs int64
 	// HTTP RPC path prefix.
 	RPCPrefix string
 	// If this is nil, RaftStates will create one.
 	EditQueue *EditQueue
 	// If this is nil, RaftStates will create one.
 	Collector *EditCollector
+	// A learner is promoted to voter once it falls behind the leader's
+	// commit sequence by no more than this number of records.
+	LearnerCatchUpLag int64
+	// If set, a candidate first checks that it could win an election
+	// before it starts a real one, and members refuse to vote while they
+	// still hear from a leader. This prevents a member that comes back
+	// from a partition from deposing a healthy leader.
+	PreVote bool
+	// If set, a leader steps down if it does not hear from a majority of
+	// voters within twice the leader timeout.
+	CheckQuorum bool
+	// Connects to other members. If this is nil, HTTPTransport is used.
+	Transport Transport
+	// Default staleness bound of stale reads.
+	MaxStaleReadMs int64
+	// How often a leader sends heartbeats. If it is 0, a quarter of the
+	// leader timeout is used.
+	HeartbeatIntervalMs int64
+	// Limits of records and bytes in a single AppendEntries.
+	MaxAppendEntries int
+	MaxAppendBytes   int64
+	// Limits of in-flight AppendEntries and their bytes to a member that
+	// is in sync with the leader.
+	MaxInflightAppends int
+	MaxInflightBytes   int64
+	// Size of a chunk of a snapshot. If it is 0, 4MB is used.
+	SnapshotChunkBytes int64
+	// How fast a leader sends a snapshot to a member. If it is 0, a
+	// snapshot is sent as fast as possible.
+	SnapshotBytesPerSec int64
+	// Source of time. If this is nil, RealClock is used.
+	Clock Clock
+	// If set, it is notified of leader elections and commits.
+	Observer RaftObserver
+	// If set, the region is served by a multi-raft layer. Its log and edit
+	// queue are kept in the shared log engine, its heartbeats are merged
+	// with those of other regions, and it goes quiescent when it is idle.
+	MultiRaft *MultiRaft
+	// Source of randomness. If this is nil, one seeded with current time
+	// is used. It is only accessed with the raft states locked.
+	Rand *rand.Rand
 }
 
 func DefaultRaftOptions(root string) *RaftOptions {
 	return &RaftOptions{
-		RaftRoot:             root,
-		CandidateWaitMs:      4000,
-		RequestVoteTimeoutMs: 2000,
-		RaftLeaderTimeoutMs:  60000,
+		RaftRoot:                root,
+		CandidateWaitMs:         4000,
+		RequestVoteTimeoutMs:    2000,
+		RaftLeaderTimeoutMs:     60000,
+		LeaderTransferTimeoutMs: 120000,
+		MergeTimeoutMs:          120000,
+		MaxStaleReadMs:          120000,
+		SnapshotBytesPerSec:     32 << 20,
 	}
 }
 
 func RaftOptionsForTest(root string) *RaftOptions {
 	return &RaftOptions{
-		RaftRoot:             root,
-		CandidateWaitMs:      800,
-		RequestVoteTimeoutMs: 400,
-		RaftLeaderTimeoutMs:  200,
+		RaftRoot:                root,
+		CandidateWaitMs:         800,
+		RequestVoteTimeoutMs:    400,
+		RaftLeaderTimeoutMs:     200,
+		LeaderTransferTimeoutMs: 2000,
+		MergeTimeoutMs:          2000,
+		MaxStaleReadMs:          1000,
+		SnapshotChunkBytes:      1024,
 	}
 }
 
@@ -79,3 +135,19 @@ func (opts *RaftOptions) GetLogDir() string {
 func (opts *RaftOptions) GetEditQueueDir() string {
 	return fmt.Sprintf("%s/editq", opts.RaftRoot)
 }
+
+func (opts *RaftOptions) GetConfigPath() string {
+	return fmt.Sprintf("%s/config", opts.RaftRoot)
+}
+
+func (opts *RaftOptions) GetHardStatePath() string {
+	return fmt.Sprintf("%s/hardstate", opts.RaftRoot)
+}
+
+func (opts *RaftOptions) GetRegionStatePath() string {
+	return fmt.Sprintf("%s/region", opts.RaftRoot)
+}
+
+func (opts *RaftOptions) GetSnapshotStatePath() string {
+	return fmt.Sprintf("%s/snapshot", opts.RaftRoot)
+}
@@ -28,11 +28,37 @@ package server
 import (
 	"bytes"
 	"encoding/gob"
+	"lbase/balancer"
+	"strconv"
+)
+
+const (
+	// A record that carries a key value mutation.
+	RAFT_RECORD_DATA = iota
+	// A record that carries a new quorum configuration in its value.
+	RAFT_RECORD_CONFIG
+	// A record that carries nothing. A new leader appends one so that
+	// records from previous terms can be committed.
+	RAFT_RECORD_NOOP
+	// A record that adds a number in its value to the counter at its key.
+	RAFT_RECORD_INCREMENT
+	// A record that splits the region at its key. Keys from it on move
+	// to a new region.
+	RAFT_RECORD_SPLIT
+	// A record that stops the region from accepting writes, so that it
+	// can be merged into the region on its left.
+	RAFT_RECORD_FREEZE
+	// A record that lets a frozen region accept writes again.
+	RAFT_RECORD_THAW
+	// A record that merges the frozen region in its value into this one.
+	RAFT_RECORD_MERGE
 )
 
 type RaftRecord struct {
 	Key   []byte
 	Value []byte
+	// One of RAFT_RECORD_* values.
+	Type int
 }
 
 // Parse a slice to store a raft record.
@@ -44,6 +70,70 @@ func NewRaftRecord(msg []byte) (ret *RaftRecord, err error) {
 	return
 }
 
+// Create a record that changes the quorum configuration.
+func NewConfigRaftRecord(config *RaftConfiguration) *RaftRecord {
+	return &RaftRecord{
+		Value: config.ToSlice(),
+		Type:  RAFT_RECORD_CONFIG,
+	}
+}
+
+// Create a record that adds @delta to the counter at @key.
+func NewIncrementRaftRecord(key []byte, delta int64) *RaftRecord {
+	return &RaftRecord{
+		Key:   key,
+		Value: []byte(strconv.FormatInt(delta, 10)),
+		Type:  RAFT_RECORD_INCREMENT,
+	}
+}
+
+// Create a record that splits the region at @key.
+func NewSplitRaftRecord(key []byte) *RaftRecord {
+	return &RaftRecord{
+		Key:  key,
+		Type: RAFT_RECORD_SPLIT,
+	}
+}
+
+// Create a record that freezes the region.
+func NewFreezeRaftRecord() *RaftRecord {
+	return &RaftRecord{Type: RAFT_RECORD_FREEZE}
+}
+
+// Create a record that thaws a frozen region.
+func NewThawRaftRecord() *RaftRecord {
+	return &RaftRecord{Type: RAFT_RECORD_THAW}
+}
+
+// What a merge record carries.
+type RaftMerge struct {
+	// The region on the right that is merged.
+	Region balancer.Region
+	// The freeze record of the region. Members of this region merge once
+	// their replicas of the region have committed it.
+	FrozenSequence RaftSequence
+}
+
+// Create a record that merges region @right, which has been frozen at
+// @frozen.
+func NewMergeRaftRecord(right balancer.Region, frozen RaftSequence) *RaftRecord {
+	var b bytes.Buffer
+	gob.NewEncoder(&b).Encode(&RaftMerge{Region: right, FrozenSequence: frozen})
+	return &RaftRecord{
+		Value: b.Bytes(),
+		Type:  RAFT_RECORD_MERGE,
+	}
+}
+
+// Parse the value of a merge record.
+func NewRaftMerge(msg []byte) (ret *RaftMerge, err error) {
+	ret = &RaftMerge{}
+	b := bytes.NewBuffer(msg)
+	dec := gob.NewDecoder(b)
+	err = dec.Decode(ret)
+	return
+}
+
 // Serialize a raft record into a slice.
 func (r *RaftRecord) ToSlice() []byte {
 	var b bytes.Buffer
@@ -0,0 +1,73 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"lbase/balancer"
+)
+
+// Key range of a region replica. It is saved once the region splits or
+// merges, so that a restarted replica serves the range that it has
+// changed to.
+type RaftRegionState struct {
+	// Current key range of the region.
+	Region balancer.Region
+	// Sequence of the committed freeze record if the region is frozen.
+	FrozenSequence RaftSequence
+	// Key range of the region when the replica was created. Keys of the
+	// replica in a shared log engine are prefixed with it, so it never
+	// changes.
+	LogRegion balancer.Region
+}
+
+// Parse a slice to get a region state.
+func NewRaftRegionState(msg []byte) (ret *RaftRegionState, err error) {
+	ret = &RaftRegionState{}
+	b := bytes.NewBuffer(msg)
+	dec := gob.NewDecoder(b)
+	err = dec.Decode(ret)
+	return
+}
+
+// Serialize a region state into a slice.
+func (r *RaftRegionState) ToSlice() []byte {
+	var b bytes.Buffer
+	enc := gob.NewEncoder(&b)
+	err := enc.Encode(r)
+	var res []byte
+	if err == nil {
+		res = b.Bytes()
+	}
+	return res
+}
+
+// Check if @key falls into region @r.
+func RegionContainsKey(r balancer.Region, key []byte) bool {
+	k := string(key)
+	return k >= r.StartKey && (r.EndKey == "" || k < r.EndKey)
+}
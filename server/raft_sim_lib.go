@@ -0,0 +1,731 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+// This file contains a raft quorum that runs on simulated time and network,
+// and a randomized driver that checks safety invariants of raft.
+
+import (
+	"bytes"
+	"fmt"
+	"lbase/balancer"
+	"math/rand"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Checks invariants that hold over the whole history of a quorum:
+// (1) Election safety: at most one leader is elected in a term;
+// (2) State machine safety: members commit the same record at an index.
+// It is notified by each member of the quorum.
+type SafetyChecker struct {
+	mutex      sync.Mutex
+	leaders    map[int64]balancer.ServerName
+	commits    map[int64]RaftSequence
+	records    map[int64][]byte
+	violations []string
+}
+
+func NewSafetyChecker() *SafetyChecker {
+	return &SafetyChecker{
+		leaders: make(map[int64]balancer.ServerName),
+		commits: make(map[int64]RaftSequence),
+		records: make(map[int64][]byte),
+	}
+}
+
+// Part of RaftObserver interface.
+func (c *SafetyChecker) BecomeLeader(sn balancer.ServerName, term int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	leader, found := c.leaders[term]
+	if found && leader != sn {
+		c.report("two leaders %v and %v in term %d", leader, sn, term)
+	}
+	c.leaders[term] = sn
+}
+
+// Part of RaftObserver interface.
+func (c *SafetyChecker) Commit(sn balancer.ServerName, seq RaftSequence, record []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	old, found := c.commits[seq.Index]
+	if !found {
+		c.commits[seq.Index] = seq
+		c.records[seq.Index] = record
+		return
+	}
+
+	if old != seq || !bytes.Equal(c.records[seq.Index], record) {
+		c.report("%v commits %v at index %d, but %v was committed",
+			sn, seq, seq.Index, old)
+	}
+}
+
+// Return the number of committed records that have been checked.
+func (c *SafetyChecker) NumCommits() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.commits)
+}
+
+// Return sequences of committed records, ordered by their indexes.
+func (c *SafetyChecker) Commits() []RaftSequence {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var indexes []int
+	for index, _ := range c.commits {
+		indexes = append(indexes, int(index))
+	}
+	sort.Ints(indexes)
+
+	ret := make([]RaftSequence, 0, len(indexes))
+	for _, index := range indexes {
+		ret = append(ret, c.commits[int64(index)])
+	}
+	return ret
+}
+
+// Return descriptions of all violations found so far.
+func (c *SafetyChecker) Violations() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.violations...)
+}
+
+func (c *SafetyChecker) report(format string, args ...interface{}) {
+	c.violations = append(c.violations, fmt.Sprintf(format, args...))
+}
+
+// A raft quorum whose members talk through a SimNetwork and run on
+// a SimClock. Members keep their data on disk, so they can be crashed
+// and restarted.
+type SimCluster struct {
+	root    string
+	region  balancer.Region
+	seed    int64
+	Clock   *SimClock
+	Network *SimNetwork
+	Checker *SafetyChecker
+	Names   []balancer.ServerName
+	// Current incarnation of each member. Nil if the member is down.
+	States  []*RaftStates
+	servers []*Server
+	// Customizes options of each member.
+	setup func(opts *RaftOptions)
+	// Number of restarts, used to derive seeds of members.
+	restarts int64
+	// Number of members that the quorum starts with. Servers added later
+	// start without any region.
+	members int
+	// Number of regions opened through region factories.
+	opened int
+	// Operations issued by clients on registers and counters.
+	Registers *History
+	Counters  *History
+	// Names of clients, which are partitioned along with members.
+	clientNames []balancer.ServerName
+	clients     sync.WaitGroup
+	mutex       sync.Mutex
+	stopping    bool
+}
+
+// Create a quorum of @num members, and start all of them. All random
+// decisions are derived from @seed.
+func NewSimCluster(
+	root string,
+	num int,
+	seed int64,
+	setup func(opts *RaftOptions)) *SimCluster {
+
+	clock := NewSimClock()
+	c := &SimCluster{
+		root:      root,
+		seed:      seed,
+		Clock:     clock,
+		Network:   NewSimNetwork(clock, seed),
+		Checker:   NewSafetyChecker(),
+		Registers: NewHistory(),
+		Counters:  NewHistory(),
+		States:    make([]*RaftStates, num),
+		servers:   make([]*Server, num),
+		setup:     setup,
+		members:   num,
+	}
+
+	// Each member runs on a host of its own, as a balancer expects.
+	for i := 0; i < num; i++ {
+		sn := balancer.ServerName{Host: fmt.Sprintf("sim%d", i+1), Port: i + 1}
+		c.Names = append(c.Names, sn)
+	}
+
+	for i := 0; i < num; i++ {
+		c.start(i, true)
+	}
+	return c
+}
+
+func (c *SimCluster) start(i int, recreate bool) {
+	name := fmt.Sprintf("%s/%d", c.root, i)
+	store := initRaftStorageForTest(name, c.region, recreate)
+
+	states := NewRaftStates(c.raftOptions(i, store, c.Names[:c.members]), store)
+	server := c.newServer(i)
+	server.RegisterRegion(store.GetRegion(), states)
+
+	c.States[i] = states
+	c.servers[i] = server
+	c.Network.AddServer(c.Names[i], server)
+	states.TransitToFollower()
+
+	// Members start one by one, so that their timers are created in the
+	// same order on every run.
+	c.waitIdle()
+}
+
+// Options of a replica on server @i of a region whose initial quorum is
+// @members.
+func (c *SimCluster) raftOptions(
+	i int,
+	store *RaftStorage,
+	members []balancer.ServerName) *RaftOptions {
+
+	c.restarts++
+	opts := store.GetRaftOptions()
+	opts.Address = c.Names[i]
+	opts.Members = members
+	opts.Clock = c.Clock
+	opts.Transport = c.Network.Transport(c.Names[i])
+	opts.Observer = c.Checker
+	opts.Rand = rand.New(rand.NewSource(c.seed*1000 + c.restarts))
+	if c.setup != nil {
+		c.setup(opts)
+	}
+	return opts
+}
+
+// Create server @i, which opens regions placed on it under its root.
+func (c *SimCluster) newServer(i int) *Server {
+	server := NewLocalServer()
+	server.SetRegionFactory(func(
+		r balancer.Region, members []balancer.ServerName) (*RaftStates, error) {
+
+		c.mutex.Lock()
+		c.opened++
+		name := fmt.Sprintf("%s/%d/region-%d", c.root, i, c.opened)
+		c.mutex.Unlock()
+
+		store := initRaftStorageForTest(name, r, true)
+		opts := c.raftOptions(i, store, members)
+		if r != c.region {
+			// The checker follows a single quorum.
+			opts.Observer = nil
+		}
+		return NewRaftStates(opts, store), nil
+	})
+	return server
+}
+
+// Add a server that does not serve any region. Return its index.
+func (c *SimCluster) AddServer() int {
+	i := len(c.Names)
+	sn := balancer.ServerName{Host: fmt.Sprintf("sim%d", i+1), Port: i + 1}
+	c.Names = append(c.Names, sn)
+	c.States = append(c.States, nil)
+
+	server := c.newServer(i)
+	c.servers = append(c.servers, server)
+	c.Network.AddServer(sn, server)
+	return i
+}
+
+// Stop a member abruptly. Its data on disk is kept.
+func (c *SimCluster) Crash(i int) {
+	if c.servers[i] == nil {
+		return
+	}
+
+	c.Network.RemoveServer(c.Names[i])
+	c.waitIdle()
+	c.servers[i].UnregisterRegions()
+	c.servers[i].Close()
+	c.States[i] = nil
+	c.servers[i] = nil
+	c.waitIdle()
+}
+
+// Start a member that has crashed from its data on disk. Servers added
+// by AddServer are not restarted.
+func (c *SimCluster) Restart(i int) {
+	if c.servers[i] != nil || i >= c.members {
+		return
+	}
+	c.start(i, false)
+}
+
+func (c *SimCluster) Close() {
+	for i, _ := range c.servers {
+		c.Crash(i)
+	}
+}
+
+// Advance simulated time by @d.
+func (c *SimCluster) Run(d time.Duration) {
+	RunSimulation(c.Clock, c.Network, d)
+}
+
+func (c *SimCluster) waitIdle() {
+	waitSimIdle()
+}
+
+// Advance simulated time by @d, one step at a time. A step fires the next
+// timer, which wakes up a member, a client or an RPC handler, or delivers
+// a message, and lasts until every goroutine that it wakes up blocks
+// again. Goroutines run on one processor meanwhile. Messages sent in a
+// step are routed before the next step, so steps and fates of messages
+// follow the same order on every run.
+func RunSimulation(clock *SimClock, network *SimNetwork, d time.Duration) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+
+	target := clock.Now().Add(d)
+	for steps := 1; ; steps++ {
+		waitSimIdle()
+		if steps%SIM_GC_STEPS == 0 {
+			runtime.GC()
+		}
+		network.Flush()
+		if !clock.Step(target) {
+			return
+		}
+	}
+}
+
+// How many times goroutines are checked before a step is taken as done
+// anyway, in case a goroutine outside the simulation keeps running.
+const SIM_IDLE_CHECKS = 10000
+
+// How often garbage is collected, in steps.
+const SIM_GC_STEPS = 256
+
+var (
+	simStacksMutex sync.Mutex
+	simStacks      = make([]byte, 1<<16)
+)
+
+// Wait until all goroutines other than this one are blocked, either on
+// simulated time or on each other.
+func waitSimIdle() {
+	simStacksMutex.Lock()
+	defer simStacksMutex.Unlock()
+
+	for i := 0; i < SIM_IDLE_CHECKS; i++ {
+		runtime.Gosched()
+
+		n := runtime.Stack(simStacks, true)
+		if n == len(simStacks) {
+			simStacks = make([]byte, 2*len(simStacks))
+			continue
+		}
+		if !othersRunning(simStacks[:n]) {
+			return
+		}
+	}
+}
+
+// Check if any goroutine in @stacks, other than the first one, which is
+// the caller, is running or about to run.
+func othersRunning(stacks []byte) bool {
+	header := []byte("\ngoroutine ")
+	for {
+		i := bytes.Index(stacks, header)
+		if i < 0 {
+			return false
+		}
+		stacks = stacks[i+len(header):]
+
+		start := bytes.IndexByte(stacks, '[')
+		end := bytes.IndexAny(stacks, ",]")
+		if start < 0 || end < start {
+			return false
+		}
+		switch string(stacks[start+1 : end]) {
+		case "running", "runnable", "syscall", "preempted":
+			return true
+		}
+	}
+}
+
+// Return a member that believes it is the leader of the latest term.
+func (c *SimCluster) Leader() *RaftStates {
+	var leader *RaftStates
+	var term int64
+	for _, states := range c.States {
+		if states == nil {
+			continue
+		}
+
+		states.mutex.Lock()
+		isLeader := states.state == RAFT_LEADER && states.leaderTerm > term
+		if isLeader {
+			leader, term = states, states.leaderTerm
+		}
+		states.mutex.Unlock()
+	}
+	return leader
+}
+
+// Check that logs of all running members match: if two logs have a record
+// with the same sequence, all records before it are the same.
+func (c *SimCluster) CheckLogMatching() []string {
+	type memberLog struct {
+		sn      balancer.ServerName
+		commit  int64
+		records map[int64]RaftSequence
+		data    map[int64][]byte
+	}
+
+	var logs []*memberLog
+	for i, states := range c.States {
+		if states == nil {
+			continue
+		}
+
+		ml := &memberLog{
+			sn:      c.Names[i],
+			records: make(map[int64]RaftSequence),
+			data:    make(map[int64][]byte),
+		}
+
+		states.mutex.Lock()
+		ml.commit = states.db.GetCommitSequence().Index
+		iter := states.db.log.CreateIterator(states.db.rdOpts)
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			seq, keyErr := NewRaftSequenceFromKey(iter.Key())
+			if keyErr != nil {
+				panic("Bad keys in log!")
+			}
+			ml.records[seq.Index] = *seq
+			ml.data[seq.Index] = iter.Value()
+		}
+		iter.Destroy()
+		states.mutex.Unlock()
+
+		logs = append(logs, ml)
+	}
+
+	var violations []string
+	for i := 0; i < len(logs); i++ {
+		for j := i + 1; j < len(logs); j++ {
+			a, b := logs[i], logs[j]
+
+			var common []int
+			for index, _ := range a.records {
+				if _, found := b.records[index]; found {
+					common = append(common, int(index))
+				}
+			}
+			sort.Sort(sort.Reverse(sort.IntSlice(common)))
+
+			matched := false
+			for _, k := range common {
+				index := int64(k)
+				same := a.records[index] == b.records[index]
+				if !matched {
+					matched = same
+					continue
+				}
+
+				// A committed record may have been replaced by a
+				// placeholder after a snapshot, so only compare data of
+				// records that neither member has committed.
+				if !same || (index > a.commit && index > b.commit &&
+					!bytes.Equal(a.data[index], b.data[index])) {
+					violations = append(violations, fmt.Sprintf(
+						"logs of %v and %v differ at index %d: %v vs %v",
+						a.sn, b.sn, index, a.records[index], b.records[index]))
+					break
+				}
+			}
+		}
+	}
+	return violations
+}
+
+// Start @num clients that read and write through the network until
+// StopClients is called.
+func (c *SimCluster) StartClients(num int) {
+	for i := 0; i < num; i++ {
+		sn := balancer.ServerName{Host: "client", Port: i}
+		c.clientNames = append(c.clientNames, sn)
+
+		k := &simKVClient{
+			cluster:   c,
+			id:        i,
+			rand:      rand.New(rand.NewSource(c.seed*1000 - int64(i))),
+			transport: c.Network.Transport(sn),
+		}
+		c.clients.Add(1)
+		go k.run()
+		c.waitIdle()
+	}
+}
+
+// Stop all clients. The quorum keeps running until they have finished
+// their last operations.
+func (c *SimCluster) StopClients() {
+	c.mutex.Lock()
+	c.stopping = true
+	c.mutex.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		c.clients.Wait()
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			c.Run(10 * time.Millisecond)
+		}
+	}
+}
+
+func (c *SimCluster) clientsStopping() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stopping
+}
+
+// Check if histories of clients are linearizable.
+func (c *SimCluster) CheckHistories() []string {
+	violations := CheckLinearizability(NewRegisterModel(), c.Registers.Operations())
+	return append(violations,
+		CheckLinearizability(NewCounterModel(), c.Counters.Operations())...)
+}
+
+// How long a client waits for a reply.
+const SIM_CLIENT_TIMEOUT_MS = 1000
+
+// A client that sends requests to the leader of the quorum, and records
+// them in histories of the cluster.
+type simKVClient struct {
+	cluster   *SimCluster
+	id        int
+	rand      *rand.Rand
+	transport Transport
+	// Index of the member that is believed to be the leader.
+	leader int
+	// Number of writes issued, which makes written values unique.
+	writes int
+}
+
+func (k *simKVClient) run() {
+	defer k.cluster.clients.Done()
+
+	for !k.cluster.clientsStopping() {
+		k.cluster.Clock.Sleep(time.Duration(k.rand.Intn(50)) * time.Millisecond)
+
+		key := fmt.Sprintf("key%d", k.rand.Intn(3))
+		switch k.rand.Intn(4) {
+		case 0:
+			k.writes++
+			value := fmt.Sprintf("%d-%d", k.id, k.writes)
+			k.write(k.cluster.Registers,
+				RegisterInput{Key: key, Write: true, Value: value},
+				&WriteRequest{Key: []byte("register-" + key), Value: []byte(value)})
+		case 1:
+			id := k.cluster.Registers.Invoke(k.id, RegisterInput{Key: key})
+			if reply, ok := k.read([]byte("register-" + key)); ok {
+				k.cluster.Registers.Complete(id,
+					RegisterOutput{Found: reply.Found, Value: string(reply.Value)})
+			} else {
+				k.cluster.Registers.Discard(id)
+			}
+		case 2:
+			delta := int64(k.rand.Intn(10) + 1)
+			k.write(k.cluster.Counters,
+				CounterInput{Key: key, Delta: delta},
+				&WriteRequest{Key: []byte("counter-" + key), Increment: true, Delta: delta})
+		default:
+			id := k.cluster.Counters.Invoke(k.id, CounterInput{Key: key, Read: true})
+			if reply, ok := k.read([]byte("counter-" + key)); ok {
+				value, _ := strconv.ParseInt(string(reply.Value), 10, 64)
+				k.cluster.Counters.Complete(id, value)
+			} else {
+				k.cluster.Counters.Discard(id)
+			}
+		}
+	}
+}
+
+// Send a write to members one by one until one of them accepts it.
+// The write stays pending in the history if its outcome is unknown.
+func (k *simKVClient) write(h *History, input interface{}, req *WriteRequest) {
+	id := h.Invoke(k.id, input)
+	req.Region = k.cluster.region
+
+	for i := 0; i < len(k.cluster.Names); i++ {
+		var reply WriteReply
+		sent, replied := k.call("ServerRPC.Write", req, &reply)
+		if !sent || (replied && reply.NotLeader) {
+			k.leader = (k.leader + 1) % len(k.cluster.Names)
+			continue
+		}
+
+		if replied && reply.Ok {
+			h.Complete(id, nil)
+		}
+		return
+	}
+
+	// No member has accepted the write.
+	h.Discard(id)
+}
+
+// Read a key from members one by one until one of them serves it.
+func (k *simKVClient) read(key []byte) (reply ReadReply, ok bool) {
+	req := ReadRequest{Region: k.cluster.region, Key: key}
+	if k.rand.Intn(2) == 0 {
+		req.Consistency = READ_LEASE
+	}
+
+	for i := 0; i < len(k.cluster.Names); i++ {
+		reply = ReadReply{}
+		_, replied := k.call("ServerRPC.Read", &req, &reply)
+		if replied && reply.Ok {
+			return reply, true
+		}
+		k.leader = (k.leader + 1) % len(k.cluster.Names)
+	}
+	return
+}
+
+// Send a request to the member that is believed to be the leader. @sent
+// is false if the request never leaves the client.
+func (k *simKVClient) call(
+	method string,
+	args interface{},
+	reply interface{}) (sent, replied bool) {
+
+	cli, err := k.transport.Dial(k.cluster.Names[k.leader], "")
+	if err != nil {
+		return
+	}
+	defer cli.Close()
+
+	call := cli.Go(method, args, reply, nil)
+	select {
+	case <-call.Done:
+		return true, call.Error == nil
+	case <-k.cluster.Clock.After(SIM_CLIENT_TIMEOUT_MS * time.Millisecond):
+		return true, false
+	}
+}
+
+// Run a random workload for @steps steps, while injecting random faults.
+// Each step proposes writes, changes faults, partitions, crashes or
+// restarts members, and then runs the quorum for a while. Return
+// violations of safety invariants. @clients clients read and write
+// through the network in the meantime, and their histories are checked
+// for linearizability.
+func (c *SimCluster) RunRandomized(steps, clients int) []string {
+	// Goroutines that steps wake up between runs also run one at a time.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	r := rand.New(rand.NewSource(c.seed))
+	num := len(c.Names)
+	written := 0
+
+	c.StartClients(clients)
+	defer c.StopClients()
+
+	for step := 0; step < steps; step++ {
+		switch action := r.Intn(10); {
+		case action < 4:
+			if leader := c.Leader(); leader != nil {
+				written++
+				record := RaftRecord{
+					Key:   []byte(fmt.Sprintf("key%d", r.Intn(10))),
+					Value: []byte(fmt.Sprintf("value%d", written)),
+				}
+				leader.Propose(&record)
+			}
+		case action < 5:
+			maxDelay := time.Duration(r.Intn(100)) * time.Millisecond
+			c.Network.SetFaults(SimFaults{
+				DropRate:      r.Float64() * 0.2,
+				DuplicateRate: r.Float64() * 0.2,
+				MaxDelay:      maxDelay,
+			})
+		case action < 6:
+			var names, group []balancer.ServerName
+			names = append(names, c.Names...)
+			names = append(names, c.clientNames...)
+			for _, sn := range names {
+				if r.Intn(2) == 0 {
+					group = append(group, sn)
+				}
+			}
+			c.Network.Partition(group)
+		case action < 7:
+			c.Network.Heal()
+		case action < 8:
+			c.Crash(r.Intn(num))
+		default:
+			c.Restart(r.Intn(num))
+		}
+
+		c.Run(time.Duration(r.Intn(200)) * time.Millisecond)
+
+		if violations := c.Checker.Violations(); len(violations) > 0 {
+			return violations
+		}
+	}
+
+	// Repair everything so that members catch up with each other.
+	c.Network.Heal()
+	c.Network.SetFaults(SimFaults{})
+	for i := 0; i < num; i++ {
+		c.Restart(i)
+	}
+	c.Run(3 * time.Second)
+	c.StopClients()
+
+	violations := c.Checker.Violations()
+	violations = append(violations, c.CheckLogMatching()...)
+	return append(violations, c.CheckHistories()...)
+}
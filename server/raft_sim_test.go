@@ -0,0 +1,626 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"flag"
+	"fmt"
+	"lbase/balancer"
+	"log"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	simSeed    = flag.Int64("sim.seed", 0, "Run raft simulation with this seed only")
+	simSteps   = flag.Int("sim.steps", 60, "Number of steps of each raft simulation")
+	simClients = flag.Int("sim.clients", 3, "Number of clients of each raft simulation")
+)
+
+func TestSimClock(t *testing.T) {
+	clock := NewSimClock()
+	start := clock.Now()
+
+	var fired []int
+	clock.AfterFunc(20*time.Millisecond, func() { fired = append(fired, 2) })
+	clock.AfterFunc(10*time.Millisecond, func() { fired = append(fired, 1) })
+	clock.AfterFunc(20*time.Millisecond, func() { fired = append(fired, 3) })
+	ch := clock.After(15 * time.Millisecond)
+	ticker := clock.NewTicker(10 * time.Millisecond)
+
+	clock.Advance(12 * time.Millisecond)
+	if len(fired) != 1 || fired[0] != 1 {
+		t.Error("Unexpected timers fired:", fired)
+	}
+	select {
+	case <-ch:
+		t.Error("Timer fires too early")
+	default:
+	}
+	<-ticker.C()
+
+	clock.Advance(10 * time.Millisecond)
+	if fmt.Sprint(fired) != "[1 2 3]" {
+		t.Error("Timers should fire in order:", fired)
+	}
+	if now := <-ch; now.Sub(start) != 15*time.Millisecond {
+		t.Error("Timer fires at a wrong time:", now.Sub(start))
+	}
+	<-ticker.C()
+
+	ticker.Stop()
+	clock.Advance(time.Second)
+	select {
+	case <-ticker.C():
+		t.Error("Stopped ticker should not fire")
+	default:
+	}
+
+	if clock.Now().Sub(start) != 1022*time.Millisecond {
+		t.Error("Unexpected time:", clock.Now().Sub(start))
+	}
+}
+
+func TestSimNetwork(t *testing.T) {
+	clock := NewSimClock()
+	network := NewSimNetwork(clock, 1)
+
+	a := balancer.ServerName{Host: "sim", Port: 1}
+	b := balancer.ServerName{Host: "sim", Port: 2}
+	network.AddServer(b, NewLocalServer())
+	network.SetFaults(SimFaults{MinDelay: 10 * time.Millisecond, MaxDelay: 20 * time.Millisecond})
+
+	cli, err := network.Transport(a).Dial(b, "")
+	if err != nil {
+		t.Fatal("Fails to dial:", err)
+	}
+
+	echo := func() (int, bool) {
+		var reply int
+		call := cli.Go("ServerRPC.Echo", 7, &reply, nil)
+		RunSimulation(clock, network, 100*time.Millisecond)
+		select {
+		case <-call.Done:
+			return reply, call.Error == nil
+		default:
+			return 0, false
+		}
+	}
+
+	if reply, ok := echo(); !ok || reply != 7 {
+		t.Error("Fails to deliver a call:", reply, ok)
+	}
+
+	network.Partition([]balancer.ServerName{a})
+	if _, ok := echo(); ok {
+		t.Error("Partitioned call should not be delivered")
+	}
+
+	network.Heal()
+	network.SetFaults(SimFaults{DropRate: 1})
+	if _, ok := echo(); ok {
+		t.Error("Dropped call should not be delivered")
+	}
+
+	network.SetFaults(SimFaults{})
+	network.RemoveServer(b)
+	if _, err := network.Transport(a).Dial(b, ""); err == nil {
+		t.Error("Should not connect to a server that is down")
+	}
+}
+
+func TestRaftSimulationCrashAndRestart(t *testing.T) {
+	log.SetFlags(log.Lshortfile)
+
+	c := NewSimCluster("/tmp/TestRaftSimulationCrashAndRestart", 3, 1, nil)
+	defer c.Close()
+
+	c.Run(3 * time.Second)
+	leader := c.Leader()
+	if leader == nil {
+		t.Fatal("Fails to elect a leader!")
+	}
+
+	for i := 0; i < 10; i++ {
+		record := RaftRecord{Key: []byte("key"), Value: []byte(fmt.Sprint(i))}
+		if _, ok := leader.Propose(&record); !ok {
+			t.Fatal("Fails to propose a record")
+		}
+	}
+	c.Run(time.Second)
+
+	// Crash the leader. The others elect a new leader and keep committing.
+	var crashed int
+	for i, states := range c.States {
+		if states == leader {
+			crashed = i
+		}
+	}
+	c.Crash(crashed)
+	c.Run(3 * time.Second)
+
+	leader = c.Leader()
+	if leader == nil {
+		t.Fatal("Fails to elect a new leader!")
+	}
+	record := RaftRecord{Key: []byte("key"), Value: []byte("after crash")}
+	seq, ok := leader.Propose(&record)
+	if !ok {
+		t.Fatal("Fails to propose a record")
+	}
+
+	// The restarted member catches up from its data on disk.
+	c.Restart(crashed)
+	c.Run(3 * time.Second)
+
+	for i, states := range c.States {
+		if states.GetCommitSequence().Index < seq.Index {
+			t.Error("Member", i, "does not catch up:", states.GetCommitSequence())
+		}
+	}
+
+	if violations := c.Checker.Violations(); len(violations) > 0 {
+		t.Error("Safety violations:", violations)
+	}
+	if c.Checker.NumCommits() < 11 {
+		t.Error("Too few commits checked:", c.Checker.NumCommits())
+	}
+}
+
+func TestRaftSimulationRandomized(t *testing.T) {
+	seeds := []int64{1, 2, 3, 4}
+	if *simSeed != 0 {
+		seeds = []int64{*simSeed}
+	}
+
+	for _, seed := range seeds {
+		root := fmt.Sprintf("/tmp/TestRaftSimulationRandomized/%d", seed)
+		c := NewSimCluster(root, 5, seed, func(opts *RaftOptions) {
+			opts.PreVote = seed%2 == 0
+			opts.CheckQuorum = seed%2 == 0
+		})
+
+		violations := c.RunRandomized(*simSteps, *simClients)
+		commits := c.Checker.NumCommits()
+		completed := countCompleted(c.Registers) + countCompleted(c.Counters)
+		c.Close()
+
+		if len(violations) > 0 {
+			t.Fatalf("Seed %d (rerun with -sim.seed=%d): %v", seed, seed, violations)
+		}
+		if commits == 0 {
+			t.Errorf("Seed %d commits nothing", seed)
+		}
+		if completed == 0 && *simClients > 0 {
+			t.Errorf("Seed %d completes no client operation", seed)
+		}
+		t.Logf("Seed %d commits %d records, clients complete %d operations",
+			seed, commits, completed)
+	}
+}
+
+// Runs with the same seed make the same decisions, so they commit the
+// same records and clients see the same results.
+func TestRaftSimulationReplay(t *testing.T) {
+	run := func(seed int64) string {
+		root := fmt.Sprintf("/tmp/TestRaftSimulationReplay/%d", seed)
+		c := NewSimCluster(root, 5, seed, func(opts *RaftOptions) {
+			opts.PreVote = seed%2 == 0
+			opts.CheckQuorum = seed%2 == 0
+		})
+		violations := c.RunRandomized(30, 3)
+		c.Close()
+
+		return fmt.Sprint(violations, c.Checker.Commits(),
+			c.Registers.Operations(), c.Counters.Operations(),
+			c.Network.NumCalls("ServerRPC.AppendEntries"), c.Clock.Now())
+	}
+
+	for _, seed := range []int64{1, 2} {
+		if first, second := run(seed), run(seed); first != second {
+			t.Errorf("Seed %d does not replay:\n%s\n%s", seed, first, second)
+		}
+	}
+}
+
+func countCompleted(h *History) (n int) {
+	for _, op := range h.Operations() {
+		if op.Return != math.MaxInt64 {
+			n++
+		}
+	}
+	return
+}
+
+// A leader is cut off from the majority, but some clients still reach it.
+// It must not serve them stale reads after a new leader is elected.
+func TestRaftSimulationPartitionedLeader(t *testing.T) {
+	for _, checkQuorum := range []bool{false, true} {
+		root := fmt.Sprintf("/tmp/TestRaftSimulationPartitionedLeader/%v", checkQuorum)
+		c := NewSimCluster(root, 5, 1, func(opts *RaftOptions) {
+			opts.CheckQuorum = checkQuorum
+		})
+		c.StartClients(3)
+		c.Run(time.Second)
+
+		leader := c.Leader()
+		if leader == nil {
+			t.Fatal("Fails to elect a leader!")
+		}
+
+		// The old leader and a client on one side, and the rest on the other.
+		group := []balancer.ServerName{c.clientNames[0]}
+		for i, states := range c.States {
+			if states == leader {
+				group = append(group, c.Names[i])
+			}
+		}
+		c.Network.Partition(group)
+		c.Run(3 * time.Second)
+
+		c.Network.Heal()
+		c.Run(time.Second)
+		c.StopClients()
+
+		if violations := c.CheckHistories(); len(violations) > 0 {
+			t.Error("Histories are not linearizable:", violations)
+		}
+		if n := countCompleted(c.Registers) + countCompleted(c.Counters); n < 100 {
+			t.Error("Too few client operations complete:", n)
+		}
+		c.Close()
+	}
+}
+
+// Remembers regions that split or merge, and tells the policy if any.
+type splitRecorder struct {
+	mutex  sync.Mutex
+	splits [][3]balancer.Region
+	merges [][3]balancer.Region
+	policy *balancer.SplitMergePolicy
+}
+
+func (r *splitRecorder) SplitRegion(origin, left, right balancer.Region) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.splits = append(r.splits, [3]balancer.Region{origin, left, right})
+	if r.policy != nil {
+		r.policy.RegionsChanged([]balancer.Region{left, right}, []balancer.Region{origin})
+	}
+	return true
+}
+
+func (r *splitRecorder) MergeRegions(left, right, light balancer.Region) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.merges = append(r.merges, [3]balancer.Region{left, right, light})
+	if r.policy != nil {
+		merged := balancer.Region{StartKey: left.StartKey, EndKey: right.EndKey}
+		r.policy.RegionsChanged([]balancer.Region{merged}, []balancer.Region{left, right})
+	}
+}
+
+func TestRaftSimulationSplit(t *testing.T) {
+	c := NewSimCluster("/tmp/TestRaftSimulationSplit", 3, 1, nil)
+	defer c.Close()
+
+	recorder := &splitRecorder{}
+	for _, server := range c.servers {
+		server.SetRegionListener(recorder)
+	}
+
+	c.Run(3 * time.Second)
+	leader := c.Leader()
+	if leader == nil {
+		t.Fatal("Fails to elect a leader!")
+	}
+
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key%02d", i))
+		if _, ok := leader.Propose(&RaftRecord{Key: key, Value: key}); !ok {
+			t.Fatal("Fails to propose a record")
+		}
+	}
+	c.Run(time.Second)
+
+	// A member that misses the split learns it from a snapshot.
+	lagging := 0
+	for c.States[lagging] == leader {
+		lagging++
+	}
+	c.Crash(lagging)
+
+	if !leader.SplitRegion(nil) {
+		t.Fatal("Fails to split the region")
+	}
+	if leader.SplitRegion(nil) {
+		t.Error("Should not split a region that is splitting")
+	}
+	c.Run(3 * time.Second)
+
+	left := leader.GetRegion()
+	right := balancer.Region{StartKey: left.EndKey}
+	if left.StartKey != "" || left.EndKey <= "key00" || left.EndKey > "key19" {
+		t.Fatal("Unexpected left region:", left)
+	}
+
+	recorder.mutex.Lock()
+	splits := len(recorder.splits)
+	recorder.mutex.Unlock()
+	if splits != 1 {
+		t.Error("Unexpected number of notified splits:", splits)
+	}
+
+	var rightLeader *RaftStates
+	for i, server := range c.servers {
+		if server == nil {
+			continue
+		}
+
+		regions := server.GetRegions()
+		if len(regions) != 2 || regions[left] == nil || regions[right] == nil {
+			t.Fatal("Member", i, "does not serve both halves:", regions)
+		}
+		if regions[right].GetState() == RAFT_LEADER {
+			rightLeader = regions[right]
+		}
+
+		for j := 0; j < 20; j++ {
+			key := []byte(fmt.Sprintf("key%02d", j))
+			_, inLeft := regions[left].GetStorage().Read(key)
+			_, inRight := regions[right].GetStorage().Read(key)
+			if inLeft != (string(key) < left.EndKey) || inRight == inLeft {
+				t.Error("Key is on the wrong side:", string(key), inLeft, inRight)
+			}
+		}
+	}
+	if rightLeader == nil {
+		t.Fatal("Fails to elect a leader of the new region")
+	}
+
+	// Each half only accepts its own keys.
+	record := &RaftRecord{Key: []byte("key99"), Value: []byte("right")}
+	if _, ok := leader.Propose(record); ok {
+		t.Error("The left region accepts a key of the right region")
+	}
+	seq, ok := rightLeader.Propose(record)
+	if !ok {
+		t.Fatal("Fails to write to the new region")
+	}
+
+	c.Restart(lagging)
+	c.Run(3 * time.Second)
+
+	if c.States[lagging].GetRegion() != left {
+		t.Error("The lagging member does not shrink:", c.States[lagging].GetRegion())
+	}
+	if c.States[lagging].GetCommitSequence() != leader.GetCommitSequence() {
+		t.Error("The lagging member does not catch up")
+	}
+	for _, server := range c.servers {
+		states := server.GetRegions()[right]
+		if states != nil && states.GetCommitSequence().Index < seq.Index {
+			t.Error("Fails to commit a write to the new region")
+		}
+	}
+
+	if violations := c.Checker.Violations(); len(violations) > 0 {
+		t.Error("Safety violations:", violations)
+	}
+}
+
+func TestRaftSimulationMerge(t *testing.T) {
+	c := NewSimCluster("/tmp/TestRaftSimulationMerge", 3, 1, nil)
+	defer c.Close()
+
+	recorder := &splitRecorder{}
+	for _, server := range c.servers {
+		server.SetRegionListener(recorder)
+	}
+
+	c.Run(3 * time.Second)
+	leader := c.Leader()
+	if leader == nil {
+		t.Fatal("Fails to elect a leader!")
+	}
+
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key%02d", i))
+		if _, ok := leader.Propose(&RaftRecord{Key: key, Value: key}); !ok {
+			t.Fatal("Fails to propose a record")
+		}
+	}
+	c.Run(time.Second)
+
+	if !leader.SplitRegion([]byte("key10")) {
+		t.Fatal("Fails to split the region")
+	}
+	c.Run(3 * time.Second)
+
+	left := leader.GetRegion()
+	right := balancer.Region{StartKey: "key10"}
+	var rightLeader *RaftStates
+	for _, server := range c.servers {
+		if states := server.GetRegions()[right]; states != nil && states.GetState() == RAFT_LEADER {
+			rightLeader = states
+		}
+	}
+	if rightLeader == nil {
+		t.Fatal("Fails to elect a leader of the new region")
+	}
+
+	// A frozen region rejects writes until it is thawed.
+	frozen := make(chan bool, 1)
+	go func() {
+		_, ok := rightLeader.Freeze()
+		frozen <- ok
+	}()
+	c.Run(time.Second)
+	if !<-frozen {
+		t.Fatal("Fails to freeze the region")
+	}
+	record := &RaftRecord{Key: []byte("key99"), Value: []byte("right")}
+	if _, ok := rightLeader.Propose(record); ok {
+		t.Error("A frozen region accepts a write")
+	}
+	if !rightLeader.Thaw() {
+		t.Fatal("Fails to thaw the region")
+	}
+	c.Run(time.Second)
+	if _, ok := rightLeader.Propose(record); !ok {
+		t.Fatal("A thawed region rejects a write")
+	}
+	c.Run(time.Second)
+
+	if leader.MergeRegion(balancer.Region{StartKey: "key11"}) {
+		t.Error("Merges a region that is not the neighbor")
+	}
+
+	merged := make(chan bool, 1)
+	go func() {
+		merged <- leader.MergeRegion(right)
+	}()
+	c.Run(5 * time.Second)
+	if !<-merged {
+		t.Fatal("Fails to merge the regions")
+	}
+
+	whole := balancer.Region{}
+	if leader.GetRegion() != whole {
+		t.Fatal("Unexpected merged region:", leader.GetRegion())
+	}
+
+	recorder.mutex.Lock()
+	merges := recorder.merges
+	recorder.mutex.Unlock()
+	if len(merges) != 1 || merges[0] != [3]balancer.Region{left, right, right} {
+		t.Error("Unexpected notified merges:", merges)
+	}
+
+	for i, server := range c.servers {
+		regions := server.GetRegions()
+		if len(regions) != 1 || regions[whole] == nil {
+			t.Fatal("Member", i, "does not retire the merged region:", regions)
+		}
+
+		store := regions[whole].GetStorage()
+		for j := 0; j < 20; j++ {
+			key := []byte(fmt.Sprintf("key%02d", j))
+			if _, found := store.Read(key); !found {
+				t.Error("Member", i, "loses a key:", string(key))
+			}
+		}
+		if _, found := store.Read(record.Key); !found {
+			t.Error("Member", i, "loses a write to the merged region")
+		}
+	}
+
+	// The merged region accepts keys of both halves.
+	if _, ok := leader.Propose(&RaftRecord{Key: []byte("key98"), Value: []byte("x")}); !ok {
+		t.Error("The merged region rejects a key of the right half")
+	}
+
+	if violations := c.Checker.Violations(); len(violations) > 0 {
+		t.Error("Safety violations:", violations)
+	}
+}
+
+func TestRaftSimulationAutoSplitMerge(t *testing.T) {
+	c := NewSimCluster("/tmp/TestRaftSimulationAutoSplitMerge", 3, 1, nil)
+	defer c.Close()
+
+	opts := &balancer.SplitMergeOptions{
+		MaxRegionSize:    1 << 30,
+		MaxRegionQps:     500,
+		MergeRegionSize:  1 << 20,
+		MergeRegionQps:   50,
+		NumStableReports: 3,
+		CooldownMs:       5000,
+		LoadExpiryMs:     1000,
+	}
+	manager := NewRegionManagerClient(c.Network.Transport(balancer.ServerName{}), "", c.Clock)
+	policy := balancer.NewSplitMergePolicy(opts, manager)
+
+	recorder := &splitRecorder{policy: policy}
+	for _, server := range c.servers {
+		server.SetRegionListener(recorder)
+		monitorOpts := RegionMonitorOptionsForTest(policy)
+		monitorOpts.Clock = c.Clock
+		server.StartRegionMonitor(monitorOpts)
+	}
+
+	c.Run(3 * time.Second)
+	leader := c.Leader()
+	if leader == nil {
+		t.Fatal("Fails to elect a leader!")
+	}
+
+	// Keys after "key50" are hot.
+	for round := 0; round < 10; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < 200; i++ {
+			wg.Add(1)
+			go func(key []byte) {
+				defer wg.Done()
+				req := ReadRequest{Region: leader.GetRegion(), Key: key}
+				var reply ReadReply
+				leader.HandleRead(&req, &reply)
+			}([]byte(fmt.Sprintf("key%02d", 50+i%50)))
+		}
+		c.Run(100 * time.Millisecond)
+		wg.Wait()
+	}
+	c.Run(time.Second)
+
+	recorder.mutex.Lock()
+	splits := append([][3]balancer.Region(nil), recorder.splits...)
+	recorder.mutex.Unlock()
+	if len(splits) != 1 {
+		t.Fatal("Fails to split a hot region:", splits)
+	}
+	if key := splits[0][1].EndKey; key <= "key50" {
+		t.Error("The hot region is not split where its load splits:", key)
+	}
+
+	// The regions are cold now, and merge back once the cooldown passes.
+	c.Run(time.Second)
+	recorder.mutex.Lock()
+	merges := len(recorder.merges)
+	recorder.mutex.Unlock()
+	if merges != 0 {
+		t.Fatal("Regions merge back before the cooldown passes")
+	}
+
+	c.Run(6 * time.Second)
+	recorder.mutex.Lock()
+	merges = len(recorder.merges)
+	recorder.mutex.Unlock()
+	if merges != 1 || leader.GetRegion() != (balancer.Region{}) {
+		t.Error("Fails to merge cold regions:", merges, leader.GetRegion())
+	}
+}
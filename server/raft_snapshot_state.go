@@ -0,0 +1,65 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"lbase/balancer"
+)
+
+// A snapshot from the leader that has been staged in full, and is being
+// installed. It is saved before the rows are replaced, so that an install
+// interrupted by a crash is done again when the replica restarts.
+type RaftSnapshotState struct {
+	// The last record that has been committed in the snapshot.
+	LastSequence RaftSequence
+	// Committed quorum configuration at LastSequence.
+	Configuration RaftConfiguration
+	// Key range of the region at LastSequence.
+	Region balancer.Region
+}
+
+// Parse a slice to get a snapshot state.
+func NewRaftSnapshotState(msg []byte) (ret *RaftSnapshotState, err error) {
+	ret = &RaftSnapshotState{}
+	b := bytes.NewBuffer(msg)
+	dec := gob.NewDecoder(b)
+	err = dec.Decode(ret)
+	return
+}
+
+// Serialize a snapshot state into a slice.
+func (r *RaftSnapshotState) ToSlice() []byte {
+	var b bytes.Buffer
+	enc := gob.NewEncoder(&b)
+	err := enc.Encode(r)
+	var res []byte
+	if err == nil {
+		res = b.Bytes()
+	}
+	return res
+}
@@ -29,8 +29,11 @@ import (
 	"fmt"
 	"lbase/balancer"
 	"log"
+	"math/rand"
 	"net/rpc"
 	"os"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -41,25 +44,133 @@ const (
 )
 
 type RaftStates struct {
+	// Protects all raft states except client connections.
+	mutex sync.Mutex
 	// Raft state.
 	state int
+	// Bumped on every state transition. A state loop quits once it finds
+	// that the epoch it was started with is stale.
+	epoch int64
 	// Cached value of biggest term.
 	lastTerm int64
 	// If this is the leader, hold current term value. Otherwise, it is 0.
 	leaderTerm int64
 	opts       *RaftOptions
 	// Underlying storage.
-	db        *RaftStorage
-	clientMap map[balancer.ServerName][]*rpc.Client
+	db *RaftStorage
+	// Protects clientMap.
+	clientMutex sync.Mutex
+	clientMap   map[balancer.ServerName][]RaftClient
 	// A channel to receive leader's activity.
 	leaderActivityChan chan bool
 	// Maps voting history for each of term.
 	termMap map[int64]balancer.ServerName
+	// Current quorum configuration. It reflects the latest configuration
+	// record in the log, whether the record has been committed or not.
+	config RaftConfiguration
+	// Sequence of the record that carries current configuration.
+	configSeq RaftSequence
+	// Set if the leader is handing over its leadership to transferTarget.
+	// New writes are rejected during the transfer.
+	transferring   bool
+	transferTarget balancer.ServerName
+	// Set if the next election is started on behalf of the leader, which
+	// skips pre-vote and is not refused by members that follow the leader.
+	forceElection bool
+	// The last time that this server heard from a leader.
+	lastLeaderContact time.Time
+	// Wakes up the leader loop when new records are appended.
+	replicateChan chan bool
+	// Set once the raft states is closed.
+	closed bool
+	// Number of readers of the storage outside the lock. The storage is
+	// closed by the last of them if the raft states is already closed.
+	storageReaders int
+	// Rows that are copied or removed without the lock for a split or
+	// merge. At most one task runs at a time, and it is a reader of the
+	// storage.
+	storeTask *storeTask
+	// If this is the leader, the index of the first record of its term.
+	leaderStartIndex int64
+	// If this is the leader, it can serve lease reads until this time.
+	leaseExpire time.Time
+	// The last time that this server was known to have committed
+	// everything that the leader had committed.
+	lastSyncTime time.Time
+	// The leader that this server follows.
+	leader balancer.ServerName
+	// Set if the region has nothing to do. A quiescent leader does not
+	// send heartbeats, and a quiescent follower does not expect them.
+	quiescent bool
+	// Sequence of the last split or merge record in the log. Writes are
+	// rejected until a split is committed, and only one of them can be
+	// in progress.
+	rangeSeq RaftSequence
+	// Sequence of the last freeze record in the log if the region is
+	// frozen. Otherwise, its index is 0.
+	frozenSeq RaftSequence
+	// Serves the region. It is told when the key range changes.
+	host regionHost
+	// Requests to the region since its load was last collected.
+	load regionLoadCounter
+	// If this is the leader, snapshots that are being sent to members.
+	snapshots map[balancer.ServerName]SnapshotProgress
+	// The snapshot that is being staged from the leader, and the number
+	// of its rows that have arrived. Rows are kept by the storage.
+	pendingSnapshotSeq  RaftSequence
+	pendingSnapshotRows int
+	// Indexes of records that proposers wait to commit. The log drops
+	// records once later ones commit, so the term that commits at each
+	// of them is kept here.
+	commitWatches map[int64]*commitWatch
+}
+
+type commitWatch struct {
+	// Term of the record committed at the index, or 0 before it commits.
+	term    int64
+	waiters int
+}
+
+// Rows that are copied to a region split off or from a region merged, or
+// removed once they have moved out. It takes time in proportion to the
+// size of the region, so it is done without the lock.
+type storeTask struct {
+	// The split or merge record that rows are copied for. Its index is 0
+	// if rows are removed.
+	seq RaftSequence
+	// The storage of the region split off.
+	right *RaftStorage
+	done  bool
+	// Once the task is done, records are committed up to this index.
+	index int64
+}
+
+// Serves regions on a server. Server implements it.
+type regionHost interface {
+	// Return the raft states of region @r.
+	findRegion(r balancer.Region) *RaftStates
+	// Called after region @origin changes to @region, with its raft states
+	// locked. Other regions that @region covers have been merged into it,
+	// and are retired. @split is the raft states of the new region split
+	// off from it, which has not been started. It is nil if the region
+	// does not split. @isLeader is set if the caller is the leader.
+	updateRegion(origin, region balancer.Region, split *RaftStates, isLeader bool)
 }
 
 func NewRaftStates(opts *RaftOptions, db *RaftStorage) *RaftStates {
-	os.MkdirAll(opts.GetLogDir(), os.ModePerm)
-	os.MkdirAll(opts.GetEditQueueDir(), os.ModePerm)
+	if opts.MultiRaft != nil {
+		// Still needed for the configuration and the hard state.
+		os.MkdirAll(opts.RaftRoot, os.ModePerm)
+		if opts.EditQueue == nil {
+			opts.EditQueue = opts.MultiRaft.GetLogEngine().GetEditQueue(db.GetLogRegion())
+		}
+		if opts.HeartbeatIntervalMs == 0 {
+			opts.HeartbeatIntervalMs = opts.MultiRaft.GetOptions().HeartbeatIntervalMs
+		}
+	} else {
+		os.MkdirAll(opts.GetLogDir(), os.ModePerm)
+		os.MkdirAll(opts.GetEditQueueDir(), os.ModePerm)
+	}
 
 	if opts.EditQueue == nil {
 		editQueueOpts := EditQueueOptions{
@@ -69,6 +180,37 @@ func NewRaftStates(opts *RaftOptions, db *RaftStorage) *RaftStates {
 		opts.EditQueue = NewEditQueue(&editQueueOpts)
 	}
 
+	if opts.Transport == nil {
+		opts.Transport = &HTTPTransport{}
+	}
+
+	if opts.Clock == nil {
+		opts.Clock = &RealClock{}
+	}
+
+	if opts.Rand == nil {
+		opts.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	if opts.HeartbeatIntervalMs == 0 {
+		opts.HeartbeatIntervalMs = opts.RaftLeaderTimeoutMs / 4
+	}
+	if opts.MaxAppendEntries == 0 {
+		opts.MaxAppendEntries = 64
+	}
+	if opts.MaxAppendBytes == 0 {
+		opts.MaxAppendBytes = 1 << 20
+	}
+	if opts.MaxInflightAppends == 0 {
+		opts.MaxInflightAppends = 8
+	}
+	if opts.MaxInflightBytes == 0 {
+		opts.MaxInflightBytes = 8 << 20
+	}
+	if opts.SnapshotChunkBytes == 0 {
+		opts.SnapshotChunkBytes = 4 << 20
+	}
+
 	if opts.Collector == nil {
 		opts.Collector = &EditCollector{
 			Region:       opts.Region,
@@ -77,14 +219,30 @@ func NewRaftStates(opts *RaftOptions, db *RaftStorage) *RaftStates {
 		}
 	}
 
-	return &RaftStates{
+	s := &RaftStates{
 		state:              RAFT_FOLLOWER,
 		opts:               opts,
 		db:                 db,
-		clientMap:          make(map[balancer.ServerName][]*rpc.Client),
+		clientMap:          make(map[balancer.ServerName][]RaftClient),
 		leaderActivityChan: make(chan bool, 1024),
+		replicateChan:      make(chan bool, 1),
 		termMap:            make(map[int64]balancer.ServerName),
+		snapshots:          make(map[balancer.ServerName]SnapshotProgress),
+		commitWatches:      make(map[int64]*commitWatch),
+	}
+
+	// Recover votes and the biggest term from the last run.
+	state, found := db.GetHardState()
+	if found {
+		if state.Votes != nil {
+			s.termMap = state.Votes
+		}
+		s.lastTerm = state.Term
+		s.updateLastTerm(db.GetRaftSequence().Term)
 	}
+
+	s.reloadConfiguration()
+	return s
 }
 
 func (s *RaftStates) GetLastTerm() int64 {
@@ -97,83 +255,107 @@ func (s *RaftStates) GetLastTerm() int64 {
 	return s.lastTerm
 }
 
-func (s *RaftStates) GetClient(name balancer.ServerName) *rpc.Client {
+// Remember the biggest term that has been seen so far.
+func (s *RaftStates) updateLastTerm(term int64) {
+	if term > s.GetLastTerm() {
+		s.lastTerm = term
+		s.saveHardState()
+	}
+}
+
+func (s *RaftStates) saveHardState() {
+	s.db.SaveHardState(&RaftHardState{Term: s.lastTerm, Votes: s.termMap})
+}
+
+func (s *RaftStates) GetClient(name balancer.ServerName) RaftClient {
+	s.clientMutex.Lock()
 	cls, found := s.clientMap[name]
 	if found && len(cls) > 0 {
 		lastIdx := len(cls) - 1
 		ret := cls[lastIdx]
 		cls = cls[:lastIdx]
 		s.clientMap[name] = cls
+		s.clientMutex.Unlock()
 		return ret
 	}
+	s.clientMutex.Unlock()
 
 	// Only create clients that are in the quorum group.
-	isMember := false
-	for _, sn := range s.opts.Members {
-		if sn == name {
-			isMember = true
-			break
-		}
-	}
-	if !isMember {
+	config := s.GetConfiguration()
+	if !config.IsMember(name) {
 		return nil
 	}
 
-	addr := fmt.Sprintf("%s:%d", name.Host, name.Port)
-	path, _ := GetServerPath(s.opts.RPCPrefix, name.Port)
-
-	cli, err := rpc.DialHTTPPath("tcp", addr, path)
+	cli, err := s.opts.Transport.Dial(name, s.opts.RPCPrefix)
 	if err != nil {
-		log.Printf("Fails to create connection to %s: %#v\n", addr, err)
+		log.Printf("Fails to create connection to %v: %#v\n", name, err)
 		return nil
 	}
 
 	return cli
 }
 
-func (s *RaftStates) ReturnClient(name balancer.ServerName, cli *rpc.Client) {
+func (s *RaftStates) ReturnClient(name balancer.ServerName, cli RaftClient) {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+
 	cls, _ := s.clientMap[name]
 	if len(cls) > 4 {
+		cli.Close()
 		return
 	}
 	cls = append(cls, cli)
 	s.clientMap[name] = cls
 }
 
+// Return the client of a failed call. The connection may be broken,
+// so do not put it back to the pool.
+func (s *RaftStates) DropClient(name balancer.ServerName, cli RaftClient) {
+	cli.Close()
+}
+
 func (s *RaftStates) TransitToCandidate() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.becomeCandidate()
+}
+
+func (s *RaftStates) becomeCandidate() {
 	if s.state != RAFT_FOLLOWER {
 		log.Panic("current state is not follower: ", s.state)
 	}
 
 	s.state = RAFT_CANDIDATE
-	go s.CandidateLoop()
+	s.quiescent = false
+	s.epoch++
+	go s.CandidateLoop(s.epoch)
 }
 
-func (s *RaftStates) CandidateLoop() {
-	numMembers := len(s.opts.Members)
+func (s *RaftStates) CandidateLoop(epoch int64) {
+	s.mutex.Lock()
 	term := s.GetLastTerm() + 1
+	leaderTransfer := s.forceElection
+	s.forceElection = false
+	s.mutex.Unlock()
+
+	// Do not disturb the quorum unless this server could win.
+	if s.opts.PreVote && !leaderTransfer && !s.preVote(epoch, term) {
+		s.mutex.Lock()
+		if s.epoch == epoch {
+			s.becomeFollower()
+		}
+		s.mutex.Unlock()
+		return
+	}
 
 	for {
-		if s.state != RAFT_CANDIDATE {
+		s.mutex.Lock()
+		if s.epoch != epoch {
+			s.mutex.Unlock()
 			return
 		}
 
-		waitTimeMs := time.Duration(s.opts.CandidateWaitMs)
-		waitChan := time.After(waitTimeMs * time.Millisecond)
-
-		cliMap := make(map[balancer.ServerName]*rpc.Client)
-
-		for _, sn := range s.opts.Members {
-			cli := s.GetClient(sn)
-			if cli != nil {
-				cliMap[sn] = cli
-			}
-		}
-
-		if len(cliMap) <= numMembers/2 {
-			time.Sleep(time.Duration(s.opts.CandidateWaitMs) * time.Millisecond)
-			continue
-		}
+		config := s.config.Clone()
 
 		// Update term number if we are falling behind.
 		{
@@ -184,47 +366,31 @@ func (s *RaftStates) CandidateLoop() {
 		}
 
 		req := RequestVote{
-			Region:       s.opts.Region,
-			ServerName:   s.opts.Address,
-			Term:         term,
-			LastSequence: s.db.GetRaftSequence(),
+			Region:         s.opts.Region,
+			ServerName:     s.opts.Address,
+			Term:           term,
+			LastSequence:   s.db.GetRaftSequence(),
+			LeaderTransfer: leaderTransfer,
 		}
+		s.mutex.Unlock()
 
-		// Start multicasting with timeout.
-		callName := "ServerRPC.RequestVote"
-
-		period := time.Duration(s.opts.RequestVoteTimeoutMs)
-		timeCh := time.After(period * time.Millisecond)
+		waitChan := s.opts.Clock.After(s.randomTimeout(s.opts.CandidateWaitMs))
 
-		calls := make(map[balancer.ServerName]*rpc.Call)
-		for sn, cli := range cliMap {
-			resp := &RequestVoteReply{}
-			calls[sn] = cli.Go(callName, &req, resp, nil)
-		}
-
-		agreed := 0
-		for sn, call := range calls {
-			select {
-			case <-call.Done:
-				reply := call.Reply.(*RequestVoteReply)
-				if reply.Ok {
-					agreed++
-				}
-				if reply.MyTerm > term {
-					term = reply.MyTerm
-				}
-				cli, found := cliMap[sn]
-				if !found {
-					log.Panic("Server ", sn, " not found")
-				}
-				s.ReturnClient(sn, cli)
-			case <-timeCh:
-				timeCh = time.After(time.Duration(0))
-			}
+		agreed, myTerm, sent := s.collectVotes(&req, &config)
+		if !sent {
+			s.opts.Clock.Sleep(time.Duration(s.opts.CandidateWaitMs) * time.Millisecond)
+			continue
+		}
+		if myTerm > term {
+			term = myTerm
 		}
 
-		if agreed > numMembers/2 {
-			s.TransitToLeader(term)
+		if agreed >= config.Quorum() {
+			s.mutex.Lock()
+			if s.epoch == epoch {
+				s.becomeLeader(term)
+			}
+			s.mutex.Unlock()
 			return
 		}
 
@@ -233,191 +399,493 @@ func (s *RaftStates) CandidateLoop() {
 	}
 }
 
+// Ask voters if they would vote for this server in an election of
+// the given term. Voters do not remember their answers.
+func (s *RaftStates) preVote(epoch, term int64) bool {
+	s.mutex.Lock()
+	if s.epoch != epoch {
+		s.mutex.Unlock()
+		return false
+	}
+
+	config := s.config.Clone()
+	req := RequestVote{
+		Region:       s.opts.Region,
+		ServerName:   s.opts.Address,
+		Term:         term,
+		LastSequence: s.db.GetRaftSequence(),
+		PreVote:      true,
+	}
+	s.mutex.Unlock()
+
+	agreed, _, sent := s.collectVotes(&req, &config)
+	return sent && agreed >= config.Quorum()
+}
+
+// Multicast a vote request to voters of the configuration. Return the
+// number of granted votes and the biggest term replied by voters. The
+// last return value is false if too few voters can be reached to form
+// a quorum, in which case no request is sent.
+func (s *RaftStates) collectVotes(
+	req *RequestVote,
+	config *RaftConfiguration) (agreed int, myTerm int64, sent bool) {
+
+	cliMap := make(map[balancer.ServerName]RaftClient)
+
+	for _, sn := range config.Voters {
+		cli := s.GetClient(sn)
+		if cli != nil {
+			cliMap[sn] = cli
+		}
+	}
+
+	if len(cliMap) < config.Quorum() {
+		for sn, cli := range cliMap {
+			s.ReturnClient(sn, cli)
+		}
+		return 0, 0, false
+	}
+
+	// Start multicasting with timeout.
+	callName := "ServerRPC.RequestVote"
+
+	period := time.Duration(s.opts.RequestVoteTimeoutMs)
+	timeCh := s.opts.Clock.After(period * time.Millisecond)
+
+	calls := make(map[balancer.ServerName]*rpc.Call)
+	for sn, cli := range cliMap {
+		resp := &RequestVoteReply{}
+		calls[sn] = cli.Go(callName, req, resp, nil)
+	}
+
+	for _, sn := range config.Voters {
+		call, found := calls[sn]
+		if !found {
+			continue
+		}
+		if !waitCall(call, timeCh) {
+			timeCh = s.opts.Clock.After(time.Duration(0))
+			continue
+		}
+
+		cli := cliMap[sn]
+		if call.Error != nil {
+			s.DropClient(sn, cli)
+			continue
+		}
+		reply := call.Reply.(*RequestVoteReply)
+		if reply.Ok {
+			agreed++
+		}
+		if reply.MyTerm > myTerm {
+			myTerm = reply.MyTerm
+		}
+		s.ReturnClient(sn, cli)
+	}
+
+	return agreed, myTerm, true
+}
+
+// Return a random duration between @ms and twice of @ms milliseconds.
+func (s *RaftStates) randomTimeout(ms int64) time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	jitter := int64(0)
+	if ms > 0 {
+		jitter = s.opts.Rand.Int63n(ms)
+	}
+	return time.Duration(ms+jitter) * time.Millisecond
+}
+
 func (s *RaftStates) TransitToLeader(term int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.becomeLeader(term)
+}
+
+func (s *RaftStates) becomeLeader(term int64) {
 	if s.state != RAFT_CANDIDATE {
 		return
 	}
 	s.state = RAFT_LEADER
 	s.leaderTerm = term
-	go s.LeaderLoop(term)
+	s.leader = s.opts.Address
+	s.quiescent = false
+	if s.opts.Observer != nil {
+		s.opts.Observer.BecomeLeader(s.opts.Address, term)
+	}
+	s.transferring = false
+	s.updateLastTerm(term)
+	s.epoch++
+
+	// Records from previous terms can only be committed together with
+	// a record of current term.
+	seq, _ := s.appendRecord(&RaftRecord{Type: RAFT_RECORD_NOOP})
+	s.leaderStartIndex = seq.Index
+
+	go s.LeaderLoop(s.epoch, term)
 }
 
-func (s *RaftStates) LeaderLoop(term int64) {
-	// Remember each server's replication progress.
-	progMap := make(map[balancer.ServerName]RaftSequence)
-	unknownProgressMap := make(map[balancer.ServerName]bool)
-	// TODO: How to get those records?
-	pendingRecords := make(map[RaftSequence][]byte)
+func (s *RaftStates) LeaderLoop(epoch, term int64) {
+	newReplicator(s, epoch, term).run()
+}
 
-	callName := "ServerRPC.AppendEntries"
-	for {
-		if s.state != RAFT_LEADER {
-			return
+// Called by the leader after a majority of voters have acknowledged
+// a round of requests that is sent at @start.
+func (s *RaftStates) extendLease(start time.Time) {
+	s.lastSyncTime = start
+
+	// Members refuse to elect another leader within the leader timeout
+	// after they hear from the leader, but only if check-quorum is on.
+	if !s.opts.CheckQuorum {
+		return
+	}
+
+	expire := start.Add(time.Duration(s.opts.RaftLeaderTimeoutMs) * time.Millisecond)
+	if expire.After(s.leaseExpire) {
+		s.leaseExpire = expire
+	}
+}
+
+// Check if a majority of voters have replied within twice the leader
+// timeout.
+func (s *RaftStates) hasActiveQuorum(
+	ackMap map[balancer.ServerName]time.Time,
+	startTime time.Time) bool {
+
+	window := time.Duration(s.opts.RaftLeaderTimeoutMs*2) * time.Millisecond
+	now := s.opts.Clock.Now()
+
+	active := 0
+	for _, sn := range s.config.Voters {
+		if sn == s.opts.Address {
+			active++
+			continue
 		}
 
-		// Set a timer so that leader loop will not progress too fast.
-		timeoutChan := make(chan bool, 1)
-		go func() {
-			ms := s.opts.RaftLeaderTimeoutMs * 3 / 4
-			time.Sleep(time.Duration(ms) * time.Millisecond)
-			timeoutChan <- true
-		}()
-
-		lastSeq := s.db.GetRaftSequence()
-		callMap := make(map[balancer.ServerName]RequestInfo)
-
-		for _, sn := range s.opts.Members {
-			// If we do not know the progress of a particular server yet,
-			// assume that it is already caught up.
-			_, found := progMap[sn]
-			if !found {
-				progMap[sn] = lastSeq
-				unknownProgressMap[sn] = true
-			}
+		ack, found := ackMap[sn]
+		if !found {
+			ack = startTime
+		}
+		if now.Sub(ack) < window {
+			active++
+		}
+	}
 
-			// Make a connection to each of servers in the quorum.
-			cli := s.GetClient(sn)
-			if cli == nil {
-				continue
-			}
+	return active >= s.config.Quorum()
+}
 
-			info := RequestInfo{Cli: cli}
+// Commit all records that have been replicated to a majority of voters.
+func (s *RaftStates) advanceCommit(
+	term int64,
+	progress map[balancer.ServerName]*Progress) {
 
-			// Send RPC to each of member servers.
-			req := AppendEntries{
-				ServerName: s.opts.Address,
-				Term:       term,
-				Region:     s.opts.Region,
-				Data:       make(map[RaftSequence][]byte),
-			}
+	var indices []int
+	for _, sn := range s.config.Voters {
+		if sn == s.opts.Address {
+			indices = append(indices, int(s.db.GetRaftSequence().Index))
+			continue
+		}
 
-			progSeq, hasProgSeq := progMap[sn]
-			if !hasProgSeq {
-				panic("Fails to find progress")
-			}
+		pr, found := progress[sn]
+		if found {
+			indices = append(indices, int(pr.Match.Index))
+		} else {
+			indices = append(indices, 0)
+		}
+	}
 
-			_, unknownProgress := unknownProgressMap[sn]
-			if unknownProgress {
-				req.LeaderGuessedSequence = progSeq
-			} else if progSeq.Index > 0 {
-				// Get data from raft logs.
-				if progSeq.Less(lastSeq) {
-					req.Data = s.ScanNoncommitLogs(&progSeq)
-				}
-
-				// Appending any new records.
-				for key, value := range pendingRecords {
-					req.Data[key] = value
-				}
-			}
+	quorum := s.config.Quorum()
+	if len(indices) < quorum {
+		return
+	}
 
-			var reply AppendEntriesReply
-			info.Call = cli.Go(callName, &req, &reply, nil)
-			callMap[sn] = info
-		}
-
-		var zeroSequence RaftSequence
-
-		timeOut := time.Duration(s.opts.RaftLeaderTimeoutMs / 2)
-		timeChan := time.After(timeOut * time.Millisecond)
-
-		// Processing RPC replies.
-		noLongerLeader := false
-		for sn, info := range callMap {
-			select {
-			case <-info.Call.Done:
-				resp := info.Call.Reply.(*AppendEntriesReply)
-				if resp.NotLeader {
-					noLongerLeader = true
-					break
-				}
-
-				prog, hasProg := progMap[sn]
-				if !hasProg {
-					panic("Do not have progMap entry!")
-				}
-
-				if resp.RealSequence == zeroSequence {
-					// If the client want to be left alone, do so.
-					delete(unknownProgressMap, sn)
-					progMap[sn] = resp.RealSequence
-				} else if resp.RealSequence == prog {
-					// Leader guessed correctly, enable record replication.
-					delete(unknownProgressMap, sn)
-				} else if prog.Less(resp.RealSequence) {
-					// Replication made progress.
-					progMap[sn] = resp.RealSequence
-				} else {
-					panic("real sequence is less than previous progress!")
-				}
-
-				s.ReturnClient(sn, info.Cli)
-			case <-timeChan:
-				timeChan = time.After(time.Duration(0))
-			}
+	sort.Sort(sort.Reverse(sort.IntSlice(indices)))
+	index := int64(indices[quorum-1])
+
+	// Only records of current term are committed by counting replicas.
+	// Previous records are committed along with them.
+	seq, found := s.db.GetSequenceAt(index)
+	if found && seq.Term == term {
+		s.commitTo(index)
+	}
+}
+
+// Promote a learner that has caught up with the leader. Only one
+// configuration change can be in progress at a time.
+func (s *RaftStates) promoteLearners(progress map[balancer.ServerName]*Progress) {
+
+	if s.configChangePending() {
+		return
+	}
+
+	commitSeq := s.db.GetCommitSequence()
+	for _, sn := range s.config.Learners {
+		pr, found := progress[sn]
+		if !found || pr.State != PROGRESS_REPLICATE {
+			continue
+		}
+
+		if pr.Match.Index+s.opts.LearnerCatchUpLag >= commitSeq.Index {
+			config := s.config.WithVoter(sn)
+			s.appendRecord(NewConfigRaftRecord(&config))
+			return
+		}
+	}
+}
+
+// Send all committed data to a member that falls too far behind. Rows
+// are sent in chunks of SnapshotChunkBytes, no faster than
+// SnapshotBytesPerSec. The transfer stops if this server is no longer the
+// leader, or the member is removed. Return the sequence that the member
+// has after installing the snapshot.
+func (s *RaftStates) sendSnapshot(
+	sn balancer.ServerName,
+	term int64) (seq RaftSequence, ok bool) {
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+
+	// Rows are read from a db snapshot without the lock.
+	if !s.acquireStorage() {
+		s.mutex.Unlock()
+		return
+	}
+	epoch := s.epoch
+	snapshot := InstallSnapshot{
+		ServerName:    s.opts.Address,
+		Term:          term,
+		Region:        s.opts.Region,
+		Configuration: s.getCommittedConfiguration(),
+	}
+	var rows *RegionSnapshot
+	snapshot.LastSequence, rows = s.db.CreateSnapshot()
+	s.mutex.Unlock()
+
+	defer func() {
+		rows.Release()
+		s.releaseStorage()
+
+		s.mutex.Lock()
+		delete(s.snapshots, sn)
+		s.mutex.Unlock()
+	}()
+
+	// The size is estimated, so it is raised if more rows are sent.
+	total := s.db.GetApproximateSize()
+	s.mutex.Lock()
+	s.snapshots[sn] = SnapshotProgress{Total: total}
+	s.mutex.Unlock()
+
+	var sent int64
+	for {
+		req := snapshot
+		var size int64
+		req.Keys, req.Values, size, req.Done = rows.Next(s.opts.SnapshotChunkBytes)
+
+		if !s.sendSnapshotChunk(sn, &req) {
+			return
+		}
+		if req.Done {
+			return snapshot.LastSequence, true
+		}
+
+		sent += size
+		snapshot.Offset += len(req.Keys)
+		if total < sent {
+			total = sent
 		}
 
-		if noLongerLeader {
-			s.TransitToFollower()
+		s.mutex.Lock()
+		s.snapshots[sn] = SnapshotProgress{Sent: sent, Total: total}
+		cancelled := s.closed || s.epoch != epoch || !s.config.IsMember(sn)
+		s.mutex.Unlock()
+		if cancelled {
 			return
 		}
 
-		<-timeoutChan
+		if s.opts.SnapshotBytesPerSec > 0 {
+			ms := size * 1000 / s.opts.SnapshotBytesPerSec
+			s.opts.Clock.Sleep(time.Duration(ms) * time.Millisecond)
+		}
+	}
+}
+
+// Send a chunk of a snapshot. Return true if the member takes it.
+func (s *RaftStates) sendSnapshotChunk(sn balancer.ServerName, req *InstallSnapshot) bool {
+	cli := s.GetClient(sn)
+	if cli == nil {
+		return false
+	}
+
+	var reply InstallSnapshotReply
+	call := cli.Go("ServerRPC.InstallSnapshot", req, &reply, nil)
+
+	timeOut := time.Duration(s.opts.RaftLeaderTimeoutMs)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			s.DropClient(sn, cli)
+			return false
+		}
+		s.ReturnClient(sn, cli)
+		return reply.Ok
+	case <-s.opts.Clock.After(timeOut * time.Millisecond):
+		return false
+	}
+}
+
+// Ask a member to start an election right away.
+func (s *RaftStates) sendTimeoutNow(sn balancer.ServerName, term int64) {
+	cli := s.GetClient(sn)
+	if cli == nil {
+		return
+	}
+
+	req := TimeoutNow{
+		ServerName: s.opts.Address,
+		Term:       term,
+		Region:     s.opts.Region,
+	}
+
+	var reply TimeoutNowReply
+	call := cli.Go("ServerRPC.TimeoutNow", &req, &reply, nil)
+
+	timeOut := time.Duration(s.opts.RequestVoteTimeoutMs)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			s.DropClient(sn, cli)
+			return
+		}
+		s.ReturnClient(sn, cli)
+	case <-s.opts.Clock.After(timeOut * time.Millisecond):
 	}
 }
 
 func (s *RaftStates) TransitToFollower() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.becomeFollower()
+}
+
+func (s *RaftStates) becomeFollower() {
 	s.state = RAFT_FOLLOWER
 	if s.leaderTerm != 0 {
 		s.leaderTerm = 0
 	}
-	go s.FollowerLoop()
+	s.transferring = false
+	s.quiescent = false
+	s.epoch++
+	go s.FollowerLoop(s.epoch)
+
+	// A quiescent leader loop only wakes up when there is something
+	// to replicate.
+	s.wakeReplicator()
 }
 
-func (s *RaftStates) FollowerLoop() {
-	ms := s.opts.RaftLeaderTimeoutMs
+func (s *RaftStates) FollowerLoop(epoch int64) {
 	for {
+		// Randomize the timeout so that followers do not start elections
+		// at the same time.
+		timeOut := s.randomTimeout(s.opts.RaftLeaderTimeoutMs)
+
+		// A quiescent follower waits until it hears from the leader, or
+		// it is woken up by Unquiesce.
+		s.mutex.Lock()
+		if s.epoch != epoch {
+			s.mutex.Unlock()
+			return
+		}
+		var timeChan <-chan time.Time
+		if !s.quiescent {
+			timeChan = s.opts.Clock.After(timeOut)
+		}
+		s.mutex.Unlock()
+
 		select {
 		case <-s.leaderActivityChan:
-		case <-time.After(time.Duration(ms) * time.Millisecond):
-			s.TransitToCandidate()
-			return
+		case <-timeChan:
+			s.mutex.Lock()
+			if s.epoch != epoch {
+				s.mutex.Unlock()
+				return
+			}
+			if s.quiescent {
+				s.mutex.Unlock()
+				continue
+			}
+
+			// Learners and removed members never run for leader.
+			if s.config.IsVoter(s.opts.Address) {
+				s.becomeCandidate()
+				s.mutex.Unlock()
+				return
+			}
+			s.mutex.Unlock()
 		}
 	}
 }
 
-func (s *RaftStates) ScanNoncommitLogs(start *RaftSequence) map[RaftSequence][]byte {
+// Return consecutive records in the log that follow @start. The record
+// at @start is also included if the log still keeps it.
+// Return consecutive records after @start, but no more than @maxRecords
+// records or @maxBytes bytes. At least one record is returned if there
+// is any.
+func (s *RaftStates) ScanNoncommitLogs(
+	start *RaftSequence,
+	maxRecords int,
+	maxBytes int64) (ret map[RaftSequence][]byte, size int64) {
+
 	iter := s.db.log.CreateIterator(s.db.rdOpts)
 	defer iter.Destroy()
 
-	iter.Seek(start.AsKey())
-	ret := make(map[RaftSequence][]byte)
-
-	cur := start.Index
+	ret = make(map[RaftSequence][]byte)
+	cur := start.Index + 1
 
-	for iter.Valid() {
+	// The record at @start may have been removed after commit.
+	for iter.Seek(start.AsKey()); iter.Valid() && len(ret) < maxRecords; iter.Next() {
 		newSeq, keyError := NewRaftSequenceFromKey(iter.Key())
 		if keyError != nil {
 			panic("Bad keys in log!")
 		}
-		if cur == newSeq.Index {
-			ret[*newSeq] = iter.Value()
-			cur++
+		if newSeq.Index == start.Index {
+			continue
+		}
+		if newSeq.Index != cur {
+			break
+		}
 
-		} else {
+		value := iter.Value()
+		if len(ret) > 0 && size+int64(len(value)) > maxBytes {
 			break
 		}
+
+		ret[*newSeq] = value
+		size += int64(len(value))
+		cur++
 	}
 
-	return ret
+	return
 }
 
 func (s *RaftStates) HandleRequestVote(req *RequestVote, resp *RequestVoteReply) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	lastTerm := s.GetLastTerm()
 	if req.Term <= lastTerm {
 		resp.Ok = false
 	} else if req.LastSequence.Less(s.db.GetRaftSequence()) {
 		resp.Ok = false
+	} else if s.refuseToVote(req) {
+		resp.Ok = false
+	} else if req.PreVote {
+		resp.Ok = true
 	} else {
 		sn, hasVote := s.termMap[req.Term]
 		if !hasVote {
@@ -425,8 +893,9 @@ func (s *RaftStates) HandleRequestVote(req *RequestVote, resp *RequestVoteReply)
 			resp.Ok = true
 
 			if len(s.termMap) > 10 {
-				go s.TrimTermMap()
+				s.TrimTermMap()
 			}
+			s.saveHardState()
 		} else if sn != req.ServerName {
 			resp.Ok = false
 		} else {
@@ -439,84 +908,1323 @@ func (s *RaftStates) HandleRequestVote(req *RequestVote, resp *RequestVoteReply)
 	}
 }
 
-func (s *RaftStates) HandleAppendEntries(req *AppendEntries, resp *AppendEntriesReply) {
-	if req.Term < s.GetLastTerm() {
-		resp.NotLeader = true
-		return
+// A server that still hears from a leader does not help other servers
+// to depose the leader, unless the leader asks for it.
+func (s *RaftStates) refuseToVote(req *RequestVote) bool {
+	if req.LeaderTransfer || req.ServerName == s.opts.Address {
+		return false
+	}
+
+	if !req.PreVote && !s.opts.CheckQuorum {
+		return false
+	}
+
+	if s.state == RAFT_LEADER {
+		return true
+	}
+
+	// The leader of a quiescent region is fine as long as its server is.
+	if s.quiescent && s.opts.MultiRaft.IsAlive(s.leader) {
+		return true
+	}
+
+	ms := time.Duration(s.opts.RaftLeaderTimeoutMs) * time.Millisecond
+	return s.opts.Clock.Now().Sub(s.lastLeaderContact) < ms
+}
+
+func (s *RaftStates) acceptLeader(term int64, leader balancer.ServerName) bool {
+	if term < s.GetLastTerm() {
+		return false
 	}
 
 	if s.state == RAFT_CANDIDATE {
-		s.TransitToFollower()
+		s.becomeFollower()
 	} else if s.state == RAFT_LEADER {
-		if req.Term < s.leaderTerm {
-			resp.NotLeader = true
-			return
-		} else if req.Term == s.leaderTerm {
-			if req.ServerName != s.opts.Address {
+		if term < s.leaderTerm {
+			return false
+		} else if term == s.leaderTerm {
+			if leader != s.opts.Address {
 				log.Panic("Having two leaders for the same term!")
 			}
 		} else {
-			s.TransitToFollower()
+			s.becomeFollower()
 		}
 	}
 
-	s.leaderActivityChan <- true
+	s.updateLastTerm(term)
+	s.lastLeaderContact = s.opts.Clock.Now()
+	s.leader = leader
+	s.quiescent = false
+
+	select {
+	case s.leaderActivityChan <- true:
+	default:
+	}
+	return true
+}
+
+func (s *RaftStates) HandleAppendEntries(req *AppendEntries, resp *AppendEntriesReply) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	// If leader has given up, do not check the data with the request.
-	var zeroSequence RaftSequence
-	if req.LeaderGuessedSequence == zeroSequence {
+	if !s.acceptLeader(req.Term, req.ServerName) {
+		resp.NotLeader = true
 		return
 	}
 
-	// If leader has not figure out my progress yet, give it a hint.
-	iter := s.db.log.CreateIterator(s.db.rdOpts)
-	defer iter.Destroy()
+	// Committed records are the same on all members, so anything
+	// up to the commit sequence matches the leader.
+	commitSeq := s.db.GetCommitSequence()
+	guessed := req.LeaderGuessedSequence
 
-	var savedSeq RaftSequence
-	var matchedSeq bool
+	if guessed.Index > commitSeq.Index && !s.db.HasRecord(guessed) {
+		// If leader has not figure out my progress yet, give it a hint.
+		resp.RealSequence = s.db.GetSequenceBefore(guessed.Index)
+		return
+	}
 
-	iter.Seek(req.LeaderGuessedSequence.AsKey())
-	if iter.Valid() {
-		tmp, _ := NewRaftSequenceFromKey(iter.Key())
-		savedSeq = *tmp
-		if savedSeq == req.LeaderGuessedSequence {
-			matchedSeq = true
-		}
+	var seqs RaftSequenceList
+	for seq, _ := range req.Data {
+		seqs = append(seqs, seq)
 	}
+	sort.Sort(seqs)
 
-	// If the sequence has not been matched, try to find the previous
-	// sequence number.
-	if !matchedSeq {
-		if iter.Valid() {
-			iter.Prev()
-			if iter.Valid() {
-				tmp, _ := NewRaftSequenceFromKey(iter.Key())
-				resp.RealSequence = *tmp
-			}
+	last := guessed
+	for _, seq := range seqs {
+		if seq.Index <= guessed.Index {
+			continue
+		}
+		last = seq
+		if seq.Index <= commitSeq.Index {
+			continue
+		}
+
+		// Remove conflicting records before saving new ones.
+		old, found := s.db.GetSequenceAt(seq.Index)
+		if found && old == seq {
+			continue
+		}
+		if found {
+			s.db.TruncateFrom(seq.Index)
+			s.reloadConfiguration()
 		}
 
-		// If we cannot move backward, we should let leader to give up
-		// by setting resp.RealSequence to 0, which is the default
-		// behavior.
+		data := req.Data[seq]
+		s.db.SaveRaftRecord(seq, data)
+		s.applyRecord(seq, data)
 	}
-}
 
-func (s *RaftStates) HandleGetRaftState(req RaftStateRequest, resp *RaftStateReply) {
-	resp.Found = true
-	resp.State = s.state
+	index := req.CommitSequence.Index
+	if last.Index < index {
+		index = last.Index
+	}
+	s.commitTo(index)
+
+	if s.db.GetCommitSequence().Index >= req.CommitSequence.Index {
+		s.lastSyncTime = s.opts.Clock.Now()
+	}
+
+	resp.Ok = true
+	resp.RealSequence = last
 }
 
-func (s *RaftStates) TrimTermMap() {
-	sureTerm := s.db.GetCommitSequence().Term
-	for k, _ := range s.termMap {
-		if k < sureTerm {
-			delete(s.termMap, k)
-		}
+func (s *RaftStates) HandleHeartbeat(req *Heartbeat, resp *HeartbeatReply) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.acceptLeader(req.Term, req.ServerName) {
+		resp.NotLeader = true
+		return
+	}
+
+	// If this server has the leader's last committed record, all records
+	// before it match the leader as well.
+	commitSeq := req.CommitSequence
+	if commitSeq.Index > s.db.GetCommitSequence().Index && s.db.HasRecord(commitSeq) {
+		s.commitTo(commitSeq.Index)
+	}
+
+	if s.db.GetCommitSequence().Index >= commitSeq.Index {
+		s.lastSyncTime = s.opts.Clock.Now()
+	}
+
+	// Go quiescent with the leader only if nothing is missing. Without
+	// multi-raft, nothing would wake this server up if the leader dies.
+	if req.Quiesce && s.opts.MultiRaft != nil &&
+		s.db.GetCommitSequence() == commitSeq {
+		s.quiescent = true
+		resp.Quiesced = true
 	}
 }
 
-func (s *RaftStates) Close() {
-	s.db.Close()
+func (s *RaftStates) HandleInstallSnapshot(
+	req *InstallSnapshot,
+	resp *InstallSnapshotReply) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.acceptLeader(req.Term, req.ServerName) {
+		resp.NotLeader = true
+		return
+	}
+
+	if s.db.GetCommitSequence().Index >= req.LastSequence.Index {
+		resp.Ok = true
+		return
+	}
+
+	// Chunks are taken in order. Committed data at the same sequence is
+	// the same, so chunks that have arrived before are skipped when the
+	// leader sends the snapshot again.
+	if s.pendingSnapshotSeq != req.LastSequence {
+		if req.Offset != 0 {
+			return
+		}
+		s.db.ResetStagedSnapshot()
+		s.pendingSnapshotSeq = req.LastSequence
+		s.pendingSnapshotRows = 0
+	}
+
+	if req.Offset == s.pendingSnapshotRows {
+		s.db.StageSnapshot(req.Keys, req.Values)
+		s.pendingSnapshotRows += len(req.Keys)
+	} else if req.Offset+len(req.Keys) > s.pendingSnapshotRows {
+		return
+	}
+
+	if req.Done {
+		// The store is swapped for the staged one, which has to wait
+		// for its readers, such as rows being copied for a split, or
+		// those left from when this server led the region. The leader
+		// sends the snapshot again, and staged rows are kept.
+		if s.storageReaders > 0 {
+			return
+		}
+		s.pendingSnapshotSeq = RaftSequence{}
+		s.pendingSnapshotRows = 0
+		s.dropStoreTask()
+
+		// The region has split or merged while this server fell behind.
+		// A region split off has to be replicated to this server again.
+		origin := s.opts.Region
+		s.db.InstallStagedSnapshot(req.LastSequence, &req.Configuration, req.Region)
+		s.reloadConfiguration()
+
+		if req.Region != origin {
+			if s.host != nil {
+				s.host.updateRegion(origin, req.Region, nil, false)
+			}
+		}
+	}
+
+	resp.Ok = true
+}
+
+// The leader asks this server to start an election immediately, because
+// it is handing over its leadership.
+func (s *RaftStates) HandleTimeoutNow(req *TimeoutNow, resp *TimeoutNowReply) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.acceptLeader(req.Term, req.ServerName) {
+		resp.NotLeader = true
+		return
+	}
+
+	if s.state != RAFT_FOLLOWER || !s.config.IsVoter(s.opts.Address) {
+		return
+	}
+
+	s.forceElection = true
+	s.becomeCandidate()
+	resp.Ok = true
+}
+
+func (s *RaftStates) HandleRead(req *ReadRequest, resp *ReadReply) {
+	switch req.Consistency {
+	case READ_LINEARIZABLE:
+		resp.Ok = s.waitForReadIndex()
+	case READ_LEASE:
+		resp.Ok = s.hasLease() || s.waitForReadIndex()
+	case READ_STALE:
+		resp.Ok = s.isFreshEnough(req.MaxStalenessMs)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !resp.Ok {
+		resp.NotLeader = req.Consistency != READ_STALE && s.state != RAFT_LEADER
+		return
+	}
+	if !RegionContainsKey(s.opts.Region, req.Key) {
+		resp.Ok = false
+		resp.WrongRegion = true
+		return
+	}
+	resp.Value, resp.Found = s.db.Read(req.Key)
+	s.load.record(req.Key, false, s.opts.Rand)
+}
+
+func (s *RaftStates) HandleWrite(req *WriteRequest, resp *WriteReply) {
+	if !RegionContainsKey(s.GetRegion(), req.Key) {
+		resp.WrongRegion = true
+		return
+	}
+
+	record := &RaftRecord{Key: req.Key, Value: req.Value}
+	if req.Increment {
+		record = NewIncrementRaftRecord(req.Key, req.Delta)
+	}
+
+	seq, ok := s.propose(record, true)
+	if !ok {
+		resp.NotLeader = true
+		return
+	}
+
+	s.mutex.Lock()
+	s.load.record(req.Key, true, s.opts.Rand)
+	s.mutex.Unlock()
+
+	resp.Ok = s.waitForCommit(seq)
+}
+
+// Wait until a record appended by this server is committed. Return false
+// if it is not committed in time, or it can no longer be told whether
+// the record is committed.
+func (s *RaftStates) waitForCommit(seq RaftSequence) bool {
+	defer s.unwatchCommit(seq)
+
+	timeOut := time.Duration(s.opts.RaftLeaderTimeoutMs) * time.Millisecond
+	deadline := s.opts.Clock.Now().Add(timeOut)
+	for {
+		s.mutex.Lock()
+		closed := s.closed
+		commitSeq := s.db.GetCommitSequence()
+		var term int64
+		if w, found := s.commitWatches[seq.Index]; found {
+			term = w.term
+		}
+		s.mutex.Unlock()
+
+		// A record of a later term may have replaced @seq. If a snapshot
+		// has been installed over it, there is no telling.
+		if term != 0 {
+			return term == seq.Term
+		}
+		if commitSeq.Index >= seq.Index || closed || !s.opts.Clock.Now().Before(deadline) {
+			return false
+		}
+		s.opts.Clock.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Remember the term that commits at the index of @seq, for waitForCommit.
+// Called with the lock held right after @seq is appended.
+func (s *RaftStates) watchCommit(seq RaftSequence) {
+	w, found := s.commitWatches[seq.Index]
+	if !found {
+		w = &commitWatch{}
+		s.commitWatches[seq.Index] = w
+	}
+	w.waiters++
+}
+
+func (s *RaftStates) unwatchCommit(seq RaftSequence) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if w, found := s.commitWatches[seq.Index]; found {
+		if w.waiters--; w.waiters == 0 {
+			delete(s.commitWatches, seq.Index)
+		}
+	}
+}
+
+// ReadIndex: remember the commit index, confirm that this server is still
+// the leader, and wait until the commit index has been applied.
+func (s *RaftStates) waitForReadIndex() bool {
+	s.mutex.Lock()
+	if s.state != RAFT_LEADER {
+		s.mutex.Unlock()
+		return false
+	}
+
+	epoch := s.epoch
+	term := s.leaderTerm
+
+	// A new leader does not know what previous leaders have committed
+	// until the first record of its own term is committed.
+	index := s.db.GetCommitSequence().Index
+	if index < s.leaderStartIndex {
+		index = s.leaderStartIndex
+	}
+	s.mutex.Unlock()
+
+	if !s.confirmLeadership(epoch, term) {
+		return false
+	}
+
+	timeOut := time.Duration(s.opts.RaftLeaderTimeoutMs) * time.Millisecond
+	deadline := s.opts.Clock.Now().Add(timeOut)
+	for {
+		s.mutex.Lock()
+		stale := s.epoch != epoch
+		done := s.db.GetCommitSequence().Index >= index
+		s.mutex.Unlock()
+
+		if stale {
+			return false
+		}
+		if done {
+			return true
+		}
+		if !s.opts.Clock.Now().Before(deadline) {
+			return false
+		}
+		s.opts.Clock.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Send a round of heartbeats to voters. Return true if a majority of
+// voters still accept this server as the leader.
+func (s *RaftStates) confirmLeadership(epoch, term int64) bool {
+	s.mutex.Lock()
+	if s.epoch != epoch {
+		s.mutex.Unlock()
+		return false
+	}
+
+	config := s.config.Clone()
+	req := Heartbeat{
+		ServerName:     s.opts.Address,
+		Term:           term,
+		Region:         s.opts.Region,
+		CommitSequence: s.db.GetCommitSequence(),
+		Quiesce:        s.quiescent,
+	}
+	s.mutex.Unlock()
+
+	start := s.opts.Clock.Now()
+	callMap := make(map[balancer.ServerName]RequestInfo)
+	for _, sn := range config.Voters {
+		if sn == s.opts.Address {
+			continue
+		}
+
+		cli := s.GetClient(sn)
+		if cli == nil {
+			continue
+		}
+
+		var reply HeartbeatReply
+		callMap[sn] = RequestInfo{
+			Cli:  cli,
+			Call: cli.Go("ServerRPC.Heartbeat", &req, &reply, nil),
+		}
+	}
+
+	timeOut := time.Duration(s.opts.RaftLeaderTimeoutMs / 2)
+	timeChan := s.opts.Clock.After(timeOut * time.Millisecond)
+
+	acked := 0
+	if config.IsVoter(s.opts.Address) {
+		acked++
+	}
+	for _, sn := range sortedServers(callMap) {
+		info := callMap[sn]
+		if !waitCall(info.Call, timeChan) {
+			timeChan = s.opts.Clock.After(time.Duration(0))
+			continue
+		}
+		if info.Call.Error != nil {
+			s.DropClient(sn, info.Cli)
+			continue
+		}
+		s.ReturnClient(sn, info.Cli)
+
+		resp := info.Call.Reply.(*HeartbeatReply)
+		if !resp.NotLeader && config.IsVoter(sn) {
+			acked++
+		}
+	}
+
+	if acked < config.Quorum() {
+		return false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.epoch != epoch {
+		return false
+	}
+	s.extendLease(start)
+	return true
+}
+
+// A leader holds a lease if a majority of voters have acknowledged it
+// recently. It also has to know everything committed by previous leaders.
+func (s *RaftStates) hasLease() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state != RAFT_LEADER || s.transferring {
+		return false
+	}
+	if s.db.GetCommitSequence().Index < s.leaderStartIndex {
+		return false
+	}
+	return s.opts.Clock.Now().Before(s.leaseExpire)
+}
+
+// Check if this server has synchronized with the leader within the
+// staleness bound.
+func (s *RaftStates) isFreshEnough(maxStalenessMs int64) bool {
+	if maxStalenessMs <= 0 {
+		maxStalenessMs = s.opts.MaxStaleReadMs
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	bound := time.Duration(maxStalenessMs) * time.Millisecond
+	return s.opts.Clock.Now().Sub(s.lastSyncTime) <= bound
+}
+
+func (s *RaftStates) HandleGetRaftState(req RaftStateRequest, resp *RaftStateReply) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	resp.Found = true
+	resp.State = s.state
+	resp.Configuration = s.config.Clone()
+	resp.Region = s.opts.Region
+	resp.CommitSequence = s.db.GetCommitSequence()
+	resp.FrozenSequence = s.frozenSeq
+	resp.ConfigurationCommitted = !s.configChangePending()
+	resp.Snapshots = make(map[balancer.ServerName]SnapshotProgress)
+	for sn, progress := range s.snapshots {
+		resp.Snapshots[sn] = progress
+	}
+}
+
+func (s *RaftStates) TrimTermMap() {
+	sureTerm := s.db.GetCommitSequence().Term
+	for k, _ := range s.termMap {
+		if k < sureTerm {
+			delete(s.termMap, k)
+		}
+	}
+}
+
+// Commit records in the log up to @index.
+func (s *RaftStates) commitTo(index int64) {
+	for {
+		commitSeq := s.db.GetCommitSequence()
+		if commitSeq.Index >= index {
+			return
+		}
+
+		seq, found := s.db.GetSequenceAt(commitSeq.Index + 1)
+		if !found {
+			return
+		}
+
+		// A split or merge is done before the record is committed, so that
+		// it is done again if this server crashes in the middle.
+		data, _ := s.db.GetRecord(seq)
+		origin := s.opts.Region
+		var right *RaftStorage
+		record, parseErr := NewRaftRecord(data)
+		if parseErr == nil && record.Type == RAFT_RECORD_SPLIT {
+			var ready bool
+			if right, ready = s.prepareSplit(record.Key, seq, index); !ready {
+				return
+			}
+			s.db.Split(record.Key, seq, right)
+		}
+		if parseErr == nil && record.Type == RAFT_RECORD_MERGE && !s.merge(record, seq, index) {
+			return
+		}
+
+		if s.opts.Observer != nil {
+			s.opts.Observer.Commit(s.opts.Address, seq, data)
+		}
+		status := s.db.Commit(seq)
+		if status != COMMIT_OK {
+			log.Panic("Fails to commit ", seq, ": ", status)
+		}
+		if w, found := s.commitWatches[seq.Index]; found {
+			w.term = seq.Term
+		}
+
+		// A merge that is interrupted by a crash has already changed the
+		// region, but the quorum merged still has to be retired.
+		isMerge := parseErr == nil && record.Type == RAFT_RECORD_MERGE
+		if right != nil {
+			s.startSplitRegion(origin, right)
+			s.startStoreTask(&storeTask{}, func() { s.db.TrimStore(record.Key) })
+		} else if (s.opts.Region != origin || isMerge) && s.host != nil {
+			s.host.updateRegion(origin, s.opts.Region, nil, s.state == RAFT_LEADER)
+		}
+	}
+}
+
+// Return the storage of the region that the split record at @seq splits
+// off at @key once rows are copied to it. Until then, @ready is false, and
+// records are committed up to @index once the copy is done.
+func (s *RaftStates) prepareSplit(
+	key []byte,
+	seq RaftSequence,
+	index int64) (right *RaftStorage, ready bool) {
+
+	task := s.storeTask
+	if s.storeTaskRunning(index) {
+		return
+	}
+	if task != nil && task.seq == seq {
+		s.storeTask = nil
+		return task.right, true
+	}
+	s.dropStoreTask()
+
+	storage := s.db.NewSplitStorage(key, seq)
+	// Split before a crash.
+	if s.db.IsSplitAt(key) {
+		return storage, true
+	}
+
+	task = &storeTask{seq: seq, right: storage, index: index}
+	if !s.startStoreTask(task, func() { s.db.CopySplitRows(storage, key) }) {
+		storage.Close()
+	}
+	return
+}
+
+// Run @work of @task without the lock. Return false if the raft states is
+// closed. Called with the lock held.
+func (s *RaftStates) startStoreTask(task *storeTask, work func()) bool {
+	if !s.acquireStorage() {
+		return false
+	}
+	s.storeTask = task
+
+	go func() {
+		work()
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		s.dropStorageReader()
+		task.done = true
+		if s.closed {
+			s.dropStoreTask()
+			return
+		}
+		if task.seq.Index == 0 {
+			s.storeTask = nil
+		}
+		s.commitTo(task.index)
+	}()
+	return true
+}
+
+// Return true if a store task is still running, in which case records are
+// committed up to @index once it is done.
+func (s *RaftStates) storeTaskRunning(index int64) bool {
+	task := s.storeTask
+	if task == nil || task.done {
+		return false
+	}
+	if task.index < index {
+		task.index = index
+	}
+	return true
+}
+
+// Forget a store task that is done. The region split off is removed, as
+// rows are copied to it again if the split is still to commit.
+func (s *RaftStates) dropStoreTask() {
+	if s.storeTask != nil && s.storeTask.right != nil {
+		s.storeTask.right.Close()
+		s.storeTask.right.Destroy()
+	}
+	s.storeTask = nil
+}
+
+// Fold data of the region in the merge record at @seq into this region.
+// Rows of the region are copied without the lock while it is frozen, and
+// records are committed up to @index once they are. Return false until
+// then, or if the replica of the region on this server has not committed
+// the freeze record yet, in which case the merge is tried again on the
+// next commit.
+func (s *RaftStates) merge(record *RaftRecord, seq RaftSequence, index int64) bool {
+	merge, err := NewRaftMerge(record.Value)
+	if err != nil {
+		log.Panic("Fails to parse a merge record: ", err)
+	}
+
+	if s.storeTaskRunning(index) {
+		return false
+	}
+	if task := s.storeTask; task != nil && task.seq == seq {
+		s.storeTask = nil
+		log.Printf("Region %v on %v merges %v\n", s.opts.Region, s.opts.Address, merge.Region)
+		s.db.Merge(merge.Region)
+		return true
+	}
+	s.dropStoreTask()
+
+	// Merged before a crash.
+	if s.db.IsMerged(merge.Region) {
+		return true
+	}
+
+	var right *RaftStates
+	if s.host != nil {
+		right = s.host.findRegion(merge.Region)
+	}
+	if right == nil {
+		log.Printf("Region %v on %v waits for %v to merge\n",
+			s.opts.Region, s.opts.Address, merge.Region)
+		return false
+	}
+
+	// Nothing is written to the region once it is frozen.
+	right.mutex.Lock()
+	frozen := right.db.GetCommitSequence().Index >= merge.FrozenSequence.Index
+	ok := frozen && right.acquireStorage()
+	right.mutex.Unlock()
+	if !ok {
+		return false
+	}
+
+	task := &storeTask{seq: seq, index: index}
+	copyRows := func() {
+		s.db.CopyMergeRows(right.db, merge.Region)
+		right.releaseStorage()
+	}
+	if !s.startStoreTask(task, copyRows) {
+		right.releaseStorage()
+	}
+	return false
+}
+
+// Start the raft states of a region that is split off from this one.
+func (s *RaftStates) startSplitRegion(origin balancer.Region, right *RaftStorage) {
+	opts := right.GetRaftOptions()
+	if s.opts.Rand != nil {
+		opts.Rand = rand.New(rand.NewSource(s.opts.Rand.Int63()))
+	}
+	states := NewRaftStates(opts, right)
+
+	log.Printf("Region %v on %v splits into %v and %v\n",
+		origin, s.opts.Address, s.opts.Region, opts.Region)
+
+	if s.host == nil {
+		states.Close()
+		return
+	}
+	s.host.updateRegion(origin, s.opts.Region, states, s.state == RAFT_LEADER)
+}
+
+// Append a new record to the log of the leader. The leader loop will
+// replicate the record to other members.
+func (s *RaftStates) appendRecord(record *RaftRecord) (seq RaftSequence, ok bool) {
+	if s.state != RAFT_LEADER || s.closed {
+		return
+	}
+
+	lastSeq := s.db.GetRaftSequence()
+	seq = RaftSequence{Term: s.leaderTerm, Index: lastSeq.Index + 1}
+
+	data := record.ToSlice()
+	if !s.db.SaveRaftRecord(seq, data) {
+		return
+	}
+
+	s.applyRecord(seq, data)
+
+	s.wakeReplicator()
+
+	ok = true
+	return
+}
+
+// Tell the leader loop that there is something to replicate.
+func (s *RaftStates) wakeReplicator() {
+	select {
+	case s.replicateChan <- true:
+	default:
+	}
+}
+
+// Take effect of a record as soon as it is added to the log.
+// Configuration changes do not wait for commit.
+func (s *RaftStates) applyRecord(seq RaftSequence, data []byte) {
+	record, err := NewRaftRecord(data)
+	if err == nil {
+		switch record.Type {
+		case RAFT_RECORD_SPLIT, RAFT_RECORD_MERGE:
+			s.rangeSeq = seq
+		case RAFT_RECORD_FREEZE:
+			s.frozenSeq = seq
+		case RAFT_RECORD_THAW:
+			s.frozenSeq = RaftSequence{}
+		}
+	}
+	if err != nil || record.Type != RAFT_RECORD_CONFIG {
+		return
+	}
+
+	config, parseErr := NewRaftConfiguration(record.Value)
+	if parseErr != nil {
+		panic(fmt.Sprintf("Fails to parse configuration: %#v", parseErr))
+	}
+
+	s.config = *config
+	s.configSeq = seq
+}
+
+// Return the configuration that has been committed.
+func (s *RaftStates) getCommittedConfiguration() RaftConfiguration {
+	config, found := s.db.GetConfiguration()
+	if !found {
+		config = RaftConfiguration{Voters: s.opts.Members}
+	}
+	return config.Clone()
+}
+
+// Figure out current configuration from the committed one and
+// configuration records that have not been committed yet.
+func (s *RaftStates) reloadConfiguration() {
+	s.config = s.getCommittedConfiguration()
+	s.configSeq = s.db.GetCommitSequence()
+	s.rangeSeq = s.configSeq
+	s.frozenSeq = s.db.GetFrozenSequence()
+
+	iter := s.db.log.CreateIterator(s.db.rdOpts)
+	defer iter.Destroy()
+
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		seq, keyErr := NewRaftSequenceFromKey(iter.Key())
+		if keyErr != nil {
+			panic("Bad keys in log!")
+		}
+		if seq.Index > s.configSeq.Index {
+			s.applyRecord(*seq, iter.Value())
+		}
+	}
+}
+
+// Return true if a configuration change has not been committed yet.
+func (s *RaftStates) configChangePending() bool {
+	return s.configSeq.Index > s.db.GetCommitSequence().Index
+}
+
+// Return true if a split or merge has not been committed yet.
+func (s *RaftStates) rangeChangePending() bool {
+	return s.rangeSeq.Index > s.db.GetCommitSequence().Index
+}
+
+func (s *RaftStates) isFrozen() bool {
+	return s.frozenSeq.Index > 0
+}
+
+// Return current quorum configuration.
+func (s *RaftStates) GetConfiguration() RaftConfiguration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.config.Clone()
+}
+
+func (s *RaftStates) GetState() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state
+}
+
+func (s *RaftStates) GetCommitSequence() RaftSequence {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.db.GetCommitSequence()
+}
+
+// Propose a new record to the quorum. Only the leader accepts proposals.
+// The record is committed asynchronously. Writes are rejected if their
+// keys are not in the region, or the region is splitting.
+func (s *RaftStates) Propose(record *RaftRecord) (seq RaftSequence, ok bool) {
+	return s.propose(record, false)
+}
+
+// Append @record like Propose. If @watch is set, the caller waits for it
+// by waitForCommit.
+func (s *RaftStates) propose(record *RaftRecord, watch bool) (seq RaftSequence, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.transferring {
+		return
+	}
+
+	isWrite := record.Type == RAFT_RECORD_DATA || record.Type == RAFT_RECORD_INCREMENT
+	if isWrite && (s.rangeChangePending() || s.isFrozen() ||
+		!RegionContainsKey(s.opts.Region, record.Key)) {
+		return
+	}
+	seq, ok = s.appendRecord(record)
+	if ok && watch {
+		s.watchCommit(seq)
+	}
+	return
+}
+
+// Split the region at @key. Keys from @key on move to a new region with
+// the same members. If @key is nil, the region is split into two halves
+// of about the same size. Return false if this is not the leader, @key is
+// not inside the region, or another split is still in progress. The
+// split is done asynchronously on each member once it is committed.
+func (s *RaftStates) SplitRegion(key []byte) bool {
+	if key == nil {
+		// Looking for the key reads the store, which is done without
+		// the lock.
+		s.mutex.Lock()
+		if !s.canSplit() || !s.acquireStorage() {
+			s.mutex.Unlock()
+			return false
+		}
+		s.mutex.Unlock()
+
+		var found bool
+		key, found = s.db.FindSplitKey()
+		s.releaseStorage()
+		if !found {
+			return false
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.canSplit() {
+		return false
+	}
+
+	// Both halves must not be empty. The region may have changed while
+	// the key was found.
+	if string(key) <= s.opts.Region.StartKey || !RegionContainsKey(s.opts.Region, key) {
+		return false
+	}
+
+	_, ok := s.appendRecord(NewSplitRaftRecord(key))
+	return ok
+}
+
+// Check if the leader can split the region. Called with the lock held.
+func (s *RaftStates) canSplit() bool {
+	return s.state == RAFT_LEADER && !s.transferring && !s.rangeChangePending() &&
+		!s.isFrozen() && s.storeTask == nil
+}
+
+// Stop writes to the region, so that it can be merged into its neighbor.
+// Block until the freeze record is committed, and return its sequence.
+// Return false if this is not the leader, or the key range or members of
+// the region are changing. A region that is already frozen stays so.
+func (s *RaftStates) Freeze() (seq RaftSequence, ok bool) {
+	s.mutex.Lock()
+	if s.state != RAFT_LEADER || s.transferring ||
+		s.configChangePending() || s.rangeChangePending() {
+		s.mutex.Unlock()
+		return
+	}
+
+	if s.isFrozen() {
+		seq = s.frozenSeq
+		s.mutex.Unlock()
+		return seq, true
+	}
+	seq, ok = s.appendRecord(NewFreezeRaftRecord())
+	if ok {
+		s.watchCommit(seq)
+	}
+	s.mutex.Unlock()
+
+	if !ok || !s.waitForCommit(seq) {
+		return RaftSequence{}, false
+	}
+	return seq, true
+}
+
+// Accept writes again after a merge fails. Return false if this is not
+// the leader.
+func (s *RaftStates) Thaw() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state != RAFT_LEADER || s.transferring {
+		return false
+	}
+	if !s.isFrozen() {
+		return true
+	}
+	_, ok := s.appendRecord(NewThawRaftRecord())
+	return ok
+}
+
+// Merge region @right, the neighbor on the right with the same members,
+// into this region. The region on the right is frozen first, and the
+// merge record is appended once every member has committed the freeze.
+// Each member then folds its copy of the frozen region into this one,
+// and retires the frozen quorum. This region always survives, so a
+// request for it still finds the quorum by its start key.
+//
+// Block until the merge is committed. Return false if this is not the
+// leader, the regions cannot be merged, or the merge does not commit in
+// time. The region on the right is thawed if the merge is never started.
+func (s *RaftStates) MergeRegion(right balancer.Region) bool {
+	s.mutex.Lock()
+	ok := s.canMerge(right)
+	config := s.config.Clone()
+	s.mutex.Unlock()
+	if !ok {
+		return false
+	}
+
+	members := config.GetMembers()
+
+	frozenSeq, frozen := s.freezeRegion(members, right)
+	if !frozen {
+		return false
+	}
+
+	if !s.waitForFrozenReplicas(members, right, frozenSeq, &config) {
+		s.thawRegion(members, right)
+		return false
+	}
+
+	s.mutex.Lock()
+	var seq RaftSequence
+	ok = s.canMerge(right) && s.config.SameMembers(&config)
+	if ok {
+		seq, ok = s.appendRecord(NewMergeRaftRecord(right, frozenSeq))
+	}
+	if ok {
+		s.watchCommit(seq)
+	}
+	s.mutex.Unlock()
+
+	if !ok {
+		s.thawRegion(members, right)
+		return false
+	}
+	return s.waitForCommit(seq)
+}
+
+// Check if region @right can be merged into this region.
+func (s *RaftStates) canMerge(right balancer.Region) bool {
+	return s.state == RAFT_LEADER && !s.transferring && !s.isFrozen() &&
+		!s.configChangePending() && !s.rangeChangePending() &&
+		s.opts.Region.EndKey != "" && s.opts.Region.EndKey == right.StartKey
+}
+
+// Ask members until the leader of region @r freezes it.
+func (s *RaftStates) freezeRegion(
+	members []balancer.ServerName,
+	r balancer.Region) (seq RaftSequence, ok bool) {
+
+	for _, sn := range members {
+		req := FreezeRegionRequest{Region: r}
+		var reply FreezeRegionReply
+		if s.callMember(sn, "ServerRPC.FreezeRegion", &req, &reply) && reply.Ok {
+			return reply.FrozenSequence, true
+		}
+	}
+	return
+}
+
+// Ask members until the leader of region @r thaws it. It is only tried
+// once, and a region that is left frozen can be merged later.
+func (s *RaftStates) thawRegion(members []balancer.ServerName, r balancer.Region) {
+	for _, sn := range members {
+		req := FreezeRegionRequest{Region: r, Thaw: true}
+		var reply FreezeRegionReply
+		if s.callMember(sn, "ServerRPC.FreezeRegion", &req, &reply) && reply.Ok {
+			return
+		}
+	}
+	log.Printf("Region %v stays frozen\n", r)
+}
+
+// Wait until each member has committed the freeze record of region @r
+// at @frozenSeq, and the region has the same members as @config.
+func (s *RaftStates) waitForFrozenReplicas(
+	members []balancer.ServerName,
+	r balancer.Region,
+	frozenSeq RaftSequence,
+	config *RaftConfiguration) bool {
+
+	timeOut := time.Duration(s.opts.MergeTimeoutMs) * time.Millisecond
+	deadline := s.opts.Clock.Now().Add(timeOut)
+
+	pending := members
+	for len(pending) > 0 {
+		var next []balancer.ServerName
+		for _, sn := range pending {
+			req := RaftStateRequest{Region: r}
+			var reply RaftStateReply
+			if !s.callMember(sn, "ServerRPC.GetRaftState", &req, &reply) ||
+				!reply.Found || reply.Region != r ||
+				reply.FrozenSequence != frozenSeq ||
+				reply.CommitSequence.Index < frozenSeq.Index ||
+				!reply.Configuration.SameMembers(config) {
+				next = append(next, sn)
+			}
+		}
+		pending = next
+
+		if len(pending) == 0 {
+			break
+		}
+		if !s.opts.Clock.Now().Before(deadline) {
+			return false
+		}
+		s.opts.Clock.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// Call @method on member @sn. Return false if the call fails or times out.
+func (s *RaftStates) callMember(
+	sn balancer.ServerName,
+	method string,
+	req interface{},
+	reply interface{}) bool {
+
+	cli := s.GetClient(sn)
+	if cli == nil {
+		return false
+	}
+
+	call := cli.Go(method, req, reply, nil)
+
+	timeOut := time.Duration(s.opts.RaftLeaderTimeoutMs)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			s.DropClient(sn, cli)
+			return false
+		}
+		s.ReturnClient(sn, cli)
+		return true
+	case <-s.opts.Clock.After(timeOut * time.Millisecond):
+		return false
+	}
+}
+
+// Return the size of the region and its load since the last call, and
+// whether this server leads the region. Only the leader sees all
+// requests.
+func (s *RaftStates) CollectLoad() (load balancer.RegionLoad, isLeader bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	load.Region = s.opts.Region
+	load.Leader = s.opts.Address
+	load.Members = s.config.GetMembers()
+	load.Size = s.db.GetApproximateSize()
+	load.ReadQps, load.WriteQps, load.LoadSplitKey = s.load.collect(s.opts.Clock.Now())
+	return load, s.state == RAFT_LEADER
+}
+
+// Return the key range that the region currently covers.
+func (s *RaftStates) GetRegion() balancer.Region {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.opts.Region
+}
+
+// Let @host serve the region.
+func (s *RaftStates) setHost(host regionHost) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.host = host
+}
+
+// Add a new member to the quorum. The member joins as a learner, and
+// the leader promotes it to a voter once it has caught up. Return false
+// if this is not the leader, or another configuration change is still
+// in progress.
+func (s *RaftStates) AddMember(sn balancer.ServerName) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state != RAFT_LEADER || s.transferring || s.configChangePending() || s.isFrozen() {
+		return false
+	}
+	if s.config.IsMember(sn) {
+		return false
+	}
+
+	config := s.config.WithLearner(sn)
+	_, ok := s.appendRecord(NewConfigRaftRecord(&config))
+	return ok
+}
+
+// Remove a member from the quorum. Return false if this is not the leader,
+// or another configuration change is still in progress.
+func (s *RaftStates) RemoveMember(sn balancer.ServerName) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.state != RAFT_LEADER || s.transferring || s.configChangePending() || s.isFrozen() {
+		return false
+	}
+	if !s.config.IsMember(sn) {
+		return false
+	}
+
+	config := s.config.Without(sn)
+	if len(config.Voters) == 0 {
+		return false
+	}
+
+	_, ok := s.appendRecord(NewConfigRaftRecord(&config))
+	return ok
+}
+
+// Hand over leadership to @target, which must be a voter. If @target is
+// empty, one of voters is picked. The leader brings the target up to date,
+// stops accepting new writes, and asks the target to start an election
+// right away. Block until this server is no longer the leader. Return false
+// if the transfer does not complete in time, in which case the leader
+// accepts new writes again.
+func (s *RaftStates) TransferLeadership(target balancer.ServerName) bool {
+	s.mutex.Lock()
+	if s.state != RAFT_LEADER || s.transferring {
+		s.mutex.Unlock()
+		return false
+	}
+
+	var empty balancer.ServerName
+	if target == empty {
+		for _, sn := range s.config.Voters {
+			if sn != s.opts.Address {
+				target = sn
+				break
+			}
+		}
+	}
+
+	if target == s.opts.Address || !s.config.IsVoter(target) {
+		s.mutex.Unlock()
+		return false
+	}
+
+	s.transferring = true
+	s.transferTarget = target
+	epoch := s.epoch
+	s.wakeReplicator()
+	s.mutex.Unlock()
+
+	timeOut := time.Duration(s.opts.LeaderTransferTimeoutMs) * time.Millisecond
+	deadline := s.opts.Clock.Now().Add(timeOut)
+	for s.opts.Clock.Now().Before(deadline) {
+		s.mutex.Lock()
+		done := s.epoch != epoch
+		s.mutex.Unlock()
+		if done {
+			return true
+		}
+		s.opts.Clock.Sleep(10 * time.Millisecond)
+	}
+
+	// Give up the transfer.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.epoch != epoch {
+		return true
+	}
+	s.transferring = false
+	return false
+}
+
+func (s *RaftStates) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Stop all state loops.
+	s.epoch++
+	s.closed = true
+	if s.storageReaders == 0 {
+		s.db.Close()
+	}
+	if s.storeTask != nil && s.storeTask.done {
+		s.dropStoreTask()
+	}
+
+	// Quiescent state loops only wake up on these channels.
+	select {
+	case s.leaderActivityChan <- true:
+	default:
+	}
+	s.wakeReplicator()
+}
+
+// Let the caller read rows of the storage without the lock, until it
+// calls releaseStorage. Return false if the raft states is closed. Called
+// with the lock held.
+func (s *RaftStates) acquireStorage() bool {
+	if s.closed {
+		return false
+	}
+	s.storageReaders++
+	return true
+}
+
+// Called without the lock once a reader is done with the storage. The
+// storage is closed here if Close is called in the meantime.
+func (s *RaftStates) releaseStorage() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dropStorageReader()
+}
+
+// Like releaseStorage, but called with the lock held.
+func (s *RaftStates) dropStorageReader() {
+	s.storageReaders--
+	if s.closed && s.storageReaders == 0 {
+		s.db.Close()
+	}
+}
+
+// Check if the region is quiescent. If so, also return its leader.
+func (s *RaftStates) GetQuiescentLeader() (leader balancer.ServerName, quiescent bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.leader, s.quiescent
+}
+
+// Wake up a quiescent follower. It starts to wait for heartbeats again,
+// and starts an election if the leader does not show up.
+func (s *RaftStates) Unquiesce() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.quiescent || s.state != RAFT_FOLLOWER {
+		return
+	}
+	s.quiescent = false
+
+	select {
+	case s.leaderActivityChan <- true:
+	default:
+	}
 }
 
 func (s *RaftStates) GetStorage() *RaftStorage {
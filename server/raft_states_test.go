@@ -52,6 +52,39 @@ func TestRaftStatesInitialized(t *testing.T) {
 	}
 }
 
+func TestRaftWaitForCommitAfterNewTerm(t *testing.T) {
+	root := "/tmp/TestRaftWaitForCommitAfterNewTerm"
+	store := initRaftStorageForTest(root, balancer.Region{}, true)
+	states := NewRaftStates(store.GetRaftOptions(), store)
+	defer states.Close()
+
+	// Records 1 and 2 of term 1 are appended, and record 2 is replaced
+	// by one of term 2 before both commit.
+	first := RaftSequence{Index: 1, Term: 1}
+	replaced := RaftSequence{Index: 2, Term: 1}
+	record := RaftRecord{Key: []byte("k"), Value: []byte("v")}
+
+	states.mutex.Lock()
+	for _, seq := range []RaftSequence{first, replaced} {
+		store.SaveRaftRecord(seq, record.ToSlice())
+		states.watchCommit(seq)
+	}
+	store.TruncateFrom(2)
+	store.SaveRaftRecord(RaftSequence{Index: 2, Term: 2}, record.ToSlice())
+	states.commitTo(2)
+	states.mutex.Unlock()
+
+	if !states.waitForCommit(first) {
+		t.Error("Reports a committed record as failed after a new term commits")
+	}
+	if states.waitForCommit(replaced) {
+		t.Error("Reports a replaced record as committed")
+	}
+	if len(states.commitWatches) != 0 {
+		t.Error("Keeps watches that nobody waits on:", len(states.commitWatches))
+	}
+}
+
 func TestRaftLeaderElection(t *testing.T) {
 	log.SetFlags(log.Lshortfile)
 
@@ -111,3 +144,472 @@ func TestRaftLeaderElection(t *testing.T) {
 
 	t.Error("Fails to elect a leader in given time!")
 }
+
+func TestRaftAddAndRemoveMember(t *testing.T) {
+	log.SetFlags(log.Lshortfile)
+
+	root := "/tmp/TestRaftAddAndRemoveMember"
+	reg := balancer.Region{}
+
+	rss, servers := initRaftQuorum(root, reg, 3, true)
+	defer func() {
+		for _, serv := range servers {
+			serv.Close()
+		}
+	}()
+
+	leader := waitForRaftLeader(rss, 5*time.Second)
+	if leader == nil {
+		t.Fatal("Fails to elect a leader!")
+	}
+
+	var lastSeq RaftSequence
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("key%d", i)
+		record := RaftRecord{Key: []byte(key), Value: []byte("value")}
+		seq, ok := leader.Propose(&record)
+		if !ok {
+			t.Fatal("Fails to propose a record")
+		}
+		lastSeq = seq
+	}
+
+	// Add a brand new server. It has to catch up before being promoted.
+	learner, learnerServer := initRaftLearner(root+"/learner", reg, root)
+	defer learnerServer.Close()
+
+	learnerName := learner.opts.Address
+	if !leader.AddMember(learnerName) {
+		t.Fatal("Fails to add a member")
+	}
+
+	config := leader.GetConfiguration()
+	if !config.IsLearner(learnerName) {
+		t.Error("New member should join as a learner")
+	}
+
+	// Only one configuration change can be in progress.
+	if leader.RemoveMember(rss[0].opts.Address) {
+		t.Error("Should not allow concurrent configuration changes")
+	}
+
+	promoted := waitForCondition(5*time.Second, func() bool {
+		config := leader.GetConfiguration()
+		leader.mutex.Lock()
+		defer leader.mutex.Unlock()
+		return config.IsVoter(learnerName) && !leader.configChangePending()
+	})
+	if !promoted {
+		t.Fatal("Fails to promote the learner")
+	}
+
+	caughtUp := waitForCondition(5*time.Second, func() bool {
+		learner.mutex.Lock()
+		defer learner.mutex.Unlock()
+		return !learner.db.GetCommitSequence().Less(lastSeq)
+	})
+	if !caughtUp {
+		t.Error("Learner fails to catch up")
+	}
+
+	config = learner.GetConfiguration()
+	if !config.IsVoter(learnerName) || len(config.Voters) != 4 {
+		t.Error("Learner does not know new configuration:", config)
+	}
+
+	// Now remove one of followers.
+	var victim balancer.ServerName
+	for _, states := range rss {
+		if states != leader {
+			victim = states.opts.Address
+			break
+		}
+	}
+
+	if !leader.RemoveMember(victim) {
+		t.Fatal("Fails to remove a member")
+	}
+
+	removed := waitForCondition(5*time.Second, func() bool {
+		config := learner.GetConfiguration()
+		return !config.IsMember(victim) && len(config.Voters) == 3
+	})
+	if !removed {
+		t.Error("Fails to remove a member")
+	}
+}
+
+func TestRaftTransferLeadership(t *testing.T) {
+	log.SetFlags(log.Lshortfile)
+
+	root := "/tmp/TestRaftTransferLeadership"
+	reg := balancer.Region{}
+
+	rss, servers := initRaftQuorum(root, reg, 3, true)
+	defer func() {
+		for _, serv := range servers {
+			serv.Close()
+		}
+	}()
+
+	leader := waitForRaftLeader(rss, 5*time.Second)
+	if leader == nil {
+		t.Fatal("Fails to elect a leader!")
+	}
+
+	record := RaftRecord{Key: []byte("hello"), Value: []byte("world")}
+	if _, ok := leader.Propose(&record); !ok {
+		t.Fatal("Fails to propose a record")
+	}
+
+	var target *RaftStates
+	for _, states := range rss {
+		if states != leader {
+			target = states
+			break
+		}
+	}
+
+	if !leader.TransferLeadership(target.opts.Address) {
+		t.Fatal("Fails to transfer leadership")
+	}
+
+	if !waitForCondition(2*time.Second, func() bool {
+		return target.GetState() == RAFT_LEADER
+	}) {
+		t.Error("Target does not become the leader")
+	}
+
+	if leader.GetState() == RAFT_LEADER {
+		t.Error("Old leader should step down")
+	}
+
+	// The new leader accepts writes, and the old leader rejects them.
+	if _, ok := target.Propose(&record); !ok {
+		t.Error("New leader should accept writes")
+	}
+	if _, ok := leader.Propose(&record); ok {
+		t.Error("Old leader should reject writes")
+	}
+}
+
+func TestRaftTransferLeadershipToNonMember(t *testing.T) {
+	root := "/tmp/TestRaftTransferLeadershipToNonMember"
+	reg := balancer.Region{}
+
+	rss, servers := initRaftQuorum(root, reg, 3, true)
+	defer func() {
+		for _, serv := range servers {
+			serv.Close()
+		}
+	}()
+
+	leader := waitForRaftLeader(rss, 5*time.Second)
+	if leader == nil {
+		t.Fatal("Fails to elect a leader!")
+	}
+
+	stranger := balancer.ServerName{Host: "127.0.0.1", Port: 1}
+	if leader.TransferLeadership(stranger) {
+		t.Error("Should not transfer leadership to a non member")
+	}
+	if leader.TransferLeadership(leader.opts.Address) {
+		t.Error("Should not transfer leadership to itself")
+	}
+}
+
+func enablePreVoteAndCheckQuorum(network *testNetwork) func(opts *RaftOptions) {
+	return func(opts *RaftOptions) {
+		opts.PreVote = true
+		opts.CheckQuorum = true
+		opts.Transport = network.Transport(opts.Address)
+	}
+}
+
+func getLeaderTerm(states *RaftStates) int64 {
+	states.mutex.Lock()
+	defer states.mutex.Unlock()
+	return states.leaderTerm
+}
+
+func TestRaftPreVoteWithPartitionedFollower(t *testing.T) {
+	log.SetFlags(log.Lshortfile)
+
+	root := "/tmp/TestRaftPreVoteWithPartitionedFollower"
+	reg := balancer.Region{}
+
+	network := newTestNetwork()
+	rss, servers := initRaftQuorumWithOptions(
+		root, reg, 3, true, enablePreVoteAndCheckQuorum(network))
+	defer func() {
+		for _, serv := range servers {
+			serv.Close()
+		}
+	}()
+
+	leader := waitForRaftLeader(rss, 5*time.Second)
+	if leader == nil {
+		t.Fatal("Fails to elect a leader!")
+	}
+	term := getLeaderTerm(leader)
+
+	var follower *RaftStates
+	for _, states := range rss {
+		if states != leader {
+			follower = states
+			break
+		}
+	}
+
+	// The partitioned follower keeps timing out, but it can never win
+	// a pre-vote.
+	network.Isolate(follower.opts.Address)
+	time.Sleep(2 * time.Second)
+	network.Heal()
+
+	if !waitForCondition(2*time.Second, func() bool {
+		return follower.GetState() == RAFT_FOLLOWER
+	}) {
+		t.Error("Partitioned follower should rejoin as a follower")
+	}
+
+	time.Sleep(time.Second)
+	if leader.GetState() != RAFT_LEADER || getLeaderTerm(leader) != term {
+		t.Error("Returning follower should not disturb the leader")
+	}
+
+	// Leader transfer bypasses pre-vote and leader stickiness.
+	if !leader.TransferLeadership(follower.opts.Address) {
+		t.Fatal("Fails to transfer leadership")
+	}
+	if !waitForCondition(2*time.Second, func() bool {
+		return follower.GetState() == RAFT_LEADER
+	}) {
+		t.Error("Target does not become the leader")
+	}
+}
+
+func TestRaftCheckQuorum(t *testing.T) {
+	log.SetFlags(log.Lshortfile)
+
+	root := "/tmp/TestRaftCheckQuorum"
+	reg := balancer.Region{}
+
+	network := newTestNetwork()
+	rss, servers := initRaftQuorumWithOptions(
+		root, reg, 3, true, enablePreVoteAndCheckQuorum(network))
+	defer func() {
+		for _, serv := range servers {
+			serv.Close()
+		}
+	}()
+
+	leader := waitForRaftLeader(rss, 5*time.Second)
+	if leader == nil {
+		t.Fatal("Fails to elect a leader!")
+	}
+
+	network.Isolate(leader.opts.Address)
+
+	if !waitForCondition(2*time.Second, func() bool {
+		return leader.GetState() != RAFT_LEADER
+	}) {
+		t.Error("Partitioned leader should step down")
+	}
+
+	var others []*RaftStates
+	for _, states := range rss {
+		if states != leader {
+			others = append(others, states)
+		}
+	}
+
+	if waitForRaftLeader(others, 5*time.Second) == nil {
+		t.Error("The majority should elect a new leader")
+	}
+}
+
+func TestRaftReadConsistency(t *testing.T) {
+	log.SetFlags(log.Lshortfile)
+
+	root := "/tmp/TestRaftReadConsistency"
+	reg := balancer.Region{}
+
+	network := newTestNetwork()
+	rss, servers := initRaftQuorumWithOptions(
+		root, reg, 3, true, enablePreVoteAndCheckQuorum(network))
+	defer func() {
+		for _, serv := range servers {
+			serv.Close()
+		}
+	}()
+
+	leader := waitForRaftLeader(rss, 5*time.Second)
+	if leader == nil {
+		t.Fatal("Fails to elect a leader!")
+	}
+
+	record := RaftRecord{Key: []byte("hello"), Value: []byte("world")}
+	seq, ok := leader.Propose(&record)
+	if !ok {
+		t.Fatal("Fails to propose a record")
+	}
+
+	var follower *RaftStates
+	for _, states := range rss {
+		if states != leader {
+			follower = states
+			break
+		}
+	}
+
+	if !waitForCondition(2*time.Second, func() bool {
+		return follower.GetCommitSequence().Index >= seq.Index
+	}) {
+		t.Fatal("Record is not committed on the follower")
+	}
+
+	read := func(states *RaftStates, req ReadRequest) ReadReply {
+		req.Key = record.Key
+		var resp ReadReply
+		states.HandleRead(&req, &resp)
+		return resp
+	}
+
+	for _, level := range []int{READ_LINEARIZABLE, READ_LEASE, READ_STALE} {
+		resp := read(leader, ReadRequest{Consistency: level})
+		if !resp.Ok || !resp.Found || string(resp.Value) != "world" {
+			t.Error("Leader fails to serve read", level, resp)
+		}
+	}
+
+	resp := read(follower, ReadRequest{Consistency: READ_LINEARIZABLE})
+	if resp.Ok || !resp.NotLeader {
+		t.Error("Follower should redirect linearizable reads", resp)
+	}
+
+	resp = read(follower, ReadRequest{Consistency: READ_STALE})
+	if !resp.Ok || string(resp.Value) != "world" {
+		t.Error("Follower fails to serve stale read", resp)
+	}
+
+	// A partitioned follower stops serving reads once it falls behind
+	// the staleness bound.
+	network.Isolate(follower.opts.Address)
+	time.Sleep(500 * time.Millisecond)
+	resp = read(follower, ReadRequest{Consistency: READ_STALE, MaxStalenessMs: 300})
+	if resp.Ok {
+		t.Error("Partitioned follower should not serve stale read", resp)
+	}
+	network.Heal()
+
+	// A partitioned leader cannot confirm its leadership.
+	network.Isolate(leader.opts.Address)
+	time.Sleep(500 * time.Millisecond)
+	resp = read(leader, ReadRequest{Consistency: READ_LINEARIZABLE})
+	if resp.Ok {
+		t.Error("Partitioned leader should not serve linearizable read", resp)
+	}
+	resp = read(leader, ReadRequest{Consistency: READ_LEASE})
+	if resp.Ok {
+		t.Error("Partitioned leader should not serve lease read", resp)
+	}
+}
+
+func TestRaftScanNoncommitLogsBounded(t *testing.T) {
+	log.SetFlags(log.Lshortfile)
+
+	root := "/tmp/TestRaftScanNoncommitLogsBounded"
+	reg := balancer.Region{}
+
+	states, server := initRaftStates(root, reg, true)
+	defer server.Close()
+
+	for i := int64(1); i <= 10; i++ {
+		record := RaftRecord{Key: []byte("key"), Value: make([]byte, 100)}
+		states.db.SaveRaftRecord(RaftSequence{Term: 1, Index: i}, record.ToSlice())
+	}
+
+	start := RaftSequence{Term: 1, Index: 2}
+	data, size := states.ScanNoncommitLogs(&start, 3, 1<<20)
+	if len(data) != 3 || size == 0 {
+		t.Error("Unexpected number of records:", len(data), size)
+	}
+	for i := int64(3); i <= 5; i++ {
+		if _, found := data[RaftSequence{Term: 1, Index: i}]; !found {
+			t.Error("Missing record", i)
+		}
+	}
+
+	// At least one record is returned even if it exceeds the byte limit.
+	data, _ = states.ScanNoncommitLogs(&start, 10, 1)
+	if len(data) != 1 {
+		t.Error("Should return exactly one record:", len(data))
+	}
+
+	last := RaftSequence{Term: 1, Index: 10}
+	data, _ = states.ScanNoncommitLogs(&last, 10, 1<<20)
+	if len(data) != 0 {
+		t.Error("Should return nothing after the last record:", len(data))
+	}
+}
+
+func TestRaftPipelinedReplication(t *testing.T) {
+	log.SetFlags(log.Lshortfile)
+
+	root := "/tmp/TestRaftPipelinedReplication"
+	reg := balancer.Region{}
+
+	// Heartbeats are much slower than replication in this test.
+	rss, servers := initRaftQuorumWithOptions(root, reg, 3, true, func(opts *RaftOptions) {
+		opts.RaftLeaderTimeoutMs = 2000
+		opts.HeartbeatIntervalMs = 500
+		opts.MaxAppendEntries = 4
+		opts.MaxInflightAppends = 2
+	})
+	defer func() {
+		for _, serv := range servers {
+			serv.Close()
+		}
+	}()
+
+	leader := waitForRaftLeader(rss, 10*time.Second)
+	if leader == nil {
+		t.Fatal("Fails to elect a leader!")
+	}
+
+	// A write is committed without waiting for the next heartbeat.
+	begin := time.Now()
+	record := RaftRecord{Key: []byte("hello"), Value: []byte("world")}
+	seq, ok := leader.Propose(&record)
+	if !ok {
+		t.Fatal("Fails to propose a record")
+	}
+	if !waitForCondition(2*time.Second, func() bool {
+		return leader.GetCommitSequence().Index >= seq.Index
+	}) {
+		t.Fatal("Fails to commit the record")
+	}
+	if elapsed := time.Since(begin); elapsed >= 500*time.Millisecond {
+		t.Error("Commit is tied to heartbeats:", elapsed)
+	}
+
+	// Many writes are split into bounded requests.
+	for i := 0; i < 100; i++ {
+		record := RaftRecord{
+			Key:   []byte(fmt.Sprintf("key%d", i)),
+			Value: []byte(fmt.Sprintf("value%d", i)),
+		}
+		if seq, ok = leader.Propose(&record); !ok {
+			t.Fatal("Fails to propose a record")
+		}
+	}
+
+	for _, states := range rss {
+		if !waitForCondition(5*time.Second, func() bool {
+			return states.GetCommitSequence().Index >= seq.Index
+		}) {
+			t.Error("Records are not committed on", states.opts.Address)
+		}
+	}
+}
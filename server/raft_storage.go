@@ -27,7 +27,11 @@ package server
 
 import (
 	"fmt"
+	"io/ioutil"
+	"lbase/balancer"
 	"lbase/db"
+	"os"
+	"strconv"
 )
 
 type RaftCommitStatus int
@@ -40,8 +44,9 @@ const (
 )
 
 type RaftStorage struct {
-	// Raft logs are kept in a separate db.
-	log db.Db
+	// Raft logs are kept in a separate db, or in a RaftLogEngine shared
+	// with other regions.
+	log *RaftLog
 	// Stores the committed data.
 	store *RegionStore
 	// Various options for raft storage.
@@ -54,27 +59,71 @@ type RaftStorage struct {
 	lastRaftSequence *RaftSequence
 	// Latest Raft sequence that has been committed.
 	lastCommitSequence *RaftSequence
+	// See RaftRegionState.LogRegion.
+	logRegion balancer.Region
+	// See RaftRegionState.FrozenSequence.
+	frozenSeq RaftSequence
+	// Keeps rows of a snapshot from the leader until all of them arrive.
+	staging *RegionStore
 }
 
 func NewRaftStorage(opts *RaftOptions, store *RegionStore) (ret *RaftStorage, err error) {
-	// Create a log db if we have not done so yet.
-	logopts := db.NewDbOptions()
-	logopts.SetCreateIfMissing(1)
+	// The region may have changed since the replica was created.
+	logRegion := opts.Region
+	var frozenSeq RaftSequence
+	data, readErr := ioutil.ReadFile(opts.GetRegionStatePath())
+	if readErr == nil {
+		state, parseErr := NewRaftRegionState(data)
+		if parseErr != nil {
+			err = parseErr
+			return
+		}
+		opts.Region = state.Region
+		logRegion = state.LogRegion
+		frozenSeq = state.FrozenSequence
+	}
 
-	log, openError := db.OpenDb(logopts, opts.GetLogDir())
-	if openError != nil {
-		err = openError
-		return
+	var log *RaftLog
+	if opts.MultiRaft != nil {
+		log = opts.MultiRaft.GetLogEngine().GetLog(logRegion)
+	} else {
+		// Create a log db if we have not done so yet.
+		var openError error
+		log, openError = OpenRaftLog(opts.GetLogDir())
+		if openError != nil {
+			err = openError
+			return
+		}
 	}
 
 	ret = &RaftStorage{
-		log:    log,
-		store:  store,
-		opts:   opts,
-		wrOpts: db.NewWriteOptions(),
-		rdOpts: db.NewReadOptions(),
+		log:       log,
+		store:     store,
+		opts:      opts,
+		wrOpts:    db.NewWriteOptions(),
+		rdOpts:    db.NewReadOptions(),
+		logRegion: logRegion,
+		frozenSeq: frozenSeq,
 	}
 
+	// Finish installing a snapshot if it is interrupted by a crash. Rows
+	// staged for a snapshot that is not complete are useless.
+	data, readErr = ioutil.ReadFile(opts.GetSnapshotStatePath())
+	if readErr == nil {
+		state, parseErr := NewRaftSnapshotState(data)
+		if parseErr != nil {
+			err = parseErr
+			return
+		}
+		ret.installStaged(state)
+	} else {
+		os.RemoveAll(ret.getStagingName())
+	}
+
+	// Rows that a split has moved out may be left by a crash.
+	if opts.Region.EndKey != "" {
+		ret.TrimStore([]byte(opts.Region.EndKey))
+	}
 	return
 }
 
@@ -82,6 +131,21 @@ func (s *RaftStorage) GetRaftOptions() *RaftOptions {
 	return s.opts
 }
 
+// Return the key range that the region currently covers.
+func (s *RaftStorage) GetRegion() balancer.Region {
+	return s.opts.Region
+}
+
+func (s *RaftStorage) GetLogRegion() balancer.Region {
+	return s.logRegion
+}
+
+// Return the committed freeze record if the region is frozen. Otherwise,
+// the index of the returned sequence is 0.
+func (s *RaftStorage) GetFrozenSequence() RaftSequence {
+	return s.frozenSeq
+}
+
 func (s *RaftStorage) GetRaftSequence() RaftSequence {
 	if s.lastRaftSequence != nil {
 		return *(s.lastRaftSequence)
@@ -152,12 +216,94 @@ func (s *RaftStorage) SaveRaftRecord(seq RaftSequence, record []byte) bool {
 	}
 
 	errPut := s.log.Put(s.wrOpts, seq.AsKey(), record)
-	if errPut == nil {
-		return true
-	} else {
+	if errPut != nil {
 		panic(fmt.Sprintf("Fails to put: %#v", errPut))
-		return false
 	}
+	return true
+}
+
+// Return true if the log has a record with exactly the sequence @seq.
+func (s *RaftStorage) HasRecord(seq RaftSequence) bool {
+	_, found := s.GetRecord(seq)
+	return found
+}
+
+// Retrieve a record from the log.
+func (s *RaftStorage) GetRecord(seq RaftSequence) (record []byte, found bool) {
+	val, getErr := s.log.Get(s.rdOpts, seq.AsKey())
+	if getErr != nil || val == nil {
+		return
+	}
+	return val, true
+}
+
+// Find the sequence of the record with the given index in the log.
+// A log never has two records with the same index, because conflicting
+// records are truncated before new ones are saved.
+func (s *RaftStorage) GetSequenceAt(index int64) (seq RaftSequence, found bool) {
+	iter := s.log.CreateIterator(s.rdOpts)
+	defer iter.Destroy()
+
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		cur, keyErr := NewRaftSequenceFromKey(iter.Key())
+		if keyErr != nil {
+			panic(fmt.Sprintf("malformed key: %#v", keyErr))
+		}
+		if cur.Index == index {
+			return *cur, true
+		}
+	}
+	return
+}
+
+// Find the sequence of the last record whose index is less than @index.
+// Return a zero sequence if there is no such record.
+func (s *RaftStorage) GetSequenceBefore(index int64) (seq RaftSequence) {
+	iter := s.log.CreateIterator(s.rdOpts)
+	defer iter.Destroy()
+
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		cur, keyErr := NewRaftSequenceFromKey(iter.Key())
+		if keyErr != nil {
+			panic(fmt.Sprintf("malformed key: %#v", keyErr))
+		}
+		if cur.Index < index && seq.Index <= cur.Index {
+			seq = *cur
+		}
+	}
+	return
+}
+
+// Remove all records whose index is equal or greater than @index.
+// Committed records can never be removed.
+func (s *RaftStorage) TruncateFrom(index int64) {
+	if index <= s.GetCommitSequence().Index {
+		panic("Try to truncate committed records!")
+	}
+
+	iter := s.log.CreateIterator(s.rdOpts)
+	defer iter.Destroy()
+
+	batch := s.log.NewBatch()
+	defer batch.Destroy()
+
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		cur, keyErr := NewRaftSequenceFromKey(iter.Key())
+		if keyErr != nil {
+			panic(fmt.Sprintf("malformed key: %#v", keyErr))
+		}
+		if cur.Index >= index {
+			batch.Delete(iter.Key())
+		}
+	}
+
+	err := s.log.Write(s.wrOpts, batch)
+	if err != nil {
+		panic(fmt.Sprintf("Fails to truncate log: %#v", err))
+	}
+
+	// The last sequence has to be figured out again.
+	s.lastRaftSequence = nil
 }
 
 func (s *RaftStorage) Commit(seq RaftSequence) RaftCommitStatus {
@@ -179,7 +325,27 @@ func (s *RaftStorage) Commit(seq RaftSequence) RaftCommitStatus {
 		return COMMIT_PARSE_ERROR
 	}
 
-	s.store.Put(record.Key, record.Value, seq.Index)
+	// Writes are not accepted while a split is pending, so they never
+	// fall out of the region. Skip them anyway rather than leaving rows
+	// that no region serves.
+	switch record.Type {
+	case RAFT_RECORD_DATA:
+		if RegionContainsKey(s.opts.Region, record.Key) {
+			s.store.Put(record.Key, record.Value, seq.Index)
+		}
+	case RAFT_RECORD_CONFIG:
+		s.saveConfiguration(record.Value)
+	case RAFT_RECORD_INCREMENT:
+		if RegionContainsKey(s.opts.Region, record.Key) {
+			s.increment(record.Key, record.Value, seq.Index)
+		}
+	case RAFT_RECORD_FREEZE:
+		s.frozenSeq = seq
+		s.saveRegionState()
+	case RAFT_RECORD_THAW:
+		s.frozenSeq = RaftSequence{}
+		s.saveRegionState()
+	}
 
 	// Adjust cached sequence number.
 	if s.lastCommitSequence != nil {
@@ -192,7 +358,7 @@ func (s *RaftStorage) Commit(seq RaftSequence) RaftCommitStatus {
 	defer iter.Destroy()
 	iter.SeekToFirst()
 
-	batch := db.NewWriteBatch()
+	batch := s.log.NewBatch()
 	defer batch.Destroy()
 	hasBatch := false
 
@@ -221,14 +387,360 @@ func (s *RaftStorage) Commit(seq RaftSequence) RaftCommitStatus {
 	return COMMIT_OK
 }
 
+// Return the latest committed quorum configuration. If no configuration
+// has ever been committed, @found is false.
+func (s *RaftStorage) GetConfiguration() (config RaftConfiguration, found bool) {
+	data, readErr := ioutil.ReadFile(s.opts.GetConfigPath())
+	if readErr != nil {
+		return
+	}
+
+	tmp, parseErr := NewRaftConfiguration(data)
+	if parseErr != nil {
+		panic(fmt.Sprintf("Fails to parse configuration: %#v", parseErr))
+	}
+	return *tmp, true
+}
+
+// Persist a serialized configuration.
+func (s *RaftStorage) saveConfiguration(data []byte) {
+	writeFileAtomically(s.opts.GetConfigPath(), data, "configuration")
+}
+
+// Return the states saved by SaveHardState. If nothing has been saved,
+// @found is false.
+func (s *RaftStorage) GetHardState() (state RaftHardState, found bool) {
+	data, readErr := ioutil.ReadFile(s.opts.GetHardStatePath())
+	if readErr != nil {
+		return
+	}
+
+	tmp, parseErr := NewRaftHardState(data)
+	if parseErr != nil {
+		panic(fmt.Sprintf("Fails to parse hard state: %#v", parseErr))
+	}
+	return *tmp, true
+}
+
+// Persist the states that must survive a restart.
+func (s *RaftStorage) SaveHardState(state *RaftHardState) {
+	writeFileAtomically(s.opts.GetHardStatePath(), state.ToSlice(), "hard state")
+}
+
+// Write to a temporary file first so that a crash never leaves a partial
+// file behind.
+func writeFileAtomically(path string, data []byte, what string) {
+	tmpPath := path + ".tmp"
+
+	writeErr := ioutil.WriteFile(tmpPath, data, 0644)
+	if writeErr != nil {
+		panic(fmt.Sprintf("Fails to write %s: %#v", what, writeErr))
+	}
+
+	renameErr := os.Rename(tmpPath, path)
+	if renameErr != nil {
+		panic(fmt.Sprintf("Fails to save %s: %#v", what, renameErr))
+	}
+}
+
+// Add a number to the counter at @key. Counters are stored as decimal
+// strings, and a value that is not a number counts as 0.
+func (s *RaftStorage) increment(key, delta []byte, ver int64) {
+	d, _ := strconv.ParseInt(string(delta), 10, 64)
+
+	var current int64
+	if value, _, found := s.store.Get(key); found {
+		current, _ = strconv.ParseInt(string(value), 10, 64)
+	}
+	s.store.Put(key, []byte(strconv.FormatInt(current+d, 10)), ver)
+}
+
+// Return the latest committed value of a key.
+func (s *RaftStorage) Read(key []byte) (value []byte, found bool) {
+	value, _, found = s.store.Get(key)
+	return
+}
+
+// Take a snapshot of committed data. Return the last committed sequence
+// and a view of the region store at that point, which the caller
+// releases once it is done.
+func (s *RaftStorage) CreateSnapshot() (seq RaftSequence, snapshot *RegionSnapshot) {
+	return s.GetCommitSequence(), s.store.CreateSnapshot([]byte(s.opts.Region.EndKey))
+}
+
+// Drop rows staged for an earlier snapshot from the leader, and start to
+// stage a new one.
+func (s *RaftStorage) ResetStagedSnapshot() {
+	s.dropStaging()
+	s.openStaging()
+}
+
+// Add rows of a snapshot from the leader to the staging store.
+func (s *RaftStorage) StageSnapshot(keys, values [][]byte) {
+	if s.staging == nil {
+		s.openStaging()
+	}
+	s.staging.Import(keys, values)
+}
+
+// Replace all data with the snapshot staged from the leader, which
+// covers @region. The log is reset so that it only keeps a placeholder
+// for the last committed record. Nothing may read the store meanwhile,
+// because it is closed and opened again.
+func (s *RaftStorage) InstallStagedSnapshot(
+	seq RaftSequence,
+	config *RaftConfiguration,
+	region balancer.Region) {
+
+	if s.staging == nil {
+		s.openStaging()
+	}
+
+	state := RaftSnapshotState{
+		LastSequence:  seq,
+		Configuration: *config,
+		Region:        region,
+	}
+	os.MkdirAll(s.opts.RaftRoot, os.ModePerm)
+	writeFileAtomically(s.opts.GetSnapshotStatePath(), state.ToSlice(), "snapshot")
+	s.installStaged(&state)
+}
+
+// The staging store takes the place of the region store by renaming
+// directories, so no row is copied. The store must have no reader. It
+// can be done again until the saved snapshot state is removed: once the
+// staging directory is gone, it has been renamed to the store.
+func (s *RaftStorage) installStaged(state *RaftSnapshotState) {
+	if s.staging != nil {
+		s.staging.Close()
+		s.staging = nil
+	}
+
+	storeOpts := s.store.opts
+	if _, statErr := os.Stat(s.getStagingName()); statErr == nil {
+		s.store.Close()
+		os.RemoveAll(s.getRetiredName())
+		renameDir(storeOpts.Name, s.getRetiredName())
+		renameDir(s.getStagingName(), storeOpts.Name)
+		s.store = NewRegionStore(storeOpts)
+	}
+
+	s.resetLog(state.LastSequence, &state.Configuration)
+	if state.Region != s.opts.Region {
+		s.SetRegion(state.Region)
+	}
+
+	// The old store is only dropped once it is no longer needed.
+	os.Remove(s.opts.GetSnapshotStatePath())
+	os.RemoveAll(s.getRetiredName())
+}
+
+func renameDir(from, to string) {
+	renameErr := os.Rename(from, to)
+	if renameErr != nil {
+		panic(fmt.Sprintf("Fails to rename %s: %#v", from, renameErr))
+	}
+}
+
+func (s *RaftStorage) getStagingName() string {
+	return s.store.opts.Name + "-staging"
+}
+
+// The directory that the store is moved to while a staged snapshot
+// replaces it.
+func (s *RaftStorage) getRetiredName() string {
+	return s.store.opts.Name + "-retired"
+}
+
+func (s *RaftStorage) openStaging() {
+	opts := *s.store.opts
+	opts.Name = s.getStagingName()
+	os.MkdirAll(opts.Name, os.ModePerm)
+	s.staging = NewRegionStore(&opts)
+}
+
+func (s *RaftStorage) dropStaging() {
+	if s.staging != nil {
+		s.staging.Close()
+		s.staging = nil
+	}
+	os.RemoveAll(s.getStagingName())
+}
+
+// Save @config, and reset the log so that it only keeps a placeholder
+// for the record at @seq, which is taken as committed.
+func (s *RaftStorage) resetLog(seq RaftSequence, config *RaftConfiguration) {
+	s.saveConfiguration(config.ToSlice())
+
+	iter := s.log.CreateIterator(s.rdOpts)
+	defer iter.Destroy()
+
+	batch := s.log.NewBatch()
+	defer batch.Destroy()
+
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		batch.Delete(iter.Key())
+	}
+
+	placeholder := RaftRecord{Type: RAFT_RECORD_NOOP}
+	batch.Put(seq.AsKey(), placeholder.ToSlice())
+
+	err := s.log.Write(s.wrOpts, batch)
+	if err != nil {
+		panic(fmt.Sprintf("Fails to reset log: %#v", err))
+	}
+
+	s.lastRaftSequence = &RaftSequence{}
+	*(s.lastRaftSequence) = seq
+	s.lastCommitSequence = &RaftSequence{}
+	*(s.lastCommitSequence) = seq
+}
+
 // Help membership move or region split/merge.
 func (s *RaftStorage) Close() {
 	s.log.Close()
 	s.store.Close()
+	if s.staging != nil {
+		s.staging.Close()
+	}
+}
+
+// Persist the key range that the region covers.
+func (s *RaftStorage) SetRegion(r balancer.Region) {
+	s.opts.Region = r
+	s.saveRegionState()
 }
 
-// Helper method for region split.
-func (s *RaftStorage) Split() (left *RaftStorage, right *RaftStorage) {
-	panic("Not implemented yet")
+func (s *RaftStorage) saveRegionState() {
+	state := RaftRegionState{
+		Region:         s.opts.Region,
+		FrozenSequence: s.frozenSeq,
+		LogRegion:      s.logRegion,
+	}
+	os.MkdirAll(s.opts.RaftRoot, os.ModePerm)
+	writeFileAtomically(s.opts.GetRegionStatePath(), state.ToSlice(), "region")
+}
+
+// Return true if region @right has been merged into this region, such
+// as before a crash.
+func (s *RaftStorage) IsMerged(right balancer.Region) bool {
+	return s.opts.Region.EndKey == right.EndKey
+}
+
+// Copy rows of region @region, the neighbor on the right, from its storage
+// @right. They are out of this region until Merge. The store of @right is
+// only read, so it is done without locks while the region is frozen.
+func (s *RaftStorage) CopyMergeRows(right *RaftStorage, region balancer.Region) {
+	s.store.CopyFrom(right.store, []byte(region.StartKey), []byte(region.EndKey))
+}
+
+// Merge region @right, which must be the neighbor on the right and whose
+// rows have been copied by CopyMergeRows, into this region. This region
+// is saved with the end key of @right. The merge can be done again if it
+// is interrupted by a crash.
+func (s *RaftStorage) Merge(right balancer.Region) {
+	s.SetRegion(balancer.Region{
+		StartKey: s.opts.Region.StartKey,
+		EndKey:   right.EndKey,
+	})
+}
+
+// Remove all data of the storage, which has been closed. It is used when
+// the region is retired from this server.
+func (s *RaftStorage) Destroy() {
+	// The shared log engine stays open.
+	if s.opts.MultiRaft != nil {
+		s.log.Clear()
+	}
+
+	os.RemoveAll(s.opts.RaftRoot)
+	os.RemoveAll(s.store.opts.Name)
+	os.RemoveAll(s.getStagingName())
+	os.RemoveAll(s.getRetiredName())
+}
+
+// Return a key that splits the region into two halves of about the same
+// size.
+func (s *RaftStorage) FindSplitKey() (key []byte, found bool) {
+	return s.store.FindSplitKey()
+}
+
+// Return the approximate size of the region in bytes.
+func (s *RaftStorage) GetApproximateSize() int64 {
+	return s.store.ApproximateSize()
+}
+
+// Open the storage of the region that the split record at @seq splits
+// off at @key. The new region has the same members, and starts from @seq
+// with nothing in its log. Rows are copied by CopySplitRows, and the
+// split is done by Split.
+func (s *RaftStorage) NewSplitStorage(key []byte, seq RaftSequence) (right *RaftStorage) {
+	rightRegion := balancer.Region{StartKey: string(key), EndKey: s.opts.Region.EndKey}
+
+	rightOpts := *s.opts
+	rightOpts.Region = rightRegion
+	rightOpts.RaftRoot = fmt.Sprintf("%s-%d", s.opts.RaftRoot, seq.Index)
+	rightOpts.EditQueue = nil
+	rightOpts.Collector = nil
+	// An observer watches a single region.
+	rightOpts.Observer = nil
+
+	storeOpts := *s.store.opts
+	storeOpts.Name = fmt.Sprintf("%s-%d", s.store.opts.Name, seq.Index)
+	storeOpts.Region = rightRegion
+	os.MkdirAll(storeOpts.Name, os.ModePerm)
+
+	right, err := NewRaftStorage(&rightOpts, NewRegionStore(&storeOpts))
+	if err != nil {
+		panic(fmt.Sprintf("Fails to create a split region: %#v", err))
+	}
 	return
 }
+
+// Return true if the region has been split at @key, such as before a
+// crash.
+func (s *RaftStorage) IsSplitAt(key []byte) bool {
+	return s.opts.Region.EndKey == string(key)
+}
+
+// Copy rows from @key on to the storage @right of the region split off.
+// Rows left by an interrupted copy are removed first. The store is only
+// read, so it is done without the lock of the region while nothing is
+// committed.
+func (s *RaftStorage) CopySplitRows(right *RaftStorage, key []byte) {
+	right.store.DeleteFrom(nil)
+	right.store.CopyFrom(s.store, key, []byte(right.opts.Region.EndKey))
+}
+
+// Split the region at @key by the split record at @seq, which must be
+// the next one to commit. This region keeps keys before @key, and @right
+// takes over those from @key on once CopySplitRows is done.
+//
+// The new region is saved before this region gets its new end key, so
+// a split that is interrupted by a crash is done again when the record
+// is committed after the restart. Rows that have moved stay in the store
+// until TrimStore removes them.
+func (s *RaftStorage) Split(key []byte, seq RaftSequence, right *RaftStorage) {
+	if s.IsSplitAt(key) {
+		return
+	}
+
+	config, found := s.GetConfiguration()
+	if !found {
+		config = RaftConfiguration{Voters: s.opts.Members}
+	}
+
+	os.MkdirAll(right.opts.RaftRoot, os.ModePerm)
+	right.resetLog(seq, &config)
+	right.SaveHardState(&RaftHardState{Term: seq.Term})
+	right.SetRegion(right.opts.Region)
+
+	s.SetRegion(balancer.Region{StartKey: s.opts.Region.StartKey, EndKey: string(key)})
+}
+
+// Remove rows from @key on, which are out of the region after a split.
+// It is done without the lock of the region, and again when the storage
+// is opened if it is interrupted.
+func (s *RaftStorage) TrimStore(key []byte) {
+	s.store.DeleteFrom(key)
+}
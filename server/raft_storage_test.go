@@ -31,42 +31,6 @@ import (
 	"testing"
 )
 
-func initRaftStorageForTest(root string, reg balancer.Region, hard bool) *RaftStorage {
-	if hard {
-		os.RemoveAll(root)
-	}
-
-	logRoot := root + "/log"
-	storeRoot := root + "/store"
-
-	if hard {
-		dirErr := os.MkdirAll(logRoot, os.ModePerm)
-		if dirErr != nil {
-			panic("Fails to create log dir")
-		}
-
-		dirErr = os.MkdirAll(storeRoot, os.ModePerm)
-		if dirErr != nil {
-			panic("Fails to create store dir")
-		}
-	}
-
-	raftOpts := RaftOptionsForTest(logRoot)
-	storeOpts := &RegionStoreOptions{Name: storeRoot, Region: reg}
-
-	regionStore := NewRegionStore(storeOpts)
-	if regionStore == nil {
-		panic("Fails to create a store")
-	}
-
-	raftStore, err := NewRaftStorage(raftOpts, regionStore)
-	if err != nil {
-		panic("Fails to create raftStore")
-	}
-
-	return raftStore
-}
-
 func TestInitRaftStorage(t *testing.T) {
 	root := "/tmp/TestRaftStorage"
 	store := initRaftStorageForTest(root, balancer.Region{}, true)
@@ -181,3 +145,219 @@ func TestRaftStorageSimpleReload(t *testing.T) {
 		}
 	}
 }
+
+func TestRaftStorageSplit(t *testing.T) {
+	root := "/tmp/TestRaftStorageSplit"
+	store := initRaftStorageForTest(root, balancer.Region{}, true)
+
+	var seq RaftSequence
+	for i, key := range []string{"a", "b", "c", "d"} {
+		record := RaftRecord{Key: []byte(key), Value: []byte(key)}
+		seq = RaftSequence{Index: int64(i + 1), Term: 1}
+		store.SaveRaftRecord(seq, record.ToSlice())
+		store.Commit(seq)
+	}
+
+	seq = RaftSequence{Index: seq.Index + 1, Term: 2}
+	store.SaveRaftRecord(seq, NewSplitRaftRecord([]byte("c")).ToSlice())
+
+	// A copy interrupted by a crash is done again.
+	right := store.NewSplitStorage([]byte("c"), seq)
+	store.CopySplitRows(right, []byte("c"))
+	right.Close()
+	right = store.NewSplitStorage([]byte("c"), seq)
+	store.CopySplitRows(right, []byte("c"))
+	store.Split([]byte("c"), seq, right)
+	store.Commit(seq)
+
+	left := balancer.Region{EndKey: "c"}
+	if store.GetRegion() != left {
+		t.Error("Unexpected left region:", store.GetRegion())
+	}
+	if right.GetRegion() != (balancer.Region{StartKey: "c"}) {
+		t.Error("Unexpected right region:", right.GetRegion())
+	}
+	if right.GetCommitSequence() != seq || right.GetRaftSequence() != seq {
+		t.Error("The new region does not start from the split")
+	}
+	if state, found := right.GetHardState(); !found || state.Term != seq.Term {
+		t.Error("Unexpected hard state of the new region:", state, found)
+	}
+
+	// Rows that have moved are left out of snapshots until they are
+	// removed.
+	_, rows := store.CreateSnapshot()
+	keys, _, _, _ := rows.Next(1 << 20)
+	rows.Release()
+	if len(keys) != 2 {
+		t.Error("Unexpected rows in the snapshot:", len(keys))
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		_, inRight := right.Read([]byte(key))
+		if inRight != (key >= "c") {
+			t.Error("Key is on the wrong side:", key, inRight)
+		}
+	}
+	right.Close()
+	store.Close()
+
+	// Both regions keep their ranges after a restart, and rows that have
+	// moved are removed.
+	store = initRaftStorageForTest(root, balancer.Region{}, false)
+	defer store.Close()
+	if store.GetRegion() != left {
+		t.Error("Fails to reload the left region:", store.GetRegion())
+	}
+	if store.GetCommitSequence() != seq {
+		t.Error("Unexpected commit sequence:", store.GetCommitSequence())
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if _, found := store.Read([]byte(key)); found != (key < "c") {
+			t.Error("Key is on the wrong side:", key, found)
+		}
+	}
+}
+
+func TestRaftStorageMerge(t *testing.T) {
+	root := "/tmp/TestRaftStorageMerge"
+	store := initRaftStorageForTest(root, balancer.Region{}, true)
+
+	var seq RaftSequence
+	for i, key := range []string{"a", "b", "c", "d"} {
+		record := RaftRecord{Key: []byte(key), Value: []byte(key)}
+		seq = RaftSequence{Index: int64(i + 1), Term: 1}
+		store.SaveRaftRecord(seq, record.ToSlice())
+		store.Commit(seq)
+	}
+
+	seq = RaftSequence{Index: seq.Index + 1, Term: 1}
+	store.SaveRaftRecord(seq, NewSplitRaftRecord([]byte("c")).ToSlice())
+	right := store.NewSplitStorage([]byte("c"), seq)
+	store.CopySplitRows(right, []byte("c"))
+	store.Split([]byte("c"), seq, right)
+	store.Commit(seq)
+	store.TrimStore([]byte("c"))
+
+	// Freeze the region on the right.
+	frozenSeq := RaftSequence{Index: seq.Index + 1, Term: 1}
+	right.SaveRaftRecord(frozenSeq, NewFreezeRaftRecord().ToSlice())
+	right.Commit(frozenSeq)
+	if right.GetFrozenSequence() != frozenSeq {
+		t.Error("Unexpected frozen sequence:", right.GetFrozenSequence())
+	}
+
+	mergeSeq := RaftSequence{Index: seq.Index + 1, Term: 1}
+	record := NewMergeRaftRecord(right.GetRegion(), frozenSeq)
+	store.SaveRaftRecord(mergeSeq, record.ToSlice())
+
+	// A merge interrupted by a crash is done again.
+	store.CopyMergeRows(right, right.GetRegion())
+	_, rows := store.CreateSnapshot()
+	if keys, _, _, _ := rows.Next(1 << 20); len(keys) != 2 {
+		t.Error("Rows copied before the merge are in the region:", len(keys))
+	}
+	rows.Release()
+	store.Merge(right.GetRegion())
+	store.CopyMergeRows(right, right.GetRegion())
+	store.Merge(right.GetRegion())
+	store.Commit(mergeSeq)
+
+	if store.GetRegion() != (balancer.Region{}) {
+		t.Error("Unexpected merged region:", store.GetRegion())
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if _, found := store.Read([]byte(key)); !found {
+			t.Error("Fails to find a merged key:", key)
+		}
+	}
+
+	merge, err := NewRaftMerge(record.Value)
+	if err != nil || merge.Region != right.GetRegion() || merge.FrozenSequence != frozenSeq {
+		t.Error("Fails to parse the merge record:", merge, err)
+	}
+
+	rightRoot := right.opts.RaftRoot
+	right.Close()
+	right.Destroy()
+	if _, err := os.Stat(rightRoot); err == nil {
+		t.Error("Fails to remove the retired region")
+	}
+	store.Close()
+
+	store = initRaftStorageForTest(root, balancer.Region{}, false)
+	defer store.Close()
+	if store.GetRegion() != (balancer.Region{}) {
+		t.Error("Fails to reload the merged region:", store.GetRegion())
+	}
+}
+
+func TestRaftStorageStagedSnapshot(t *testing.T) {
+	root := "/tmp/TestRaftStorageStagedSnapshot"
+	leader := initRaftStorageForTest(root+"/leader", balancer.Region{}, true)
+	defer leader.Close()
+	follower := initRaftStorageForTest(root+"/follower", balancer.Region{}, true)
+
+	var seq RaftSequence
+	for i, key := range []string{"a", "b", "c", "d"} {
+		record := RaftRecord{Key: []byte(key), Value: []byte(key)}
+		seq = RaftSequence{Index: int64(i + 1), Term: 1}
+		leader.SaveRaftRecord(seq, record.ToSlice())
+		leader.Commit(seq)
+	}
+	record := RaftRecord{Key: []byte("z"), Value: []byte("z")}
+	follower.SaveRaftRecord(RaftSequence{Index: 1, Term: 1}, record.ToSlice())
+	follower.Commit(RaftSequence{Index: 1, Term: 1})
+
+	snapSeq, rows := leader.CreateSnapshot()
+
+	// Writes after the snapshot is taken are not in it.
+	record = RaftRecord{Key: []byte("e"), Value: []byte("e")}
+	leader.SaveRaftRecord(RaftSequence{Index: seq.Index + 1, Term: 1}, record.ToSlice())
+	leader.Commit(RaftSequence{Index: seq.Index + 1, Term: 1})
+
+	// A row in each chunk.
+	follower.ResetStagedSnapshot()
+	var numChunks int
+	for done := false; !done; numChunks++ {
+		var keys, values [][]byte
+		keys, values, _, done = rows.Next(1)
+		follower.StageSnapshot(keys, values)
+	}
+	rows.Release()
+	if numChunks != 4 {
+		t.Error("Unexpected number of chunks:", numChunks)
+	}
+
+	// An install interrupted by a crash is done again after a restart.
+	region := balancer.Region{EndKey: "m"}
+	state := RaftSnapshotState{LastSequence: snapSeq, Region: region}
+	writeFileAtomically(follower.opts.GetSnapshotStatePath(), state.ToSlice(), "snapshot")
+	follower.Close()
+
+	// The crash happens after the store is moved away, and before the
+	// staging store takes its place.
+	if err := os.Rename(follower.store.opts.Name, follower.getRetiredName()); err != nil {
+		t.Fatal("Fails to move the store:", err)
+	}
+
+	follower = initRaftStorageForTest(root+"/follower", balancer.Region{}, false)
+	defer follower.Close()
+	if follower.GetCommitSequence() != snapSeq || follower.GetRegion() != region {
+		t.Error("Fails to install the snapshot:", follower.GetCommitSequence(), follower.GetRegion())
+	}
+	for _, key := range []string{"a", "b", "c", "d", "e", "z"} {
+		_, found := follower.Read([]byte(key))
+		if found != (key < "e") {
+			t.Error("Unexpected row after the snapshot:", key, found)
+		}
+	}
+	if _, err := os.Stat(follower.getStagingName()); err == nil {
+		t.Error("Fails to remove the staging store")
+	}
+	if _, err := os.Stat(follower.getRetiredName()); err == nil {
+		t.Error("Fails to remove the old store")
+	}
+	if _, err := os.Stat(follower.opts.GetSnapshotStatePath()); err == nil {
+		t.Error("Fails to remove the snapshot state")
+	}
+}
@@ -28,10 +28,54 @@ package server
 // This file contains code that is used for raft unit tests.
 
 import (
+	"errors"
 	"fmt"
 	"lbase/balancer"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
 )
 
+// Create a raft storage under @root. If @hard is set, existing data is
+// removed first.
+func initRaftStorageForTest(root string, reg balancer.Region, hard bool) *RaftStorage {
+	if hard {
+		os.RemoveAll(root)
+	}
+
+	logRoot := root + "/log"
+	storeRoot := root + "/store"
+
+	if hard {
+		dirErr := os.MkdirAll(logRoot, os.ModePerm)
+		if dirErr != nil {
+			panic("Fails to create log dir")
+		}
+
+		dirErr = os.MkdirAll(storeRoot, os.ModePerm)
+		if dirErr != nil {
+			panic("Fails to create store dir")
+		}
+	}
+
+	raftOpts := RaftOptionsForTest(logRoot)
+	raftOpts.Region = reg
+	storeOpts := &RegionStoreOptions{Name: storeRoot, Region: reg}
+
+	regionStore := NewRegionStore(storeOpts)
+	if regionStore == nil {
+		panic("Fails to create a store")
+	}
+
+	raftStore, err := NewRaftStorage(raftOpts, regionStore)
+	if err != nil {
+		panic("Fails to create raftStore")
+	}
+
+	return raftStore
+}
+
 // Given a root directory and a region specification, return a new raft states.
 // This function can be used to test a single raft instance.
 func initRaftStates(
@@ -64,6 +108,18 @@ func initRaftQuorum(
 	num int,
 	recreate bool) (rss []*RaftStates, servers []*Server) {
 
+	return initRaftQuorumWithOptions(root, reg, num, recreate, nil)
+}
+
+// Same as initRaftQuorum, but @setup is called to customize options of
+// each raft states before it is created.
+func initRaftQuorumWithOptions(
+	root string,
+	reg balancer.Region,
+	num int,
+	recreate bool,
+	setup func(opts *RaftOptions)) (rss []*RaftStates, servers []*Server) {
+
 	// First creates @num servers.
 	var ports []int
 	for i := 0; i < num; i++ {
@@ -95,6 +151,9 @@ func initRaftQuorum(
 		opts.Address = balancer.ServerName{Host: "127.0.0.1", Port: ports[i]}
 		opts.Members = names
 		opts.RPCPrefix = root
+		if setup != nil {
+			setup(opts)
+		}
 
 		states := NewRaftStates(opts, store)
 		rss = append(rss, states)
@@ -109,3 +168,150 @@ func initRaftQuorum(
 
 	return
 }
+
+// Create a raft states that is going to join an existing quorum. The new
+// member starts with an empty configuration and learns the configuration
+// from the leader. @prefix must be the RPC prefix used by the quorum.
+func initRaftLearner(
+	root string,
+	reg balancer.Region,
+	prefix string) (states *RaftStates, server *Server) {
+
+	server, port := NewServer(prefix, 0)
+	if server == nil {
+		panic("Fails to create a server")
+	}
+
+	store := initRaftStorageForTest(root, reg, true)
+	if store == nil {
+		panic("Fails to create a store")
+	}
+
+	opts := store.GetRaftOptions()
+	opts.Address = balancer.ServerName{Host: "127.0.0.1", Port: port}
+	opts.RPCPrefix = prefix
+
+	states = NewRaftStates(opts, store)
+	server.RegisterRegion(reg, states)
+	states.TransitToFollower()
+	return
+}
+
+// Wait until one of the raft states becomes the leader.
+// Return nil if no leader is elected before the timeout.
+func waitForRaftLeader(rss []*RaftStates, timeout time.Duration) *RaftStates {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, states := range rss {
+			if states.GetState() == RAFT_LEADER {
+				return states
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil
+}
+
+// Poll a condition until it becomes true or the timeout expires.
+func waitForCondition(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return cond()
+}
+
+var errPartitioned = errors.New("network partitioned")
+
+// A simulated network that can isolate servers from each other.
+type testNetwork struct {
+	mutex    sync.Mutex
+	isolated map[balancer.ServerName]bool
+}
+
+func newTestNetwork() *testNetwork {
+	return &testNetwork{isolated: make(map[balancer.ServerName]bool)}
+}
+
+// Cut all connections between @sn and other servers.
+func (n *testNetwork) Isolate(sn balancer.ServerName) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.isolated[sn] = true
+}
+
+// Restore all connections.
+func (n *testNetwork) Heal() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.isolated = make(map[balancer.ServerName]bool)
+}
+
+func (n *testNetwork) isBlocked(from, to balancer.ServerName) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if from == to {
+		return false
+	}
+	return n.isolated[from] || n.isolated[to]
+}
+
+// Return a transport that sends RPCs from @from through the network.
+func (n *testNetwork) Transport(from balancer.ServerName) Transport {
+	return &partitionTransport{network: n, from: from}
+}
+
+type partitionTransport struct {
+	network *testNetwork
+	from    balancer.ServerName
+	http    HTTPTransport
+}
+
+func (t *partitionTransport) Dial(
+	name balancer.ServerName,
+	rpcPrefix string) (RaftClient, error) {
+
+	cli, err := t.http.Dial(name, rpcPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &partitionClient{cli: cli, transport: t, to: name}, nil
+}
+
+// A client that fails calls immediately if its peer is unreachable.
+type partitionClient struct {
+	cli       RaftClient
+	transport *partitionTransport
+	to        balancer.ServerName
+}
+
+func (c *partitionClient) Go(
+	serviceMethod string,
+	args interface{},
+	reply interface{},
+	done chan *rpc.Call) *rpc.Call {
+
+	if !c.transport.network.isBlocked(c.transport.from, c.to) {
+		return c.cli.Go(serviceMethod, args, reply, done)
+	}
+
+	if done == nil {
+		done = make(chan *rpc.Call, 1)
+	}
+	call := &rpc.Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Error:         errPartitioned,
+		Done:          done,
+	}
+	call.Done <- call
+	return call
+}
+
+func (c *partitionClient) Close() error {
+	return c.cli.Close()
+}
@@ -0,0 +1,261 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"lbase/balancer"
+	"sort"
+	"time"
+)
+
+// Where a region is, by the latest stats of servers.
+type regionLocation struct {
+	region balancer.Region
+	// Servers that report a replica of the region.
+	members map[balancer.ServerName]bool
+	// The latest load that a leader of the region reports, and when it
+	// arrives. Two servers may both report that they lead the region for
+	// a while, and the later report wins.
+	load       balancer.RegionLoad
+	hasLeader  bool
+	reportedAt time.Time
+}
+
+// Finds regions by keys, and is kept up to date as servers report their
+// stats. Regions overlap while a split or merge is being reported. Of
+// regions that overlap, those with a leader win, and then those whose
+// leaders reported last.
+type regionIndex struct {
+	locations map[balancer.Region]*regionLocation
+	// Regions that do not overlap, ordered by their start keys. It is
+	// rebuilt on lookup once regions or their leaders change.
+	sorted []*regionLocation
+	dirty  bool
+}
+
+func newRegionIndex() *regionIndex {
+	return &regionIndex{locations: make(map[balancer.Region]*regionLocation)}
+}
+
+// Replace regions that server @sn has reported in @old with those in
+// @stat, which arrives at @now. @old is nil if the server is new, and
+// @stat is nil if it is dead.
+func (x *regionIndex) update(
+	sn balancer.ServerName,
+	old, stat *balancer.ServerStat,
+	now time.Time) {
+
+	regions := make(map[balancer.Region]bool)
+	led := make(map[balancer.Region]bool)
+	if stat != nil {
+		for _, r := range stat.Regions {
+			x.get(r).members[sn] = true
+			regions[r] = true
+		}
+		for _, load := range stat.Loads {
+			loc := x.get(load.Region)
+			if !loc.hasLeader || loc.load.Leader != load.Leader {
+				x.dirty = true
+			}
+			loc.load = load
+			loc.hasLeader = true
+			loc.reportedAt = now
+			led[load.Region] = true
+		}
+	}
+	if old == nil {
+		return
+	}
+
+	for _, r := range old.Regions {
+		if loc, found := x.locations[r]; found && !regions[r] {
+			delete(loc.members, sn)
+			x.dropIfEmpty(loc)
+		}
+	}
+	for _, load := range old.Loads {
+		loc, found := x.locations[load.Region]
+		if found && !led[load.Region] && loc.hasLeader && loc.load.Leader == sn {
+			loc.hasLeader = false
+			loc.load = balancer.RegionLoad{}
+			x.dirty = true
+			x.dropIfEmpty(loc)
+		}
+	}
+}
+
+func (x *regionIndex) get(r balancer.Region) *regionLocation {
+	loc, found := x.locations[r]
+	if !found {
+		loc = &regionLocation{
+			region:  r,
+			members: make(map[balancer.ServerName]bool),
+		}
+		x.locations[r] = loc
+		x.dirty = true
+	}
+	return loc
+}
+
+func (x *regionIndex) dropIfEmpty(loc *regionLocation) {
+	if len(loc.members) == 0 && !loc.hasLeader {
+		delete(x.locations, loc.region)
+		x.dirty = true
+	}
+}
+
+// Return the region that contains @key, with its leader and members.
+func (x *regionIndex) locate(key []byte) (location balancer.RegionLoad, found bool) {
+	if x.dirty {
+		x.rebuild()
+	}
+
+	k := string(key)
+	i := sort.Search(len(x.sorted), func(i int) bool {
+		return x.sorted[i].region.StartKey > k
+	})
+	if i == 0 || !RegionContainsKey(x.sorted[i-1].region, key) {
+		return
+	}
+	return x.sorted[i-1].location(), true
+}
+
+// Return region @r with its leader and members.
+func (x *regionIndex) lookup(r balancer.Region) (location balancer.RegionLoad, found bool) {
+	loc, found := x.locations[r]
+	if !found {
+		return
+	}
+	return loc.location(), true
+}
+
+// Members come from the leader if there is one, and otherwise from the
+// servers that report the region.
+func (loc *regionLocation) location() balancer.RegionLoad {
+	if loc.hasLeader {
+		return loc.load
+	}
+
+	ret := balancer.RegionLoad{Region: loc.region}
+	for sn, _ := range loc.members {
+		ret.Members = append(ret.Members, sn)
+	}
+	sort.Sort(serverNames(ret.Members))
+	return ret
+}
+
+func (x *regionIndex) rebuild() {
+	all := make([]*regionLocation, 0, len(x.locations))
+	for _, loc := range x.locations {
+		all = append(all, loc)
+	}
+	sort.Sort(locationsByStartKey(all))
+
+	// Each group is a run of regions that overlap one another.
+	x.sorted = x.sorted[:0]
+	for i := 0; i < len(all); {
+		end := all[i].region.EndKey
+		j := i + 1
+		for ; j < len(all) && (end == "" || all[j].region.StartKey < end); j++ {
+			if last := all[j].region.EndKey; end != "" && (last == "" || last > end) {
+				end = last
+			}
+		}
+		x.sorted = append(x.sorted, pickLocations(all[i:j])...)
+		i = j
+	}
+	x.dirty = false
+}
+
+// Pick regions of @group that do not overlap, by their priority.
+func pickLocations(group []*regionLocation) []*regionLocation {
+	if len(group) == 1 {
+		return group
+	}
+
+	candidates := append([]*regionLocation(nil), group...)
+	sort.Sort(locationsByPriority(candidates))
+
+	var picked []*regionLocation
+	for _, loc := range candidates {
+		overlaps := false
+		for _, p := range picked {
+			if regionsOverlap(loc.region, p.region) {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			picked = append(picked, loc)
+		}
+	}
+	sort.Sort(locationsByStartKey(picked))
+	return picked
+}
+
+func regionsOverlap(a, b balancer.Region) bool {
+	return (a.EndKey == "" || b.StartKey < a.EndKey) &&
+		(b.EndKey == "" || a.StartKey < b.EndKey)
+}
+
+type locationsByStartKey []*regionLocation
+
+func (a locationsByStartKey) Len() int      { return len(a) }
+func (a locationsByStartKey) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a locationsByStartKey) Less(i, j int) bool {
+	return a[i].region.StartKey < a[j].region.StartKey
+}
+
+// Regions with leaders go first, then those whose leaders reported last.
+// Ties are broken by key ranges, so the order is always the same.
+type locationsByPriority []*regionLocation
+
+func (a locationsByPriority) Len() int      { return len(a) }
+func (a locationsByPriority) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a locationsByPriority) Less(i, j int) bool {
+	x, y := a[i], a[j]
+	if x.hasLeader != y.hasLeader {
+		return x.hasLeader
+	}
+	if !x.reportedAt.Equal(y.reportedAt) {
+		return x.reportedAt.After(y.reportedAt)
+	}
+	if x.region.StartKey != y.region.StartKey {
+		return x.region.StartKey < y.region.StartKey
+	}
+	return x.region.EndKey < y.region.EndKey
+}
+
+type serverNames []balancer.ServerName
+
+func (a serverNames) Len() int      { return len(a) }
+func (a serverNames) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a serverNames) Less(i, j int) bool {
+	if a[i].Host != a[j].Host {
+		return a[i].Host < a[j].Host
+	}
+	return a[i].Port < a[j].Port
+}
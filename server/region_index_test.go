@@ -0,0 +1,100 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"lbase/balancer"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRegionIndex(t *testing.T) {
+	a := balancer.ServerName{Host: "a", Port: 1}
+	b := balancer.ServerName{Host: "b", Port: 1}
+	c := balancer.ServerName{Host: "c", Port: 1}
+	whole := balancer.Region{}
+	left := balancer.Region{EndKey: "m"}
+	right := balancer.Region{StartKey: "m"}
+	now := time.Unix(100, 0)
+
+	leads := func(sn balancer.ServerName, r balancer.Region) balancer.RegionLoad {
+		return balancer.RegionLoad{Region: r, Leader: sn, Members: []balancer.ServerName{a, b, c}}
+	}
+
+	x := newRegionIndex()
+	statA := &balancer.ServerStat{ServerName: a, Regions: []balancer.Region{whole}}
+	statB := &balancer.ServerStat{ServerName: b, Regions: []balancer.Region{whole}}
+	x.update(b, nil, statB, now)
+	x.update(a, nil, statA, now)
+
+	// Without a leader, members are those that report the region.
+	location, found := x.locate([]byte("k"))
+	if !found || location.Leader != (balancer.ServerName{}) ||
+		!reflect.DeepEqual(location.Members, []balancer.ServerName{a, b}) {
+		t.Error("Unexpected location:", location, found)
+	}
+
+	// Two servers claim to lead the region, and the later report wins.
+	oldA := statA
+	statA = &balancer.ServerStat{ServerName: a, Regions: []balancer.Region{whole},
+		Loads: []balancer.RegionLoad{leads(a, whole)}}
+	x.update(a, oldA, statA, now.Add(time.Second))
+	oldB := statB
+	statB = &balancer.ServerStat{ServerName: b, Regions: []balancer.Region{whole},
+		Loads: []balancer.RegionLoad{leads(b, whole)}}
+	x.update(b, oldB, statB, now.Add(2*time.Second))
+	if location, _ = x.locate([]byte("k")); location.Leader != b {
+		t.Error("Unexpected leader:", location.Leader)
+	}
+
+	// The leader splits the region, but a stays behind with the whole
+	// region, which loses to the regions that have leaders.
+	oldB = statB
+	statB = &balancer.ServerStat{ServerName: b, Regions: []balancer.Region{left, right},
+		Loads: []balancer.RegionLoad{leads(b, left), leads(b, right)}}
+	x.update(b, oldB, statB, now.Add(3*time.Second))
+	oldA = statA
+	statA = &balancer.ServerStat{ServerName: a, Regions: []balancer.Region{whole}}
+	x.update(a, oldA, statA, now.Add(4*time.Second))
+
+	if location, _ = x.locate([]byte("k")); location.Region != left || location.Leader != b {
+		t.Error("Unexpected location on the left:", location)
+	}
+	if location, _ = x.locate([]byte("z")); location.Region != right || location.Leader != b {
+		t.Error("Unexpected location on the right:", location)
+	}
+
+	// Regions of a dead server are gone.
+	x.update(b, statB, nil, now.Add(5*time.Second))
+	if location, _ = x.locate([]byte("z")); location.Region != whole {
+		t.Error("Unexpected location after the leader is dead:", location)
+	}
+	x.update(a, statA, nil, now.Add(5*time.Second))
+	if location, found = x.locate([]byte("z")); found || len(x.locations) != 0 {
+		t.Error("Finds a region without servers:", location)
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Number of request keys that a region keeps to find its load split key.
+const LOAD_SAMPLE_SIZE = 64
+
+// Counts requests to a region since its load was last collected, and
+// samples their keys, so that a hot region can be split where its load
+// splits into halves.
+type regionLoadCounter struct {
+	reads  int64
+	writes int64
+	// Keys of requests. Each request has the same chance to be sampled.
+	samples []string
+	// When the load was last collected.
+	since time.Time
+}
+
+func (c *regionLoadCounter) record(key []byte, isWrite bool, r *rand.Rand) {
+	if isWrite {
+		c.writes++
+	} else {
+		c.reads++
+	}
+
+	// Reservoir sampling.
+	if len(c.samples) < LOAD_SAMPLE_SIZE {
+		c.samples = append(c.samples, string(key))
+	} else if i := r.Int63n(c.reads + c.writes); i < LOAD_SAMPLE_SIZE {
+		c.samples[i] = string(key)
+	}
+}
+
+// Return requests per second since the last call, and the median of
+// sampled keys. Start counting again from @now.
+func (c *regionLoadCounter) collect(now time.Time) (readQps, writeQps int64, splitKey string) {
+	elapsedMs := int64(now.Sub(c.since) / time.Millisecond)
+	if elapsedMs > 0 && !c.since.IsZero() {
+		readQps = c.reads * 1000 / elapsedMs
+		writeQps = c.writes * 1000 / elapsedMs
+	}
+	if len(c.samples) > 0 {
+		sort.Strings(c.samples)
+		splitKey = c.samples[len(c.samples)/2]
+	}
+
+	c.reads = 0
+	c.writes = 0
+	c.samples = nil
+	c.since = now
+	return
+}
@@ -0,0 +1,64 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestRegionLoadCounter(t *testing.T) {
+	var c regionLoadCounter
+	r := rand.New(rand.NewSource(1))
+
+	start := time.Unix(100, 0)
+	c.collect(start)
+
+	// Most requests go to keys after "key50".
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%02d", i%100))
+		if i%4 != 0 {
+			key = []byte(fmt.Sprintf("key%02d", 50+i%50))
+		}
+		c.record(key, i%2 == 0, r)
+	}
+
+	readQps, writeQps, splitKey := c.collect(start.Add(2 * time.Second))
+	if readQps != 250 || writeQps != 250 {
+		t.Error("Unexpected qps:", readQps, writeQps)
+	}
+	if splitKey <= "key50" {
+		t.Error("The split key does not split the load:", splitKey)
+	}
+
+	// Counting starts again.
+	readQps, writeQps, splitKey = c.collect(start.Add(3 * time.Second))
+	if readQps != 0 || writeQps != 0 || splitKey != "" {
+		t.Error("The load is not reset:", readQps, writeQps, splitKey)
+	}
+}
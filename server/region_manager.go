@@ -0,0 +1,84 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"lbase/balancer"
+	"time"
+)
+
+// How long to wait for a split or merge. A merge waits for the region on
+// the right to catch up, so it takes longer than most requests.
+const REGION_CHANGE_TIMEOUT_MS = 300000
+
+// Sends split and merge requests of a balancer to the leaders of regions.
+// Requests are sent in the background, and their results are reported
+// by servers through RegionListener.
+type RegionManagerClient struct {
+	transport Transport
+	rpcPrefix string
+	clock     Clock
+}
+
+// If @transport is nil, HTTPTransport is used. If @clock is nil,
+// RealClock is used.
+func NewRegionManagerClient(
+	transport Transport,
+	rpcPrefix string,
+	clock Clock) *RegionManagerClient {
+
+	if transport == nil {
+		transport = &HTTPTransport{}
+	}
+	if clock == nil {
+		clock = &RealClock{}
+	}
+	return &RegionManagerClient{
+		transport: transport,
+		rpcPrefix: rpcPrefix,
+		clock:     clock,
+	}
+}
+
+func (c *RegionManagerClient) Split(leader balancer.ServerName, r balancer.Region, key string) {
+	req := &SplitRegionRequest{Region: r, Key: []byte(key)}
+	go c.call(leader, "ServerRPC.SplitRegion", req, &SplitRegionReply{})
+}
+
+func (c *RegionManagerClient) Merge(leader balancer.ServerName, left, right balancer.Region) {
+	req := &MergeRegionsRequest{Left: left, Right: right}
+	go c.call(leader, "ServerRPC.MergeRegions", req, &MergeRegionsReply{})
+}
+
+func (c *RegionManagerClient) call(
+	sn balancer.ServerName,
+	method string,
+	req interface{},
+	reply interface{}) {
+
+	timeOut := time.Duration(REGION_CHANGE_TIMEOUT_MS) * time.Millisecond
+	callServer(c.transport, c.rpcPrefix, c.clock, timeOut, sn, method, req, reply)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"lbase/balancer"
+	"time"
+)
+
+// Receives sizes and loads of regions from servers. A SplitMergePolicy
+// is one.
+type RegionLoadListener interface {
+	UpdateRegionLoads(timestamp int64, loads []balancer.RegionLoad)
+}
+
+type RegionMonitorOptions struct {
+	// How often loads of regions are collected.
+	IntervalMs int64
+	// Receives loads of regions that this server leads.
+	Listener RegionLoadListener
+	// Source of time. If this is nil, RealClock is used.
+	Clock Clock
+}
+
+func DefaultRegionMonitorOptions(listener RegionLoadListener) *RegionMonitorOptions {
+	return &RegionMonitorOptions{
+		IntervalMs: 60000,
+		Listener:   listener,
+	}
+}
+
+func RegionMonitorOptionsForTest(listener RegionLoadListener) *RegionMonitorOptions {
+	return &RegionMonitorOptions{
+		IntervalMs: 100,
+		Listener:   listener,
+	}
+}
+
+// Periodically collects sizes and loads of regions that this server
+// leads, and reports them to the listener.
+type RegionMonitor struct {
+	opts RegionMonitorOptions
+	// Returns regions served by this server.
+	regions func() map[balancer.Region]*RaftStates
+	quit    chan bool
+}
+
+func newRegionMonitor(
+	opts *RegionMonitorOptions,
+	regions func() map[balancer.Region]*RaftStates) *RegionMonitor {
+
+	ret := &RegionMonitor{
+		opts:    *opts,
+		regions: regions,
+		quit:    make(chan bool),
+	}
+	if ret.opts.Clock == nil {
+		ret.opts.Clock = &RealClock{}
+	}
+	return ret
+}
+
+func (m *RegionMonitor) Close() {
+	close(m.quit)
+}
+
+func (m *RegionMonitor) run() {
+	interval := time.Duration(m.opts.IntervalMs) * time.Millisecond
+	ticker := m.opts.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			m.report()
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// Report loads of regions that this server leads.
+func (m *RegionMonitor) report() {
+	var loads []balancer.RegionLoad
+	for _, states := range m.regions() {
+		load, isLeader := states.CollectLoad()
+		if isLeader {
+			loads = append(loads, load)
+		}
+	}
+
+	if len(loads) > 0 {
+		timestamp := m.opts.Clock.Now().UnixNano() / int64(time.Millisecond)
+		m.opts.Listener.UpdateRegionLoads(timestamp, loads)
+	}
+}
@@ -26,11 +26,23 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package server
 
 import (
+	"bytes"
 	"fmt"
 	"lbase/balancer"
 	"lbase/db"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
 )
 
+// Rows are copied or removed in write batches of about this many bytes,
+// so that a large range of rows is never held in memory.
+const STORE_BATCH_BYTES = 4 << 20
+
+// Number of times that FindSplitKey halves the range of keys.
+const SPLIT_KEY_BISECTIONS = 64
+
 type RegionStoreOptions struct {
 	// Path to the data store.
 	Name string
@@ -42,6 +54,7 @@ type RegionStore struct {
 	opts   *RegionStoreOptions
 	db     db.Db
 	wrOpts db.WriteOptions
+	rdOpts db.ReadOptions
 }
 
 func NewRegionStore(ropts *RegionStoreOptions) *RegionStore {
@@ -57,6 +70,7 @@ func NewRegionStore(ropts *RegionStoreOptions) *RegionStore {
 		opts:   ropts,
 		db:     leveldb,
 		wrOpts: db.NewWriteOptions(),
+		rdOpts: db.NewReadOptions(),
 	}
 }
 
@@ -68,6 +82,399 @@ func (s *RegionStore) Put(key, value []byte, ver int64) {
 	}
 }
 
+// Return the latest version of a key. Versions of a key are stored next
+// to each other in ascending order, so look for the last of them.
+func (s *RegionStore) Get(key []byte) (value []byte, ver int64, found bool) {
+	iter := s.db.CreateIterator(s.rdOpts)
+	defer iter.Destroy()
+
+	iter.Seek(NewStoreKey(append([]byte(nil), key...), math.MaxInt64))
+	if iter.Valid() {
+		iter.Prev()
+	} else {
+		iter.SeekToLast()
+	}
+
+	// Skip longer keys that share the same prefix.
+	for ; iter.Valid(); iter.Prev() {
+		storeKey := iter.Key()
+		if !bytes.HasPrefix(storeKey, key) {
+			return
+		}
+
+		realKey, realVer := ParseStoreKey(storeKey)
+		if bytes.Equal(realKey, key) {
+			return iter.Value(), realVer, true
+		}
+	}
+	return
+}
+
+// Return all rows (store keys and values) in the region store.
+func (s *RegionStore) Dump() (keys, values [][]byte) {
+	iter := s.db.CreateIterator(s.rdOpts)
+	defer iter.Destroy()
+
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Key())
+		values = append(values, iter.Value())
+	}
+	return
+}
+
+// Replace all rows in the region store with the given store keys and values.
+func (s *RegionStore) Reset(keys, values [][]byte) {
+	iter := s.db.CreateIterator(s.rdOpts)
+	defer iter.Destroy()
+
+	batch := db.NewWriteBatch()
+	defer batch.Destroy()
+
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		batch.Delete(iter.Key())
+	}
+
+	for i := 0; i < len(keys); i++ {
+		batch.Put(keys[i], values[i])
+	}
+
+	err := s.db.Write(s.wrOpts, batch)
+	if err != nil {
+		panic(fmt.Sprintf("Reset: %#v", err))
+	}
+}
+
+// Return rows whose keys are no less than @key.
+func (s *RegionStore) DumpFrom(key []byte) (keys, values [][]byte) {
+	iter := s.db.CreateIterator(s.rdOpts)
+	defer iter.Destroy()
+
+	// A store key is never less than its key, but a shorter key that
+	// is a prefix of @key may still be seen.
+	for iter.Seek(key); iter.Valid(); iter.Next() {
+		realKey, _ := ParseStoreKey(iter.Key())
+		if bytes.Compare(realKey, key) >= 0 {
+			keys = append(keys, iter.Key())
+			values = append(values, iter.Value())
+		}
+	}
+	return
+}
+
+// Add rows (store keys and values) to the region store.
+func (s *RegionStore) Import(keys, values [][]byte) {
+	batch := db.NewWriteBatch()
+	defer batch.Destroy()
+
+	for i := 0; i < len(keys); i++ {
+		batch.Put(keys[i], values[i])
+	}
+
+	err := s.db.Write(s.wrOpts, batch)
+	if err != nil {
+		panic(fmt.Sprintf("Import: %#v", err))
+	}
+}
+
+// Copy rows whose keys are from @start and before @end from store @from,
+// one batch at a time. A nil @start copies from the first row, and a nil
+// @end to the last one.
+func (s *RegionStore) CopyFrom(from *RegionStore, start, end []byte) {
+	iter := from.db.CreateIterator(from.rdOpts)
+	defer iter.Destroy()
+
+	batch := db.NewWriteBatch()
+	defer batch.Destroy()
+
+	var size int
+	for seekFrom(iter, start); iter.Valid(); iter.Next() {
+		if !keyInRange(iter.Key(), start, end) {
+			continue
+		}
+
+		batch.Put(iter.Key(), iter.Value())
+		size += len(iter.Key()) + len(iter.Value())
+		if size >= STORE_BATCH_BYTES {
+			s.writeBatch(batch, "CopyFrom")
+			batch.Clear()
+			size = 0
+		}
+	}
+	if size > 0 {
+		s.writeBatch(batch, "CopyFrom")
+	}
+}
+
+// Remove rows whose keys are no less than @key, one batch at a time. A
+// nil @key removes all rows.
+func (s *RegionStore) DeleteFrom(key []byte) {
+	iter := s.db.CreateIterator(s.rdOpts)
+	defer iter.Destroy()
+
+	batch := db.NewWriteBatch()
+	defer batch.Destroy()
+
+	var size int
+	for seekFrom(iter, key); iter.Valid(); iter.Next() {
+		realKey, _ := ParseStoreKey(iter.Key())
+		if bytes.Compare(realKey, key) < 0 {
+			continue
+		}
+
+		batch.Delete(iter.Key())
+		size += len(iter.Key())
+		if size >= STORE_BATCH_BYTES {
+			s.writeBatch(batch, "DeleteFrom")
+			batch.Clear()
+			size = 0
+		}
+	}
+	if size > 0 {
+		s.writeBatch(batch, "DeleteFrom")
+	}
+}
+
+// Return true if the key of row @storeKey is from @start and before @end.
+// An empty @end is after all keys. A key that is a prefix of another one
+// may be stored after it, so rows out of the range are skipped rather
+// than ending a scan.
+func keyInRange(storeKey, start, end []byte) bool {
+	realKey, _ := ParseStoreKey(storeKey)
+	return bytes.Compare(realKey, start) >= 0 &&
+		(len(end) == 0 || bytes.Compare(realKey, end) < 0)
+}
+
+// Move @iter to the first row from @key. An empty key is before all rows.
+func seekFrom(iter db.Iterator, key []byte) {
+	if len(key) == 0 {
+		iter.SeekToFirst()
+	} else {
+		iter.Seek(key)
+	}
+}
+
+func (s *RegionStore) writeBatch(batch db.WriteBatch, what string) {
+	err := s.db.Write(s.wrOpts, batch)
+	if err != nil {
+		panic(fmt.Sprintf("%s: %#v", what, err))
+	}
+}
+
+// Return a key that splits the rows into two halves of about the same
+// size. @found is false if there are less than two different keys.
+//
+// The range of keys is halved by sizes that the db estimates from its
+// files, so rows are not read. If nothing has been flushed to files yet,
+// the few rows are scanned instead.
+func (s *RegionStore) FindSplitKey() (key []byte, found bool) {
+	iter := s.db.CreateIterator(s.rdOpts)
+	defer iter.Destroy()
+
+	iter.SeekToFirst()
+	if !iter.Valid() {
+		return
+	}
+	lo := append([]byte(nil), iter.Key()...)
+	first, _ := ParseStoreKey(lo)
+	iter.SeekToLast()
+	hi := append(append([]byte(nil), iter.Key()...), 0)
+	last, _ := ParseStoreKey(iter.Key())
+	if bytes.Equal(first, last) {
+		return
+	}
+
+	start := string(lo)
+	sizeBefore := func(limit []byte) int64 {
+		return s.db.ApproximateSizes([]string{start}, []string{string(limit)})[0]
+	}
+
+	total := sizeBefore(hi)
+	if total <= 0 {
+		return s.scanSplitKey()
+	}
+
+	// Rows before @lo take less than half, and rows before @hi take at
+	// least half.
+	for i := 0; i < SPLIT_KEY_BISECTIONS; i++ {
+		mid := middleKey(lo, hi)
+		if 2*sizeBefore(mid) < total {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	iter.Seek(hi)
+	if !iter.Valid() {
+		iter.SeekToLast()
+	}
+	realKey, _ := ParseStoreKey(iter.Key())
+	if bytes.Equal(realKey, first) {
+		// The first key takes more than half of the rows.
+		realKey = last
+	}
+	return append([]byte(nil), realKey...), true
+}
+
+// Find the split key by scanning all rows.
+func (s *RegionStore) scanSplitKey() (key []byte, found bool) {
+	iter := s.db.CreateIterator(s.rdOpts)
+	defer iter.Destroy()
+
+	var total int64
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		total += int64(len(iter.Key()) + len(iter.Value()))
+	}
+
+	var first []byte
+	var size int64
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		realKey, _ := ParseStoreKey(iter.Key())
+		if first == nil {
+			first = append([]byte(nil), realKey...)
+		} else if 2*size >= total && !bytes.Equal(realKey, first) {
+			return append([]byte(nil), realKey...), true
+		}
+		size += int64(len(iter.Key()) + len(iter.Value()))
+	}
+
+	// The last key takes more than half of the rows.
+	iter.SeekToLast()
+	if iter.Valid() {
+		realKey, _ := ParseStoreKey(iter.Key())
+		if !bytes.Equal(realKey, first) {
+			key, found = append([]byte(nil), realKey...), true
+		}
+	}
+	return
+}
+
+// Return a key halfway between @lo and @hi, reading keys as fractions in
+// base 256. The result has one more byte than the longer of the two.
+func middleKey(lo, hi []byte) []byte {
+	n := len(lo)
+	if len(hi) > n {
+		n = len(hi)
+	}
+
+	pad := func(b []byte) *big.Int {
+		padded := make([]byte, n)
+		copy(padded, b)
+		return new(big.Int).SetBytes(padded)
+	}
+
+	// (lo + hi) / 2, with one more byte of precision.
+	sum := new(big.Int).Add(pad(lo), pad(hi))
+	sum.Lsh(sum, 7)
+	return sum.FillBytes(make([]byte, n+1))
+}
+
+// Return the approximate size of all rows in bytes. Rows that have not
+// been flushed to files are not counted.
+func (s *RegionStore) ApproximateSize() int64 {
+	iter := s.db.CreateIterator(s.rdOpts)
+	defer iter.Destroy()
+
+	iter.SeekToFirst()
+	if !iter.Valid() {
+		return 0
+	}
+	first := string(iter.Key())
+	iter.SeekToLast()
+	last := string(iter.Key()) + "\x00"
+
+	size := s.db.ApproximateSizes([]string{first}, []string{last})[0]
+
+	// Files of different levels may overlap, so the size of a range can
+	// be more than all files together. Sizes of levels are rounded to
+	// megabytes, so small ones are not trusted.
+	if total, found := s.totalFileSize(); found && total > 0 && total < size {
+		size = total
+	}
+	return size
+}
+
+// Add up sizes of all levels in "leveldb.stats", which looks like:
+//
+//	Level  Files Size(MB) Time(sec) Read(MB) Write(MB)
+//	--------------------------------------------------
+//	  0        2        1         0        0         1
+func (s *RegionStore) totalFileSize() (size int64, found bool) {
+	stats, hasStats := s.db.PropertyValue("leveldb.stats")
+	if !hasStats {
+		return
+	}
+
+	for _, line := range strings.Split(stats, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 6 {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[0]); err != nil {
+			continue
+		}
+		mb, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			continue
+		}
+		size += int64(mb * (1 << 20))
+		found = true
+	}
+	return
+}
+
+// A view of rows at the time that it is taken. It is read one chunk at a
+// time without blocking writes to the store, which it does not see.
+type RegionSnapshot struct {
+	db     db.Db
+	snap   db.Snapshot
+	rdOpts db.ReadOptions
+	iter   db.Iterator
+	// Rows from this key on are left out, such as those that a split has
+	// moved out of the region but are not removed yet.
+	end []byte
+}
+
+// Take a view of rows whose keys are before @end. A nil @end takes all
+// rows.
+func (s *RegionStore) CreateSnapshot(end []byte) *RegionSnapshot {
+	snap := s.db.CreateSnapshot()
+	rdOpts := db.NewReadOptions()
+	rdOpts.SetSnapshot(snap)
+
+	iter := s.db.CreateIterator(rdOpts)
+	iter.SeekToFirst()
+	return &RegionSnapshot{db: s.db, snap: snap, rdOpts: rdOpts, iter: iter, end: end}
+}
+
+// Return the next rows of the snapshot, which take no more than
+// @maxBytes unless a single row does. @done is set once the last row is
+// returned.
+func (r *RegionSnapshot) Next(maxBytes int64) (keys, values [][]byte, size int64, done bool) {
+	for ; r.iter.Valid(); r.iter.Next() {
+		if !keyInRange(r.iter.Key(), nil, r.end) {
+			continue
+		}
+		key, value := r.iter.Key(), r.iter.Value()
+		rowSize := int64(len(key) + len(value))
+		if len(keys) > 0 && size+rowSize > maxBytes {
+			break
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+		size += rowSize
+	}
+	done = !r.iter.Valid()
+	return
+}
+
+// Release the snapshot, which must be done before the store is closed.
+func (r *RegionSnapshot) Release() {
+	r.iter.Destroy()
+	r.rdOpts.Destroy()
+	r.db.ReleaseSnapshot(r.snap)
+}
+
 func (s *RegionStore) GetDb() db.Db {
 	return s.db
 }
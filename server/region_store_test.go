@@ -0,0 +1,152 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"fmt"
+	"lbase/balancer"
+	"os"
+	"testing"
+)
+
+func TestRegionStoreGet(t *testing.T) {
+	root := "/tmp/TestRegionStoreGet"
+	os.RemoveAll(root)
+	os.MkdirAll(root, os.ModePerm)
+
+	store := NewRegionStore(&RegionStoreOptions{Name: root, Region: balancer.Region{}})
+	defer store.Close()
+
+	store.Put([]byte("abc"), []byte("v1"), 1)
+	store.Put([]byte("abc"), []byte("v2"), 5)
+	store.Put([]byte("abcd"), []byte("v3"), 9)
+	store.Put([]byte("b"), []byte("v4"), 2)
+
+	value, ver, found := store.Get([]byte("abc"))
+	if !found || string(value) != "v2" || ver != 5 {
+		t.Error("Unexpected latest version:", string(value), ver, found)
+	}
+
+	value, ver, found = store.Get([]byte("b"))
+	if !found || string(value) != "v4" || ver != 2 {
+		t.Error("Unexpected value of the last key:", string(value), ver, found)
+	}
+
+	if _, _, found = store.Get([]byte("ab")); found {
+		t.Error("Should not find a key that is only a prefix")
+	}
+
+	if _, _, found = store.Get([]byte("c")); found {
+		t.Error("Should not find a missing key")
+	}
+}
+
+func TestRegionStoreSplitRange(t *testing.T) {
+	root := "/tmp/TestRegionStoreSplitRange"
+	os.RemoveAll(root)
+	os.MkdirAll(root, os.ModePerm)
+
+	store := NewRegionStore(&RegionStoreOptions{Name: root, Region: balancer.Region{}})
+	defer store.Close()
+
+	if _, found := store.FindSplitKey(); found {
+		t.Error("Should not split an empty store")
+	}
+
+	store.Put([]byte("a"), []byte("v1"), 1)
+	store.Put([]byte("a"), []byte("v2"), 2)
+	if _, found := store.FindSplitKey(); found {
+		t.Error("Should not split a single key")
+	}
+
+	store.Put([]byte("b"), []byte("v3"), 3)
+	store.Put([]byte("bb"), []byte("v4"), 4)
+	store.Put([]byte("c"), []byte("v5"), 5)
+	store.Put([]byte("d"), []byte("v6"), 6)
+
+	key, found := store.FindSplitKey()
+	if !found || string(key) != "c" {
+		t.Error("Unexpected split key:", string(key), found)
+	}
+
+	// "b" is a prefix of "bb", but is not moved.
+	keys, _ := store.DumpFrom([]byte("bb"))
+	if len(keys) != 3 {
+		t.Error("Unexpected number of rows from the split key:", len(keys))
+	}
+
+	store.DeleteFrom([]byte("bb"))
+	if _, _, found = store.Get([]byte("b")); !found {
+		t.Error("Removes a key before the split key")
+	}
+	if _, _, found = store.Get([]byte("bb")); found {
+		t.Error("Fails to remove the split key")
+	}
+	if _, _, found = store.Get([]byte("d")); found {
+		t.Error("Fails to remove the last key")
+	}
+}
+
+func TestRegionStoreCopyInBatches(t *testing.T) {
+	root := "/tmp/TestRegionStoreCopyInBatches"
+	os.RemoveAll(root)
+	os.MkdirAll(root+"/left", os.ModePerm)
+	os.MkdirAll(root+"/right", os.ModePerm)
+
+	left := NewRegionStore(&RegionStoreOptions{Name: root + "/left"})
+	defer left.Close()
+	right := NewRegionStore(&RegionStoreOptions{Name: root + "/right"})
+	defer right.Close()
+
+	// Rows take a few batches.
+	value := make([]byte, 64<<10)
+	numRows := 3 * STORE_BATCH_BYTES / len(value)
+	for i := 0; i < numRows; i++ {
+		left.Put([]byte(fmt.Sprintf("k%04d", i)), value, 1)
+	}
+
+	key, found := left.FindSplitKey()
+	if !found || string(key) != fmt.Sprintf("k%04d", numRows/2) {
+		t.Error("Unexpected split key:", string(key), found)
+	}
+
+	right.CopyFrom(left, key, nil)
+	left.DeleteFrom(key)
+
+	leftKeys, _ := left.Dump()
+	rightKeys, _ := right.Dump()
+	if len(leftKeys) != numRows/2 || len(rightKeys) != numRows-numRows/2 {
+		t.Error("Unexpected rows after the split:", len(leftKeys), len(rightKeys))
+	}
+	if _, _, found = right.Get(key); !found {
+		t.Error("Fails to copy the split key")
+	}
+
+	right.DeleteFrom(nil)
+	if rightKeys, _ = right.Dump(); len(rightKeys) != 0 {
+		t.Error("Fails to remove all rows:", len(rightKeys))
+	}
+}
@@ -0,0 +1,725 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"errors"
+	"lbase/balancer"
+	"log"
+	"net/rpc"
+	"time"
+)
+
+var errRequestTimeout = errors.New("request timeout")
+
+// Kinds of replies received by a leader.
+const (
+	LEADER_EVENT_APPEND = iota
+	LEADER_EVENT_HEARTBEAT
+	LEADER_EVENT_SNAPSHOT
+)
+
+// A reply to, or the failure of, a request sent by a leader.
+type leaderEvent struct {
+	kind int
+	sn   balancer.ServerName
+	cli  RaftClient
+	err  error
+	// Generation of the member's progress when the request is sent.
+	generation int64
+	// Heartbeat round of the request.
+	round          int64
+	req            *AppendEntries
+	appendReply    *AppendEntriesReply
+	heartbeatReply *HeartbeatReply
+	snapshotSeq    RaftSequence
+	snapshotOk     bool
+}
+
+// An AppendEntries to be sent once the lock is released.
+type pendingAppend struct {
+	sn         balancer.ServerName
+	req        *AppendEntries
+	generation int64
+}
+
+// Replicates records of a leader to other members. Records are pipelined
+// to members that are in sync, and heartbeats are sent separately on a
+// fixed interval. All fields are only accessed by the leader loop.
+type replicator struct {
+	s     *RaftStates
+	epoch int64
+	term  int64
+	// Replication progress of each member.
+	progress map[balancer.ServerName]*Progress
+	// One connection to each member, shared by all requests.
+	clients map[balancer.ServerName]RaftClient
+	// The last time that each member replied. Every member is assumed
+	// to be active when the leader is elected.
+	startTime time.Time
+	ackMap    map[balancer.ServerName]time.Time
+	// Replies are delivered to the leader loop through this channel.
+	events chan *leaderEvent
+	// Closed once the leader loop quits.
+	quit chan bool
+	// Current heartbeat round, and recent rounds that may still be
+	// acknowledged. Merged heartbeats may be acknowledged after the next
+	// round has started.
+	round  int64
+	rounds map[int64]*heartbeatRound
+	// The last time that TimeoutNow is sent to the transfer target.
+	lastTimeoutNow time.Time
+	// Ticks on the heartbeat interval. It is stopped while the region is
+	// quiescent.
+	ticker Ticker
+	// Number of consecutive ticks that the leader has nothing to do.
+	idleTicks int
+	// The first round that asks members to go quiescent at
+	// quiesceCommit, and members that have done so since. Replies to
+	// later rounds count too, because they often arrive after the next
+	// round has started.
+	quiesceRound  int64
+	quiesceCommit RaftSequence
+	quiesceAcks   map[balancer.ServerName]bool
+	quiescent     bool
+}
+
+// A round of heartbeats. The lease is extended from the start of a round
+// once a majority of voters acknowledge it.
+type heartbeatRound struct {
+	start   time.Time
+	acks    map[balancer.ServerName]bool
+	granted bool
+}
+
+// Number of recent heartbeat rounds that may still be acknowledged.
+const HEARTBEAT_ROUNDS_KEPT = 4
+
+func newReplicator(s *RaftStates, epoch, term int64) *replicator {
+	return &replicator{
+		s:         s,
+		epoch:     epoch,
+		term:      term,
+		progress:  make(map[balancer.ServerName]*Progress),
+		clients:   make(map[balancer.ServerName]RaftClient),
+		startTime: s.opts.Clock.Now(),
+		ackMap:    make(map[balancer.ServerName]time.Time),
+		events:    make(chan *leaderEvent, 64),
+		quit:      make(chan bool),
+		rounds:    make(map[int64]*heartbeatRound),
+	}
+}
+
+func (r *replicator) run() {
+	defer r.stop()
+
+	r.startTicker()
+	if !r.sendHeartbeats(false) {
+		return
+	}
+
+	for {
+		// A quiescent leader stops ticking.
+		var tickChan <-chan time.Time
+		if r.ticker != nil {
+			tickChan = r.ticker.C()
+		}
+
+		select {
+		case <-r.s.replicateChan:
+			if r.quiescent && !r.unquiesce() {
+				return
+			}
+		case ev := <-r.events:
+			if !r.handleEvent(ev) {
+				return
+			}
+		case <-tickChan:
+			if !r.tick() {
+				return
+			}
+		}
+
+		if !r.replicate() {
+			return
+		}
+	}
+}
+
+func (r *replicator) startTicker() {
+	interval := time.Duration(r.s.opts.HeartbeatIntervalMs) * time.Millisecond
+	r.ticker = r.s.opts.Clock.NewTicker(interval)
+}
+
+func (r *replicator) stop() {
+	if r.ticker != nil {
+		r.ticker.Stop()
+	}
+	close(r.quit)
+	for sn, cli := range r.clients {
+		r.s.ReturnClient(sn, cli)
+	}
+}
+
+// Send records to members, and advance the commit sequence. Return false
+// if this server is no longer the leader.
+func (r *replicator) replicate() bool {
+	s := r.s
+	opts := s.opts
+
+	s.mutex.Lock()
+	if s.epoch != r.epoch {
+		s.mutex.Unlock()
+		return false
+	}
+
+	now := opts.Clock.Now()
+	lastSeq := s.db.GetRaftSequence()
+	commitSeq := s.db.GetCommitSequence()
+
+	// Forget servers that are no longer members.
+	for sn, _ := range r.progress {
+		if !s.config.IsMember(sn) {
+			delete(r.progress, sn)
+			delete(r.ackMap, sn)
+		}
+	}
+
+	var appends []pendingAppend
+	var snapshots []balancer.ServerName
+
+	for _, sn := range s.config.GetMembers() {
+		if sn == opts.Address {
+			continue
+		}
+
+		// If we do not know the progress of a particular server yet,
+		// assume that it is already caught up.
+		pr, found := r.progress[sn]
+		if !found {
+			pr = NewProgress(lastSeq)
+			r.progress[sn] = pr
+		}
+
+		for pr.CanSend(now, opts.MaxInflightAppends, opts.MaxInflightBytes) {
+			// Records before the commit sequence have been removed
+			// from the log, so only a snapshot can bring the member
+			// past them. Retry keeps Next, so a lost reply alone does
+			// not get here.
+			if pr.Next.Index < commitSeq.Index {
+				pr.BecomeSnapshot()
+				snapshots = append(snapshots, sn)
+				break
+			}
+
+			if pr.State == PROGRESS_REPLICATE && !pr.Next.Less(lastSeq) {
+				break
+			}
+
+			data, size := s.ScanNoncommitLogs(
+				&pr.Next, opts.MaxAppendEntries, opts.MaxAppendBytes)
+			if pr.State == PROGRESS_REPLICATE && len(data) == 0 {
+				break
+			}
+
+			last := pr.Next
+			for seq, _ := range data {
+				if last.Index < seq.Index {
+					last = seq
+				}
+			}
+
+			req := &AppendEntries{
+				ServerName:            opts.Address,
+				Term:                  r.term,
+				Region:                opts.Region,
+				LeaderGuessedSequence: pr.Next,
+				Data:                  data,
+				CommitSequence:        commitSeq,
+			}
+			appends = append(appends, pendingAppend{sn, req, pr.generation})
+			pr.Sent(last, size)
+		}
+	}
+
+	s.advanceCommit(r.term, r.progress)
+
+	// A leader that has been removed from the quorum steps down once
+	// the removal is committed.
+	if !s.config.IsVoter(opts.Address) && !s.configChangePending() {
+		s.becomeFollower()
+		s.mutex.Unlock()
+		return false
+	}
+
+	s.promoteLearners(r.progress)
+
+	// Hand over leadership once the transfer target has caught up.
+	sendTimeoutNow := false
+	target := s.transferTarget
+	if s.transferring {
+		interval := time.Duration(opts.HeartbeatIntervalMs) * time.Millisecond
+		pr, found := r.progress[target]
+		if found && pr.Match == s.db.GetRaftSequence() &&
+			r.s.opts.Clock.Now().Sub(r.lastTimeoutNow) >= interval {
+			sendTimeoutNow = true
+			r.lastTimeoutNow = r.s.opts.Clock.Now()
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, pa := range appends {
+		r.sendAppend(&pa)
+	}
+
+	for _, sn := range snapshots {
+		go r.sendSnapshot(sn)
+	}
+
+	if sendTimeoutNow {
+		go s.sendTimeoutNow(target, r.term)
+	}
+
+	return true
+}
+
+// Handle the reply of a request. Return false if this server is no
+// longer the leader.
+func (r *replicator) handleEvent(ev *leaderEvent) bool {
+	interval := time.Duration(r.s.opts.HeartbeatIntervalMs) * time.Millisecond
+	retryAt := r.s.opts.Clock.Now().Add(interval)
+
+	if ev.err != nil {
+		r.dropClient(ev.sn, ev.cli)
+	} else if ev.kind != LEADER_EVENT_SNAPSHOT || ev.snapshotOk {
+		r.ackMap[ev.sn] = r.s.opts.Clock.Now()
+	}
+
+	switch ev.kind {
+	case LEADER_EVENT_APPEND:
+		pr, found := r.progress[ev.sn]
+		if !found {
+			return true
+		}
+
+		if ev.err != nil {
+			if ev.generation == pr.generation {
+				pr.Retry(retryAt)
+			}
+			return true
+		}
+
+		resp := ev.appendReply
+		if resp.NotLeader {
+			return r.stepDown()
+		}
+
+		if resp.Ok {
+			pr.Acked(resp.RealSequence)
+			return true
+		}
+
+		// Replies to abandoned requests are out of date.
+		if ev.generation != pr.generation {
+			return true
+		}
+
+		// Move backward to the record that the server has hinted.
+		index := resp.RealSequence.Index
+		if index >= ev.req.LeaderGuessedSequence.Index {
+			index = ev.req.LeaderGuessedSequence.Index - 1
+		}
+
+		r.s.mutex.Lock()
+		guess, found := r.s.db.GetSequenceAt(index)
+		r.s.mutex.Unlock()
+
+		// If the leader does not keep the record any more, the server
+		// needs a snapshot.
+		if !found {
+			guess = RaftSequence{Index: index}
+		}
+		pr.BecomeProbe(guess)
+
+	case LEADER_EVENT_HEARTBEAT:
+		if ev.err != nil {
+			return true
+		}
+
+		if ev.heartbeatReply.NotLeader {
+			return r.stepDown()
+		}
+
+		if rd, found := r.rounds[ev.round]; found {
+			rd.acks[ev.sn] = true
+			r.checkRound(rd)
+		}
+
+		quiesceRound := r.quiesceRound > 0 && ev.round >= r.quiesceRound
+		if quiesceRound && ev.heartbeatReply.Quiesced {
+			r.quiesceAcks[ev.sn] = true
+			r.checkQuiesce()
+		}
+
+	case LEADER_EVENT_SNAPSHOT:
+		pr, found := r.progress[ev.sn]
+		if !found || pr.State != PROGRESS_SNAPSHOT {
+			return true
+		}
+
+		if ev.snapshotOk {
+			pr.SnapshotInstalled(ev.snapshotSeq)
+		} else {
+			pr.Retry(retryAt)
+		}
+	}
+
+	return true
+}
+
+// Called on every heartbeat interval. Return false if this server is no
+// longer the leader.
+func (r *replicator) tick() bool {
+	s := r.s
+
+	s.mutex.Lock()
+	if s.epoch != r.epoch {
+		s.mutex.Unlock()
+		return false
+	}
+
+	// Step down if the leader may have been partitioned away from
+	// the quorum. Other servers may have elected a new leader.
+	if s.opts.CheckQuorum && !s.hasActiveQuorum(r.ackMap, r.startTime) {
+		log.Printf("Leader %v loses contact with quorum\n", s.opts.Address)
+		s.becomeFollower()
+		s.mutex.Unlock()
+		return false
+	}
+
+	// Ask members to go quiescent after the leader has been idle for
+	// a while.
+	quiesce := false
+	if m := s.opts.MultiRaft; m != nil && m.GetOptions().QuiesceAfterTicks > 0 {
+		if r.isIdle() {
+			r.idleTicks++
+		} else {
+			r.idleTicks = 0
+			r.quiesceRound = 0
+		}
+		quiesce = r.idleTicks >= m.GetOptions().QuiesceAfterTicks
+	}
+	s.mutex.Unlock()
+
+	return r.sendHeartbeats(quiesce)
+}
+
+// Check if there is nothing to replicate, and every member has every
+// record. Called with the raft states locked.
+func (r *replicator) isIdle() bool {
+	s := r.s
+	if s.transferring || s.configChangePending() {
+		return false
+	}
+
+	lastSeq := s.db.GetRaftSequence()
+	if s.db.GetCommitSequence() != lastSeq {
+		return false
+	}
+
+	for _, sn := range s.config.GetMembers() {
+		if sn == s.opts.Address {
+			continue
+		}
+		pr, found := r.progress[sn]
+		if !found || pr.Match != lastSeq {
+			return false
+		}
+	}
+	return true
+}
+
+// Go quiescent once every member has done so.
+func (r *replicator) checkQuiesce() {
+	if r.quiescent {
+		return
+	}
+
+	s := r.s
+	s.mutex.Lock()
+	if s.epoch != r.epoch || !r.isIdle() {
+		s.mutex.Unlock()
+		return
+	}
+	for _, sn := range s.config.GetMembers() {
+		if sn != s.opts.Address && !r.quiesceAcks[sn] {
+			s.mutex.Unlock()
+			return
+		}
+	}
+	s.quiescent = true
+	s.mutex.Unlock()
+
+	r.quiescent = true
+	r.ticker.Stop()
+	r.ticker = nil
+}
+
+// Wake up a quiescent leader. Members have not heard from it for a while,
+// so heartbeats are sent right away. Return false if this server is no
+// longer the leader.
+func (r *replicator) unquiesce() bool {
+	s := r.s
+	s.mutex.Lock()
+	if s.epoch != r.epoch {
+		s.mutex.Unlock()
+		return false
+	}
+	s.quiescent = false
+	s.mutex.Unlock()
+
+	r.quiescent = false
+	r.idleTicks = 0
+	r.quiesceRound = 0
+
+	// Members were not supposed to reply while the region is quiescent.
+	r.startTime = s.opts.Clock.Now()
+	r.ackMap = make(map[balancer.ServerName]time.Time)
+
+	r.startTicker()
+	return r.sendHeartbeats(false)
+}
+
+// Start a new round of heartbeats to all members. If @quiesce is set,
+// members are asked to go quiescent.
+func (r *replicator) sendHeartbeats(quiesce bool) bool {
+	s := r.s
+
+	s.mutex.Lock()
+	if s.epoch != r.epoch {
+		s.mutex.Unlock()
+		return false
+	}
+
+	members := s.config.GetMembers()
+	req := &Heartbeat{
+		ServerName:     s.opts.Address,
+		Term:           r.term,
+		Region:         s.opts.Region,
+		CommitSequence: s.db.GetCommitSequence(),
+		Quiesce:        quiesce,
+	}
+	s.mutex.Unlock()
+
+	r.round++
+	rd := &heartbeatRound{
+		start: r.s.opts.Clock.Now(),
+		acks:  make(map[balancer.ServerName]bool),
+	}
+	r.rounds[r.round] = rd
+	delete(r.rounds, r.round-HEARTBEAT_ROUNDS_KEPT)
+
+	if quiesce && (r.quiesceRound == 0 || r.quiesceCommit != req.CommitSequence) {
+		r.quiesceRound = r.round
+		r.quiesceCommit = req.CommitSequence
+		r.quiesceAcks = make(map[balancer.ServerName]bool)
+	}
+
+	for _, sn := range members {
+		if sn == s.opts.Address {
+			continue
+		}
+
+		if s.opts.MultiRaft != nil {
+			r.queueHeartbeat(sn, req)
+			continue
+		}
+
+		cli := r.getClient(sn)
+		if cli == nil {
+			continue
+		}
+
+		reply := &HeartbeatReply{}
+		call := cli.Go("ServerRPC.Heartbeat", req, reply, nil)
+		go r.wait(call, r.callTimeout(), &leaderEvent{
+			kind:           LEADER_EVENT_HEARTBEAT,
+			sn:             sn,
+			cli:            cli,
+			round:          r.round,
+			heartbeatReply: reply,
+		})
+	}
+
+	// A single voter does not wait for anybody.
+	r.checkRound(rd)
+	if quiesce {
+		r.checkQuiesce()
+	}
+	return true
+}
+
+// Send a heartbeat along with heartbeats of other regions.
+func (r *replicator) queueHeartbeat(sn balancer.ServerName, req *Heartbeat) {
+	round := r.round
+	r.s.opts.MultiRaft.SendHeartbeat(sn, req, func(reply *HeartbeatReply, err error) {
+		ev := &leaderEvent{
+			kind:           LEADER_EVENT_HEARTBEAT,
+			sn:             sn,
+			err:            err,
+			round:          round,
+			heartbeatReply: reply,
+		}
+
+		select {
+		case r.events <- ev:
+		case <-r.quit:
+		}
+	})
+}
+
+// Extend the lease once a majority of voters acknowledge a round.
+func (r *replicator) checkRound(rd *heartbeatRound) {
+	if rd.granted {
+		return
+	}
+
+	s := r.s
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	acked := 0
+	for _, sn := range s.config.Voters {
+		if sn == s.opts.Address || rd.acks[sn] {
+			acked++
+		}
+	}
+
+	if acked >= s.config.Quorum() {
+		rd.granted = true
+		s.extendLease(rd.start)
+	}
+}
+
+func (r *replicator) sendAppend(pa *pendingAppend) {
+	cli := r.getClient(pa.sn)
+	if cli == nil {
+		pr, found := r.progress[pa.sn]
+		if found && pr.generation == pa.generation {
+			interval := time.Duration(r.s.opts.HeartbeatIntervalMs)
+			pr.Retry(r.s.opts.Clock.Now().Add(interval * time.Millisecond))
+		}
+		return
+	}
+
+	reply := &AppendEntriesReply{}
+	call := cli.Go("ServerRPC.AppendEntries", pa.req, reply, nil)
+	go r.wait(call, r.callTimeout(), &leaderEvent{
+		kind:        LEADER_EVENT_APPEND,
+		sn:          pa.sn,
+		cli:         cli,
+		generation:  pa.generation,
+		req:         pa.req,
+		appendReply: reply,
+	})
+}
+
+func (r *replicator) sendSnapshot(sn balancer.ServerName) {
+	seq, ok := r.s.sendSnapshot(sn, r.term)
+
+	ev := &leaderEvent{
+		kind:        LEADER_EVENT_SNAPSHOT,
+		sn:          sn,
+		snapshotSeq: seq,
+		snapshotOk:  ok,
+	}
+
+	select {
+	case r.events <- ev:
+	case <-r.quit:
+	}
+}
+
+// Start the timeout of a call. It is started by the sender rather than
+// by the goroutine that waits, so that timeouts of calls are created in
+// the order the calls are sent.
+func (r *replicator) callTimeout() <-chan time.Time {
+	timeOut := time.Duration(r.s.opts.RaftLeaderTimeoutMs) * time.Millisecond
+	return r.s.opts.Clock.After(timeOut)
+}
+
+// Wait for the reply of a call until @timeOut fires, and deliver it to
+// the leader loop.
+func (r *replicator) wait(call *rpc.Call, timeOut <-chan time.Time, ev *leaderEvent) {
+	select {
+	case <-call.Done:
+		ev.err = call.Error
+	case <-timeOut:
+		ev.err = errRequestTimeout
+	case <-r.quit:
+		return
+	}
+
+	select {
+	case r.events <- ev:
+	case <-r.quit:
+	}
+}
+
+func (r *replicator) getClient(sn balancer.ServerName) RaftClient {
+	cli, found := r.clients[sn]
+	if found {
+		return cli
+	}
+
+	cli = r.s.GetClient(sn)
+	if cli != nil {
+		r.clients[sn] = cli
+	}
+	return cli
+}
+
+// Close a broken connection. Requests that are still using it fail.
+func (r *replicator) dropClient(sn balancer.ServerName, cli RaftClient) {
+	if cli == nil {
+		return
+	}
+
+	cur, found := r.clients[sn]
+	if found && cur == cli {
+		delete(r.clients, sn)
+		r.s.DropClient(sn, cli)
+	}
+}
+
+func (r *replicator) stepDown() bool {
+	r.s.mutex.Lock()
+	defer r.s.mutex.Unlock()
+	if r.s.epoch == r.epoch {
+		r.s.becomeFollower()
+	}
+	return false
+}
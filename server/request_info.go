@@ -26,11 +26,43 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package server
 
 import (
+	"lbase/balancer"
 	"net/rpc"
+	"sort"
+	"time"
 )
 
 // Common data structure needed for a RPC call.
 type RequestInfo struct {
-	Cli  *rpc.Client
+	Cli  RaftClient
 	Call *rpc.Call
 }
+
+// Wait until @call is done or @timeOut fires. Return false if it times
+// out. A call that is done wins over a timeout that has fired too, so
+// that the outcome does not depend on which one select picks.
+func waitCall(call *rpc.Call, timeOut <-chan time.Time) bool {
+	select {
+	case <-call.Done:
+		return true
+	default:
+	}
+
+	select {
+	case <-call.Done:
+		return true
+	case <-timeOut:
+		return false
+	}
+}
+
+// Return servers of @calls in order, so that their replies are waited for
+// in the same order every time.
+func sortedServers(calls map[balancer.ServerName]RequestInfo) []balancer.ServerName {
+	ret := make([]balancer.ServerName, 0, len(calls))
+	for sn, _ := range calls {
+		ret = append(ret, sn)
+	}
+	sort.Sort(serverNames(ret))
+	return ret
+}
@@ -39,6 +39,12 @@ type RequestVote struct {
 	Term int64
 	// The sequence value of the candidate.
 	LastSequence RaftSequence
+	// Set it to true if the candidate only wants to know if it could win
+	// an election. A server does not remember its answer to a pre-vote.
+	PreVote bool
+	// Set it to true if the election is started because the leader is
+	// handing over its leadership to the candidate.
+	LeaderTransfer bool
 }
 
 // The response for a RequestVote request.
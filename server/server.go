@@ -28,10 +28,12 @@ package server
 import (
 	"fmt"
 	"lbase/balancer"
+	"log"
 	"net"
 	"net/http"
 	"net/rpc"
 	"strconv"
+	"sync"
 )
 
 var (
@@ -99,8 +101,125 @@ func NewServer(prefix string, port int) (s *Server, rport int) {
 	return
 }
 
+// Create a server that does not listen on the network. RPCs are delivered
+// to it through a Transport such as SimNetwork.
+func NewLocalServer() *Server {
+	s := &Server{ServerRPC: ServerRPC{}}
+	s.ServerRPC.init()
+	return s
+}
+
+// Start a multi-raft layer for regions served by this server. Regions
+// join it by setting RaftOptions.MultiRaft before they are created.
+func (s *Server) StartMultiRaft(opts *MultiRaftOptions) (m *MultiRaft, err error) {
+	m, err = newMultiRaft(opts, s.GetRegions)
+	if err != nil {
+		return
+	}
+
+	s.mutex.Lock()
+	s.multiRaft = m
+	s.mutex.Unlock()
+
+	go m.run()
+	return
+}
+
+// Start reporting sizes and loads of regions that this server leads.
+func (s *Server) StartRegionMonitor(opts *RegionMonitorOptions) *RegionMonitor {
+	m := newRegionMonitor(opts, s.GetRegions)
+
+	s.mutex.Lock()
+	s.regionMonitor = m
+	s.mutex.Unlock()
+
+	go m.run()
+	return m
+}
+
+// Start sending stats of this server to a master.
+func (s *Server) StartStatReporter(opts *StatReporterOptions) *StatReporter {
+	r := newStatReporter(opts, s.GetRegions)
+
+	s.mutex.Lock()
+	s.statReporter = r
+	s.mutex.Unlock()
+
+	go r.run()
+	return r
+}
+
+// Host a master on this server. Other servers report their stats to it.
+func (s *Server) StartMaster(opts *MasterOptions) *Master {
+	m := NewMaster(opts)
+
+	s.mutex.Lock()
+	s.master = m
+	s.mutex.Unlock()
+
+	go m.run()
+	return m
+}
+
+func (s *Server) GetMultiRaft() *MultiRaft {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.multiRaft
+}
+
+// Stop serving. Regions must have been unregistered before, because
+// the multi-raft layer closes the log engine that they share.
 func (s *Server) Close() {
-	s.listener.Close()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+
+	s.mutex.Lock()
+	m := s.multiRaft
+	s.multiRaft = nil
+	monitor := s.regionMonitor
+	s.regionMonitor = nil
+	reporter := s.statReporter
+	s.statReporter = nil
+	master := s.master
+	s.master = nil
+	s.mutex.Unlock()
+
+	if monitor != nil {
+		monitor.Close()
+	}
+	if reporter != nil {
+		reporter.Close()
+	}
+	if master != nil {
+		master.Close()
+	}
+	if m != nil {
+		m.Close()
+	}
+}
+
+// Gracefully shut down the server. Leadership of regions led by this server
+// is handed over to other members first, so that the regions do not wait
+// for the leader timeout to elect a new leader.
+func (s *Server) Shutdown() {
+	var wg sync.WaitGroup
+	for _, states := range s.GetRegions() {
+		if states.GetState() == RAFT_LEADER {
+			wg.Add(1)
+			go func(states *RaftStates) {
+				defer wg.Done()
+				states.TransferLeadership(balancer.ServerName{})
+			}(states)
+		}
+	}
+	wg.Wait()
+
+	for r, _ := range s.GetRegions() {
+		s.UnregisterRegion(r)
+	}
+
+	s.Close()
 }
 
 func (s *Server) GetRpcPath() string {
@@ -112,15 +231,161 @@ func (s *Server) GetDebugPath() string {
 }
 
 func (s *Server) RegisterRegion(r balancer.Region, states *RaftStates) {
+	states.setHost(s)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.regionRaftMap[r] = states
 }
 
 func (s *Server) UnregisterRegion(r balancer.Region) {
+	s.mutex.Lock()
 	val, found := s.regionRaftMap[r]
 	if found {
-		val.Close()
 		delete(s.regionRaftMap, r)
 	}
+	s.mutex.Unlock()
+
+	if found {
+		val.Close()
+	}
+}
+
+// Close all regions. Regions that split off while they are being closed
+// are closed too.
+func (s *Server) UnregisterRegions() {
+	for regions := s.GetRegions(); len(regions) > 0; regions = s.GetRegions() {
+		for r, _ := range regions {
+			s.UnregisterRegion(r)
+		}
+	}
+}
+
+// Learns about regions that change on servers. A Balancer is one.
+type RegionListener interface {
+	// Called when @origin splits into @left and @right.
+	SplitRegion(origin, left, right balancer.Region) bool
+	// Called when @left and @right merge. @light is the one whose quorum
+	// is retired.
+	MergeRegions(left, right, light balancer.Region)
+}
+
+// Let @listener learn about regions that split or merge on this server. It is only
+// told by the leader of a region. It is called with the raft states of the
+// region locked, so it must not block.
+func (s *Server) SetRegionListener(listener RegionListener) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.regionListener = listener
+}
+
+// Return the raft states of region @r, which must match exactly.
+func (s *Server) findRegion(r balancer.Region) *RaftStates {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.regionRaftMap[r]
+}
+
+// Serve a region by its new key range. Retire regions merged into it, and
+// start the region split off from it.
+func (s *Server) updateRegion(
+	origin, region balancer.Region,
+	right *RaftStates,
+	isLeader bool) {
+
+	s.mutex.Lock()
+	states, found := s.regionRaftMap[origin]
+	if found {
+		delete(s.regionRaftMap, origin)
+		s.regionRaftMap[region] = states
+	}
+
+	var merged []balancer.Region
+	var retired []*RaftStates
+	for cur, curStates := range s.regionRaftMap {
+		if curStates != states && coversRegion(region, cur) {
+			delete(s.regionRaftMap, cur)
+			merged = append(merged, cur)
+			retired = append(retired, curStates)
+		}
+	}
+	listener := s.regionListener
+	s.mutex.Unlock()
+
+	for i, states := range retired {
+		states.Close()
+		states.GetStorage().Destroy()
+		if isLeader && listener != nil {
+			listener.MergeRegions(origin, merged[i], merged[i])
+		}
+	}
+
+	if right == nil {
+		return
+	}
+
+	// The region has been closed.
+	if !found {
+		right.Close()
+		return
+	}
+
+	rightRegion := right.GetRegion()
+	s.RegisterRegion(rightRegion, right)
+
+	// The leader of the original region is the most likely one to win.
+	if isLeader {
+		right.TransitToCandidate()
+	} else {
+		right.TransitToFollower()
+	}
+
+	if isLeader && listener != nil {
+		listener.SplitRegion(origin, region, rightRegion)
+	}
+}
+
+// Creates the raft states of a region that is placed on this server, with
+// no data. If @members is empty, the region joins its quorum as a learner.
+type RegionFactory func(r balancer.Region, members []balancer.ServerName) (*RaftStates, error)
+
+// Let @factory create regions that are placed on this server.
+func (s *Server) SetRegionFactory(factory RegionFactory) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Regions are opened one at a time, so that a region is not opened
+	// twice.
+	var opening sync.Mutex
+	s.openRegion = func(r balancer.Region, members []balancer.ServerName) bool {
+		opening.Lock()
+		defer opening.Unlock()
+
+		if s.findRegion(r) != nil {
+			return true
+		}
+
+		states, err := factory(r, members)
+		if err != nil {
+			log.Printf("Fails to open region %v: %v\n", r, err)
+			return false
+		}
+		s.RegisterRegion(r, states)
+		states.TransitToFollower()
+		return true
+	}
+}
+
+// Return a copy of all regions served by this server.
+func (s *Server) GetRegions() map[balancer.Region]*RaftStates {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	ret := make(map[balancer.Region]*RaftStates)
+	for r, states := range s.regionRaftMap {
+		ret[r] = states
+	}
+	return ret
 }
 
 func (s *Server) GetPort() int {
@@ -27,16 +27,58 @@ package server
 
 import (
 	"lbase/balancer"
+	"sync"
 )
 
 type ServerRPC struct {
+	// Protects all fields below.
+	mutex         sync.RWMutex
 	regionRaftMap map[balancer.Region]*RaftStates
+	// Nil unless the server runs a multi-raft layer.
+	multiRaft *MultiRaft
+	// Learns about regions that split or merge.
+	regionListener RegionListener
+	// Nil unless loads of regions are reported.
+	regionMonitor *RegionMonitor
+	// Creates and starts regions placed on this server. It is nil unless
+	// a RegionFactory is set.
+	openRegion func(r balancer.Region, members []balancer.ServerName) bool
+	// Nil unless stats of this server are sent to a master.
+	statReporter *StatReporter
+	// Nil unless this server hosts a master.
+	master *Master
 }
 
 func (s *ServerRPC) init() {
 	s.regionRaftMap = make(map[balancer.Region]*RaftStates)
 }
 
+// Return the raft states of region @r. Members of a region that splits
+// do not split at the same time, so a region that starts at the same key
+// and either covers @r or is covered by it is the same raft quorum.
+func (s *ServerRPC) getRegion(r balancer.Region) (states *RaftStates, found bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	states, found = s.regionRaftMap[r]
+	if found {
+		return
+	}
+
+	for cur, curStates := range s.regionRaftMap {
+		if cur.StartKey == r.StartKey && (coversRegion(cur, r) || coversRegion(r, cur)) {
+			return curStates, true
+		}
+	}
+	return
+}
+
+// Check if @outer covers every key of @inner.
+func coversRegion(outer, inner balancer.Region) bool {
+	return inner.StartKey >= outer.StartKey &&
+		(outer.EndKey == "" || (inner.EndKey != "" && inner.EndKey <= outer.EndKey))
+}
+
 // A simple RPC method to test if the server is alive.
 func (s *ServerRPC) Echo(x int, resp *int) error {
 	*resp = x
@@ -44,7 +86,7 @@ func (s *ServerRPC) Echo(x int, resp *int) error {
 }
 
 func (s *ServerRPC) RequestVote(req RequestVote, resp *RequestVoteReply) error {
-	states, found := s.regionRaftMap[req.Region]
+	states, found := s.getRegion(req.Region)
 	if found {
 		states.HandleRequestVote(&req, resp)
 	}
@@ -52,25 +94,81 @@ func (s *ServerRPC) RequestVote(req RequestVote, resp *RequestVoteReply) error {
 }
 
 func (s *ServerRPC) AppendEntries(req AppendEntries, resp *AppendEntriesReply) error {
-	states, found := s.regionRaftMap[req.Region]
+	states, found := s.getRegion(req.Region)
 	if found {
 		states.HandleAppendEntries(&req, resp)
 	}
 	return nil
 }
 
+func (s *ServerRPC) Heartbeat(req Heartbeat, resp *HeartbeatReply) error {
+	states, found := s.getRegion(req.Region)
+	if found {
+		states.HandleHeartbeat(&req, resp)
+	}
+	return nil
+}
+
+// Heartbeats of all regions that another server leads. Each heartbeat is
+// handled as if it is sent alone.
+func (s *ServerRPC) BatchHeartbeat(req *BatchHeartbeat, resp *BatchHeartbeatReply) error {
+	s.mutex.RLock()
+	m := s.multiRaft
+	s.mutex.RUnlock()
+
+	if m != nil {
+		m.RecordContact(req.ServerName)
+	}
+
+	resp.Replies = make([]HeartbeatReply, len(req.Heartbeats))
+	for i, _ := range req.Heartbeats {
+		raft, found := s.getRegion(req.Heartbeats[i].Region)
+		if found {
+			raft.HandleHeartbeat(&req.Heartbeats[i], &resp.Replies[i])
+		}
+	}
+	return nil
+}
+
+func (s *ServerRPC) InstallSnapshot(
+	req InstallSnapshot,
+	resp *InstallSnapshotReply) error {
+
+	states, found := s.getRegion(req.Region)
+	if found {
+		states.HandleInstallSnapshot(&req, resp)
+	}
+	return nil
+}
+
+func (s *ServerRPC) TimeoutNow(req TimeoutNow, resp *TimeoutNowReply) error {
+	states, found := s.getRegion(req.Region)
+	if found {
+		states.HandleTimeoutNow(&req, resp)
+	}
+	return nil
+}
+
 // Request to get the state of a raft member.
 type RaftStateRequest struct {
 	Region balancer.Region
 }
 
 type RaftStateReply struct {
-	Found bool
-	State int
+	Found          bool
+	State          int
+	Configuration  RaftConfiguration
+	Region         balancer.Region
+	CommitSequence RaftSequence
+	FrozenSequence RaftSequence
+	// Set if Configuration has been committed.
+	ConfigurationCommitted bool
+	// If this is the leader, snapshots that are being sent to members.
+	Snapshots map[balancer.ServerName]SnapshotProgress
 }
 
 func (s *ServerRPC) GetRaftState(req RaftStateRequest, resp *RaftStateReply) error {
-	states, found := s.regionRaftMap[req.Region]
+	states, found := s.getRegion(req.Region)
 	if found {
 		states.HandleGetRaftState(req, resp)
 	}
@@ -88,7 +186,7 @@ type AppendEditReply struct {
 }
 
 func (s *ServerRPC) AppendEdit(req *AppendEditRequest, resp *AppendEditReply) error {
-	raft, found := s.regionRaftMap[req.Region]
+	raft, found := s.getRegion(req.Region)
 	if found {
 		raft.GetEditQueue().AppendEdit(req.Data)
 		resp.Ok = true
@@ -112,7 +210,7 @@ func (s *ServerRPC) GetNRecords(
 	req *GetNRecordsRequest,
 	resp *GetNRecordsReply) error {
 
-	raft, found := s.regionRaftMap[req.Region]
+	raft, found := s.getRegion(req.Region)
 	if found {
 		var seq int64
 		queue := raft.GetEditQueue()
@@ -138,10 +236,361 @@ func (s *ServerRPC) TrimEditQueue(
 	req *TrimEditQueueRequest,
 	resp *TrimEditQueueReply) error {
 
-	raft, found := s.regionRaftMap[req.Region]
+	raft, found := s.getRegion(req.Region)
 	if found {
 		raft.GetEditQueue().Trim(req.EndSequence)
 		resp.Ok = true
 	}
 	return nil
 }
+
+// Request to add or remove a member of a raft quorum. The request must be
+// sent to the leader of the quorum.
+type MembershipRequest struct {
+	Region     balancer.Region
+	ServerName balancer.ServerName
+}
+
+type MembershipReply struct {
+	Ok bool
+}
+
+func (s *ServerRPC) AddMember(
+	req *MembershipRequest,
+	resp *MembershipReply) error {
+
+	raft, found := s.getRegion(req.Region)
+	if found {
+		resp.Ok = raft.AddMember(req.ServerName)
+	}
+	return nil
+}
+
+func (s *ServerRPC) RemoveMember(
+	req *MembershipRequest,
+	resp *MembershipReply) error {
+
+	raft, found := s.getRegion(req.Region)
+	if found {
+		resp.Ok = raft.RemoveMember(req.ServerName)
+	}
+	return nil
+}
+
+// Request to move the leadership of a region to another member. The request
+// must be sent to the leader of the region. If Target is empty, the leader
+// picks one of the voters.
+type TransferLeadershipRequest struct {
+	Region balancer.Region
+	Target balancer.ServerName
+}
+
+type TransferLeadershipReply struct {
+	Ok bool
+}
+
+func (s *ServerRPC) TransferLeadership(
+	req *TransferLeadershipRequest,
+	resp *TransferLeadershipReply) error {
+
+	raft, found := s.getRegion(req.Region)
+	if found {
+		resp.Ok = raft.TransferLeadership(req.Target)
+	}
+	return nil
+}
+
+// Consistency levels of a read.
+const (
+	// Confirm leadership with a round of heartbeats before reading from
+	// the leader.
+	READ_LINEARIZABLE = iota
+	// Read from the leader if it holds a lease. Fall back to
+	// READ_LINEARIZABLE otherwise.
+	READ_LEASE
+	// Read from any member that has synchronized with the leader recently.
+	READ_STALE
+)
+
+// Request to read the latest value of a key. Linearizable and lease reads
+// must be sent to the leader of the region.
+type ReadRequest struct {
+	Region      balancer.Region
+	Key         []byte
+	Consistency int
+	// For stale reads only. How far the member may fall behind the leader.
+	// If it is 0, RaftOptions.MaxStaleReadMs is used.
+	MaxStalenessMs int64
+}
+
+type ReadReply struct {
+	// Set if the read is served.
+	Ok        bool
+	NotLeader bool
+	// Set if the key exists.
+	Found bool
+	Value []byte
+	// Set if the key is not in the region, because the region has split.
+	WrongRegion bool
+}
+
+func (s *ServerRPC) Read(req *ReadRequest, resp *ReadReply) error {
+	raft, found := s.getRegion(req.Region)
+	if found {
+		raft.HandleRead(req, resp)
+	}
+	return nil
+}
+
+// Request to write a key through the quorum. It must be sent to the leader
+// of the region, and the reply is sent after the write is committed.
+type WriteRequest struct {
+	Region balancer.Region
+	Key    []byte
+	Value  []byte
+	// If set, Delta is added to the counter at Key, and Value is ignored.
+	Increment bool
+	Delta     int64
+}
+
+type WriteReply struct {
+	// Set if the write is committed.
+	Ok bool
+	// Set if the write is not accepted. It never takes effect, so it is
+	// safe to retry it on another member. If neither Ok nor NotLeader
+	// is set, the write may or may not take effect.
+	NotLeader bool
+	// Set if the key is not in the region, because the region has split.
+	// The write never takes effect.
+	WrongRegion bool
+}
+
+func (s *ServerRPC) Write(req *WriteRequest, resp *WriteReply) error {
+	raft, found := s.getRegion(req.Region)
+	if found {
+		raft.HandleWrite(req, resp)
+	} else {
+		resp.NotLeader = true
+	}
+	return nil
+}
+
+// Request to split a region. It must be sent to the leader of the region.
+// If Key is empty, the region is split into two halves of about the same
+// size.
+type SplitRegionRequest struct {
+	Region balancer.Region
+	Key    []byte
+}
+
+type SplitRegionReply struct {
+	// Set if the split is proposed. It is done once it is committed.
+	Ok bool
+}
+
+func (s *ServerRPC) SplitRegion(
+	req *SplitRegionRequest,
+	resp *SplitRegionReply) error {
+
+	raft, found := s.getRegion(req.Region)
+	if found {
+		key := req.Key
+		if len(key) == 0 {
+			key = nil
+		}
+		resp.Ok = raft.SplitRegion(key)
+	}
+	return nil
+}
+
+// Request to freeze a region before it is merged, or to thaw it if the
+// merge fails. It must be sent to the leader of the region.
+type FreezeRegionRequest struct {
+	Region balancer.Region
+	Thaw   bool
+}
+
+type FreezeRegionReply struct {
+	Ok bool
+	// Sequence of the freeze record, which has been committed.
+	FrozenSequence RaftSequence
+}
+
+func (s *ServerRPC) FreezeRegion(
+	req *FreezeRegionRequest,
+	resp *FreezeRegionReply) error {
+
+	raft, found := s.getRegion(req.Region)
+	if !found || raft.GetRegion() != req.Region {
+		return nil
+	}
+
+	if req.Thaw {
+		resp.Ok = raft.Thaw()
+	} else {
+		resp.FrozenSequence, resp.Ok = raft.Freeze()
+	}
+	return nil
+}
+
+// Request to merge region Right into its neighbor Left. It must be sent
+// to the leader of Left, and blocks until the merge is committed.
+type MergeRegionsRequest struct {
+	Left  balancer.Region
+	Right balancer.Region
+}
+
+type MergeRegionsReply struct {
+	Ok bool
+}
+
+func (s *ServerRPC) MergeRegions(
+	req *MergeRegionsRequest,
+	resp *MergeRegionsReply) error {
+
+	raft, found := s.getRegion(req.Left)
+	if found {
+		resp.Ok = raft.MergeRegion(req.Right)
+	}
+	return nil
+}
+
+// Request to serve a region that is being placed on this server. If
+// Members is empty, the new replica waits for the leader to add it to the
+// quorum. Otherwise, it starts a new quorum of Members.
+type OpenRegionRequest struct {
+	Region  balancer.Region
+	Members []balancer.ServerName
+}
+
+type OpenRegionReply struct {
+	Ok bool
+}
+
+func (s *ServerRPC) OpenRegion(
+	req *OpenRegionRequest,
+	resp *OpenRegionReply) error {
+
+	s.mutex.RLock()
+	_, found := s.regionRaftMap[req.Region]
+	open := s.openRegion
+	s.mutex.RUnlock()
+
+	if found {
+		resp.Ok = true
+	} else if open != nil {
+		resp.Ok = open(req.Region, req.Members)
+	}
+	return nil
+}
+
+// Request to stop serving a region that has been moved away from this
+// server. All data of the region on this server is removed.
+type DropRegionRequest struct {
+	Region balancer.Region
+}
+
+type DropRegionReply struct {
+	Ok bool
+}
+
+func (s *ServerRPC) DropRegion(
+	req *DropRegionRequest,
+	resp *DropRegionReply) error {
+
+	s.mutex.Lock()
+	states, found := s.regionRaftMap[req.Region]
+	delete(s.regionRaftMap, req.Region)
+	s.mutex.Unlock()
+
+	if found {
+		states.Close()
+		states.GetStorage().Destroy()
+	}
+	resp.Ok = true
+	return nil
+}
+
+// A stat that a server reports to the master periodically, which serves
+// as its heartbeat.
+type ReportStatRequest struct {
+	Stat balancer.ServerStat
+}
+
+type ReportStatReply struct {
+	// Set if this server hosts a master.
+	Ok bool
+}
+
+func (s *ServerRPC) ReportStat(
+	req *ReportStatRequest,
+	resp *ReportStatReply) error {
+
+	s.mutex.RLock()
+	m := s.master
+	s.mutex.RUnlock()
+
+	if m != nil {
+		m.ReportStat(&req.Stat)
+		resp.Ok = true
+	}
+	return nil
+}
+
+// Request to find the region that contains a key. Any master answers it
+// from stats that servers report.
+type LocateRegionRequest struct {
+	Key []byte
+}
+
+type LocateRegionReply struct {
+	Found  bool
+	Region balancer.Region
+	// Empty if the leader is not known yet.
+	Leader  balancer.ServerName
+	Members []balancer.ServerName
+}
+
+func (s *ServerRPC) LocateRegion(
+	req *LocateRegionRequest,
+	resp *LocateRegionReply) error {
+
+	s.mutex.RLock()
+	m := s.master
+	s.mutex.RUnlock()
+
+	if m != nil {
+		location, found := m.LocateRegion(req.Key)
+		resp.Found = found
+		resp.Region = location.Region
+		resp.Leader = location.Leader
+		resp.Members = location.Members
+	}
+	return nil
+}
+
+// Request to replace hints of where leaders of regions should be. A hint
+// for a table covers the key range of the table.
+type SetPreferredLeadersRequest struct {
+	Hints []balancer.PreferredLeader
+}
+
+type SetPreferredLeadersReply struct {
+	// Set if this server hosts a master.
+	Ok bool
+}
+
+func (s *ServerRPC) SetPreferredLeaders(
+	req *SetPreferredLeadersRequest,
+	resp *SetPreferredLeadersReply) error {
+
+	s.mutex.RLock()
+	m := s.master
+	s.mutex.RUnlock()
+
+	if m != nil {
+		m.SetPreferredLeaders(req.Hints)
+		resp.Ok = true
+	}
+	return nil
+}
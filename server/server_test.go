@@ -27,8 +27,10 @@ package server
 
 import (
 	"fmt"
+	"lbase/balancer"
 	"net/rpc"
 	"testing"
+	"time"
 )
 
 func TestServerAlive(t *testing.T) {
@@ -87,3 +89,36 @@ func TestAsyncCall(t *testing.T) {
 		t.Error("Result mismatch!")
 	}
 }
+
+func TestServerShutdownTransfersLeadership(t *testing.T) {
+	root := "/tmp/TestServerShutdownTransfersLeadership"
+	reg := balancer.Region{}
+
+	rss, servers := initRaftQuorum(root, reg, 3, true)
+
+	leader := waitForRaftLeader(rss, 5*time.Second)
+	if leader == nil {
+		t.Fatal("Fails to elect a leader!")
+	}
+
+	var others []*RaftStates
+	for i, states := range rss {
+		if states == leader {
+			servers[i].Shutdown()
+		} else {
+			others = append(others, states)
+			defer servers[i].Close()
+		}
+	}
+
+	// The leadership has been handed over before shutdown returns.
+	found := false
+	for _, states := range others {
+		if states.GetState() == RAFT_LEADER {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("No leader after graceful shutdown")
+	}
+}
@@ -0,0 +1,237 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"container/heap"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Number of frames of the call stack that tells timers apart.
+const SIM_TIMER_SITE_DEPTH = 16
+
+// A simulated timer. A timer either sends to a channel or calls a function
+// when it fires. A timer with a period fires repeatedly.
+type simTimer struct {
+	when time.Time
+	// Step of the clock in which the timer is created, and the call stack
+	// that creates it.
+	step   int64
+	site   []uintptr
+	id     int64
+	period time.Duration
+	ch     chan time.Time
+	f      func()
+	index  int
+}
+
+type simTimerHeap []*simTimer
+
+func (h simTimerHeap) Len() int {
+	return len(h)
+}
+
+func (h simTimerHeap) Less(i, j int) bool {
+	a, b := h[i], h[j]
+	if !a.when.Equal(b.when) {
+		return a.when.Before(b.when)
+	}
+	if a.step != b.step {
+		return a.step < b.step
+	}
+	for k := 0; k < len(a.site) && k < len(b.site); k++ {
+		if a.site[k] != b.site[k] {
+			return a.site[k] < b.site[k]
+		}
+	}
+	if len(a.site) != len(b.site) {
+		return len(a.site) < len(b.site)
+	}
+	return a.id < b.id
+}
+
+func (h simTimerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *simTimerHeap) Push(x interface{}) {
+	t := x.(*simTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *simTimerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	t.index = -1
+	return t
+}
+
+// A clock that only moves when it is advanced. Timers fire in the order
+// of their deadlines, and timers with the same deadline fire in the order
+// of the steps that create them. Goroutines woken in the same step may
+// create timers in any order, so those timers are ordered by where they
+// are created instead.
+type SimClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	steps  int64
+	nextId int64
+	timers simTimerHeap
+}
+
+func NewSimClock() *SimClock {
+	return &SimClock{now: time.Unix(0, 0)}
+}
+
+func (c *SimClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *SimClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.Now()
+		return ch
+	}
+	c.schedule(d, 0, ch, nil)
+	return ch
+}
+
+func (c *SimClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *SimClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	ch := make(chan time.Time, 1)
+	return &simTicker{c, c.schedule(d, d, ch, nil), ch}
+}
+
+// Call @f after @d. @f is called by the goroutine that advances the clock,
+// so it must not block.
+func (c *SimClock) AfterFunc(d time.Duration, f func()) {
+	c.schedule(d, 0, nil, f)
+}
+
+// Move the clock forward and fire all timers that expire.
+func (c *SimClock) Advance(d time.Duration) {
+	target := c.Now().Add(d)
+	for c.Step(target) {
+	}
+}
+
+// Fire the next timer if it expires by @target, and move the clock to its
+// deadline. Otherwise, move the clock to @target and return false.
+func (c *SimClock) Step(target time.Time) bool {
+	c.mutex.Lock()
+	if len(c.timers) == 0 || c.timers[0].when.After(target) {
+		if c.now.Before(target) {
+			c.now = target
+		}
+		c.mutex.Unlock()
+		return false
+	}
+
+	t := c.timers[0]
+	c.now = t.when
+	c.steps++
+	if t.period > 0 {
+		t.when = t.when.Add(t.period)
+		heap.Fix(&c.timers, 0)
+	} else {
+		heap.Pop(&c.timers)
+	}
+
+	if t.ch != nil {
+		// Like time.Ticker, drop ticks if the receiver is slow.
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+		c.mutex.Unlock()
+	} else {
+		c.mutex.Unlock()
+		t.f()
+	}
+	return true
+}
+
+func (c *SimClock) schedule(
+	d, period time.Duration,
+	ch chan time.Time,
+	f func()) *simTimer {
+
+	site := make([]uintptr, SIM_TIMER_SITE_DEPTH)
+	site = site[:runtime.Callers(3, site)]
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.nextId++
+	t := &simTimer{
+		when:   c.now.Add(d),
+		step:   c.steps,
+		site:   site,
+		id:     c.nextId,
+		period: period,
+		ch:     ch,
+		f:      f,
+	}
+	heap.Push(&c.timers, t)
+	return t
+}
+
+func (c *SimClock) stop(t *simTimer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if t.index >= 0 && t.index < len(c.timers) && c.timers[t.index] == t {
+		heap.Remove(&c.timers, t.index)
+	}
+}
+
+type simTicker struct {
+	clock *SimClock
+	timer *simTimer
+	ch    chan time.Time
+}
+
+func (t *simTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *simTicker) Stop() {
+	t.clock.stop(t.timer)
+}
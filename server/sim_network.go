@@ -0,0 +1,363 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"lbase/balancer"
+	"math/rand"
+	"net/rpc"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errServerDown = errors.New("server is down")
+
+// Faults injected by a SimNetwork. Rates are probabilities between 0 and 1.
+// Each message is delayed by a random duration between MinDelay and
+// MaxDelay, so messages are reordered if the two differ.
+type SimFaults struct {
+	DropRate      float64
+	DuplicateRate float64
+	MinDelay      time.Duration
+	MaxDelay      time.Duration
+}
+
+// A request or a reply that has been sent, but not routed yet.
+type simMessage struct {
+	from, to balancer.ServerName
+	call     *rpc.Call
+	// Serialized request or reply.
+	data  []byte
+	err   error
+	reply bool
+	// Makes sure that a call is done once, even if its reply is duplicated.
+	once *sync.Once
+}
+
+type simMessagesByRoute []*simMessage
+
+func (a simMessagesByRoute) Len() int      { return len(a) }
+func (a simMessagesByRoute) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a simMessagesByRoute) Less(i, j int) bool {
+	if a[i].from != a[j].from {
+		return lessServerName(a[i].from, a[j].from)
+	}
+	if a[i].to != a[j].to {
+		return lessServerName(a[i].to, a[j].to)
+	}
+	return a[i].call.ServiceMethod < a[j].call.ServiceMethod
+}
+
+func lessServerName(a, b balancer.ServerName) bool {
+	if a.Host != b.Host {
+		return a.Host < b.Host
+	}
+	return a.Port < b.Port
+}
+
+// An in-memory network that delivers RPCs to local servers on simulated
+// time. Requests and replies are serialized, just like they are on a real
+// network. Messages sent during a step of the simulation are routed once
+// the step is done, ordered by their senders and receivers, so all random
+// decisions are made from a seeded source in the same order on every run.
+type SimNetwork struct {
+	mutex   sync.Mutex
+	clock   *SimClock
+	rand    *rand.Rand
+	faults  SimFaults
+	servers map[balancer.ServerName]*Server
+	// Servers in different groups cannot talk to each other.
+	groups map[balancer.ServerName]int
+	// Number of requests sent for each method.
+	calls map[string]int
+	// Messages that wait to be routed.
+	outbox []*simMessage
+}
+
+func NewSimNetwork(clock *SimClock, seed int64) *SimNetwork {
+	return &SimNetwork{
+		clock:   clock,
+		rand:    rand.New(rand.NewSource(seed)),
+		servers: make(map[balancer.ServerName]*Server),
+		groups:  make(map[balancer.ServerName]int),
+		calls:   make(map[string]int),
+	}
+}
+
+func (n *SimNetwork) SetFaults(faults SimFaults) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.faults = faults
+}
+
+// Make @server reachable at @sn.
+func (n *SimNetwork) AddServer(sn balancer.ServerName, server *Server) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.servers[sn] = server
+}
+
+// Make the server at @sn unreachable. Messages to it are lost.
+func (n *SimNetwork) RemoveServer(sn balancer.ServerName) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	delete(n.servers, sn)
+}
+
+// Split servers into groups. Servers that are not in any group form
+// another group.
+func (n *SimNetwork) Partition(groups ...[]balancer.ServerName) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.groups = make(map[balancer.ServerName]int)
+	for i, group := range groups {
+		for _, sn := range group {
+			n.groups[sn] = i + 1
+		}
+	}
+}
+
+// Remove all partitions.
+func (n *SimNetwork) Heal() {
+	n.Partition()
+}
+
+// Return the number of requests sent for @serviceMethod, such as
+// "ServerRPC.Heartbeat".
+func (n *SimNetwork) NumCalls(serviceMethod string) int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.calls[serviceMethod]
+}
+
+// Return a transport that sends RPCs from @from.
+func (n *SimNetwork) Transport(from balancer.ServerName) Transport {
+	return &simTransport{network: n, from: from}
+}
+
+// Route messages sent since the last flush. Each copy of a message that
+// is not lost is delivered after its delay.
+func (n *SimNetwork) Flush() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	outbox := n.outbox
+	n.outbox = nil
+	sort.Stable(simMessagesByRoute(outbox))
+
+	for _, msg := range outbox {
+		msg := msg
+		for _, delay := range n.route(msg.from, msg.to) {
+			if msg.reply {
+				n.clock.AfterFunc(delay, func() { n.complete(msg) })
+			} else {
+				n.clock.AfterFunc(delay, func() { n.deliver(msg) })
+			}
+		}
+	}
+}
+
+// Decide the fate of a message from @from to @to. Return the delays of
+// its copies. Nothing is returned if the message is lost.
+func (n *SimNetwork) route(from, to balancer.ServerName) (delays []time.Duration) {
+	if !n.connected(from, to) || n.rand.Float64() < n.faults.DropRate {
+		return
+	}
+
+	// Writes of clients are not idempotent, and servers do not filter
+	// duplicated requests, so only messages of servers are duplicated.
+	_, isServer := n.servers[from]
+	copies := 1
+	if n.rand.Float64() < n.faults.DuplicateRate && isServer {
+		copies++
+	}
+
+	for i := 0; i < copies; i++ {
+		delay := n.faults.MinDelay
+		if n.faults.MaxDelay > n.faults.MinDelay {
+			span := int64(n.faults.MaxDelay - n.faults.MinDelay)
+			delay += time.Duration(n.rand.Int63n(span))
+		}
+		delays = append(delays, delay)
+	}
+	return
+}
+
+func (n *SimNetwork) connected(from, to balancer.ServerName) bool {
+	return from == to || n.groups[from] == n.groups[to]
+}
+
+// Deliver a request to its receiver, and send back the reply once the
+// receiver handles it.
+func (n *SimNetwork) deliver(msg *simMessage) {
+	n.mutex.Lock()
+	server, found := n.servers[msg.to]
+	if !found || !n.connected(msg.from, msg.to) {
+		n.mutex.Unlock()
+		return
+	}
+	n.mutex.Unlock()
+
+	go func() {
+		reply, err := dispatch(server, msg.call.ServiceMethod, msg.data)
+
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		n.outbox = append(n.outbox, &simMessage{
+			from:  msg.to,
+			to:    msg.from,
+			call:  msg.call,
+			data:  reply,
+			err:   err,
+			reply: true,
+			once:  msg.once,
+		})
+	}()
+}
+
+// Finish the call of a reply, unless a copy of it has done so.
+func (n *SimNetwork) complete(msg *simMessage) {
+	msg.once.Do(func() {
+		call := msg.call
+		err := msg.err
+		if err == nil {
+			err = gob.NewDecoder(bytes.NewBuffer(msg.data)).Decode(call.Reply)
+		}
+		call.Error = err
+		call.Done <- call
+	})
+}
+
+// Call a method of the server by its name, such as "ServerRPC.Echo".
+// Return the serialized reply.
+func dispatch(server *Server, serviceMethod string, args []byte) ([]byte, error) {
+	name := serviceMethod[strings.LastIndex(serviceMethod, ".")+1:]
+	method := reflect.ValueOf(&server.ServerRPC).MethodByName(name)
+	if !method.IsValid() {
+		return nil, errors.New("unknown method " + serviceMethod)
+	}
+
+	argType := method.Type().In(0)
+	argv := reflect.New(argType)
+	if argType.Kind() == reflect.Ptr {
+		argv = reflect.New(argType.Elem())
+	}
+
+	decodeErr := gob.NewDecoder(bytes.NewBuffer(args)).DecodeValue(argv)
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	if argType.Kind() != reflect.Ptr {
+		argv = argv.Elem()
+	}
+
+	replyv := reflect.New(method.Type().In(1).Elem())
+	ret := method.Call([]reflect.Value{argv, replyv})
+	if errv := ret[0].Interface(); errv != nil {
+		return nil, errv.(error)
+	}
+
+	var b bytes.Buffer
+	encodeErr := gob.NewEncoder(&b).EncodeValue(replyv)
+	if encodeErr != nil {
+		return nil, encodeErr
+	}
+	return b.Bytes(), nil
+}
+
+type simTransport struct {
+	network *SimNetwork
+	from    balancer.ServerName
+}
+
+func (t *simTransport) Dial(
+	name balancer.ServerName,
+	rpcPrefix string) (RaftClient, error) {
+
+	t.network.mutex.Lock()
+	defer t.network.mutex.Unlock()
+
+	_, found := t.network.servers[name]
+	if !found || !t.network.connected(t.from, name) {
+		return nil, errServerDown
+	}
+	return &simClient{network: t.network, from: t.from, to: name}, nil
+}
+
+type simClient struct {
+	network *SimNetwork
+	from    balancer.ServerName
+	to      balancer.ServerName
+}
+
+func (c *simClient) Go(
+	serviceMethod string,
+	args interface{},
+	reply interface{},
+	done chan *rpc.Call) *rpc.Call {
+
+	if done == nil {
+		done = make(chan *rpc.Call, 1)
+	}
+	call := &rpc.Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          done,
+	}
+
+	var b bytes.Buffer
+	encodeErr := gob.NewEncoder(&b).Encode(args)
+	if encodeErr != nil {
+		call.Error = encodeErr
+		call.Done <- call
+		return call
+	}
+
+	// A lost message leaves the call pending, and the caller times out.
+	c.network.mutex.Lock()
+	defer c.network.mutex.Unlock()
+	c.network.calls[serviceMethod]++
+	c.network.outbox = append(c.network.outbox, &simMessage{
+		from: c.from,
+		to:   c.to,
+		call: call,
+		data: b.Bytes(),
+		once: &sync.Once{},
+	})
+	return call
+}
+
+func (c *simClient) Close() error {
+	return nil
+}
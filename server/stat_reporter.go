@@ -0,0 +1,189 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"lbase/balancer"
+	"sync"
+	"time"
+)
+
+type StatReporterOptions struct {
+	// Name of this server that the master knows.
+	Address balancer.ServerName
+	// Masters that receive stats. Standbys are kept up to date as well, so
+	// that one can take over right away.
+	Masters []balancer.ServerName
+	// HTTP RPC path prefix.
+	RPCPrefix string
+	// How often stats are sent. The master takes a server that misses a
+	// few reports as dead.
+	IntervalMs int64
+	// Timeout of a report.
+	RPCTimeoutMs int64
+	// Connects to the master. If this is nil, HTTPTransport is used.
+	Transport Transport
+	// Source of time. If this is nil, RealClock is used.
+	Clock Clock
+	// Bytes of disk for regions, or 0 if the master should balance by
+	// Weight instead.
+	DiskCapacity int64
+	// Capacity of this server relative to others. 0 means the default.
+	Weight int
+}
+
+func DefaultStatReporterOptions(
+	address balancer.ServerName,
+	masters []balancer.ServerName) *StatReporterOptions {
+
+	return &StatReporterOptions{
+		Address:      address,
+		Masters:      masters,
+		IntervalMs:   3000,
+		RPCTimeoutMs: 3000,
+	}
+}
+
+func StatReporterOptionsForTest(
+	address balancer.ServerName,
+	masters []balancer.ServerName) *StatReporterOptions {
+
+	return &StatReporterOptions{
+		Address:      address,
+		Masters:      masters,
+		IntervalMs:   100,
+		RPCTimeoutMs: 100,
+	}
+}
+
+// Periodically sends the master a ServerStat of this server, which serves
+// as a heartbeat. Loads of regions are collected since the last report,
+// so a server does not run a RegionMonitor along with it.
+type StatReporter struct {
+	opts StatReporterOptions
+	// Returns regions served by this server.
+	regions func() map[balancer.Region]*RaftStates
+	// When the reporter starts, in milliseconds.
+	upTimestamp int64
+	quit        chan bool
+}
+
+func newStatReporter(
+	opts *StatReporterOptions,
+	regions func() map[balancer.Region]*RaftStates) *StatReporter {
+
+	ret := &StatReporter{
+		opts:    *opts,
+		regions: regions,
+		quit:    make(chan bool),
+	}
+	if ret.opts.Transport == nil {
+		ret.opts.Transport = &HTTPTransport{}
+	}
+	if ret.opts.Clock == nil {
+		ret.opts.Clock = &RealClock{}
+	}
+	ret.upTimestamp = ret.opts.Clock.Now().UnixNano() / int64(time.Millisecond)
+	return ret
+}
+
+func (r *StatReporter) Close() {
+	close(r.quit)
+}
+
+func (r *StatReporter) run() {
+	interval := time.Duration(r.opts.IntervalMs) * time.Millisecond
+	ticker := r.opts.Clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		r.report()
+
+		select {
+		case <-ticker.C():
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+func (r *StatReporter) report() {
+	req := ReportStatRequest{Stat: r.collect()}
+	timeOut := time.Duration(r.opts.RPCTimeoutMs) * time.Millisecond
+
+	var wg sync.WaitGroup
+	for _, master := range r.opts.Masters {
+		wg.Add(1)
+		go func(master balancer.ServerName) {
+			defer wg.Done()
+			callServer(r.opts.Transport, r.opts.RPCPrefix, r.opts.Clock, timeOut,
+				master, "ServerRPC.ReportStat", &req, &ReportStatReply{})
+		}(master)
+	}
+	wg.Wait()
+}
+
+// Return the current stat of this server.
+func (r *StatReporter) collect() balancer.ServerStat {
+	stat := balancer.ServerStat{
+		ServerName:   r.opts.Address,
+		UpTimestamp:  r.upTimestamp,
+		DiskCapacity: r.opts.DiskCapacity,
+		Weight:       r.opts.Weight,
+	}
+
+	// Regions of a multi-raft layer share edit queues.
+	queues := make(map[*EditQueue]bool)
+	for region, states := range r.regions() {
+		load, isLeader := states.CollectLoad()
+		stat.DiskUsage += load.Size
+
+		// A replica that has been removed from its quorum, or has not
+		// learned its quorum yet, does not count.
+		if isMember(load.Members, r.opts.Address) {
+			stat.Regions = append(stat.Regions, region)
+		}
+		if isLeader {
+			stat.Loads = append(stat.Loads, load)
+		}
+
+		queue := states.GetEditQueue()
+		if queue != nil && !queues[queue] {
+			queues[queue] = true
+			stat.EditBacklog += queue.Len()
+		}
+	}
+	return stat
+}
+
+func isMember(members []balancer.ServerName, sn balancer.ServerName) bool {
+	for _, member := range members {
+		if member == sn {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package server
+
+import (
+	"fmt"
+	"lbase/balancer"
+	"log"
+	"net/rpc"
+	"time"
+)
+
+// A connection to another member of a quorum. *rpc.Client implements
+// this interface.
+type RaftClient interface {
+	Go(serviceMethod string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call
+	Close() error
+}
+
+// A Transport creates connections to other members of a quorum.
+type Transport interface {
+	Dial(name balancer.ServerName, rpcPrefix string) (RaftClient, error)
+}
+
+// The default transport that sends RPCs over HTTP.
+type HTTPTransport struct {
+}
+
+func (t *HTTPTransport) Dial(
+	name balancer.ServerName,
+	rpcPrefix string) (RaftClient, error) {
+
+	addr := fmt.Sprintf("%s:%d", name.Host, name.Port)
+	path, _ := GetServerPath(rpcPrefix, name.Port)
+
+	cli, err := rpc.DialHTTPPath("tcp", addr, path)
+	if err != nil {
+		return nil, err
+	}
+	return cli, nil
+}
+
+// Call @method on server @sn over a new connection. Return false if the
+// call fails or does not finish in @timeOut.
+func callServer(
+	transport Transport,
+	rpcPrefix string,
+	clock Clock,
+	timeOut time.Duration,
+	sn balancer.ServerName,
+	method string,
+	req interface{},
+	reply interface{}) bool {
+
+	cli, err := transport.Dial(sn, rpcPrefix)
+	if err != nil {
+		log.Printf("Fails to create connection to %v: %#v\n", sn, err)
+		return false
+	}
+	defer cli.Close()
+
+	call := cli.Go(method, req, reply, nil)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			log.Printf("Fails to call %v on %v: %v\n", method, sn, call.Error)
+			return false
+		}
+		return true
+	case <-clock.After(timeOut):
+		log.Printf("Times out calling %v on %v\n", method, sn)
+		return false
+	}
+}
@@ -32,10 +32,31 @@ package zk
 import "C"
 
 import (
+	"log"
 	"unsafe"
 	"reflect"
 )
 
+//export GoSessionWatcher
+func GoSessionWatcher(Type C.int, state C.int, ctx unsafe.Pointer) {
+	if int(state) == ZOO_EXPIRED_SESSION_STATE {
+		log.Printf("Zookeeper session has expired\n")
+	}
+
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	id := uintptr(ctx)
+	watches, found := sessionWatches[id]
+	if !found {
+		return
+	}
+	for _, watch := range watches {
+		watch <- Watcher{Type: int(Type), State: int(state)}
+	}
+	sessionWatches[id] = nil
+}
+
 //export GoVoidCompletion
 func GoVoidCompletion(rc C.int, data unsafe.Pointer) {
 	ch := (*chan int)(data)
@@ -0,0 +1,88 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package coord
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"strings"
+)
+
+// Permissions of ACL entries, which may be ORed together.
+const (
+	ZOO_PERM_READ   = 1
+	ZOO_PERM_WRITE  = 2
+	ZOO_PERM_CREATE = 4
+	ZOO_PERM_DELETE = 8
+	ZOO_PERM_ADMIN  = 16
+	ZOO_PERM_ALL    = 31
+)
+
+// Schemes of identities.
+const (
+	// Anyone, whose id is "anyone".
+	SCHEME_WORLD = "world"
+	// Every identity that the session creating a node has added.
+	SCHEME_AUTH = "auth"
+	// A user with a password. Credentials are "user:password", and ids in
+	// ACLs are the user with a hash of the credentials.
+	SCHEME_DIGEST = "digest"
+)
+
+// An entry of the access control list of a node, which grants @Perms to
+// identity @Id of @Scheme.
+type ACL struct {
+	Perms  int
+	Scheme string
+	Id     string
+}
+
+// Grant @perms to anyone.
+func WorldACL(perms int) []ACL {
+	return []ACL{{Perms: perms, Scheme: SCHEME_WORLD, Id: "anyone"}}
+}
+
+// Grant all permissions to identities that the creating session has
+// added. Creates with it fail with ZINVALIDACL if the session has none.
+func CreatorAllACL() []ACL {
+	return []ACL{{Perms: ZOO_PERM_ALL, Scheme: SCHEME_AUTH, Id: ""}}
+}
+
+// Grant @perms to digest user @user with @password.
+func DigestACL(user, password string, perms int) []ACL {
+	return []ACL{{Perms: perms, Scheme: SCHEME_DIGEST, Id: digestId(user + ":" + password)}}
+}
+
+// The id of digest credentials "user:password", which zookeeper computes
+// as the user with the base64 of the SHA1 of the credentials.
+func digestId(cert string) string {
+	user := cert
+	if idx := strings.Index(cert, ":"); idx >= 0 {
+		user = cert[:idx]
+	}
+	hash := sha1.Sum([]byte(cert))
+	return user + ":" + base64.StdEncoding.EncodeToString(hash[:])
+}
@@ -0,0 +1,679 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package coord
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long to wait for a server to accept a connection.
+	CLIENT_CONNECT_TIMEOUT_MS = 1000
+	// How long to wait before trying all servers again.
+	CLIENT_RETRY_MS = 100
+)
+
+// A request that waits for its reply.
+type clientCall struct {
+	reply record
+	// Watch to register if the request succeeds.
+	watchPath string
+	watches   map[string][]chan Event
+	watch     chan Event
+	// Exists leaves a watch on a node that does not exist.
+	watchMissing bool
+	// A transaction that fails has results of its ops.
+	bodyOnError bool
+	done        chan int
+}
+
+// A session with a zookeeper ensemble through its wire protocol, which
+// implements Coordinator. The client moves to another server when its
+// connection breaks, and keeps its session unless the session expires.
+// Watches do not survive a disconnection: they all fire with
+// ZOO_SESSION_EVENT, and callers read and watch again.
+type Client struct {
+	servers []string
+
+	mutex     sync.Mutex
+	state     int
+	conn      net.Conn
+	timeoutMs int
+	sessionId int64
+	passwd    []byte
+	lastZxid  int64
+	xid       int32
+	pending   map[int32]*clientCall
+	// Credentials that are sent on each connection, and replies that
+	// AddAuth waits for in order. Replies of credentials that are sent
+	// again have nil.
+	auths     []*authPacket
+	authCalls []chan int
+	createACL []ACL
+	// Watches set by exists and get data, and by get children.
+	dataWatches  map[string][]chan Event
+	childWatches map[string][]chan Event
+	stateWatches []chan Event
+	// Closed once the client first connects or gives up.
+	started chan bool
+	quit    chan bool
+}
+
+// Start a session with one of @hosts, which are comma separated host:port
+// pairs, or resume session @id if it is not nil. Wait up to @timeoutMs for
+// the session, which expires if the client cannot reach the ensemble for
+// that long.
+func Dial(hosts string, timeoutMs int, id *ZkID) (c *Client, ok bool) {
+	c = &Client{
+		servers:      strings.Split(hosts, ","),
+		state:        ZOO_CONNECTING_STATE,
+		timeoutMs:    timeoutMs,
+		pending:      make(map[int32]*clientCall),
+		dataWatches:  make(map[string][]chan Event),
+		childWatches: make(map[string][]chan Event),
+		started:      make(chan bool),
+		quit:         make(chan bool),
+	}
+	if id != nil {
+		c.sessionId = id.SessionId
+		c.passwd = id.Passwd
+	}
+	go c.run()
+
+	select {
+	case <-c.started:
+	case <-time.After(time.Duration(timeoutMs) * time.Millisecond):
+	}
+	if c.GetState() != ZOO_CONNECTED_STATE {
+		c.Close()
+		return nil, false
+	}
+	return c, true
+}
+
+// End the session, which removes its ephemeral nodes.
+func (c *Client) Close() {
+	c.mutex.Lock()
+	select {
+	case <-c.quit:
+		c.mutex.Unlock()
+		return
+	default:
+		close(c.quit)
+	}
+	c.mutex.Unlock()
+
+	// Best effort, since the session expires anyway.
+	c.call(OP_CLOSE_SESSION, &emptyRecord{}, &emptyRecord{})
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.setState(ZOO_EXPIRED_SESSION_STATE)
+}
+
+func (c *Client) GetState() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.state
+}
+
+func (c *Client) WatchState() (watch chan Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	watch = make(chan Event, 1)
+	c.stateWatches = append(c.stateWatches, watch)
+	return watch
+}
+
+// Return the session that the client has, which is empty before the
+// client connects.
+func (c *Client) GetZkID() ZkID {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return ZkID{SessionId: c.sessionId, Passwd: append([]byte{}, c.passwd...)}
+}
+
+// Change the state of the session. The caller holds the mutex.
+func (c *Client) setState(state int) {
+	if state == c.state {
+		return
+	}
+	c.state = state
+	for _, watch := range c.stateWatches {
+		watch <- Event{Type: ZOO_SESSION_EVENT, State: state}
+	}
+	c.stateWatches = nil
+}
+
+func (c *Client) Exists(path string) (exists bool, rc int) {
+	rc = c.call(OP_EXISTS, &pathWatchRequest{Path: path}, &stat{})
+	return rc == ZOK, rc
+}
+
+func (c *Client) ExistsW(path string) (exists bool, watch chan Event, rc int) {
+	call := c.newCall(&stat{})
+	call.watchPath = path
+	call.watches = c.dataWatches
+	call.watchMissing = true
+	rc = c.do(OP_EXISTS, &pathWatchRequest{Path: path, Watch: true}, call)
+	return rc == ZOK, call.watch, rc
+}
+
+func (c *Client) Get(path string) (data []byte, version int32, rc int) {
+	reply := &getDataResponse{}
+	rc = c.call(OP_GET_DATA, &pathWatchRequest{Path: path}, reply)
+	return reply.Data, reply.Stat.Version, rc
+}
+
+func (c *Client) GetW(path string) (data []byte, version int32, watch chan Event, rc int) {
+	reply := &getDataResponse{}
+	call := c.newCall(reply)
+	call.watchPath = path
+	call.watches = c.dataWatches
+	rc = c.do(OP_GET_DATA, &pathWatchRequest{Path: path, Watch: true}, call)
+	return reply.Data, reply.Stat.Version, call.watch, rc
+}
+
+func (c *Client) Set(path string, data []byte, version int) (rc int) {
+	request := &setDataRequest{Path: path, Data: data, Version: int32(version)}
+	return c.call(OP_SET_DATA, request, &stat{})
+}
+
+func (c *Client) GetChildren(path string) (children []string, rc int) {
+	reply := &getChildrenResponse{}
+	rc = c.call(OP_GET_CHILDREN, &pathWatchRequest{Path: path}, reply)
+	return reply.Children, rc
+}
+
+func (c *Client) GetChildrenW(path string) (children []string, watch chan Event, rc int) {
+	reply := &getChildrenResponse{}
+	call := c.newCall(reply)
+	call.watchPath = path
+	call.watches = c.childWatches
+	rc = c.do(OP_GET_CHILDREN, &pathWatchRequest{Path: path, Watch: true}, call)
+	return reply.Children, call.watch, rc
+}
+
+func (c *Client) AddAuth(scheme string, cert []byte) (rc int) {
+	if cert == nil {
+		cert = []byte{}
+	}
+	request := &authPacket{Scheme: scheme, Auth: cert}
+	done := make(chan int, 1)
+
+	c.mutex.Lock()
+	if rc = c.usable(OP_AUTH); rc != ZOK {
+		c.mutex.Unlock()
+		return rc
+	}
+	c.auths = append(c.auths, request)
+	c.authCalls = append(c.authCalls, done)
+	conn := c.conn
+	err := c.write(conn, &requestHeader{Xid: XID_AUTH, Type: OP_AUTH}, request)
+	c.mutex.Unlock()
+
+	return c.wait(conn, err, done)
+}
+
+func (c *Client) SetCreateACL(acl []ACL) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.createACL = append([]ACL(nil), acl...)
+}
+
+// Return the ACL of new nodes.
+func (c *Client) getCreateACL() []ACL {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.createACL == nil {
+		return WorldACL(ZOO_PERM_ALL)
+	}
+	return c.createACL
+}
+
+func (c *Client) Create(path string, data []byte, flags int) (name string, rc int) {
+	if data == nil {
+		data = []byte{}
+	}
+	acl := c.getCreateACL()
+	request := &createRequest{Path: path, Data: data, ACL: acl, Flags: int32(flags)}
+	reply := &pathResponse{}
+	rc = c.call(OP_CREATE, request, reply)
+	return reply.Path, rc
+}
+
+func (c *Client) Delete(path string, version int) (rc int) {
+	return c.call(OP_DELETE, &deleteRequest{Path: path, Version: int32(version)}, &emptyRecord{})
+}
+
+func (c *Client) Multi(ops []Op) (results []OpResult, rc int) {
+	acl := c.getCreateACL()
+	ops = append([]Op(nil), ops...)
+	for i, _ := range ops {
+		if ops[i].Type == OP_CREATE && ops[i].ACL == nil {
+			ops[i].ACL = acl
+		}
+	}
+
+	reply := &multiResponse{}
+	call := c.newCall(reply)
+	call.bodyOnError = true
+	rc = c.do(OP_MULTI, &multiRequest{Ops: ops}, call)
+
+	if len(reply.Results) != len(ops) {
+		if rc == ZOK {
+			rc = ZMARSHALLINGERROR
+		}
+		results = make([]OpResult, len(ops))
+		for i, _ := range results {
+			results[i].Rc = rc
+		}
+		return results, rc
+	}
+
+	for _, result := range reply.Results {
+		if result.Rc != ZOK {
+			return reply.Results, result.Rc
+		}
+	}
+	return reply.Results, rc
+}
+
+func (c *Client) newCall(reply record) *clientCall {
+	return &clientCall{reply: reply, done: make(chan int, 1)}
+}
+
+func (c *Client) call(opcode int32, request, reply record) int {
+	return c.do(opcode, request, c.newCall(reply))
+}
+
+// Send a request and wait for its reply. A request fails right away
+// while the client is disconnected.
+func (c *Client) do(opcode int32, request record, call *clientCall) int {
+	c.mutex.Lock()
+	if rc := c.usable(opcode); rc != ZOK {
+		c.mutex.Unlock()
+		return rc
+	}
+
+	c.xid++
+	xid := c.xid
+	c.pending[xid] = call
+	conn := c.conn
+	err := c.write(conn, &requestHeader{Xid: xid, Type: opcode}, request)
+	c.mutex.Unlock()
+
+	return c.wait(conn, err, call.done)
+}
+
+// Check if a request of @opcode can be sent. The caller holds the mutex.
+func (c *Client) usable(opcode int32) int {
+	switch {
+	case c.state == ZOO_EXPIRED_SESSION_STATE:
+		return ZSESSIONEXPIRED
+	case c.state == ZOO_AUTH_FAILED_STATE:
+		return ZAUTHFAILED
+	case opcode != OP_CLOSE_SESSION && c.closed():
+		return ZCLOSING
+	case c.state != ZOO_CONNECTED_STATE:
+		return ZCONNECTIONLOSS
+	}
+	return ZOK
+}
+
+// Wait for the reply of a request that is sent on @conn, where @err is
+// the error of sending it.
+func (c *Client) wait(conn net.Conn, err error, done chan int) int {
+	if err != nil {
+		// The receiving loop fails pending requests.
+		conn.Close()
+	}
+
+	select {
+	case rc := <-done:
+		return rc
+	case <-time.After(time.Duration(c.timeoutMs) * time.Millisecond):
+		// The connection is stuck, so move to another server.
+		conn.Close()
+		return <-done
+	}
+}
+
+// Write a packet. The caller holds the mutex, so that packets do not
+// interleave.
+func (c *Client) write(conn net.Conn, records ...record) error {
+	conn.SetWriteDeadline(time.Now().Add(time.Duration(c.timeoutMs) * time.Millisecond))
+	return writePacket(conn, records...)
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Keep connected until the session ends.
+func (c *Client) run() {
+	defer c.once()
+
+	for {
+		conn, ok := c.connect()
+		if !ok {
+			return
+		}
+		c.once()
+
+		pingDone := make(chan bool)
+		go c.ping(conn, pingDone)
+		c.receive(conn)
+		close(pingDone)
+		c.disconnect(conn)
+	}
+}
+
+// Tell Dial that the client has connected or given up.
+func (c *Client) once() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	select {
+	case <-c.started:
+	default:
+		close(c.started)
+	}
+}
+
+// Connect to servers in turn until one takes the session. Return false if
+// the client is closed or the session has expired.
+func (c *Client) connect() (conn net.Conn, ok bool) {
+	for i := 0; ; i++ {
+		if c.closed() || c.GetState() == ZOO_AUTH_FAILED_STATE {
+			return nil, false
+		}
+		if i > 0 && i%len(c.servers) == 0 {
+			time.Sleep(CLIENT_RETRY_MS * time.Millisecond)
+		}
+
+		server := c.servers[i%len(c.servers)]
+		conn, err := net.DialTimeout("tcp", server, CLIENT_CONNECT_TIMEOUT_MS*time.Millisecond)
+		if err != nil {
+			continue
+		}
+
+		c.mutex.Lock()
+		request := &connectRequest{
+			LastZxidSeen: c.lastZxid,
+			TimeOut:      int32(c.timeoutMs),
+			SessionId:    c.sessionId,
+			Passwd:       c.passwd,
+		}
+		if request.Passwd == nil {
+			request.Passwd = make([]byte, 16)
+		}
+		c.mutex.Unlock()
+
+		response := &connectResponse{}
+		conn.SetDeadline(time.Now().Add(CLIENT_CONNECT_TIMEOUT_MS * time.Millisecond))
+		err = writePacket(conn, request)
+		if err == nil {
+			var d *decoder
+			if d, err = readPacket(conn); err == nil {
+				response.decode(d)
+				err = d.err
+			}
+		}
+		if err != nil {
+			log.Printf("Fails to connect to zookeeper %s: %v\n", server, err)
+			conn.Close()
+			continue
+		}
+		conn.SetDeadline(time.Time{})
+
+		c.mutex.Lock()
+		// A session that is resumed keeps its id, or else the session
+		// is gone.
+		if response.TimeOut <= 0 || (c.sessionId != 0 && response.SessionId != c.sessionId) {
+			log.Printf("Zookeeper session %x has expired\n", c.sessionId)
+			conn.Close()
+			c.setState(ZOO_EXPIRED_SESSION_STATE)
+			c.fireAll(ZOO_EXPIRED_SESSION_STATE)
+			c.mutex.Unlock()
+			return nil, false
+		}
+		if c.closed() {
+			conn.Close()
+			c.mutex.Unlock()
+			return nil, false
+		}
+		c.sessionId = response.SessionId
+		c.passwd = response.Passwd
+		c.timeoutMs = int(response.TimeOut)
+		c.conn = conn
+		// Credentials are sent again before any other request.
+		for _, auth := range c.auths {
+			c.authCalls = append(c.authCalls, nil)
+			if err := c.write(conn, &requestHeader{Xid: XID_AUTH, Type: OP_AUTH}, auth); err != nil {
+				conn.Close()
+				break
+			}
+		}
+		c.setState(ZOO_CONNECTED_STATE)
+		c.mutex.Unlock()
+		return conn, true
+	}
+}
+
+// Ping often enough that the server keeps the session, and that the
+// client notices a dead server before the session expires.
+func (c *Client) ping(conn net.Conn, done chan bool) {
+	c.mutex.Lock()
+	interval := time.Duration(c.timeoutMs/3) * time.Millisecond
+	c.mutex.Unlock()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+
+		c.mutex.Lock()
+		err := c.write(conn, &requestHeader{Xid: XID_PING, Type: OP_PING})
+		c.mutex.Unlock()
+		if err != nil {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Dispatch replies and notifications until the connection breaks.
+func (c *Client) receive(conn net.Conn) {
+	for {
+		c.mutex.Lock()
+		timeout := time.Duration(c.timeoutMs*2/3) * time.Millisecond
+		c.mutex.Unlock()
+
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		d, err := readPacket(conn)
+		if err != nil {
+			if !c.closed() {
+				log.Printf("Loses connection to zookeeper: %v\n", err)
+			}
+			return
+		}
+
+		header := &replyHeader{}
+		header.decode(d)
+		if d.err != nil {
+			return
+		}
+
+		switch header.Xid {
+		case XID_PING:
+		case XID_AUTH:
+			c.authenticated(header)
+		case XID_NOTIFICATION:
+			event := &watcherEvent{}
+			event.decode(d)
+			if d.err != nil {
+				return
+			}
+			c.notify(event)
+		default:
+			if !c.reply(header, d) {
+				return
+			}
+		}
+	}
+}
+
+// Finish a pending request. Return false if the reply is broken.
+func (c *Client) reply(header *replyHeader, d *decoder) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if header.Zxid > c.lastZxid {
+		c.lastZxid = header.Zxid
+	}
+	call, found := c.pending[header.Xid]
+	if !found {
+		return true
+	}
+	delete(c.pending, header.Xid)
+
+	rc := int(header.Err)
+	if rc == ZOK {
+		call.reply.decode(d)
+		if d.err != nil {
+			rc = ZMARSHALLINGERROR
+		}
+	} else if call.bodyOnError && len(d.buf) > 0 {
+		call.reply.decode(d)
+	}
+
+	// Register the watch before later notifications are dispatched.
+	if call.watches != nil && (rc == ZOK || (rc == ZNONODE && call.watchMissing)) {
+		call.watch = make(chan Event, 1)
+		call.watches[call.watchPath] = append(call.watches[call.watchPath], call.watch)
+	}
+	call.done <- rc
+	return rc != ZMARSHALLINGERROR
+}
+
+// Finish the earliest credentials that wait for a reply. A session whose
+// credentials are rejected cannot be used any more.
+func (c *Client) authenticated(header *replyHeader) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var done chan int
+	if len(c.authCalls) > 0 {
+		done = c.authCalls[0]
+		c.authCalls = c.authCalls[1:]
+	}
+
+	rc := int(header.Err)
+	if rc != ZOK {
+		log.Printf("Zookeeper rejects credentials of session %x: %d\n", c.sessionId, rc)
+		c.setState(ZOO_AUTH_FAILED_STATE)
+		c.fireAll(ZOO_AUTH_FAILED_STATE)
+	}
+	if done != nil {
+		done <- rc
+	}
+}
+
+func (c *Client) notify(event *watcherEvent) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	fired := Event{Type: int(event.Type), State: int(event.State), Path: event.Path}
+	fire := func(watches map[string][]chan Event) {
+		for _, watch := range watches[event.Path] {
+			watch <- fired
+		}
+		delete(watches, event.Path)
+	}
+
+	switch fired.Type {
+	case ZOO_CREATED_EVENT, ZOO_CHANGED_EVENT:
+		fire(c.dataWatches)
+	case ZOO_DELETED_EVENT:
+		fire(c.dataWatches)
+		fire(c.childWatches)
+	case ZOO_CHILD_EVENT:
+		fire(c.childWatches)
+	}
+}
+
+// Fail requests that wait on a broken connection.
+func (c *Client) disconnect(conn net.Conn) {
+	conn.Close()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for xid, call := range c.pending {
+		call.done <- ZCONNECTIONLOSS
+		delete(c.pending, xid)
+	}
+	for _, done := range c.authCalls {
+		if done != nil {
+			done <- ZCONNECTIONLOSS
+		}
+	}
+	c.authCalls = nil
+	c.conn = nil
+	if c.state == ZOO_CONNECTED_STATE {
+		c.setState(ZOO_CONNECTING_STATE)
+	}
+	c.fireAll(c.state)
+}
+
+// Fire all watches with a session event. The caller holds the mutex.
+func (c *Client) fireAll(state int) {
+	for _, watches := range []map[string][]chan Event{c.dataWatches, c.childWatches} {
+		for path, list := range watches {
+			for _, watch := range list {
+				watch <- Event{Type: ZOO_SESSION_EVENT, State: state}
+			}
+			delete(watches, path)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package coord
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Serves the wire protocol on top of a MemoryStore, like an ensemble of
+// one server.
+type testServer struct {
+	store    *MemoryStore
+	listener net.Listener
+
+	mutex    sync.Mutex
+	sessions map[int64]*MemorySession
+	conns    map[net.Conn]int64
+	nextId   int64
+	// Number of credentials that clients send.
+	auths int
+}
+
+func startTestServer(t *testing.T) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Fails to listen:", err)
+	}
+
+	s := &testServer{
+		store:    NewMemoryStore(),
+		listener: listener,
+		sessions: make(map[int64]*MemorySession),
+		conns:    make(map[net.Conn]int64),
+		nextId:   1,
+	}
+	go s.serve()
+	return s
+}
+
+func (s *testServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testServer) close() {
+	s.listener.Close()
+	s.dropConnections()
+}
+
+// Break connections, which keeps their sessions.
+func (s *testServer) dropConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for conn, _ := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *testServer) expireAll() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, session := range s.sessions {
+		session.Expire()
+	}
+	for conn, _ := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	d, err := readPacket(conn)
+	if err != nil {
+		return
+	}
+	request := &connectRequest{}
+	request.decode(d)
+
+	s.mutex.Lock()
+	id := request.SessionId
+	if id == 0 {
+		id = s.nextId
+		s.nextId++
+		s.sessions[id] = s.store.NewSession()
+	}
+	session := s.sessions[id]
+	passwd := []byte(fmt.Sprintf("%016d", id))
+	response := &connectResponse{SessionId: id, Passwd: passwd}
+	if request.SessionId != 0 && !bytes.Equal(request.Passwd, passwd) {
+		session = nil
+	}
+	if session != nil && session.GetState() == ZOO_CONNECTED_STATE {
+		response.TimeOut = request.TimeOut
+	}
+	s.conns[conn] = id
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+	}()
+
+	var writeMutex sync.Mutex
+	write := func(records ...record) {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		writePacket(conn, records...)
+	}
+	// Notifications go after the reply that sets the watch.
+	forward := func(watch chan Event) {
+		if watch == nil {
+			return
+		}
+		go func() {
+			event := <-watch
+			if event.Type != ZOO_SESSION_EVENT {
+				notification := &watcherEvent{
+					Type:  int32(event.Type),
+					State: int32(event.State),
+					Path:  event.Path,
+				}
+				write(&replyHeader{Xid: XID_NOTIFICATION, Zxid: -1}, notification)
+			}
+		}()
+	}
+
+	write(response)
+	if response.TimeOut == 0 {
+		return
+	}
+
+	for {
+		d, err := readPacket(conn)
+		if err != nil {
+			return
+		}
+		header := &requestHeader{}
+		header.decode(d)
+
+		var reply record = &emptyRecord{}
+		var watch chan Event
+		rc := ZOK
+		switch header.Type {
+		case OP_PING:
+		case OP_CLOSE_SESSION:
+			session.Expire()
+		case OP_EXISTS:
+			request := &pathWatchRequest{}
+			request.decode(d)
+			if request.Watch {
+				_, watch, rc = session.ExistsW(request.Path)
+			} else {
+				_, rc = session.Exists(request.Path)
+			}
+			reply = &stat{}
+		case OP_GET_DATA:
+			request := &pathWatchRequest{}
+			request.decode(d)
+			response := &getDataResponse{}
+			if request.Watch {
+				response.Data, response.Stat.Version, watch, rc = session.GetW(request.Path)
+			} else {
+				response.Data, response.Stat.Version, rc = session.Get(request.Path)
+			}
+			reply = response
+		case OP_SET_DATA:
+			request := &setDataRequest{}
+			request.decode(d)
+			rc = session.Set(request.Path, request.Data, int(request.Version))
+			reply = &stat{}
+		case OP_GET_CHILDREN:
+			request := &pathWatchRequest{}
+			request.decode(d)
+			response := &getChildrenResponse{}
+			if request.Watch {
+				response.Children, watch, rc = session.GetChildrenW(request.Path)
+			} else {
+				response.Children, rc = session.GetChildren(request.Path)
+			}
+			reply = response
+		case OP_CREATE:
+			request := &createRequest{}
+			request.decode(d)
+			response := &pathResponse{}
+			// Multi takes the ACL of the request.
+			op := CreateOp(request.Path, request.Data, int(request.Flags))
+			op.ACL = request.ACL
+			var results []OpResult
+			results, rc = session.Multi([]Op{op})
+			response.Path = results[0].Path
+			reply = response
+		case OP_AUTH:
+			request := &authPacket{}
+			request.decode(d)
+			rc = session.AddAuth(request.Scheme, request.Auth)
+			s.mutex.Lock()
+			s.auths++
+			s.mutex.Unlock()
+		case OP_DELETE:
+			request := &deleteRequest{}
+			request.decode(d)
+			rc = session.Delete(request.Path, int(request.Version))
+		case OP_MULTI:
+			request := &multiRequest{}
+			request.decode(d)
+			response := &multiResponse{}
+			response.Results, rc = session.Multi(request.Ops)
+			// Every result of a transaction that fails is an error.
+			for _, op := range request.Ops {
+				if rc == ZOK {
+					response.Types = append(response.Types, int32(op.Type))
+				} else {
+					response.Types = append(response.Types, OP_ERROR)
+				}
+			}
+			reply = response
+		default:
+			rc = ZUNIMPLEMENTED
+		}
+
+		if d.err != nil {
+			return
+		}
+		if rc == ZOK || header.Type == OP_MULTI {
+			write(&replyHeader{Xid: header.Xid, Err: int32(rc)}, reply)
+		} else {
+			write(&replyHeader{Xid: header.Xid, Err: int32(rc)})
+		}
+		forward(watch)
+		// Zookeeper drops the connection of rejected credentials.
+		if header.Type == OP_AUTH && rc != ZOK {
+			return
+		}
+	}
+}
+
+func dialTestServer(t *testing.T, s *testServer) *Client {
+	c, ok := Dial(s.addr(), 1000, nil)
+	if !ok {
+		t.Fatal("Fails to connect")
+	}
+	return c
+}
+
+func waitForState(t *testing.T, c *Client, state int) {
+	for i := 0; c.GetState() != state; i++ {
+		if i == 100 {
+			t.Fatal("Unexpected state:", c.GetState())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClient(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+
+	var clients []*Client
+	checkCoordinator(t, func() Coordinator {
+		c := dialTestServer(t, s)
+		clients = append(clients, c)
+		return c
+	})
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
+func TestClientDialFails(t *testing.T) {
+	s := startTestServer(t)
+	s.close()
+
+	if _, ok := Dial(s.addr(), 200, nil); ok {
+		t.Fatal("Connects to a closed server")
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+
+	c := dialTestServer(t, s)
+	defer c.Close()
+	c.Create("/a", nil, ZOO_EPHEMERAL)
+	c.AddAuth(SCHEME_DIGEST, []byte("lbase:secret"))
+	_, _, watch, _ := c.GetW("/a")
+	state := c.WatchState()
+
+	// Watches fire when the connection breaks, and the session goes on
+	// over a new connection.
+	s.dropConnections()
+	checkFired(t, watch, ZOO_SESSION_EVENT)
+	if event := <-state; event.State != ZOO_CONNECTING_STATE {
+		t.Fatal("Unexpected state:", event)
+	}
+	state = c.WatchState()
+	waitForState(t, c, ZOO_CONNECTED_STATE)
+	if event := <-state; event.State != ZOO_CONNECTED_STATE {
+		t.Fatal("Unexpected state:", event)
+	}
+
+	if exists, rc := c.Exists("/a"); !exists {
+		t.Fatal("Loses an ephemeral node:", rc)
+	}
+	_, _, watch, _ = c.GetW("/a")
+	c.Set("/a", nil, -1)
+	checkFired(t, watch, ZOO_CHANGED_EVENT)
+
+	// Credentials are sent again on the new connection.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.auths != 2 {
+		t.Fatal("Unexpected number of credentials:", s.auths)
+	}
+}
+
+func TestClientExpire(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+
+	c := dialTestServer(t, s)
+	defer c.Close()
+	_, watch, _ := c.ExistsW("/a")
+
+	s.expireAll()
+	waitForState(t, c, ZOO_EXPIRED_SESSION_STATE)
+	checkFired(t, watch, ZOO_SESSION_EVENT)
+	if _, rc := c.Create("/a", nil, 0); rc != ZSESSIONEXPIRED {
+		t.Fatal("Creates a node after expiry:", rc)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+
+	a := dialTestServer(t, s)
+	b := dialTestServer(t, s)
+	defer b.Close()
+
+	a.Create("/a", nil, ZOO_EPHEMERAL)
+	_, watch, _ := b.ExistsW("/a")
+	a.Close()
+	checkFired(t, watch, ZOO_DELETED_EVENT)
+
+	if _, rc := a.Create("/b", nil, 0); rc != ZSESSIONEXPIRED {
+		t.Fatal("Creates a node after close:", rc)
+	}
+}
+
+func TestClientResume(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+
+	a := dialTestServer(t, s)
+	defer a.Close()
+	a.Create("/a", nil, ZOO_EPHEMERAL)
+
+	// A session with a wrong password is not resumed.
+	id := a.GetZkID()
+	wrong := ZkID{SessionId: id.SessionId, Passwd: []byte("wrong")}
+	if _, ok := Dial(s.addr(), 200, &wrong); ok {
+		t.Fatal("Resumes a session with a wrong password")
+	}
+
+	b, ok := Dial(s.addr(), 1000, &id)
+	if !ok {
+		t.Fatal("Fails to resume a session")
+	}
+	if b.GetZkID().SessionId != id.SessionId {
+		t.Fatal("Starts a new session")
+	}
+
+	// Both clients are in the same session, which b ends.
+	_, watch, _ := a.ExistsW("/a")
+	b.Close()
+	checkFired(t, watch, ZOO_DELETED_EVENT)
+}
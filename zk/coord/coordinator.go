@@ -0,0 +1,201 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// Package coord keeps the coordination service that lbase relies on behind
+// an interface, so that code on top of it does not need the native
+// zookeeper library. Client speaks the zookeeper wire protocol in Go,
+// lbase/zk provides the interface on a ZHandle, and MemoryStore keeps
+// znodes in memory for tests.
+package coord
+
+// Zookeeper return codes. They have the same values as those of lbase/zk.
+const (
+	ZOK = 0
+
+	// System errors.
+	ZSYSTEMERROR          = -1
+	ZRUNTIMEINCONSISTENCY = -2
+	ZDATAINCONSISTENCY    = -3
+	ZCONNECTIONLOSS       = -4
+	ZMARSHALLINGERROR     = -5
+	ZUNIMPLEMENTED        = -6
+	ZOPERATIONTIMEOUT     = -7
+	ZBADARGUMENTS         = -8
+	ZINVALIDSTATE         = -9
+
+	// API errors.
+	ZAPIERROR                = -100
+	ZNONODE                  = -101
+	ZNOAUTH                  = -102
+	ZBADVERSION              = -103
+	ZNOCHILDRENFOREPHEMERALS = -108
+	ZNODEEXISTS              = -110
+	ZNOTEMPTY                = -111
+	ZSESSIONEXPIRED          = -112
+	ZINVALIDCALLBACK         = -113
+	ZINVALIDACL              = -114
+	ZAUTHFAILED              = -115
+	ZCLOSING                 = -116
+	ZNOTHING                 = -117
+	ZSESSIONMOVED            = -118
+)
+
+// Flags of Create, which may be ORed together.
+const (
+	// The node is deleted when the session that creates it ends.
+	ZOO_EPHEMERAL = 1
+	// A sequence that increases among children of the parent is appended
+	// to the name of the node.
+	ZOO_SEQUENCE = 2
+)
+
+// States of a session.
+const (
+	ZOO_EXPIRED_SESSION_STATE = -112
+	ZOO_AUTH_FAILED_STATE     = -113
+	ZOO_CONNECTING_STATE      = 1
+	ZOO_ASSOCIATING_STATE     = 2
+	ZOO_CONNECTED_STATE       = 3
+)
+
+// Types of events that fire watches.
+const (
+	ZOO_CREATED_EVENT = 1
+	ZOO_DELETED_EVENT = 2
+	ZOO_CHANGED_EVENT = 3
+	ZOO_CHILD_EVENT   = 4
+	// The session is disconnected or has expired. Watches are not kept
+	// across disconnections, so they all fire with this event.
+	ZOO_SESSION_EVENT     = -1
+	ZOO_NOTWATCHING_EVENT = -2
+)
+
+// An operation of a transaction. Type is one of OP_CREATE, OP_DELETE,
+// OP_SET_DATA and OP_CHECK.
+type Op struct {
+	Type    int
+	Path    string
+	Data    []byte
+	Flags   int
+	Version int
+	// ACL of the node that a create makes. The session's ACL for new
+	// nodes is used if it is nil.
+	ACL []ACL
+}
+
+func CreateOp(path string, data []byte, flags int) Op {
+	return Op{Type: OP_CREATE, Path: path, Data: data, Flags: flags}
+}
+
+func DeleteOp(path string, version int) Op {
+	return Op{Type: OP_DELETE, Path: path, Version: version}
+}
+
+func SetOp(path string, data []byte, version int) Op {
+	return Op{Type: OP_SET_DATA, Path: path, Data: data, Version: version}
+}
+
+// Fails the transaction unless the node is at @version.
+func CheckOp(path string, version int) Op {
+	return Op{Type: OP_CHECK, Path: path, Version: version}
+}
+
+type OpResult struct {
+	Rc int
+	// Path of the node that a create makes.
+	Path string
+}
+
+// Results of a transaction that fails at the @failed op. Like zookeeper,
+// ops before it are ZOK, and ops after it are ZRUNTIMEINCONSISTENCY.
+func abortedResults(results []OpResult, failed int) []OpResult {
+	for i, _ := range results {
+		if i < failed {
+			results[i] = OpResult{Rc: ZOK}
+		} else if i > failed {
+			results[i] = OpResult{Rc: ZRUNTIMEINCONSISTENCY}
+		}
+	}
+	results[failed].Path = ""
+	return results
+}
+
+// Identifies a session, so that another client can resume it before it
+// expires.
+type ZkID struct {
+	SessionId int64
+	Passwd    []byte
+}
+
+// What fires a watch.
+type Event struct {
+	Type  int
+	State int
+	Path  string
+}
+
+// A session with a zookeeper like service. Results carry the return codes
+// above. A watch fires once, and operations that fail leave no watch
+// unless stated otherwise. Operations fail with ZNOAUTH unless ACLs of the
+// nodes grant the session the permissions.
+type Coordinator interface {
+	// Return one of the session states.
+	GetState() int
+	// Watch is fired with ZOO_SESSION_EVENT when the state of the session
+	// changes next.
+	WatchState() (watch chan Event)
+	// End the session, which removes its ephemeral nodes.
+	Close()
+	// Add credentials of @scheme to the session, such as "user:password"
+	// of SCHEME_DIGEST. The session keeps them across reconnections. If
+	// they are rejected, this fails with ZAUTHFAILED and the session moves
+	// to ZOO_AUTH_FAILED_STATE.
+	AddAuth(scheme string, cert []byte) (rc int)
+	// Create later nodes with @acl, or open to anyone if @acl is nil.
+	SetCreateACL(acl []ACL)
+	Exists(path string) (exists bool, rc int)
+	// Watch is fired when the node is created, changed or deleted. It is
+	// set even if the node does not exist.
+	ExistsW(path string) (exists bool, watch chan Event, rc int)
+	Get(path string) (data []byte, version int32, rc int)
+	// Watch is fired when the node is changed or deleted.
+	GetW(path string) (data []byte, version int32, watch chan Event, rc int)
+	// Fails with ZBADVERSION unless @version is -1 or the version of the
+	// node.
+	Set(path string, data []byte, version int) (rc int)
+	GetChildren(path string) (children []string, rc int)
+	// Watch is fired when a child is created or deleted, or the node is
+	// deleted.
+	GetChildrenW(path string) (children []string, watch chan Event, rc int)
+	// Return the path of the new node, which has a sequence appended if
+	// @flags has ZOO_SEQUENCE.
+	Create(path string, data []byte, flags int) (name string, rc int)
+	// Fails with ZBADVERSION unless @version is -1 or the version of the
+	// node.
+	Delete(path string, version int) (rc int)
+	// Apply all @ops, or none of them. Return the result of each op, and
+	// the return code of the first op that fails.
+	Multi(ops []Op) (results []OpResult, rc int)
+}
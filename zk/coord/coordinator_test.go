@@ -0,0 +1,289 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package coord
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Wait for @watch to fire with @eventType.
+func checkFired(t *testing.T, watch chan Event, eventType int) {
+	select {
+	case event := <-watch:
+		if event.Type != eventType {
+			t.Fatal("Unexpected event:", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Watch does not fire")
+	}
+}
+
+func checkNotFired(t *testing.T, watch chan Event) {
+	select {
+	case event := <-watch:
+		t.Fatal("Unexpected event:", event)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// Check a Coordinator against what zookeeper does. @newSession returns a
+// new session of the same ensemble every time.
+func checkCoordinator(t *testing.T, newSession func() Coordinator) {
+	a := newSession()
+	b := newSession()
+	if a.GetState() != ZOO_CONNECTED_STATE {
+		t.Fatal("Unexpected state:", a.GetState())
+	}
+
+	if _, rc := a.Create("/a/b", nil, 0); rc != ZNONODE {
+		t.Fatal("Creates a node without its parent:", rc)
+	}
+	if name, rc := a.Create("/a", []byte("x"), 0); rc != ZOK || name != "/a" {
+		t.Fatal("Fails to create a node:", name, rc)
+	}
+	if _, rc := b.Create("/a", nil, 0); rc != ZNODEEXISTS {
+		t.Fatal("Creates a node twice:", rc)
+	}
+	if exists, rc := b.Exists("/a"); !exists || rc != ZOK {
+		t.Fatal("Fails to find a node:", rc)
+	}
+	if exists, rc := b.Exists("/b"); exists || rc != ZNONODE {
+		t.Fatal("Finds a missing node:", rc)
+	}
+
+	// Versions.
+	data, version, rc := b.Get("/a")
+	if rc != ZOK || string(data) != "x" || version != 0 {
+		t.Fatal("Unexpected node:", string(data), version, rc)
+	}
+	if rc := b.Set("/a", []byte("y"), 1); rc != ZBADVERSION {
+		t.Fatal("Sets a node at a wrong version:", rc)
+	}
+	if rc := b.Set("/a", []byte("y"), 0); rc != ZOK {
+		t.Fatal("Fails to set a node:", rc)
+	}
+	if rc := b.Set("/a", nil, -1); rc != ZOK {
+		t.Fatal("Fails to set a node at any version:", rc)
+	}
+	data, version, rc = a.Get("/a")
+	if rc != ZOK || len(data) != 0 || version != 2 {
+		t.Fatal("Unexpected node:", string(data), version, rc)
+	}
+
+	// Sequence and ephemeral nodes.
+	flags := ZOO_EPHEMERAL | ZOO_SEQUENCE
+	first, rc := a.Create("/a/c-", nil, flags)
+	if rc != ZOK || first != "/a/c-0000000000" {
+		t.Fatal("Unexpected sequence node:", first, rc)
+	}
+	second, rc := b.Create("/a/c-", nil, flags)
+	if rc != ZOK || second != "/a/c-0000000001" {
+		t.Fatal("Unexpected sequence node:", second, rc)
+	}
+	if _, rc := a.Create(first+"/d", nil, 0); rc != ZNOCHILDRENFOREPHEMERALS {
+		t.Fatal("Creates a child of an ephemeral node:", rc)
+	}
+	children, rc := a.GetChildren("/a")
+	if rc != ZOK || !reflect.DeepEqual(children, []string{"c-0000000000", "c-0000000001"}) {
+		t.Fatal("Unexpected children:", children, rc)
+	}
+	if rc := a.Delete("/a", -1); rc != ZNOTEMPTY {
+		t.Fatal("Deletes a node with children:", rc)
+	}
+
+	// Watches that other sessions fire.
+	_, missing, rc := a.ExistsW("/b")
+	if rc != ZNONODE || missing == nil {
+		t.Fatal("Fails to watch a missing node:", rc)
+	}
+	_, _, changed, rc := a.GetW("/a")
+	if rc != ZOK {
+		t.Fatal("Fails to watch a node:", rc)
+	}
+	_, childChanged, rc := a.GetChildrenW("/a")
+	if rc != ZOK {
+		t.Fatal("Fails to watch children:", rc)
+	}
+	checkNotFired(t, missing)
+	checkNotFired(t, changed)
+	checkNotFired(t, childChanged)
+
+	b.Create("/b", nil, 0)
+	checkFired(t, missing, ZOO_CREATED_EVENT)
+	b.Set("/a", []byte("z"), -1)
+	checkFired(t, changed, ZOO_CHANGED_EVENT)
+	b.Delete(second, -1)
+	checkFired(t, childChanged, ZOO_CHILD_EVENT)
+
+	_, deleted, _ := b.ExistsW("/b")
+	b.Delete("/b", -1)
+	checkFired(t, deleted, ZOO_DELETED_EVENT)
+
+	// Deleting a node fires its watches.
+	_, _, rc = a.Get("/a/missing")
+	if rc != ZNONODE {
+		t.Fatal("Gets a missing node:", rc)
+	}
+	if rc := b.Delete("/a/missing", -1); rc != ZNONODE {
+		t.Fatal("Deletes a missing node:", rc)
+	}
+	if rc := b.Delete(first, 1); rc != ZBADVERSION {
+		t.Fatal("Deletes a node at a wrong version:", rc)
+	}
+	_, _, firstDeleted, _ := b.GetW(first)
+	if rc := b.Delete(first, 0); rc != ZOK {
+		t.Fatal("Fails to delete a node:", rc)
+	}
+	checkFired(t, firstDeleted, ZOO_DELETED_EVENT)
+
+	// Transactions.
+	_, _, watch, _ := b.GetW("/a")
+	ops := []Op{
+		CheckOp("/a", 3),
+		CreateOp("/a/m-", []byte("x"), ZOO_SEQUENCE),
+		SetOp("/a", []byte("y"), -1),
+		DeleteOp("/missing", -1),
+	}
+	results, rc := a.Multi(ops)
+	if rc != ZNONODE || len(results) != 4 || results[0].Rc != ZOK || results[3].Rc != ZNONODE {
+		t.Fatal("Unexpected results:", results, rc)
+	}
+	checkNotFired(t, watch)
+	if children, _ := b.GetChildren("/a"); len(children) != 0 {
+		t.Fatal("Applies part of a transaction:", children)
+	}
+
+	results, rc = a.Multi(ops[:3])
+	if rc != ZOK || results[1].Path != "/a/m-0000000002" {
+		t.Fatal("Unexpected results:", results, rc)
+	}
+	checkFired(t, watch, ZOO_CHANGED_EVENT)
+	if data, _, _ := b.Get("/a"); string(data) != "y" {
+		t.Fatal("Unexpected data:", string(data))
+	}
+	if _, rc := a.Multi(ops[:1]); rc != ZBADVERSION {
+		t.Fatal("Passes a stale check:", rc)
+	}
+
+	// ACLs.
+	owner := newSession()
+	other := newSession()
+	if rc := owner.AddAuth(SCHEME_DIGEST, []byte("lbase:secret")); rc != ZOK {
+		t.Fatal("Fails to add credentials:", rc)
+	}
+	if rc := other.AddAuth(SCHEME_DIGEST, []byte("lbase:secret")); rc != ZOK {
+		t.Fatal("Fails to add credentials:", rc)
+	}
+	owner.SetCreateACL(append(CreatorAllACL(), WorldACL(ZOO_PERM_READ)...))
+	if _, rc := owner.Create("/acl", []byte("x"), 0); rc != ZOK {
+		t.Fatal("Fails to create a node with an ACL:", rc)
+	}
+	if data, _, rc := b.Get("/acl"); rc != ZOK || string(data) != "x" {
+		t.Fatal("Fails to read a node that anyone reads:", rc)
+	}
+	if rc := b.Set("/acl", []byte("y"), -1); rc != ZNOAUTH {
+		t.Fatal("Writes a node without permission:", rc)
+	}
+	if _, rc := b.Create("/acl/child", nil, 0); rc != ZNOAUTH {
+		t.Fatal("Creates a child without permission:", rc)
+	}
+	if _, rc := b.Multi([]Op{SetOp("/acl", nil, -1)}); rc != ZNOAUTH {
+		t.Fatal("Writes a node without permission:", rc)
+	}
+	if rc := other.Set("/acl", []byte("y"), -1); rc != ZOK {
+		t.Fatal("Fails to write a node with the same credentials:", rc)
+	}
+
+	// Creates of transactions take the ACL of the session.
+	owner.SetCreateACL(DigestACL("lbase", "secret", ZOO_PERM_ALL))
+	if _, rc := owner.Multi([]Op{CreateOp("/acl/private", nil, 0)}); rc != ZOK {
+		t.Fatal("Fails to create a node with an ACL:", rc)
+	}
+	if _, _, rc := b.Get("/acl/private"); rc != ZNOAUTH {
+		t.Fatal("Reads a node without permission:", rc)
+	}
+	if rc := b.Delete("/acl/private", -1); rc != ZNOAUTH {
+		t.Fatal("Deletes a node without permission:", rc)
+	}
+	if rc := other.Delete("/acl/private", -1); rc != ZOK {
+		t.Fatal("Fails to delete a node with the same credentials:", rc)
+	}
+	b.SetCreateACL(CreatorAllACL())
+	if _, rc := b.Create("/noauth", nil, 0); rc != ZINVALIDACL {
+		t.Fatal("Creates a node for a creator without credentials:", rc)
+	}
+
+	// A session with rejected credentials is unusable.
+	rejected := newSession()
+	if rc := rejected.AddAuth("unknown", []byte("x")); rc != ZAUTHFAILED {
+		t.Fatal("Accepts credentials of an unknown scheme:", rc)
+	}
+	if rejected.GetState() != ZOO_AUTH_FAILED_STATE {
+		t.Fatal("Unexpected state:", rejected.GetState())
+	}
+	if _, _, rc := rejected.Get("/acl"); rc != ZAUTHFAILED {
+		t.Fatal("Reads a node after credentials are rejected:", rc)
+	}
+}
+
+// Digest ids are what zookeeper computes.
+func TestDigestACL(t *testing.T) {
+	acl := DigestACL("super", "test", ZOO_PERM_ALL)
+	if len(acl) != 1 || acl[0].Id != "super:D/InIHSb7yEEbrWz8b9l71RjZJU=" {
+		t.Fatal("Unexpected ACL:", acl)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	checkCoordinator(t, func() Coordinator {
+		return store.NewSession()
+	})
+}
+
+func TestMemoryStoreExpire(t *testing.T) {
+	store := NewMemoryStore()
+	a := store.NewSession()
+	b := store.NewSession()
+
+	a.Create("/a", nil, ZOO_EPHEMERAL)
+	_, deleted, _ := b.ExistsW("/a")
+	_, lost, _ := a.ExistsW("/b")
+	state := a.WatchState()
+
+	a.Expire()
+	checkFired(t, deleted, ZOO_DELETED_EVENT)
+	checkFired(t, lost, ZOO_SESSION_EVENT)
+	checkFired(t, state, ZOO_SESSION_EVENT)
+	if a.GetState() != ZOO_EXPIRED_SESSION_STATE {
+		t.Fatal("Unexpected state:", a.GetState())
+	}
+	if _, rc := a.Create("/b", nil, 0); rc != ZSESSIONEXPIRED {
+		t.Fatal("Creates a node after expiry:", rc)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package coord
+
+const (
+	// How many times a helper tries again when other sessions change
+	// nodes that it works on.
+	HELPER_RETRIES = 100
+)
+
+// Create persistent nodes along @path if they do not exist, like
+// mkdir -p.
+func CreateAll(c Coordinator, path string) (rc int) {
+	for i := 1; i <= len(path); i++ {
+		if i < len(path) && path[i] != '/' {
+			continue
+		}
+
+		_, rc = c.Create(path[:i], nil, 0)
+		if rc != ZOK && rc != ZNODEEXISTS {
+			return rc
+		}
+	}
+	return ZOK
+}
+
+// Delete @path and all nodes under it. A node that is gone already is not
+// an error.
+func DeleteRecursive(c Coordinator, path string) (rc int) {
+	if path == "/" {
+		return ZBADARGUMENTS
+	}
+
+	for i := 0; i < HELPER_RETRIES; i++ {
+		children, rc := c.GetChildren(path)
+		if rc == ZNONODE {
+			return ZOK
+		}
+		if rc != ZOK {
+			return rc
+		}
+
+		for _, child := range children {
+			if rc := DeleteRecursive(c, path+"/"+child); rc != ZOK {
+				return rc
+			}
+		}
+
+		// Another session may add a child meanwhile.
+		rc = c.Delete(path, -1)
+		if rc == ZOK || rc == ZNONODE {
+			return ZOK
+		}
+		if rc != ZNOTEMPTY {
+			return rc
+		}
+	}
+	return ZNOTEMPTY
+}
+
+// Set @path to what @update returns for its data. @update is called
+// again with new data if another session changes the node in between,
+// so it should not have side effects. Return the data that is set.
+func UpdateWithRetry(
+	c Coordinator,
+	path string,
+	update func([]byte) []byte) (data []byte, rc int) {
+
+	for i := 0; i < HELPER_RETRIES; i++ {
+		old, version, rc := c.Get(path)
+		if rc != ZOK {
+			return nil, rc
+		}
+
+		data = update(old)
+		rc = c.Set(path, data, int(version))
+		if rc != ZBADVERSION {
+			return data, rc
+		}
+	}
+	return nil, ZBADVERSION
+}
@@ -0,0 +1,94 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package coord
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestCreateAllAndDeleteRecursive(t *testing.T) {
+	c := NewMemoryStore().NewSession()
+
+	if rc := CreateAll(c, "/a/b/c"); rc != ZOK {
+		t.Fatal("Fails to create nodes:", rc)
+	}
+	if rc := CreateAll(c, "/a/b/c"); rc != ZOK {
+		t.Fatal("Fails on nodes that exist:", rc)
+	}
+	CreateAll(c, "/a/d")
+	if exists, _ := c.Exists("/a/b/c"); !exists {
+		t.Fatal("Misses a node")
+	}
+
+	if rc := DeleteRecursive(c, "/a"); rc != ZOK {
+		t.Fatal("Fails to delete nodes:", rc)
+	}
+	if children, _ := c.GetChildren("/"); len(children) != 0 {
+		t.Fatal("Leaves nodes:", children)
+	}
+	if rc := DeleteRecursive(c, "/a"); rc != ZOK {
+		t.Fatal("Fails on nodes that are gone:", rc)
+	}
+}
+
+func TestUpdateWithRetry(t *testing.T) {
+	store := NewMemoryStore()
+	store.NewSession().Create("/counter", []byte("0"), 0)
+
+	// Sessions add to a counter at the same time.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := store.NewSession()
+			for j := 0; j < 10; j++ {
+				_, rc := UpdateWithRetry(c, "/counter", func(data []byte) []byte {
+					n, _ := strconv.Atoi(string(data))
+					return []byte(strconv.Itoa(n + 1))
+				})
+				if rc != ZOK {
+					t.Error("Fails to update:", rc)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, _, _ := store.NewSession().Get("/counter")
+	if string(data) != "100" {
+		t.Fatal("Loses updates:", string(data))
+	}
+
+	_, rc := UpdateWithRetry(store.NewSession(), "/missing", func(data []byte) []byte {
+		return data
+	})
+	if rc != ZNONODE {
+		t.Fatal("Updates a missing node:", rc)
+	}
+}
@@ -0,0 +1,276 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package coord
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// How long to wait before starting a new session again.
+	KEEPER_RETRY_MS = 1000
+)
+
+// Keeps a session with a coordination service, and starts a new one when
+// the session expires. It implements Coordinator on the current session.
+// Ephemeral nodes and watches go away with an expired session, so callers
+// register functions by OnRenew to restore them on the new session.
+type SessionKeeper struct {
+	dial func() (Coordinator, bool)
+
+	mutex        sync.Mutex
+	current      Coordinator
+	renewals     []func(Coordinator)
+	stateWatches []chan Event
+	quit         chan bool
+	// Credentials and the ACL of new nodes, which are set on each new
+	// session.
+	auths     []keeperAuth
+	createACL []ACL
+}
+
+type keeperAuth struct {
+	scheme string
+	cert   []byte
+}
+
+// Start a session by @dial, which is also called to start new sessions.
+func NewSessionKeeper(dial func() (Coordinator, bool)) (k *SessionKeeper, ok bool) {
+	current, ok := dial()
+	if !ok {
+		return nil, false
+	}
+
+	k = &SessionKeeper{
+		dial:    dial,
+		current: current,
+		quit:    make(chan bool),
+	}
+	go k.run()
+	return k, true
+}
+
+// Call @renew with each session that replaces an expired one.
+func (k *SessionKeeper) OnRenew(renew func(c Coordinator)) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.renewals = append(k.renewals, renew)
+}
+
+func (k *SessionKeeper) Close() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	select {
+	case <-k.quit:
+	default:
+		close(k.quit)
+		k.current.Close()
+	}
+}
+
+// Watch is also fired with ZOO_CONNECTED_STATE when a new session
+// replaces an expired one.
+func (k *SessionKeeper) WatchState() (watch chan Event) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	watch = make(chan Event, 1)
+	k.stateWatches = append(k.stateWatches, watch)
+	return watch
+}
+
+func (k *SessionKeeper) session() Coordinator {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.current
+}
+
+func (k *SessionKeeper) closed() bool {
+	select {
+	case <-k.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (k *SessionKeeper) fireState(state int) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	for _, watch := range k.stateWatches {
+		watch <- Event{Type: ZOO_SESSION_EVENT, State: state}
+	}
+	k.stateWatches = nil
+}
+
+// Pass on state changes of the current session, and renew it when it
+// expires.
+func (k *SessionKeeper) run() {
+	for {
+		current := k.session()
+		watch := current.WatchState()
+		state := current.GetState()
+		if state != ZOO_EXPIRED_SESSION_STATE {
+			select {
+			case event := <-watch:
+				state = event.State
+			case <-k.quit:
+				return
+			}
+		}
+		if k.closed() {
+			return
+		}
+
+		k.fireState(state)
+		if state == ZOO_EXPIRED_SESSION_STATE {
+			log.Printf("Zookeeper session has expired, and starts a new one\n")
+			if !k.renew(current) {
+				return
+			}
+		}
+	}
+}
+
+// Replace session @expired with a new one. Return false if the keeper is
+// closed first.
+func (k *SessionKeeper) renew(expired Coordinator) bool {
+	expired.Close()
+
+	var current Coordinator
+	for {
+		var ok bool
+		if current, ok = k.dial(); ok {
+			break
+		}
+		select {
+		case <-time.After(KEEPER_RETRY_MS * time.Millisecond):
+		case <-k.quit:
+			return false
+		}
+	}
+
+	// Credentials are added before anyone uses the new session.
+	k.mutex.Lock()
+	auths := append([]keeperAuth{}, k.auths...)
+	k.mutex.Unlock()
+	for _, auth := range auths {
+		if rc := current.AddAuth(auth.scheme, auth.cert); rc != ZOK {
+			log.Printf("Fails to add %s credentials to the new session: %d\n", auth.scheme, rc)
+		}
+	}
+
+	k.mutex.Lock()
+	if k.closed() {
+		k.mutex.Unlock()
+		current.Close()
+		return false
+	}
+	current.SetCreateACL(k.createACL)
+	k.current = current
+	renewals := append([]func(Coordinator){}, k.renewals...)
+	k.mutex.Unlock()
+
+	log.Printf("Starts a new zookeeper session\n")
+	for _, renew := range renewals {
+		renew(current)
+	}
+	k.fireState(current.GetState())
+	return true
+}
+
+// Credentials are also added to each new session once they are accepted.
+func (k *SessionKeeper) AddAuth(scheme string, cert []byte) (rc int) {
+	if rc = k.session().AddAuth(scheme, cert); rc != ZOK {
+		return
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.auths = append(k.auths, keeperAuth{scheme: scheme, cert: append([]byte{}, cert...)})
+	return ZOK
+}
+
+func (k *SessionKeeper) SetCreateACL(acl []ACL) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	// Under the mutex, so that a session that is being renewed gets it.
+	k.createACL = append([]ACL(nil), acl...)
+	k.current.SetCreateACL(acl)
+}
+
+func (k *SessionKeeper) GetState() int {
+	return k.session().GetState()
+}
+
+func (k *SessionKeeper) Exists(path string) (exists bool, rc int) {
+	return k.session().Exists(path)
+}
+
+func (k *SessionKeeper) ExistsW(path string) (exists bool, watch chan Event, rc int) {
+	return k.session().ExistsW(path)
+}
+
+func (k *SessionKeeper) Get(path string) (data []byte, version int32, rc int) {
+	return k.session().Get(path)
+}
+
+func (k *SessionKeeper) GetW(
+	path string) (data []byte, version int32, watch chan Event, rc int) {
+
+	return k.session().GetW(path)
+}
+
+func (k *SessionKeeper) Set(path string, data []byte, version int) (rc int) {
+	return k.session().Set(path, data, version)
+}
+
+func (k *SessionKeeper) GetChildren(path string) (children []string, rc int) {
+	return k.session().GetChildren(path)
+}
+
+func (k *SessionKeeper) GetChildrenW(
+	path string) (children []string, watch chan Event, rc int) {
+
+	return k.session().GetChildrenW(path)
+}
+
+func (k *SessionKeeper) Create(path string, data []byte, flags int) (name string, rc int) {
+	return k.session().Create(path, data, flags)
+}
+
+func (k *SessionKeeper) Delete(path string, version int) (rc int) {
+	return k.session().Delete(path, version)
+}
+
+func (k *SessionKeeper) Multi(ops []Op) (results []OpResult, rc int) {
+	return k.session().Multi(ops)
+}
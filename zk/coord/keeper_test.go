@@ -0,0 +1,107 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package coord
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSessionKeeper(t *testing.T) {
+	store := NewMemoryStore()
+	var mutex sync.Mutex
+	var sessions []*MemorySession
+	k, ok := NewSessionKeeper(func() (Coordinator, bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		session := store.NewSession()
+		sessions = append(sessions, session)
+		return session, true
+	})
+	if !ok {
+		t.Fatal("Fails to start a session")
+	}
+	defer k.Close()
+
+	// Credentials and the ACL of new nodes carry over to new sessions.
+	if rc := k.AddAuth(SCHEME_DIGEST, []byte("lbase:secret")); rc != ZOK {
+		t.Fatal("Fails to add credentials:", rc)
+	}
+	k.SetCreateACL(DigestACL("lbase", "secret", ZOO_PERM_ALL))
+
+	// Ephemeral nodes are created again on new sessions. The renewal waits
+	// for the test to watch the state.
+	renewed := make(chan bool)
+	register := func(c Coordinator) {
+		c.Create("/server", []byte("a"), ZOO_EPHEMERAL)
+	}
+	register(k)
+	k.OnRenew(func(c Coordinator) {
+		register(c)
+		renewed <- true
+	})
+
+	other := store.NewSession()
+	_, deleted, _ := other.ExistsW("/server")
+	_, watch, _ := k.ExistsW("/missing")
+	state := k.WatchState()
+
+	mutex.Lock()
+	sessions[0].Expire()
+	mutex.Unlock()
+
+	checkFired(t, deleted, ZOO_DELETED_EVENT)
+	checkFired(t, watch, ZOO_SESSION_EVENT)
+	if event := <-state; event.State != ZOO_EXPIRED_SESSION_STATE {
+		t.Fatal("Unexpected state:", event)
+	}
+	state = k.WatchState()
+	<-renewed
+	if event := <-state; event.State != ZOO_CONNECTED_STATE {
+		t.Fatal("Unexpected state:", event)
+	}
+
+	if exists, _ := other.Exists("/server"); !exists {
+		t.Fatal("Fails to restore an ephemeral node")
+	}
+	if k.GetState() != ZOO_CONNECTED_STATE {
+		t.Fatal("Unexpected state:", k.GetState())
+	}
+	if _, rc := k.Create("/a", nil, 0); rc != ZOK {
+		t.Fatal("Fails to use the new session:", rc)
+	}
+	if _, _, rc := other.Get("/a"); rc != ZNOAUTH {
+		t.Fatal("Creates a node without the ACL:", rc)
+	}
+	if _, _, rc := k.Get("/server"); rc != ZOK {
+		t.Fatal("Loses credentials:", rc)
+	}
+
+	// Closing the keeper ends its session.
+	_, deleted, _ = other.ExistsW("/server")
+	k.Close()
+	checkFired(t, deleted, ZOO_DELETED_EVENT)
+}
@@ -0,0 +1,611 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package coord
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type memoryNode struct {
+	data    []byte
+	version int32
+	acl     []ACL
+	// Session that owns an ephemeral node. Nil if the node is persistent.
+	owner *MemorySession
+	// Sequence of the next sequential child.
+	seq int
+}
+
+type memoryWatch struct {
+	session *MemorySession
+	watch   chan Event
+}
+
+// An event that fires watches once a write is done.
+type memoryEvent struct {
+	watches map[string][]memoryWatch
+	path    string
+	event   int
+}
+
+// Znodes in memory, which sessions share like clients of one zookeeper
+// ensemble.
+type MemoryStore struct {
+	mutex        sync.Mutex
+	nodes        map[string]*memoryNode
+	dataWatches  map[string][]memoryWatch
+	childWatches map[string][]memoryWatch
+	// Events of the write in progress.
+	events []memoryEvent
+	// Number of writes that succeed before writes fail with connection
+	// loss. Writes never fail if it is negative.
+	writesLeft int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		nodes:        map[string]*memoryNode{"/": &memoryNode{acl: WorldACL(ZOO_PERM_ALL)}},
+		dataWatches:  make(map[string][]memoryWatch),
+		childWatches: make(map[string][]memoryWatch),
+		writesLeft:   -1,
+	}
+}
+
+// Let @n writes succeed, and fail the rest. A negative @n lets all
+// writes succeed.
+func (z *MemoryStore) FailWritesAfter(n int) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	z.writesLeft = n
+}
+
+func (z *MemoryStore) NewSession() *MemorySession {
+	return &MemorySession{store: z}
+}
+
+// A session of MemoryStore, which implements Coordinator.
+type MemorySession struct {
+	store        *MemoryStore
+	expired      bool
+	authFailed   bool
+	stateWatches []chan Event
+	// Identities that the session has added, whose Perms are unused.
+	ids       []ACL
+	createACL []ACL
+}
+
+// Expire the session, which removes its ephemeral nodes, and fires its
+// watches with ZOO_SESSION_EVENT.
+func (s *MemorySession) Expire() {
+	z := s.store
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	if s.expired {
+		return
+	}
+	s.expired = true
+	for path, node := range z.nodes {
+		if node.owner == s {
+			z.remove(path)
+		}
+	}
+	z.flush()
+
+	for _, watches := range []map[string][]memoryWatch{z.dataWatches, z.childWatches} {
+		for path, list := range watches {
+			kept := list[:0]
+			for _, w := range list {
+				if w.session == s {
+					w.watch <- Event{Type: ZOO_SESSION_EVENT, State: ZOO_EXPIRED_SESSION_STATE}
+				} else {
+					kept = append(kept, w)
+				}
+			}
+			watches[path] = kept
+		}
+	}
+
+	s.fireState(ZOO_EXPIRED_SESSION_STATE)
+}
+
+func (s *MemorySession) fireState(state int) {
+	for _, watch := range s.stateWatches {
+		watch <- Event{Type: ZOO_SESSION_EVENT, State: state}
+	}
+	s.stateWatches = nil
+}
+
+// Only SCHEME_DIGEST credentials are accepted.
+func (s *MemorySession) AddAuth(scheme string, cert []byte) (rc int) {
+	z := s.store
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	if rc = s.check(false); rc != ZOK {
+		return
+	}
+	if scheme != SCHEME_DIGEST {
+		s.authFailed = true
+		s.fireState(ZOO_AUTH_FAILED_STATE)
+		return ZAUTHFAILED
+	}
+
+	id := ACL{Scheme: scheme, Id: digestId(string(cert))}
+	for _, added := range s.ids {
+		if added == id {
+			return ZOK
+		}
+	}
+	s.ids = append(s.ids, id)
+	return ZOK
+}
+
+func (s *MemorySession) SetCreateACL(acl []ACL) {
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+	s.createACL = append([]ACL(nil), acl...)
+}
+
+// Check if @acl grants @perm to the session.
+func (s *MemorySession) allowed(acl []ACL, perm int) bool {
+	for _, a := range acl {
+		if a.Perms&perm == 0 {
+			continue
+		}
+		if a.Scheme == SCHEME_WORLD && a.Id == "anyone" {
+			return true
+		}
+		for _, id := range s.ids {
+			if a.Scheme == id.Scheme && a.Id == id.Id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Return @acl of a new node, where SCHEME_AUTH entries are replaced by
+// identities of the session.
+func (s *MemorySession) fixACL(acl []ACL) (fixed []ACL, rc int) {
+	if acl == nil {
+		acl = s.createACL
+	}
+	if acl == nil {
+		acl = WorldACL(ZOO_PERM_ALL)
+	}
+
+	for _, a := range acl {
+		switch {
+		case a.Scheme == SCHEME_AUTH:
+			if len(s.ids) == 0 {
+				return nil, ZINVALIDACL
+			}
+			for _, id := range s.ids {
+				fixed = append(fixed, ACL{Perms: a.Perms, Scheme: id.Scheme, Id: id.Id})
+			}
+		case a.Scheme == SCHEME_WORLD && a.Id == "anyone", a.Scheme == SCHEME_DIGEST:
+			fixed = append(fixed, a)
+		default:
+			return nil, ZINVALIDACL
+		}
+	}
+	if len(fixed) == 0 {
+		return nil, ZINVALIDACL
+	}
+	return fixed, ZOK
+}
+
+// End the session like Expire.
+func (s *MemorySession) Close() {
+	s.Expire()
+}
+
+func (s *MemorySession) WatchState() (watch chan Event) {
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+
+	watch = make(chan Event, 1)
+	s.stateWatches = append(s.stateWatches, watch)
+	return watch
+}
+
+func parentOf(path string) string {
+	idx := strings.LastIndex(path, "/")
+	if idx == 0 {
+		return "/"
+	}
+	return path[:idx]
+}
+
+func (z *MemoryStore) fire(watches map[string][]memoryWatch, path string, event int) {
+	z.events = append(z.events, memoryEvent{watches: watches, path: path, event: event})
+}
+
+// Fire watches by events of the write that is done.
+func (z *MemoryStore) flush() {
+	for _, e := range z.events {
+		for _, w := range e.watches[e.path] {
+			w.watch <- Event{Type: e.event, State: ZOO_CONNECTED_STATE, Path: e.path}
+		}
+		delete(e.watches, e.path)
+	}
+	z.events = nil
+}
+
+// Copy znodes, so that a transaction that fails can be undone.
+func (z *MemoryStore) snapshot() map[string]memoryNode {
+	ret := make(map[string]memoryNode)
+	for path, node := range z.nodes {
+		ret[path] = *node
+	}
+	return ret
+}
+
+func (z *MemoryStore) restore(snapshot map[string]memoryNode) {
+	z.nodes = make(map[string]*memoryNode)
+	for path, node := range snapshot {
+		copied := node
+		z.nodes[path] = &copied
+	}
+	z.events = nil
+}
+
+func (s *MemorySession) watch(watches map[string][]memoryWatch, path string) chan Event {
+	watch := make(chan Event, 1)
+	watches[path] = append(watches[path], memoryWatch{session: s, watch: watch})
+	return watch
+}
+
+func (z *MemoryStore) remove(path string) {
+	delete(z.nodes, path)
+	z.fire(z.dataWatches, path, ZOO_DELETED_EVENT)
+	z.fire(z.childWatches, path, ZOO_DELETED_EVENT)
+	z.fire(z.childWatches, parentOf(path), ZOO_CHILD_EVENT)
+}
+
+func (z *MemoryStore) children(path string) []string {
+	prefix := path + "/"
+	if path == "/" {
+		prefix = "/"
+	}
+
+	var ret []string
+	for p, _ := range z.nodes {
+		if p != "/" && strings.HasPrefix(p, prefix) && !strings.Contains(p[len(prefix):], "/") {
+			ret = append(ret, p[len(prefix):])
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Check if an operation can go on. Writes count against writesLeft.
+func (s *MemorySession) check(write bool) int {
+	if s.expired {
+		return ZSESSIONEXPIRED
+	}
+	if s.authFailed {
+		return ZAUTHFAILED
+	}
+	if write && s.store.writesLeft == 0 {
+		return ZCONNECTIONLOSS
+	}
+	if write && s.store.writesLeft > 0 {
+		s.store.writesLeft--
+	}
+	return ZOK
+}
+
+func (s *MemorySession) GetState() int {
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+
+	if s.expired {
+		return ZOO_EXPIRED_SESSION_STATE
+	}
+	if s.authFailed {
+		return ZOO_AUTH_FAILED_STATE
+	}
+	return ZOO_CONNECTED_STATE
+}
+
+func (s *MemorySession) Exists(path string) (exists bool, rc int) {
+	exists, _, rc = s.exists(path, false)
+	return
+}
+
+func (s *MemorySession) ExistsW(path string) (exists bool, watch chan Event, rc int) {
+	return s.exists(path, true)
+}
+
+func (s *MemorySession) exists(path string, setWatch bool) (
+	exists bool,
+	watch chan Event,
+	rc int) {
+
+	z := s.store
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	if rc = s.check(false); rc != ZOK {
+		return
+	}
+	if setWatch {
+		watch = s.watch(z.dataWatches, path)
+	}
+	if _, exists = z.nodes[path]; !exists {
+		rc = ZNONODE
+	}
+	return
+}
+
+func (s *MemorySession) Get(path string) (data []byte, version int32, rc int) {
+	data, version, _, rc = s.get(path, false)
+	return
+}
+
+func (s *MemorySession) GetW(
+	path string) (data []byte, version int32, watch chan Event, rc int) {
+
+	return s.get(path, true)
+}
+
+func (s *MemorySession) get(path string, setWatch bool) (
+	data []byte,
+	version int32,
+	watch chan Event,
+	rc int) {
+
+	z := s.store
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	if rc = s.check(false); rc != ZOK {
+		return
+	}
+	node, found := z.nodes[path]
+	if !found {
+		rc = ZNONODE
+		return
+	}
+	if !s.allowed(node.acl, ZOO_PERM_READ) {
+		rc = ZNOAUTH
+		return
+	}
+	if setWatch {
+		watch = s.watch(z.dataWatches, path)
+	}
+	return append([]byte{}, node.data...), node.version, watch, ZOK
+}
+
+func (s *MemorySession) Set(path string, data []byte, version int) (rc int) {
+	z := s.store
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	if rc = s.check(true); rc != ZOK {
+		return
+	}
+	rc = s.set(path, data, version)
+	z.flush()
+	return
+}
+
+func (s *MemorySession) set(path string, data []byte, version int) (rc int) {
+	z := s.store
+	node, rc := s.checkVersion(path, version, ZOO_PERM_WRITE)
+	if rc != ZOK {
+		return
+	}
+
+	node.data = append([]byte{}, data...)
+	node.version++
+	z.fire(z.dataWatches, path, ZOO_CHANGED_EVENT)
+	return ZOK
+}
+
+// Check that the node at @path is at @version, and that its ACL grants
+// @perm to the session.
+func (s *MemorySession) checkVersion(
+	path string,
+	version int,
+	perm int) (node *memoryNode, rc int) {
+
+	node, found := s.store.nodes[path]
+	if !found {
+		return nil, ZNONODE
+	}
+	if perm != 0 && !s.allowed(node.acl, perm) {
+		return nil, ZNOAUTH
+	}
+	if version != -1 && int32(version) != node.version {
+		return nil, ZBADVERSION
+	}
+	return node, ZOK
+}
+
+func (s *MemorySession) GetChildren(path string) (children []string, rc int) {
+	children, _, rc = s.getChildren(path, false)
+	return
+}
+
+func (s *MemorySession) GetChildrenW(
+	path string) (children []string, watch chan Event, rc int) {
+
+	return s.getChildren(path, true)
+}
+
+func (s *MemorySession) getChildren(path string, setWatch bool) (
+	children []string,
+	watch chan Event,
+	rc int) {
+
+	z := s.store
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	if rc = s.check(false); rc != ZOK {
+		return
+	}
+	node, found := z.nodes[path]
+	if !found {
+		rc = ZNONODE
+		return
+	}
+	if !s.allowed(node.acl, ZOO_PERM_READ) {
+		rc = ZNOAUTH
+		return
+	}
+	if setWatch {
+		watch = s.watch(z.childWatches, path)
+	}
+	return z.children(path), watch, ZOK
+}
+
+func (s *MemorySession) Create(path string, data []byte, flags int) (name string, rc int) {
+	z := s.store
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	if rc = s.check(true); rc != ZOK {
+		return
+	}
+	name, rc = s.create(path, data, flags, nil)
+	z.flush()
+	return
+}
+
+// Create a node with @acl, or the ACL of the session if it is nil.
+func (s *MemorySession) create(
+	path string,
+	data []byte,
+	flags int,
+	acl []ACL) (name string, rc int) {
+
+	z := s.store
+	parent, found := z.nodes[parentOf(path)]
+	if !found {
+		return "", ZNONODE
+	}
+	if !s.allowed(parent.acl, ZOO_PERM_CREATE) {
+		return "", ZNOAUTH
+	}
+	if acl, rc = s.fixACL(acl); rc != ZOK {
+		return "", rc
+	}
+	if parent.owner != nil {
+		return "", ZNOCHILDRENFOREPHEMERALS
+	}
+
+	if flags&ZOO_SEQUENCE != 0 {
+		path = fmt.Sprintf("%s%010d", path, parent.seq)
+		parent.seq++
+	}
+	if _, found := z.nodes[path]; found {
+		return "", ZNODEEXISTS
+	}
+
+	node := &memoryNode{data: append([]byte{}, data...), acl: acl}
+	if flags&ZOO_EPHEMERAL != 0 {
+		node.owner = s
+	}
+	z.nodes[path] = node
+	z.fire(z.dataWatches, path, ZOO_CREATED_EVENT)
+	z.fire(z.childWatches, parentOf(path), ZOO_CHILD_EVENT)
+	return path, ZOK
+}
+
+func (s *MemorySession) Delete(path string, version int) (rc int) {
+	z := s.store
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	if rc = s.check(true); rc != ZOK {
+		return
+	}
+	rc = s.delete(path, version)
+	z.flush()
+	return
+}
+
+func (s *MemorySession) delete(path string, version int) (rc int) {
+	z := s.store
+	if parent, found := z.nodes[parentOf(path)]; found && !s.allowed(parent.acl, ZOO_PERM_DELETE) {
+		return ZNOAUTH
+	}
+	if _, rc = s.checkVersion(path, version, 0); rc != ZOK {
+		return
+	}
+	if len(z.children(path)) > 0 {
+		return ZNOTEMPTY
+	}
+
+	z.remove(path)
+	return ZOK
+}
+
+// Apply all @ops, or none of them. A write that fails makes the store
+// fail the whole transaction.
+func (s *MemorySession) Multi(ops []Op) (results []OpResult, rc int) {
+	z := s.store
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	results = make([]OpResult, len(ops))
+	if rc = s.check(true); rc != ZOK {
+		for i, _ := range results {
+			results[i].Rc = rc
+		}
+		return
+	}
+
+	snapshot := z.snapshot()
+	for i, op := range ops {
+		switch op.Type {
+		case OP_CREATE:
+			results[i].Path, results[i].Rc = s.create(op.Path, op.Data, op.Flags, op.ACL)
+		case OP_DELETE:
+			results[i].Rc = s.delete(op.Path, op.Version)
+		case OP_SET_DATA:
+			results[i].Rc = s.set(op.Path, op.Data, op.Version)
+		case OP_CHECK:
+			_, results[i].Rc = s.checkVersion(op.Path, op.Version, ZOO_PERM_READ)
+		default:
+			results[i].Rc = ZBADARGUMENTS
+		}
+
+		if rc = results[i].Rc; rc != ZOK {
+			z.restore(snapshot)
+			return abortedResults(results, i), rc
+		}
+	}
+	z.flush()
+	return results, ZOK
+}
@@ -0,0 +1,680 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package coord
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// Operation codes of the zookeeper wire protocol.
+const (
+	OP_NOTIFY        = 0
+	OP_CREATE        = 1
+	OP_DELETE        = 2
+	OP_EXISTS        = 3
+	OP_GET_DATA      = 4
+	OP_SET_DATA      = 5
+	OP_GET_CHILDREN  = 8
+	OP_PING          = 11
+	OP_CHECK         = 13
+	OP_MULTI         = 14
+	OP_AUTH          = 100
+	OP_CLOSE_SESSION = -11
+	// Result of an op that fails in a transaction.
+	OP_ERROR = -1
+)
+
+// Reserved xids of messages that are not replies of requests.
+const (
+	XID_NOTIFICATION = -1
+	XID_PING         = -2
+	XID_AUTH         = -4
+)
+
+// Largest packet that either side accepts.
+const MAX_PACKET_SIZE = 16 * 1024 * 1024
+
+var errMarshalling = errors.New("bad zookeeper packet")
+
+// Writes records in the jute encoding, which is big endian with lengths
+// before strings, buffers and vectors.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) writeInt(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) writeLong(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *encoder) writeBool(v bool) {
+	if v {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+// A nil buffer is written with length -1.
+func (e *encoder) writeBuffer(v []byte) {
+	if v == nil {
+		e.writeInt(-1)
+		return
+	}
+	e.writeInt(int32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) writeString(v string) {
+	e.writeInt(int32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) writeStrings(v []string) {
+	e.writeInt(int32(len(v)))
+	for _, s := range v {
+		e.writeString(s)
+	}
+}
+
+// Reads records that encoder writes. The first error sticks, and later
+// reads return zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || n < 0 || n > len(d.buf) {
+		d.err = errMarshalling
+		return nil
+	}
+	ret := d.buf[:n]
+	d.buf = d.buf[n:]
+	return ret
+}
+
+func (d *decoder) readInt() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) readLong() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) readBool() bool {
+	if b := d.next(1); b != nil {
+		return b[0] != 0
+	}
+	return false
+}
+
+func (d *decoder) readBuffer() []byte {
+	n := d.readInt()
+	if n == -1 {
+		return nil
+	}
+	if b := d.next(int(n)); b != nil {
+		return append([]byte{}, b...)
+	}
+	return nil
+}
+
+func (d *decoder) readString() string {
+	n := d.readInt()
+	if n == -1 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *decoder) readStrings() []string {
+	n := d.readInt()
+	if n < 0 || int64(n)*4 > int64(len(d.buf)) {
+		if n != -1 {
+			d.err = errMarshalling
+		}
+		return nil
+	}
+	ret := make([]string, 0, n)
+	for i := int32(0); i < n; i++ {
+		ret = append(ret, d.readString())
+	}
+	return ret
+}
+
+// A record of the protocol.
+type record interface {
+	encode(e *encoder)
+	decode(d *decoder)
+}
+
+// Write a packet, which has the length of @records before them.
+func writePacket(w io.Writer, records ...record) error {
+	e := &encoder{buf: make([]byte, 4, 64)}
+	for _, r := range records {
+		r.encode(e)
+	}
+	binary.BigEndian.PutUint32(e.buf, uint32(len(e.buf)-4))
+	_, err := w.Write(e.buf)
+	return err
+}
+
+// Read the content of a packet.
+func readPacket(r io.Reader) (*decoder, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > MAX_PACKET_SIZE || n > math.MaxInt32 {
+		return nil, errMarshalling
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return &decoder{buf: buf}, nil
+}
+
+type connectRequest struct {
+	ProtocolVersion int32
+	LastZxidSeen    int64
+	TimeOut         int32
+	SessionId       int64
+	Passwd          []byte
+}
+
+func (r *connectRequest) encode(e *encoder) {
+	e.writeInt(r.ProtocolVersion)
+	e.writeLong(r.LastZxidSeen)
+	e.writeInt(r.TimeOut)
+	e.writeLong(r.SessionId)
+	e.writeBuffer(r.Passwd)
+}
+
+func (r *connectRequest) decode(d *decoder) {
+	r.ProtocolVersion = d.readInt()
+	r.LastZxidSeen = d.readLong()
+	r.TimeOut = d.readInt()
+	r.SessionId = d.readLong()
+	r.Passwd = d.readBuffer()
+}
+
+// A server rejects a session that has expired with a zero TimeOut.
+type connectResponse struct {
+	ProtocolVersion int32
+	TimeOut         int32
+	SessionId       int64
+	Passwd          []byte
+}
+
+func (r *connectResponse) encode(e *encoder) {
+	e.writeInt(r.ProtocolVersion)
+	e.writeInt(r.TimeOut)
+	e.writeLong(r.SessionId)
+	e.writeBuffer(r.Passwd)
+}
+
+func (r *connectResponse) decode(d *decoder) {
+	r.ProtocolVersion = d.readInt()
+	r.TimeOut = d.readInt()
+	r.SessionId = d.readLong()
+	r.Passwd = d.readBuffer()
+}
+
+type requestHeader struct {
+	Xid  int32
+	Type int32
+}
+
+func (r *requestHeader) encode(e *encoder) {
+	e.writeInt(r.Xid)
+	e.writeInt(r.Type)
+}
+
+func (r *requestHeader) decode(d *decoder) {
+	r.Xid = d.readInt()
+	r.Type = d.readInt()
+}
+
+// A reply has a body only if Err is ZOK.
+type replyHeader struct {
+	Xid  int32
+	Zxid int64
+	Err  int32
+}
+
+func (r *replyHeader) encode(e *encoder) {
+	e.writeInt(r.Xid)
+	e.writeLong(r.Zxid)
+	e.writeInt(r.Err)
+}
+
+func (r *replyHeader) decode(d *decoder) {
+	r.Xid = d.readInt()
+	r.Zxid = d.readLong()
+	r.Err = d.readInt()
+}
+
+type stat struct {
+	Czxid          int64
+	Mzxid          int64
+	Ctime          int64
+	Mtime          int64
+	Version        int32
+	Cversion       int32
+	Aversion       int32
+	EphemeralOwner int64
+	DataLength     int32
+	NumChildren    int32
+	Pzxid          int64
+}
+
+func (r *stat) encode(e *encoder) {
+	e.writeLong(r.Czxid)
+	e.writeLong(r.Mzxid)
+	e.writeLong(r.Ctime)
+	e.writeLong(r.Mtime)
+	e.writeInt(r.Version)
+	e.writeInt(r.Cversion)
+	e.writeInt(r.Aversion)
+	e.writeLong(r.EphemeralOwner)
+	e.writeInt(r.DataLength)
+	e.writeInt(r.NumChildren)
+	e.writeLong(r.Pzxid)
+}
+
+func (r *stat) decode(d *decoder) {
+	r.Czxid = d.readLong()
+	r.Mzxid = d.readLong()
+	r.Ctime = d.readLong()
+	r.Mtime = d.readLong()
+	r.Version = d.readInt()
+	r.Cversion = d.readInt()
+	r.Aversion = d.readInt()
+	r.EphemeralOwner = d.readLong()
+	r.DataLength = d.readInt()
+	r.NumChildren = d.readInt()
+	r.Pzxid = d.readLong()
+}
+
+// Used by exists, get data and get children requests.
+type pathWatchRequest struct {
+	Path  string
+	Watch bool
+}
+
+func (r *pathWatchRequest) encode(e *encoder) {
+	e.writeString(r.Path)
+	e.writeBool(r.Watch)
+}
+
+func (r *pathWatchRequest) decode(d *decoder) {
+	r.Path = d.readString()
+	r.Watch = d.readBool()
+}
+
+type getDataResponse struct {
+	Data []byte
+	Stat stat
+}
+
+func (r *getDataResponse) encode(e *encoder) {
+	e.writeBuffer(r.Data)
+	r.Stat.encode(e)
+}
+
+func (r *getDataResponse) decode(d *decoder) {
+	r.Data = d.readBuffer()
+	r.Stat.decode(d)
+}
+
+type setDataRequest struct {
+	Path    string
+	Data    []byte
+	Version int32
+}
+
+func (r *setDataRequest) encode(e *encoder) {
+	e.writeString(r.Path)
+	e.writeBuffer(r.Data)
+	e.writeInt(r.Version)
+}
+
+func (r *setDataRequest) decode(d *decoder) {
+	r.Path = d.readString()
+	r.Data = d.readBuffer()
+	r.Version = d.readInt()
+}
+
+type getChildrenResponse struct {
+	Children []string
+}
+
+func (r *getChildrenResponse) encode(e *encoder) {
+	e.writeStrings(r.Children)
+}
+
+func (r *getChildrenResponse) decode(d *decoder) {
+	r.Children = d.readStrings()
+}
+
+// Adds credentials to the session. Type is unused and always 0.
+type authPacket struct {
+	Type   int32
+	Scheme string
+	Auth   []byte
+}
+
+func (r *authPacket) encode(e *encoder) {
+	e.writeInt(r.Type)
+	e.writeString(r.Scheme)
+	e.writeBuffer(r.Auth)
+}
+
+func (r *authPacket) decode(d *decoder) {
+	r.Type = d.readInt()
+	r.Scheme = d.readString()
+	r.Auth = d.readBuffer()
+}
+
+func encodeACL(e *encoder, acl []ACL) {
+	e.writeInt(int32(len(acl)))
+	for _, a := range acl {
+		e.writeInt(int32(a.Perms))
+		e.writeString(a.Scheme)
+		e.writeString(a.Id)
+	}
+}
+
+func decodeACL(d *decoder) []ACL {
+	n := d.readInt()
+	if n < 0 || int64(n)*12 > int64(len(d.buf)) {
+		d.err = errMarshalling
+		return nil
+	}
+	acl := make([]ACL, n)
+	for i, _ := range acl {
+		acl[i].Perms = int(d.readInt())
+		acl[i].Scheme = d.readString()
+		acl[i].Id = d.readString()
+	}
+	return acl
+}
+
+type createRequest struct {
+	Path  string
+	Data  []byte
+	ACL   []ACL
+	Flags int32
+}
+
+func (r *createRequest) encode(e *encoder) {
+	e.writeString(r.Path)
+	e.writeBuffer(r.Data)
+	encodeACL(e, r.ACL)
+	e.writeInt(r.Flags)
+}
+
+func (r *createRequest) decode(d *decoder) {
+	r.Path = d.readString()
+	r.Data = d.readBuffer()
+	r.ACL = decodeACL(d)
+	r.Flags = d.readInt()
+}
+
+// Used by create responses.
+type pathResponse struct {
+	Path string
+}
+
+func (r *pathResponse) encode(e *encoder) {
+	e.writeString(r.Path)
+}
+
+func (r *pathResponse) decode(d *decoder) {
+	r.Path = d.readString()
+}
+
+type deleteRequest struct {
+	Path    string
+	Version int32
+}
+
+func (r *deleteRequest) encode(e *encoder) {
+	e.writeString(r.Path)
+	e.writeInt(r.Version)
+}
+
+func (r *deleteRequest) decode(d *decoder) {
+	r.Path = d.readString()
+	r.Version = d.readInt()
+}
+
+// Sent with XID_NOTIFICATION when a watch fires.
+type watcherEvent struct {
+	Type  int32
+	State int32
+	Path  string
+}
+
+func (r *watcherEvent) encode(e *encoder) {
+	e.writeInt(r.Type)
+	e.writeInt(r.State)
+	e.writeString(r.Path)
+}
+
+func (r *watcherEvent) decode(d *decoder) {
+	r.Type = d.readInt()
+	r.State = d.readInt()
+	r.Path = d.readString()
+}
+
+// A request or response without a body.
+type emptyRecord struct {
+}
+
+func (r *emptyRecord) encode(e *encoder) {
+}
+
+func (r *emptyRecord) decode(d *decoder) {
+}
+
+type checkVersionRequest struct {
+	Path    string
+	Version int32
+}
+
+func (r *checkVersionRequest) encode(e *encoder) {
+	e.writeString(r.Path)
+	e.writeInt(r.Version)
+}
+
+func (r *checkVersionRequest) decode(d *decoder) {
+	r.Path = d.readString()
+	r.Version = d.readInt()
+}
+
+// Goes before each op of a transaction and its result. A header with Done
+// ends them.
+type multiHeader struct {
+	Type int32
+	Done bool
+	Err  int32
+}
+
+func (r *multiHeader) encode(e *encoder) {
+	e.writeInt(r.Type)
+	e.writeBool(r.Done)
+	e.writeInt(r.Err)
+}
+
+func (r *multiHeader) decode(d *decoder) {
+	r.Type = d.readInt()
+	r.Done = d.readBool()
+	r.Err = d.readInt()
+}
+
+var multiEnd = multiHeader{Type: -1, Done: true, Err: -1}
+
+type multiRequest struct {
+	Ops []Op
+}
+
+func (r *multiRequest) encode(e *encoder) {
+	for _, op := range r.Ops {
+		header := &multiHeader{Type: int32(op.Type), Err: -1}
+		header.encode(e)
+		opRecord(op).encode(e)
+	}
+	multiEnd.encode(e)
+}
+
+func (r *multiRequest) decode(d *decoder) {
+	r.Ops = nil
+	for d.err == nil {
+		header := &multiHeader{}
+		header.decode(d)
+		if header.Done {
+			return
+		}
+
+		var op Op
+		switch header.Type {
+		case OP_CREATE:
+			request := &createRequest{}
+			request.decode(d)
+			op = CreateOp(request.Path, request.Data, int(request.Flags))
+			op.ACL = request.ACL
+		case OP_DELETE:
+			request := &deleteRequest{}
+			request.decode(d)
+			op = DeleteOp(request.Path, int(request.Version))
+		case OP_SET_DATA:
+			request := &setDataRequest{}
+			request.decode(d)
+			op = SetOp(request.Path, request.Data, int(request.Version))
+		case OP_CHECK:
+			request := &checkVersionRequest{}
+			request.decode(d)
+			op = CheckOp(request.Path, int(request.Version))
+		default:
+			d.err = errMarshalling
+			return
+		}
+		r.Ops = append(r.Ops, op)
+	}
+}
+
+// The request record of @op.
+func opRecord(op Op) record {
+	switch op.Type {
+	case OP_CREATE:
+		data := op.Data
+		if data == nil {
+			data = []byte{}
+		}
+		acl := op.ACL
+		if acl == nil {
+			acl = WorldACL(ZOO_PERM_ALL)
+		}
+		return &createRequest{Path: op.Path, Data: data, ACL: acl, Flags: int32(op.Flags)}
+	case OP_DELETE:
+		return &deleteRequest{Path: op.Path, Version: int32(op.Version)}
+	case OP_SET_DATA:
+		return &setDataRequest{Path: op.Path, Data: op.Data, Version: int32(op.Version)}
+	default:
+		return &checkVersionRequest{Path: op.Path, Version: int32(op.Version)}
+	}
+}
+
+// Results of a transaction. Each has the type of its op, or OP_ERROR with
+// a return code.
+type multiResponse struct {
+	Types   []int32
+	Results []OpResult
+}
+
+func (r *multiResponse) encode(e *encoder) {
+	for i, result := range r.Results {
+		header := &multiHeader{Type: r.Types[i], Err: int32(result.Rc)}
+		header.encode(e)
+		switch r.Types[i] {
+		case OP_CREATE:
+			e.writeString(result.Path)
+		case OP_SET_DATA:
+			(&stat{}).encode(e)
+		case OP_ERROR:
+			e.writeInt(int32(result.Rc))
+		}
+	}
+	multiEnd.encode(e)
+}
+
+func (r *multiResponse) decode(d *decoder) {
+	r.Types = nil
+	r.Results = nil
+	for d.err == nil {
+		header := &multiHeader{}
+		header.decode(d)
+		if header.Done {
+			return
+		}
+
+		var result OpResult
+		switch header.Type {
+		case OP_CREATE:
+			result.Path = d.readString()
+		case OP_SET_DATA:
+			(&stat{}).decode(d)
+		case OP_DELETE, OP_CHECK:
+		case OP_ERROR:
+			result.Rc = int(d.readInt())
+		default:
+			d.err = errMarshalling
+			return
+		}
+		r.Types = append(r.Types, header.Type)
+		r.Results = append(r.Results, result)
+	}
+}
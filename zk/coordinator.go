@@ -0,0 +1,284 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package zk
+
+import (
+	"lbase/zk/coord"
+	"sync"
+	"time"
+)
+
+// Provides coord.Coordinator on a ZHandle. Return codes and constants of
+// both packages have the same values.
+type zHandleCoordinator struct {
+	zh *ZHandle
+
+	mutex sync.RWMutex
+	// The handle is freed once closed.
+	closed    bool
+	createACL []coord.ACL
+}
+
+func NewCoordinator(zh *ZHandle) coord.Coordinator {
+	return &zHandleCoordinator{zh: zh}
+}
+
+// Start a session like coord.Dial does, through the native library.
+func DialCoordinator(hosts string, timeoutMs int, id *ZkID) (c coord.Coordinator, ok bool) {
+	zh, ok := NewZHandle(hosts, timeoutMs, id)
+	if !ok {
+		return nil, false
+	}
+	c = NewCoordinator(&zh)
+
+	deadline := time.After(time.Duration(timeoutMs) * time.Millisecond)
+	for {
+		watch := c.WatchState()
+		switch c.GetState() {
+		case ZOO_CONNECTED_STATE:
+			return c, true
+		case ZOO_EXPIRED_SESSION_STATE, ZOO_AUTH_FAILED_STATE:
+			c.Close()
+			return nil, false
+		}
+
+		select {
+		case <-watch:
+		case <-deadline:
+			c.Close()
+			return nil, false
+		}
+	}
+}
+
+func (c *zHandleCoordinator) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		c.zh.Close()
+	}
+}
+
+func (c *zHandleCoordinator) WatchState() (watch chan coord.Event) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.closed {
+		return make(chan coord.Event, 1)
+	}
+	return forwardWatch(c.zh.WatchState())
+}
+
+// Forward the event of @watch. Nil if there is no watch.
+func forwardWatch(watch chan Watcher) chan coord.Event {
+	if watch == nil {
+		return nil
+	}
+	ret := make(chan coord.Event, 1)
+	go func() {
+		w := <-watch
+		ret <- coord.Event{Type: w.Type, State: w.State, Path: w.Path}
+	}()
+	return ret
+}
+
+func (c *zHandleCoordinator) AddAuth(scheme string, cert []byte) (rc int) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.closed {
+		return ZCLOSING
+	}
+
+	return c.zh.AddAuth(scheme, cert)
+}
+
+func (c *zHandleCoordinator) SetCreateACL(acl []coord.ACL) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.createACL = append([]coord.ACL(nil), acl...)
+}
+
+func (c *zHandleCoordinator) GetState() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.closed {
+		return ZOO_EXPIRED_SESSION_STATE
+	}
+	return c.zh.GetState()
+}
+
+// Ops hold a read lock, so that the handle is not freed under them.
+func (c *zHandleCoordinator) Exists(path string) (exists bool, rc int) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.closed {
+		return false, ZCLOSING
+	}
+
+	res := c.zh.Exists(path)
+	rc = res.GetRc()
+	return rc == ZOK, rc
+}
+
+func (c *zHandleCoordinator) ExistsW(path string) (exists bool, watch chan coord.Event, rc int) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.closed {
+		return false, nil, ZCLOSING
+	}
+
+	res, w := c.zh.ExistsW(path)
+	rc = res.GetRc()
+	if rc == ZOK || rc == ZNONODE {
+		watch = forwardWatch(w)
+	}
+	return rc == ZOK, watch, rc
+}
+
+func (c *zHandleCoordinator) Get(path string) (data []byte, version int32, rc int) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.closed {
+		return nil, 0, ZCLOSING
+	}
+
+	res := c.zh.Get(path)
+	return res.GetData(), res.GetVersion(), res.GetRc()
+}
+
+func (c *zHandleCoordinator) GetW(
+	path string) (data []byte, version int32, watch chan coord.Event, rc int) {
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.closed {
+		return nil, 0, nil, ZCLOSING
+	}
+
+	res, w := c.zh.GetW(path)
+	rc = res.GetRc()
+	if rc == ZOK {
+		watch = forwardWatch(w)
+	}
+	return res.GetData(), res.GetVersion(), watch, rc
+}
+
+func (c *zHandleCoordinator) Set(path string, data []byte, version int) (rc int) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.closed {
+		return ZCLOSING
+	}
+
+	res := c.zh.Set(path, data, version)
+	return res.GetRc()
+}
+
+func (c *zHandleCoordinator) GetChildren(path string) (children []string, rc int) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.closed {
+		return nil, ZCLOSING
+	}
+
+	res := c.zh.GetChildren(path)
+	return res.GetStrings(), res.GetRc()
+}
+
+func (c *zHandleCoordinator) GetChildrenW(
+	path string) (children []string, watch chan coord.Event, rc int) {
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.closed {
+		return nil, nil, ZCLOSING
+	}
+
+	res, w := c.zh.GetChildrenW(path)
+	rc = res.GetRc()
+	if rc == ZOK {
+		watch = forwardWatch(w)
+	}
+	return res.GetStrings(), watch, rc
+}
+
+func (c *zHandleCoordinator) Create(path string, data []byte, flags int) (name string, rc int) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.closed {
+		return "", ZCLOSING
+	}
+
+	acls := ZOO_OPEN_ACLS
+	if c.createACL != nil {
+		acls = make([]ACL, 0, len(c.createACL))
+		for _, acl := range c.createACL {
+			acls = append(acls, ACL(acl))
+		}
+	}
+	res := c.zh.Create(path, string(data), acls, flags)
+	return res.GetString(), res.GetRc()
+}
+
+func (c *zHandleCoordinator) Delete(path string, version int) (rc int) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.closed {
+		return ZCLOSING
+	}
+
+	return c.zh.Delete(path, version)
+}
+
+func (c *zHandleCoordinator) Multi(ops []coord.Op) (results []coord.OpResult, rc int) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	rc = ZCLOSING
+	if !c.closed {
+		if c.createACL != nil {
+			ops = append([]coord.Op(nil), ops...)
+			for i, _ := range ops {
+				if ops[i].Type == coord.OP_CREATE && ops[i].ACL == nil {
+					ops[i].ACL = c.createACL
+				}
+			}
+		}
+		res := c.zh.Multi(ops)
+		results = res.GetResults()
+		rc = res.GetRc()
+	}
+	if len(results) != len(ops) {
+		results = make([]coord.OpResult, len(ops))
+		for i, _ := range results {
+			results[i].Rc = rc
+		}
+	}
+	return results, rc
+}
@@ -0,0 +1,159 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package recipes
+
+import (
+	"lbase/zk/coord"
+	"log"
+)
+
+const (
+	// Name of the znode that is created once enough participants enter a
+	// double barrier.
+	BARRIER_READY_NODE = "ready"
+)
+
+// A double barrier lets a fixed number of participants start and finish a
+// computation together. Each participant creates an ephemeral znode under
+// the barrier root on entering, and deletes it on leaving.
+type DoubleBarrier struct {
+	zk   coord.Coordinator
+	root string
+	// Name of the znode of this participant.
+	name string
+	size int
+}
+
+// Create a participant @name of a barrier among @size participants.
+func NewDoubleBarrier(client coord.Coordinator, root, name string, size int) *DoubleBarrier {
+	return &DoubleBarrier{
+		zk:   client,
+		root: root,
+		name: name,
+		size: size,
+	}
+}
+
+// Wait up to @timeoutMs until all participants enter, or forever if
+// @timeoutMs is negative. Return false on timeout, after which this
+// participant is no longer in the barrier.
+func (b *DoubleBarrier) Enter(timeoutMs int) bool {
+	deadline := after(timeoutMs)
+	for {
+		entered, watch := b.enter()
+		if entered {
+			return true
+		}
+		if !wait(watch, nil, deadline) {
+			b.zk.Delete(b.root+"/"+b.name, -1)
+			return false
+		}
+	}
+}
+
+// Wait up to @timeoutMs until all participants leave, or forever if
+// @timeoutMs is negative. Return false on timeout.
+func (b *DoubleBarrier) Leave(timeoutMs int) bool {
+	deadline := after(timeoutMs)
+	if rc := b.zk.Delete(b.root+"/"+b.name, -1); rc != coord.ZOK && rc != coord.ZNONODE {
+		log.Printf("Fails to leave %s: %d\n", b.root, rc)
+		return false
+	}
+
+	for {
+		children, watch, rc := b.zk.GetChildrenW(b.root)
+		if rc == coord.ZOK && count(children) == 0 {
+			// The barrier can be entered again.
+			b.zk.Delete(b.root+"/"+BARRIER_READY_NODE, -1)
+			return true
+		}
+		if !wait(watch, nil, deadline) {
+			return false
+		}
+	}
+}
+
+// Create the znode of this participant.
+func (b *DoubleBarrier) join() bool {
+	if rc := coord.CreateAll(b.zk, b.root); rc != coord.ZOK {
+		log.Printf("Fails to create %s: %d\n", b.root, rc)
+		return false
+	}
+
+	_, rc := b.zk.Create(b.root+"/"+b.name, nil, coord.ZOO_EPHEMERAL)
+	if rc != coord.ZOK && rc != coord.ZNODEEXISTS {
+		log.Printf("Fails to enter %s: %d\n", b.root, rc)
+		return false
+	}
+	return true
+}
+
+// Enter the barrier, and return true if all participants have entered.
+// Otherwise return a watch on the ready znode, or nil on errors.
+func (b *DoubleBarrier) enter() (entered bool, watch chan coord.Event) {
+	if !b.join() {
+		return false, nil
+	}
+
+	ready := b.root + "/" + BARRIER_READY_NODE
+	exists, watch, rc := b.zk.ExistsW(ready)
+	if exists {
+		return true, nil
+	}
+	if rc != coord.ZNONODE {
+		return false, nil
+	}
+
+	// The last participant to enter marks the barrier ready.
+	if participants, ok := b.participants(); !ok || participants < b.size {
+		return false, watch
+	}
+	if _, rc = b.zk.Create(ready, nil, 0); rc != coord.ZOK && rc != coord.ZNODEEXISTS {
+		log.Printf("Fails to create %s: %d\n", ready, rc)
+		return false, watch
+	}
+	return true, nil
+}
+
+// Return the number of participants in the barrier.
+func (b *DoubleBarrier) participants() (int, bool) {
+	children, rc := b.zk.GetChildren(b.root)
+	if rc != coord.ZOK {
+		return 0, false
+	}
+	return count(children), true
+}
+
+// Count znodes of participants among @children.
+func count(children []string) int {
+	num := 0
+	for _, child := range children {
+		if child != BARRIER_READY_NODE {
+			num++
+		}
+	}
+	return num
+}
@@ -0,0 +1,96 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package recipes
+
+import (
+	"lbase/zk/coord"
+	"testing"
+	"time"
+)
+
+// Run @step of each participant in the background, and return the number
+// that succeed.
+func runAll(barriers []*DoubleBarrier, step func(b *DoubleBarrier) bool) int {
+	results := make(chan bool, len(barriers))
+	for _, b := range barriers {
+		go func(b *DoubleBarrier) {
+			results <- step(b)
+		}(b)
+	}
+
+	num := 0
+	for range barriers {
+		if <-results {
+			num++
+		}
+	}
+	return num
+}
+
+func TestDoubleBarrier(t *testing.T) {
+	fake := coord.NewMemoryStore()
+	barriers := []*DoubleBarrier{
+		NewDoubleBarrier(fake.NewSession(), "/lbase/barrier", "p1", 3),
+		NewDoubleBarrier(fake.NewSession(), "/lbase/barrier", "p2", 3),
+		NewDoubleBarrier(fake.NewSession(), "/lbase/barrier", "p3", 3),
+	}
+
+	// Too few participants to enter.
+	if barriers[0].Enter(50) {
+		t.Fatal("Enters a barrier without enough participants")
+	}
+
+	enter := func(b *DoubleBarrier) bool { return b.Enter(-1) }
+	if num := runAll(barriers, enter); num != len(barriers) {
+		t.Fatal("Only some participants enter:", num)
+	}
+
+	// Nobody finishes until all leave.
+	if barriers[0].Leave(50) {
+		t.Fatal("Leaves a barrier that others are still in")
+	}
+	leave := func(b *DoubleBarrier) bool { return b.Leave(-1) }
+	if num := runAll(barriers[1:], leave); num != len(barriers)-1 {
+		t.Fatal("Only some participants leave:", num)
+	}
+
+	// The barrier can be used again.
+	if barriers[0].Enter(50) {
+		t.Fatal("Enters a barrier without enough participants")
+	}
+	done := make(chan bool, 1)
+	go func() {
+		done <- runAll(barriers, enter) == len(barriers)
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatal("Fails to enter a barrier again")
+		}
+	case <-time.After(2 * RECIPE_RETRY_MS * time.Millisecond):
+		t.Fatal("Fails to enter a barrier again")
+	}
+}
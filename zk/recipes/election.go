@@ -0,0 +1,117 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package recipes
+
+import (
+	"lbase/zk/coord"
+	"log"
+)
+
+const (
+	// Prefix of znodes of candidates.
+	ELECTION_NODE_PREFIX = "candidate-"
+)
+
+// Elects one leader among candidates. Each candidate waits in a queue
+// under the election root, and the one at the head leads.
+type LeaderElection struct {
+	queue
+	quit chan bool
+}
+
+// Create a candidate that saves @value, such as its address, in its
+// znode.
+func NewLeaderElection(client coord.Coordinator, root, value string) *LeaderElection {
+	return &LeaderElection{
+		queue: queue{
+			zk:     client,
+			root:   root,
+			prefix: ELECTION_NODE_PREFIX,
+			value:  []byte(value),
+		},
+		quit: make(chan bool),
+	}
+}
+
+// Block until this candidate leads. Return a channel that is closed once
+// the candidate loses leadership, because its znode is gone, or it loses
+// its connection to zookeeper, or it resigns. Return false if the election
+// is closed first.
+func (e *LeaderElection) Campaign() (lost chan bool, ok bool) {
+	if !e.waitForHead(e.quit, nil) {
+		return nil, false
+	}
+
+	lost = make(chan bool)
+	go e.watchLeadership(e.getNode(), lost)
+	return lost, true
+}
+
+// Return the value of the leader.
+func (e *LeaderElection) GetLeader() (value string, ok bool) {
+	members, ok := e.members()
+	if !ok || len(members) == 0 {
+		return "", false
+	}
+
+	data, _, rc := e.zk.Get(e.root + "/" + members[0])
+	if rc != coord.ZOK {
+		return "", false
+	}
+	return string(data), true
+}
+
+// Leave the election. Another candidate leads if this one does.
+func (e *LeaderElection) Resign() {
+	e.leave()
+}
+
+func (e *LeaderElection) Close() {
+	close(e.quit)
+}
+
+// Close @lost once @node is gone or the session is disconnected. A leader
+// that is disconnected steps down, because others may elect a new leader
+// once its session expires.
+func (e *LeaderElection) watchLeadership(node string, lost chan bool) {
+	defer close(lost)
+
+	for {
+		if e.zk.GetState() != coord.ZOO_CONNECTED_STATE {
+			log.Printf("Loses connection to zookeeper\n")
+			return
+		}
+
+		_, watch, rc := e.zk.ExistsW(e.root + "/" + node)
+		if rc == coord.ZNONODE {
+			log.Printf("Loses leadership of %s\n", e.root)
+			return
+		}
+		if !wait(watch, e.quit, nil) {
+			return
+		}
+	}
+}
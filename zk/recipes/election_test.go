@@ -0,0 +1,129 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package recipes
+
+import (
+	"lbase/zk/coord"
+	"testing"
+	"time"
+)
+
+// Run Campaign of @e in the background. The channel receives the lost
+// channel of the leader, or nil if the campaign fails.
+func campaign(e *LeaderElection) chan chan bool {
+	done := make(chan chan bool, 1)
+	go func() {
+		lost, _ := e.Campaign()
+		done <- lost
+	}()
+	return done
+}
+
+func checkElected(t *testing.T, done chan chan bool, expected bool) chan bool {
+	select {
+	case lost := <-done:
+		if !expected || lost == nil {
+			t.Fatal("Unexpected campaign result:", lost != nil)
+		}
+		return lost
+	case <-time.After(100 * time.Millisecond):
+		if expected {
+			t.Fatal("Fails to become leader")
+		}
+	}
+	return nil
+}
+
+func checkLost(t *testing.T, lost chan bool) {
+	select {
+	case <-lost:
+	case <-time.After(2 * RECIPE_RETRY_MS * time.Millisecond):
+		t.Fatal("Leader does not step down")
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	fake := coord.NewMemoryStore()
+	first := fake.NewSession()
+	e1 := NewLeaderElection(first, "/lbase/election", "m1")
+	e2 := NewLeaderElection(fake.NewSession(), "/lbase/election", "m2")
+	e3 := NewLeaderElection(fake.NewSession(), "/lbase/election", "m3")
+	defer e2.Close()
+	defer e3.Close()
+
+	lost1, ok := e1.Campaign()
+	if !ok {
+		t.Fatal("Fails to elect the first candidate")
+	}
+	done2 := campaign(e2)
+	checkElected(t, done2, false)
+	done3 := campaign(e3)
+	checkElected(t, done3, false)
+
+	if value, ok := e3.GetLeader(); !ok || value != "m1" {
+		t.Fatal("Unexpected leader:", value)
+	}
+
+	// The session of the leader expires.
+	first.Expire()
+	checkLost(t, lost1)
+
+	lost2 := checkElected(t, done2, true)
+	checkElected(t, done3, false)
+	if value, ok := e3.GetLeader(); !ok || value != "m2" {
+		t.Fatal("Unexpected leader:", value)
+	}
+
+	// The next one takes over after a resignation.
+	e2.Resign()
+	checkLost(t, lost2)
+	checkElected(t, done3, true)
+	if value, ok := e3.GetLeader(); !ok || value != "m3" {
+		t.Fatal("Unexpected leader:", value)
+	}
+}
+
+func TestLeaderElectionClose(t *testing.T) {
+	fake := coord.NewMemoryStore()
+	e1 := NewLeaderElection(fake.NewSession(), "/lbase/election", "m1")
+	e2 := NewLeaderElection(fake.NewSession(), "/lbase/election", "m2")
+
+	if _, ok := e1.Campaign(); !ok {
+		t.Fatal("Fails to elect the first candidate")
+	}
+	done := campaign(e2)
+	e2.Close()
+
+	select {
+	case lost := <-done:
+		if lost != nil {
+			t.Fatal("Becomes leader after close")
+		}
+	case <-time.After(2 * RECIPE_RETRY_MS * time.Millisecond):
+		t.Fatal("Campaign does not return after close")
+	}
+	e1.Close()
+}
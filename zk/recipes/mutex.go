@@ -0,0 +1,67 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package recipes
+
+import (
+	"lbase/zk/coord"
+)
+
+const (
+	// Prefix of znodes of lock waiters.
+	MUTEX_NODE_PREFIX = "lock-"
+)
+
+// A lock shared among processes. Waiters queue under the lock root, and
+// the one at the head holds the lock. The lock is released once the
+// session of its holder expires, so a holder that cares watches the state
+// of its session.
+type Mutex struct {
+	queue
+}
+
+func NewMutex(client coord.Coordinator, root string) *Mutex {
+	return &Mutex{
+		queue: queue{
+			zk:     client,
+			root:   root,
+			prefix: MUTEX_NODE_PREFIX,
+		},
+	}
+}
+
+// Wait up to @timeoutMs for the lock, or forever if @timeoutMs is
+// negative. Return false on timeout.
+func (m *Mutex) Lock(timeoutMs int) bool {
+	if m.waitForHead(nil, after(timeoutMs)) {
+		return true
+	}
+	m.leave()
+	return false
+}
+
+func (m *Mutex) Unlock() {
+	m.leave()
+}
@@ -0,0 +1,97 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package recipes
+
+import (
+	"lbase/zk/coord"
+	"testing"
+	"time"
+)
+
+// Run Lock of @m in the background.
+func lock(m *Mutex) chan bool {
+	locked := make(chan bool, 1)
+	go func() {
+		locked <- m.Lock(-1)
+	}()
+	return locked
+}
+
+func checkLocked(t *testing.T, locked chan bool, expected bool) {
+	timeout := 50 * time.Millisecond
+	if expected {
+		timeout = 2 * RECIPE_RETRY_MS * time.Millisecond
+	}
+
+	select {
+	case ok := <-locked:
+		if !expected || !ok {
+			t.Fatal("Unexpected lock result:", ok)
+		}
+	case <-time.After(timeout):
+		if expected {
+			t.Fatal("Fails to get a released mutex")
+		}
+	}
+}
+
+func TestMutex(t *testing.T) {
+	fake := coord.NewMemoryStore()
+	third := fake.NewSession()
+	m1 := NewMutex(fake.NewSession(), "/lbase/lock")
+	m2 := NewMutex(fake.NewSession(), "/lbase/lock")
+	m3 := NewMutex(third, "/lbase/lock")
+
+	if !m1.Lock(0) {
+		t.Fatal("Fails to lock a free mutex")
+	}
+	if m2.Lock(50) {
+		t.Fatal("Locks a held mutex")
+	}
+	// A waiter that times out leaves the queue.
+	if members, _ := m1.members(); len(members) != 1 {
+		t.Fatal("Unexpected waiters:", members)
+	}
+
+	locked3 := lock(m3)
+	checkLocked(t, locked3, false)
+	locked2 := lock(m2)
+	checkLocked(t, locked2, false)
+
+	// Waiters get the lock in order.
+	m1.Unlock()
+	checkLocked(t, locked3, true)
+	checkLocked(t, locked2, false)
+
+	// The lock is released once the session of its holder expires.
+	third.Expire()
+	checkLocked(t, locked2, true)
+	m2.Unlock()
+
+	if !m1.Lock(0) {
+		t.Fatal("Fails to lock a free mutex")
+	}
+}
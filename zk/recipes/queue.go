@@ -0,0 +1,197 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+// Package recipes builds common coordination patterns on a
+// coord.Coordinator: leader election, locks, barriers and a registry of
+// servers. Most of them wait in a queue of ephemeral sequential znodes.
+// A ZHandle is used through zk.NewCoordinator.
+package recipes
+
+import (
+	"lbase/zk/coord"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long to wait before trying zookeeper again, and how often
+	// recipes check their state while waiting for a watch.
+	RECIPE_RETRY_MS = 1000
+)
+
+// A place in a queue of ephemeral sequential znodes under a root. The
+// znode with the smallest sequence is at the head. A member watches only
+// the znode just before its own, so one that leaves only wakes up its
+// successor.
+type queue struct {
+	zk     coord.Coordinator
+	root   string
+	prefix string
+	value  []byte
+
+	mutex sync.Mutex
+	// Name of the znode of this member. It is empty if the member has
+	// not joined, or its znode is gone with its session.
+	node string
+}
+
+func (q *queue) getNode() string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.node
+}
+
+func (q *queue) setNode(node string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.node = node
+}
+
+// Create the znode of this member if it has none.
+func (q *queue) join() bool {
+	if q.getNode() != "" {
+		return true
+	}
+	if rc := coord.CreateAll(q.zk, q.root); rc != coord.ZOK {
+		log.Printf("Fails to create %s: %d\n", q.root, rc)
+		return false
+	}
+
+	flags := coord.ZOO_EPHEMERAL | coord.ZOO_SEQUENCE
+	path, rc := q.zk.Create(q.root+"/"+q.prefix, q.value, flags)
+	if rc != coord.ZOK {
+		log.Printf("Fails to join %s: %d\n", q.root, rc)
+		return false
+	}
+	q.setNode(path[strings.LastIndex(path, "/")+1:])
+	return true
+}
+
+// Remove the znode of this member.
+func (q *queue) leave() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.node != "" {
+		q.zk.Delete(q.root+"/"+q.node, -1)
+		q.node = ""
+	}
+}
+
+// Return znodes in the queue, ordered by their sequences.
+func (q *queue) members() (members []string, ok bool) {
+	children, rc := q.zk.GetChildren(q.root)
+	if rc != coord.ZOK {
+		return nil, false
+	}
+
+	for _, child := range children {
+		if strings.HasPrefix(child, q.prefix) {
+			members = append(members, child)
+		}
+	}
+	sort.Strings(members)
+	return members, true
+}
+
+// Return true if this member is at the head. Otherwise return a watch on
+// the member before it, or nil if the queue cannot be read. A member whose
+// znode is gone has to join again.
+func (q *queue) position() (head bool, watch chan coord.Event) {
+	node := q.getNode()
+	members, ok := q.members()
+	if !ok {
+		return false, nil
+	}
+
+	idx := sort.SearchStrings(members, node)
+	if idx == len(members) || members[idx] != node {
+		log.Printf("Loses znode %s of %s\n", node, q.root)
+		q.setNode("")
+		return false, nil
+	}
+	if idx == 0 {
+		return true, nil
+	}
+
+	exists, watch, _ := q.zk.ExistsW(q.root + "/" + members[idx-1])
+	if !exists {
+		// Gone already, so look again right away.
+		watch = make(chan coord.Event, 1)
+		watch <- coord.Event{Type: coord.ZOO_DELETED_EVENT}
+	}
+	return false, watch
+}
+
+// Wait until this member is at the head. Return false if @quit is closed
+// or @deadline passes first.
+func (q *queue) waitForHead(quit chan bool, deadline <-chan time.Time) bool {
+	for {
+		if !q.join() {
+			if !wait(nil, quit, deadline) {
+				return false
+			}
+			continue
+		}
+
+		head, watch := q.position()
+		if head {
+			return true
+		}
+		if q.getNode() == "" {
+			continue
+		}
+		if !wait(watch, quit, deadline) {
+			return false
+		}
+	}
+}
+
+// Wait for @watch to fire, or for a while. Return false if @quit is
+// closed or @deadline passes first.
+func wait(watch chan coord.Event, quit chan bool, deadline <-chan time.Time) bool {
+	select {
+	case <-watch:
+		return true
+	case <-time.After(RECIPE_RETRY_MS * time.Millisecond):
+		return true
+	case <-quit:
+		return false
+	case <-deadline:
+		return false
+	}
+}
+
+// Return a channel that fires after @timeoutMs, or nil that never fires
+// if @timeoutMs is negative.
+func after(timeoutMs int) <-chan time.Time {
+	if timeoutMs < 0 {
+		return nil
+	}
+	return time.After(time.Duration(timeoutMs) * time.Millisecond)
+}
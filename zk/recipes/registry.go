@@ -0,0 +1,171 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package recipes
+
+import (
+	"fmt"
+	"lbase/balancer"
+	"lbase/zk/coord"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Keeps track of live servers. Each server registers an ephemeral znode
+// named "host:port" under the registry root, which goes away with its
+// session. Clients list and watch the children of the root.
+type ServiceRegistry struct {
+	zk   coord.Coordinator
+	root string
+
+	mutex sync.Mutex
+	// Servers registered through this registry.
+	registered map[balancer.ServerName]bool
+}
+
+// Create a registry under @root. If @client is a SessionKeeper, servers
+// are registered again on each session that replaces an expired one.
+func NewServiceRegistry(client coord.Coordinator, root string) *ServiceRegistry {
+	r := &ServiceRegistry{
+		zk:         client,
+		root:       root,
+		registered: make(map[balancer.ServerName]bool),
+	}
+	if keeper, ok := client.(*coord.SessionKeeper); ok {
+		keeper.OnRenew(r.renew)
+	}
+	return r
+}
+
+// Add @name to live servers until its session ends or it is unregistered.
+func (r *ServiceRegistry) Register(name balancer.ServerName) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.create(r.zk, name) {
+		return false
+	}
+	r.registered[name] = true
+	return true
+}
+
+func (r *ServiceRegistry) Unregister(name balancer.ServerName) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.registered, name)
+	rc := r.zk.Delete(r.root+"/"+nodeName(name), -1)
+	return rc == coord.ZOK || rc == coord.ZNONODE
+}
+
+// Return live servers, ordered by their names.
+func (r *ServiceRegistry) GetServers() ([]balancer.ServerName, bool) {
+	children, rc := r.zk.GetChildren(r.root)
+	if rc == coord.ZNONODE {
+		return nil, true
+	}
+	if rc != coord.ZOK {
+		return nil, false
+	}
+	return parseServers(children), true
+}
+
+// Return live servers, and a watch that fires once they change. Callers
+// read and watch again after the watch fires.
+func (r *ServiceRegistry) WatchServers() (
+	servers []balancer.ServerName,
+	watch chan coord.Event,
+	ok bool) {
+
+	// The root is created first, because zookeeper sets no child watch
+	// on a missing znode.
+	if rc := coord.CreateAll(r.zk, r.root); rc != coord.ZOK {
+		log.Printf("Fails to create %s: %d\n", r.root, rc)
+		return nil, nil, false
+	}
+
+	children, watch, rc := r.zk.GetChildrenW(r.root)
+	if rc != coord.ZOK {
+		return nil, nil, false
+	}
+	return parseServers(children), watch, true
+}
+
+// Register servers again on @client, whose session replaces an expired
+// one.
+func (r *ServiceRegistry) renew(client coord.Coordinator) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for name := range r.registered {
+		r.create(client, name)
+	}
+}
+
+func (r *ServiceRegistry) create(client coord.Coordinator, name balancer.ServerName) bool {
+	if rc := coord.CreateAll(client, r.root); rc != coord.ZOK {
+		log.Printf("Fails to create %s: %d\n", r.root, rc)
+		return false
+	}
+
+	path := r.root + "/" + nodeName(name)
+	_, rc := client.Create(path, nil, coord.ZOO_EPHEMERAL)
+	if rc == coord.ZNODEEXISTS {
+		// The znode may belong to an earlier session of the same server,
+		// and would go away once that session expires.
+		client.Delete(path, -1)
+		_, rc = client.Create(path, nil, coord.ZOO_EPHEMERAL)
+	}
+	if rc != coord.ZOK {
+		log.Printf("Fails to register %s: %d\n", path, rc)
+		return false
+	}
+	return true
+}
+
+func nodeName(name balancer.ServerName) string {
+	return fmt.Sprintf("%s:%d", name.Host, name.Port)
+}
+
+// Parse znode names into servers, and skip malformed ones.
+func parseServers(children []string) []balancer.ServerName {
+	sort.Strings(children)
+	servers := make([]balancer.ServerName, 0, len(children))
+	for _, child := range children {
+		idx := strings.LastIndex(child, ":")
+		if idx < 0 {
+			continue
+		}
+		port, err := strconv.Atoi(child[idx+1:])
+		if err != nil {
+			continue
+		}
+		servers = append(servers, balancer.ServerName{Host: child[:idx], Port: port})
+	}
+	return servers
+}
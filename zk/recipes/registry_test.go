@@ -0,0 +1,117 @@
+/*
+Copyright (c) 2015, snappysystem
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+package recipes
+
+import (
+	"lbase/balancer"
+	"lbase/zk/coord"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func checkServers(t *testing.T, r *ServiceRegistry, expected []balancer.ServerName) {
+	servers, ok := r.GetServers()
+	if !ok || !reflect.DeepEqual(servers, expected) {
+		t.Fatal("Unexpected servers:", servers)
+	}
+}
+
+func checkWatchFired(t *testing.T, watch chan coord.Event) {
+	select {
+	case <-watch:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Watch does not fire")
+	}
+}
+
+func TestServiceRegistry(t *testing.T) {
+	fake := coord.NewMemoryStore()
+	second := fake.NewSession()
+	client := NewServiceRegistry(fake.NewSession(), "/lbase/servers")
+	r1 := NewServiceRegistry(fake.NewSession(), "/lbase/servers")
+	r2 := NewServiceRegistry(second, "/lbase/servers")
+
+	s1 := balancer.ServerName{Host: "host1", Port: 9000}
+	s2 := balancer.ServerName{Host: "host2", Port: 9001}
+
+	servers, watch, ok := client.WatchServers()
+	if !ok || len(servers) != 0 {
+		t.Fatal("Unexpected servers:", servers)
+	}
+
+	if !r1.Register(s1) || !r2.Register(s2) {
+		t.Fatal("Fails to register servers")
+	}
+	checkWatchFired(t, watch)
+	checkServers(t, client, []balancer.ServerName{s1, s2})
+
+	// A server is gone with its session.
+	_, watch, _ = client.WatchServers()
+	second.Expire()
+	checkWatchFired(t, watch)
+	checkServers(t, client, []balancer.ServerName{s1})
+
+	if !r1.Unregister(s1) {
+		t.Fatal("Fails to unregister a server")
+	}
+	checkServers(t, client, []balancer.ServerName{})
+}
+
+func TestServiceRegistryRenew(t *testing.T) {
+	fake := coord.NewMemoryStore()
+	sessions := make(chan *coord.MemorySession, 2)
+	keeper, _ := coord.NewSessionKeeper(func() (coord.Coordinator, bool) {
+		s := fake.NewSession()
+		sessions <- s
+		return s, true
+	})
+	defer keeper.Close()
+
+	client := NewServiceRegistry(fake.NewSession(), "/lbase/servers")
+	r := NewServiceRegistry(keeper, "/lbase/servers")
+	s1 := balancer.ServerName{Host: "host1", Port: 9000}
+	if !r.Register(s1) {
+		t.Fatal("Fails to register a server")
+	}
+
+	// The server is registered again on a new session.
+	_, watch, _ := client.WatchServers()
+	(<-sessions).Expire()
+	checkWatchFired(t, watch)
+	deadline := time.After(2 * coord.KEEPER_RETRY_MS * time.Millisecond)
+	for {
+		if servers, _ := client.GetServers(); len(servers) == 1 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("Server is not registered again")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	checkServers(t, client, []balancer.ServerName{s1})
+}
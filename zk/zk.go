@@ -29,14 +29,25 @@ package zk
 #cgo CFLAGS: -I/usr/include
 #cgo LDFLAGS: -lzookeeper_mt
 
+#include <stdint.h>
 #include <zookeeper/zookeeper.h>
 
+extern void GoSessionWatcher(int type, int state, void* ctx);
+
+// Passes session events to the handle that @ctx identifies.
 void my_global_watcher(
   zhandle_t *zh,
   int type,
   int state,
   const char* path,
   void *ctx) {
+  if (type == ZOO_SESSION_EVENT) {
+    GoSessionWatcher(type, state, ctx);
+  }
+}
+
+static void* handle_context(uintptr_t id) {
+  return (void*)id;
 }
 
 extern void GoWatcher(int type, int state, void* path, void* ctx);
@@ -100,8 +111,10 @@ void my_acl_completion(int rc, struct ACL_vector *acl,
 import "C"
 
 import (
+	"lbase/zk/coord"
 	"unsafe"
 	"reflect"
+	"sync"
 )
 
 // Zookeeper return code.
@@ -473,14 +486,55 @@ func (sr *ACLResult) GetDataLength() int32 {
 }
 
 
+type MultiResult struct {
+	rc C.int
+	results []coord.OpResult
+}
+
+func (sr *MultiResult) GetResults() []coord.OpResult {
+	return sr.results
+}
+
+func (sr *MultiResult) GetRc() int {
+	return int(sr.rc)
+}
+
 type ZkID struct {
 	id C.clientid_t
 }
 
+// Build the id of a session to resume.
+func NewZkID(sessionId int64, passwd []byte) ZkID {
+	var ret ZkID
+	ret.id.client_id = C.int64_t(sessionId)
+	for i := 0; i < len(passwd) && i < len(ret.id.passwd); i++ {
+		ret.id.passwd[i] = C.char(passwd[i])
+	}
+	return ret
+}
+
+func (id *ZkID) GetSessionId() int64 {
+	return int64(id.id.client_id)
+}
+
+func (id *ZkID) GetPasswd() []byte {
+	return C.GoBytes(unsafe.Pointer(&id.id.passwd[0]), C.int(len(id.id.passwd)))
+}
+
 type ZHandle struct {
 	handle *C.zhandle_t
+	// Identifies the handle to the global watcher.
+	id uintptr
 }
 
+// Watches of session states, by ids of handles. The C library only keeps
+// an integer id, since it must not hold go pointers.
+var (
+	sessionMutex   sync.Mutex
+	sessionWatches = make(map[uintptr][]chan Watcher)
+	nextHandleId   uintptr = 1
+)
+
 /**
  * \brief create a new zookeeper handle to communicate with server.
  * 
@@ -517,18 +571,71 @@ func NewZHandle(hosts string, recvTimeout int, id *ZkID) (h ZHandle, ok bool) {
 		cid = &id.id
 	}
 
+	sessionMutex.Lock()
+	handleId := nextHandleId
+	nextHandleId++
+	sessionWatches[handleId] = nil
+	sessionMutex.Unlock()
+
 	handle, err := C.zookeeper_init(
-		chosts, (C.watcher_fn)(C.my_global_watcher), C.int(recvTimeout), cid, nil, 0)
+		chosts,
+		(C.watcher_fn)(C.my_global_watcher),
+		C.int(recvTimeout),
+		cid,
+		C.handle_context(C.uintptr_t(handleId)),
+		0)
 
 	if err != nil {
 		ok = false
+		sessionMutex.Lock()
+		delete(sessionWatches, handleId)
+		sessionMutex.Unlock()
 	} else {
 		ok = true
-		h = ZHandle{handle: handle}
+		h = ZHandle{handle: handle, id: handleId}
 	}
 	return
 }
 
+/**
+ * \brief close the zookeeper handle and free up any resources.
+ *
+ * The session ends, and its ephemeral nodes are removed. The handle must
+ * not be used afterwards.
+ */
+func (zh *ZHandle) Close() int {
+	sessionMutex.Lock()
+	delete(sessionWatches, zh.id)
+	sessionMutex.Unlock()
+
+	return int(C.zookeeper_close(zh.handle))
+}
+
+/**
+ * \brief watch the state of the session.
+ *
+ * The watch is fired with ZOO_SESSION_EVENT when the state changes next,
+ * such as when the connection is lost or the session expires.
+ */
+func (zh *ZHandle) WatchState() chan Watcher {
+	watch := make(chan Watcher, 1)
+
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	if _, found := sessionWatches[zh.id]; found {
+		sessionWatches[zh.id] = append(sessionWatches[zh.id], watch)
+	}
+	return watch
+}
+
+/**
+ * \brief return the id of the session, which is valid once the session is
+ * connected. A new handle resumes the session with it.
+ */
+func (zh *ZHandle) GetZkID() ZkID {
+	return ZkID{id: *C.zoo_client_id(zh.handle)}
+}
+
 /**
  * \brief get the state of the zookeeper connection.
  * 
@@ -668,11 +775,17 @@ func (zh *ZHandle) Set(path string, buffer []byte, version int) StatResult {
 	cpath := C.CString(path)
 	defer C.free(unsafe.Pointer(cpath))
 
+	// An empty buffer clears the data.
+	var cbuffer *C.char
+	if len(buffer) > 0 {
+		cbuffer = (*C.char)(unsafe.Pointer(&buffer[0]))
+	}
+
 	res := make(chan StatResult, 1)
 	rc,err := C.zoo_aset(
 		zh.handle,
 		cpath,
-		(*C.char)(unsafe.Pointer(&buffer[0])),
+		cbuffer,
 		C.int(len(buffer)),
 		C.int(version),
 		C.stat_completion_t(C.my_stat_completion),
@@ -1047,3 +1160,170 @@ func (zh *ZHandle) Delete(path string, version int) int {
 
 	return ret
 }
+
+/**
+ * \brief specify application credentials.
+ *
+ * The application calls this function to specify its credentials for purposes
+ * of authentication. The server will use the security provider specified by
+ * the scheme parameter to authenticate the client connection. If the
+ * authentication request has failed:
+ * - the server connection is dropped
+ * - the watcher is called with the ZOO_AUTH_FAILED_STATE value as the state
+ * parameter.
+ * \param scheme the id of authentication scheme. Natively supported:
+ * "digest" password-based authentication
+ * \param cert application credentials. The actual value depends on the scheme.
+ * \return ZOK on success or one of the following errcodes on failure:
+ * ZAUTHFAILED the server rejects the credentials.
+ * ZBADARGUMENTS - invalid input parameters
+ * ZINVALIDSTATE - zhandle state is either ZOO_SESSION_EXPIRED_STATE or ZOO_AUTH_FAILED_STATE
+ * ZMARSHALLINGERROR - failed to marshall a request; possibly, out of memory
+ * ZSYSTEMERROR - a system error occured
+ */
+func (zh *ZHandle) AddAuth(scheme string, cert []byte) int {
+	cscheme := C.CString(scheme)
+	defer C.free(unsafe.Pointer(cscheme))
+
+	// The library copies credentials before zoo_add_auth returns.
+	ccert := C.CString(string(cert))
+	defer C.free(unsafe.Pointer(ccert))
+
+	res := make(chan int, 1)
+	rc,err := C.zoo_add_auth(
+		zh.handle,
+		cscheme,
+		ccert,
+		C.int(len(cert)),
+		C.void_completion_t(C.my_void_completion),
+		unsafe.Pointer(&res))
+
+	var ret int
+	if err != nil {
+		ret = int(rc)
+	} else {
+		ret = <-res
+	}
+
+	return ret
+}
+
+// Most ops that a transaction may have.
+const MAX_MULTI_OPS = 1 << 16
+
+/**
+ * \brief atomically commits multiple zookeeper operations.
+ *
+ * Either all of the ops are applied, or none of them. Ops are built by
+ * coord.CreateOp, coord.DeleteOp, coord.SetOp and coord.CheckOp, and
+ * nodes are created with the ACL of each op, or ZOO_OPEN_ACLS if it is nil.
+ * \return the result of each op, and ZOK on success or the return code
+ * of the first op that fails.
+ */
+func (zh *ZHandle) Multi(ops []coord.Op) MultiResult {
+	count := len(ops)
+	if count == 0 {
+		return MultiResult{rc: ZOK}
+	}
+	if count > MAX_MULTI_OPS {
+		return MultiResult{rc: ZBADARGUMENTS}
+	}
+
+	// The library fills results after zoo_amulti returns, so everything
+	// that ops and results point to is allocated in C.
+	var allocs []unsafe.Pointer
+	defer func() {
+		for _, p := range allocs {
+			C.free(p)
+		}
+	}()
+	alloc := func(size int) unsafe.Pointer {
+		p := C.calloc(1, C.size_t(size))
+		allocs = append(allocs, p)
+		return p
+	}
+	cstring := func(s string) *C.char {
+		p := C.CString(s)
+		allocs = append(allocs, unsafe.Pointer(p))
+		return p
+	}
+	cacl := func(acls []coord.ACL) *C.struct_ACL_vector {
+		if acls == nil {
+			return &C.ZOO_OPEN_ACL_UNSAFE
+		}
+		n := len(acls)
+		vec := (*C.struct_ACL_vector)(alloc(int(unsafe.Sizeof(C.struct_ACL_vector{}))))
+		data := alloc((n + 1) * int(unsafe.Sizeof(C.struct_ACL{})))
+		entries := (*[1 << 16]C.struct_ACL)(data)[:n:n]
+		for j, acl := range acls {
+			entries[j].perms = C.int32_t(acl.Perms)
+			entries[j].id.scheme = cstring(acl.Scheme)
+			entries[j].id.id = cstring(acl.Id)
+		}
+		vec.count = C.int32_t(n)
+		vec.data = (*C.struct_ACL)(data)
+		return vec
+	}
+
+	opSize := int(unsafe.Sizeof(C.zoo_op_t{}))
+	resultSize := int(unsafe.Sizeof(C.zoo_op_result_t{}))
+	cops := (*[MAX_MULTI_OPS]C.zoo_op_t)(alloc(count * opSize))[:count:count]
+	cresults := (*[MAX_MULTI_OPS]C.zoo_op_result_t)(alloc(count * resultSize))[:count:count]
+
+	for i, op := range ops {
+		cpath := cstring(op.Path)
+		switch op.Type {
+		case coord.OP_CREATE:
+			// Room for the sequence that may be appended.
+			pathLen := len(op.Path) + 16
+			C.zoo_create_op_init(
+				&cops[i],
+				cpath,
+				cstring(string(op.Data)),
+				C.int(len(op.Data)),
+				cacl(op.ACL),
+				C.int(op.Flags),
+				(*C.char)(alloc(pathLen)),
+				C.int(pathLen))
+		case coord.OP_DELETE:
+			C.zoo_delete_op_init(&cops[i], cpath, C.int(op.Version))
+		case coord.OP_SET_DATA:
+			C.zoo_set_op_init(
+				&cops[i],
+				cpath,
+				cstring(string(op.Data)),
+				C.int(len(op.Data)),
+				C.int(op.Version),
+				nil)
+		case coord.OP_CHECK:
+			C.zoo_check_op_init(&cops[i], cpath, C.int(op.Version))
+		default:
+			return MultiResult{rc: ZBADARGUMENTS}
+		}
+	}
+
+	res := make(chan int, 1)
+	rc,err := C.zoo_amulti(
+		zh.handle,
+		C.int(count),
+		&cops[0],
+		&cresults[0],
+		C.void_completion_t(C.my_void_completion),
+		unsafe.Pointer(&res))
+
+	var ret MultiResult
+	if err != nil {
+		ret.rc = rc
+		return ret
+	}
+
+	ret.rc = C.int(<-res)
+	ret.results = make([]coord.OpResult, count)
+	for i, op := range ops {
+		ret.results[i].Rc = int(cresults[i].err)
+		if op.Type == coord.OP_CREATE && cresults[i].err == ZOK {
+			ret.results[i].Path = C.GoString(cresults[i].value)
+		}
+	}
+	return ret
+}
@@ -251,3 +251,48 @@ func TestZkGetChildren(t *testing.T) {
 		t.Error("Has number of strings: ", len(strings))
 	}
 }
+
+func TestZkSession(t *testing.T) {
+	path := "/testZkSession"
+	service := fmt.Sprintf("localhost:%d", Port)
+	c,ok := DialCoordinator(service, Timeout, nil)
+	if !ok {
+		t.Fatal("Fails to connect to zookeeper")
+	}
+
+	zh := c.(*zHandleCoordinator).zh
+	id := zh.GetZkID()
+	if id.GetSessionId() == 0 || len(id.GetPasswd()) != 16 {
+		t.Error("Unexpected session id ", id.GetSessionId())
+	}
+
+	// Another handle resumes the session, and sees its ephemeral node.
+	c.Delete(path, -1)
+	if _,rc := c.Create(path, nil, int(ZOO_EPHEMERAL)); rc != ZOK {
+		t.Error("Fails to create a path")
+	}
+	resumed := NewZkID(id.GetSessionId(), id.GetPasswd())
+	other,ok := DialCoordinator(service, Timeout, &resumed)
+	if !ok {
+		t.Fatal("Fails to resume a session")
+	}
+	if exists,_ := other.Exists(path); !exists {
+		t.Error("Fails to find an ephemeral node")
+	}
+
+	// Closing the session removes the node.
+	other.Close()
+	c.Close()
+	if c.GetState() != ZOO_EXPIRED_SESSION_STATE {
+		t.Error("Unexpected state ", c.GetState())
+	}
+
+	check,ok := DialCoordinator(service, Timeout, nil)
+	if !ok {
+		t.Fatal("Fails to connect to zookeeper")
+	}
+	defer check.Close()
+	if exists,_ := check.Exists(path); exists {
+		t.Error("Keeps an ephemeral node of a closed session")
+	}
+}